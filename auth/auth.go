@@ -1,49 +1,109 @@
 package auth
 
 import (
+	"strings"
+	"time"
+
 	"github.com/contiv/auth_proxy/auth/ldap"
 	"github.com/contiv/auth_proxy/auth/local"
 	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/db"
-	"github.com/contiv/auth_proxy/state"
 
 	log "github.com/Sirupsen/logrus"
-	uuid "github.com/satori/go.uuid"
 )
 
 // Authenticate authenticates the user against local DB or AD using the given credentials
-// it returns a token which carries the role, capabilities, etc.
+// it returns a token which carries the role, capabilities, user attributes, etc.
+// The login is recorded in the principal record of the user and the audit trail.
 // params:
 //    username: local or AD username of the user
 //    password: password of the user
 // return values:
 //    `Token` string on successful authentication otherwise ErrADConfigNotFound or any relevant error.
+//    If the local user has to change the password, the returned token is restricted and can only be
+//    used to change the password (see Token.MustChangePassword).
 func Authenticate(username, password string) (string, error) {
 	userPrincipals, err := local.Authenticate(username, password)
 	if err == nil {
-		return generateToken(userPrincipals, username) // local authentication succeeded!
+		attributes, err := localUserAttributes(username)
+		if err != nil {
+			return "", err
+		}
+
+		recordLogin(&types.Principal{Username: username, Local: true, Attributes: attributes})
+		return generateLocalUserToken(userPrincipals, username, attributes) // local authentication succeeded!
+	}
+
+	// valid credentials, but the user is only allowed to change the password
+	if err == auth_errors.ErrPasswordChangeRequired {
+		return generateRestrictedToken(username)
 	}
 
 	// Same username can be there in both local setup and LDAP.
 	// So, we try LDAP if `access is denied` from local authentication; coz, the same user(name) could also be part of LDAP.
 	if err == auth_errors.ErrUserNotFound || err == auth_errors.ErrAccessDenied {
-		userPrincipals, err = ldap.Authenticate(username, password)
+		user, err := ldap.AuthenticateUser(username, password)
 		if err == nil {
-			return generateToken(userPrincipals, username) // ldap authentication succeeded!
+			recordLogin(&types.Principal{Username: username, Domain: user.Domain, DN: user.DN, Attributes: user.Attributes})
+			return generateToken(user.Groups, username, user.Domain, user.DN, user.Attributes) // ldap authentication succeeded!
 		}
+
+		return "", err
 	}
 	return "", err // error from authentication
 }
 
+// localUserAttributes returns the attributes of the given local user carried in the token.
+// params:
+//  username: local username of the user
+// return values:
+//  map[string]string: `display_name` made of the first and last name of the user, if any
+//  error: nil if successful, else as returned by db.GetLocalUser
+func localUserAttributes(username string) (map[string]string, error) {
+	user, err := db.GetLocalUser(username)
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := map[string]string{}
+	if displayName := strings.TrimSpace(user.FirstName + " " + user.LastName); !common.IsEmpty(displayName) {
+		attributes["display_name"] = displayName
+	}
+
+	return attributes, nil
+}
+
+// recordLogin records the login of the given user in its principal record and the audit trail.
+// Failing to update the principal record doesn't fail the login.
+// params:
+//  principal: principal record of the user; `LastLogin` is set to the current time
+func recordLogin(principal *types.Principal) {
+	principal.LastLogin = time.Now().Unix()
+	if err := db.UpdatePrincipal(principal); err != nil {
+		log.Errorf("Failed to update the principal record of %q: %v", principal.Username, err)
+	}
+
+	audit.Record("login", audit.Fields{
+		"username":   principal.Username,
+		"local":      principal.Local,
+		"domain":     principal.Domain,
+		"attributes": principal.Attributes,
+	})
+}
+
 // generateToken generates JWT(JSON Web Token) with the given user principals
 // params:
 //  principals: user principals; []string containing LDAP groups or username based on the authentication type(LDAP/Local)
 //  username: local or AD username of the user
+//  domain: name of the LDAP configuration the user was authenticated against; used to re-validate the user
+//  dn: distinguished name of the LDAP user; deny authorizations of the user are matched against it
+//  attributes: user attributes to be carried in the token; keyed by the claim name
 // return values:
 //    `Token` string on successful creation of JWT otherwise any relevant error from the subsequent function
-func generateToken(principals []string, username string) (string, error) {
+func generateToken(principals []string, username, domain, dn string, attributes map[string]string) (string, error) {
 	log.Debugf("generating token for user %q", username)
 
 	authZ, err := NewTokenWithClaims(principals) // create a new token with default `expiry` claim
@@ -51,12 +111,64 @@ func generateToken(principals []string, username string) (string, error) {
 		return "", err
 	}
 
+	authZ.AddAttributesClaim(attributes)
+	authZ.AddClaim(domainClaimKey, domain)
+	authZ.AddUserPrincipalClaim(dn)
+
 	// finally, add username to the token
 	authZ.AddClaim("username", username)
 
 	return authZ.Stringify()
 }
 
+// generateLocalUserToken generates JWT(JSON Web Token) for a local user with the given user principals.
+// The token is bound to the current session generation of the user, so it can be revoked.
+// params:
+//  principals: user principals of the local user
+//  username: local username of the user
+//  attributes: user attributes to be carried in the token; keyed by the claim name
+// return values:
+//    `Token` string on successful creation of JWT otherwise any relevant error from the subsequent function
+func generateLocalUserToken(principals []string, username string, attributes map[string]string) (string, error) {
+	log.Debugf("generating token for local user %q", username)
+
+	authZ, err := NewTokenWithClaims(principals) // create a new token with default `expiry` claim
+	if err != nil {
+		return "", err
+	}
+
+	authZ.AddAttributesClaim(attributes)
+
+	if err := authZ.AddLocalUserClaims(username); err != nil {
+		return "", err
+	}
+
+	// finally, add username to the token
+	authZ.AddClaim("username", username)
+
+	return authZ.Stringify()
+}
+
+// generateRestrictedToken generates JWT(JSON Web Token) for a local user who has to change the password.
+// The token carries no principals, so it grants no access to any resource.
+// params:
+//  username: local username of the user
+// return values:
+//    `Token` string on successful creation of JWT otherwise any relevant error from the subsequent function
+func generateRestrictedToken(username string) (string, error) {
+	log.Debugf("generating restricted token for user %q", username)
+
+	authZ := NewToken()
+	if err := authZ.AddLocalUserClaims(username); err != nil {
+		return "", err
+	}
+
+	authZ.AddClaim(mustChangePasswordClaimKey, true)
+	authZ.AddClaim("username", username)
+
+	return authZ.Stringify()
+}
+
 //
 // checkAccessClaim checks whether the granted role has desired level of access
 // which is specified as a role itself.
@@ -96,176 +208,98 @@ func checkAccessClaim(granted types.RoleType, desired interface{}) error {
 // AddAuthorization stores authorization claim(s) for a specific named
 // principal in the KV store. Success of various tenant related operations will
 // depend on the named principal's capabilities, determined by the role that is
-// associated with the claim.
+// associated with the claim. The tenant claim and the role claim are written
+// as a batch (see ApplyAuthorizationOperations).
 // TODO: principal and tenant should exist
 //
 // Parameters:
 //  tenantName: tenant name, if specified
 //  role: type of role that specifies permissions associated with tenant or global permissions
 //  principalName: Name of user for whom the authorization is to be added,
-//            Can either be a local user or an LDAP group.
-//  isLocal: true if the named principal is a local user, false if ldap group.
+//            Can either be a local user, a local group (see types.LocalGroupPrincipal)
+//            or an LDAP group.
+//  isLocal: true if the named principal is a local user/group, false if ldap group.
+//  notBefore: unix timestamp the authorization takes effect at; 0 if now
+//  expiresAt: unix timestamp the authorization expires at; 0 if never. The
+//    role claim raised for a time-bound authorization expires along with it.
 //
 // Return values:
 //  types.Authorization: new authorization that was added
 //  error: nil if successful, else
 //    auth_errors.ErrIllegalOperation if trying to add authorization to built-in
 //      local admin user.
+//    auth_errors.ErrIllegalArguments if the principal is an LDAP user (see
+//      types.LdapUserPrincipal); they are authorized through their groups
+//    *db.AuthorizationBatchError if writing the claims fails
+//    auth_errors.ErrKeyModified if another batch of authorizations could
+//      not be waited for (see db.ApplyAuthorizationChanges)
 //
 func AddAuthorization(tenantName string, role types.RoleType, principalName string,
-	isLocal bool) (types.Authorization, error) {
+	isLocal bool, notBefore, expiresAt int64) (types.Authorization, error) {
 
 	defer common.Untrace(common.Trace())
-	var authz types.Authorization
-	var err error
-
-	if isLocal && types.Admin.String() == principalName {
-		return authz, auth_errors.ErrIllegalOperation
-	}
-
-	// Adding authorization is generally a two part operation
-	// - Adding tenant claim
-	// - Adding/updating role claim. This caches "highest" access role available for principal.
-
-	switch role {
-	// Short circuit to just adding/updating role claim since we don't care
-	// about tenant specific info for admins
-	case types.Admin:
-		authz, err = addUpdateRoleAuthorization(role, principalName, isLocal)
-	default:
-		authz, err = addTenantAuthorization(tenantName, role, principalName, isLocal)
-		if err == nil {
-			// Ignore role authorization claim
-			_, err = addUpdateRoleAuthorization(role, principalName, isLocal)
-		}
-	}
 
-	// Upstream callers should ignore value of authz if err != nil
-	return authz, err
-}
-
-// addTenantAuthorization stores authorization claim(s) for a
-// specific named principal and a teant. Success of various tenant related
-// operations will depend on the named principal's capabilities, determined by
-// the role that is associated with the claim.
-//
-// Parameters:
-//  tenantName: tenant name
-//  role: type of role that specifies permissions associated with tenant
-//  principalName: Name of user for whom the authorization is to be added,
-//            Can either be a local user or an LDAP group.
-//  isLocal: true if the named principal is a local user, false if ldap group.
-//
-// Return values:
-//    TODO: errors.NonExistentLocalUserError: if a local user doesn't exist
-//    TODO: errors.NonExistentLdapGroupError: if ldap group doesn't exist
-//    : error from db.InsertAuthorization if adding a tenant authorization
-//      fails.
-func addTenantAuthorization(tenantName string, role types.RoleType, principalName string,
-	isLocal bool) (types.Authorization, error) {
-
-	claimStr, err := GenerateClaimKey(types.Tenant(tenantName))
-	if err != nil {
-		log.Error("failed in generating claim:", err)
-		return types.Authorization{}, err
-	}
-
-	// create an authorization
-	sd, err := state.GetStateDriver()
+	plan := newAuthzPlan()
+	authz, err := plan.add(tenantName, role, principalName, isLocal, notBefore, expiresAt)
 	if err != nil {
 		return types.Authorization{}, err
 	}
-	tenantAuthz := types.Authorization{
-		CommonState: types.CommonState{
-			StateDriver: sd,
-			ID:          uuid.NewV4().String(),
-		},
-		UUID:          uuid.NewV4().String(),
-		PrincipalName: principalName,
-		Local:         isLocal,
-		ClaimKey:      claimStr,
-		ClaimValue:    role.String(),
-	}
 
-	// insert tenant authorization
-	if err := db.InsertAuthorization(&tenantAuthz); err != nil {
-		log.Error("failed in adding tenant claim:", err)
+	if err := plan.apply(); err != nil {
+		log.Error("failed in adding authorization:", err)
 		return types.Authorization{}, err
 	}
 
-	log.Debugf("successfully added tenant authorization %#v", tenantAuthz)
-	return tenantAuthz, nil
+	log.Debugf("successfully added authorization %#v", authz)
+	return authz, nil
 }
 
-// addUpdaterRoleAuthorization adds/updates authorization claim for a specific
-// named principal's role. This claim "caches" the highest privilege role claim
-// for the principal. This authorization is used by APIs that only need to
-// check for role claim (e.g., admin role claim for global object).  Update is
-// only perfomed if role specified is higher privilege than existing role claim
-// for the principal.
+//
+// AddDenyAuthorization stores a deny authorization for a specific named
+// principal in the KV store: the principal is denied access to the tenant, or
+// to a resource of it, whatever the authorizations granting access to the
+// principal or the other principals of the user (e.g. LDAP groups). Admins
+// are not subject to deny authorizations.
 //
 // Parameters:
-//  role: type of role that specifies permissions associated with tenant
-//  principalName: Name of user for whom the authorization is to be added,
-//            Can either be a local user or an LDAP group.
-//  isLocal: true if the named principal is a local user, false if ldap group.
+//  tenantName: tenant the access is denied to
+//  principalName: Name of the principal the access is denied to, see
+//    AddAuthorization; it can also be an LDAP user (see types.LdapUserPrincipal)
+//  isLocal: true if the named principal is a local user/group, false if ldap group.
+//  resource: resource of the tenant the access is denied to; the whole tenant
+//    if its type is empty, all the resources of the type if its name is empty
+//  notBefore: unix timestamp the authorization takes effect at; 0 if now
+//  expiresAt: unix timestamp the authorization expires at; 0 if never
 //
 // Return values:
-//    TODO: errors.NonExistentLocalUserError: if a local user doesn't exist
-//    TODO: errors.NonExistentLdapGroupError: if ldap group doesn't exist
-//    : error from db.InsertAuthorization if adding/updating a role authorization
-//      fails.
-//    : error from db.ListAuthorizationsByClaimAndPrincipal if listing authorizations
-//      fails.
-func addUpdateRoleAuthorization(role types.RoleType, principalName string,
-	isLocal bool) (types.Authorization, error) {
+//  types.Authorization: new authorization that was added
+//  error: nil if successful, else
+//    auth_errors.ErrIllegalOperation if trying to add authorization to built-in
+//      local admin user.
+//    auth_errors.ErrIllegalArguments if the tenant is missing, or a resource
+//      name is given without a resource type
+//    *db.AuthorizationBatchError if writing the authorization fails
+//    auth_errors.ErrKeyModified if another batch of authorizations could
+//      not be waited for
+//
+func AddDenyAuthorization(tenantName, principalName string, isLocal bool,
+	resource types.Resource, notBefore, expiresAt int64) (types.Authorization, error) {
+
+	defer common.Untrace(common.Trace())
 
-	authz, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, principalName)
+	plan := newAuthzPlan()
+	authz, err := plan.addDeny(tenantName, principalName, isLocal, resource, notBefore, expiresAt)
 	if err != nil {
-		log.Error("failed in listing role claim for principal ",
-			principalName, ", error:", err)
 		return types.Authorization{}, err
 	}
 
-	l := len(authz)
-	switch {
-	case l == 0:
-		// A role authz doesn't exist, add one
-		return addRoleAuthorization(principalName, isLocal, role)
-
-	case l == 1:
-		roleAuthz := authz[0]
-		grantedRole, err := types.Role(roleAuthz.ClaimValue)
-		// Invalid claim in authorizations db
-		if err != nil {
-			log.Errorf("illegal role in authorization %#v", roleAuthz)
-			return types.Authorization{}, err
-		}
-
-		// Need to update if role < grantedRole
-		if role < grantedRole {
-			roleAuthz.ClaimValue = role.String()
-			// Inserting an existing authz updates it
-			if err := db.InsertAuthorization(&roleAuthz); err != nil {
-				log.Error("failed in updating role claim:", err)
-				return types.Authorization{}, err
-			}
-
-			log.Info("updated role claim for principal ", principalName,
-				", previous:", grantedRole.String(), ", updated:", role.String())
-			return roleAuthz, nil
-		}
-
-		log.Info("not updating role claim for principal ", principalName,
-			", previous:", grantedRole.String(), ", requested:", role.String())
-		return roleAuthz, nil
-
-	default:
-		// There should only be one role authz claim, so return error
-		log.Error("multiple role authorizations found, expected 1, found ", l)
-		return types.Authorization{}, auth_errors.ErrInternal
-
+	if err := plan.apply(); err != nil {
+		log.Error("failed in adding deny authorization:", err)
+		return types.Authorization{}, err
 	}
+
+	log.Debugf("successfully added deny authorization %#v", authz)
+	return authz, nil
 }
 
 //
@@ -280,28 +314,22 @@ func addUpdateRoleAuthorization(role types.RoleType, principalName string,
 //    types.UnauthorizedError: if caller isn't authorized to make this API call.
 //    auth_errors.ErrIllegalOperation: if attempting to delete authorization for
 //      built-in admin user.
-//    : error from db.DeleteAuthorization if deleting an authorization
-//      fails
+//    auth_errors.ErrKeyNotFound: if the authorization doesn't exist
+//    *db.AuthorizationBatchError: if deleting the authorization fails
+//    auth_errors.ErrKeyModified: if another batch of authorizations could
+//      not be waited for
 //
 func DeleteAuthorization(authUUID string) error {
 
 	defer common.Untrace(common.Trace())
 
-	// Return error if authorization doesn't exist
-	authorization, err := db.GetAuthorization(authUUID)
-	if err != nil {
-		log.Warn("failed to get authorization, err: ", err)
+	plan := newAuthzPlan()
+	if _, err := plan.delete(authUUID); err != nil {
 		return err
 	}
 
-	// don't allow deletion of claims on the built-in "admin" account
-	if authorization.BelongsToBuiltInAdmin() {
-		log.Warn("can't delete authorizations on built-in admin user")
-		return auth_errors.ErrIllegalOperation
-	}
-
 	// delete authz from the KV store
-	if err := db.DeleteAuthorization(authUUID); err != nil {
+	if err := plan.apply(); err != nil {
 		log.Warn("failed to delete tenant authZ")
 		return err
 	}
@@ -367,8 +395,9 @@ func ListAuthorizations() ([]types.Authorization, error) {
 //
 // Parameters:
 //  principalName: Name of user for whom the authorization is to be added,
-//            Can either be a local user or an LDAP group.
-//  isLocal: true if the named principal is a local user, false if ldap group.
+//            Can either be a local user, a local group (see types.LocalGroupPrincipal)
+//            or an LDAP group.
+//  isLocal: true if the named principal is a local user/group, false if ldap group.
 //  role: role that needs to be added as claim value
 //
 // Return values:
@@ -385,21 +414,10 @@ func addRoleAuthorization(principalName string,
 	defer common.Untrace(common.Trace())
 
 	// create an authorization
-	sd, err := state.GetStateDriver()
+	roleAuthz, err := newAuthorization(principalName, isLocal, types.RoleClaimKey, role)
 	if err != nil {
 		return types.Authorization{}, err
 	}
-	roleAuthz := types.Authorization{
-		CommonState: types.CommonState{
-			StateDriver: sd,
-			ID:          uuid.NewV4().String(),
-		},
-		UUID:          uuid.NewV4().String(),
-		PrincipalName: principalName,
-		Local:         isLocal,
-		ClaimKey:      types.RoleClaimKey,
-		ClaimValue:    role.String(),
-	}
 
 	// insert authorization
 	if err := db.InsertAuthorization(&roleAuthz); err != nil {
@@ -414,14 +432,45 @@ func addRoleAuthorization(principalName string,
 // AddDefaultUsers adds pre-defined  users(admin,ops) to the system. Names of
 // these users is same as that of role type (admin or ops). Also adds admin role
 // authorization for admin user.
-func AddDefaultUsers() error {
+// If no admin password is given, the password of each built-in user is same as
+// its name and has to be changed on the first login. Otherwise, admin gets the
+// given password and ops gets a random one which has to be reset by the admin;
+// so no default credential is ever created.
+// The given admin password must satisfy the password policy.
+// params:
+//  adminPassword: initial password of the admin user; "" to use the default
+// return values:
+//  error: nil if successful, the policy violation if the admin password doesn't satisfy the
+//         password policy, else as returned by db.AddLocalUser
+func AddDefaultUsers(adminPassword string) error {
+	if !common.IsEmpty(adminPassword) {
+		passwordPolicy, err := db.GetPasswordPolicy()
+		if err != nil {
+			return err
+		}
+
+		if err := passwordPolicy.Check(types.Admin.String(), adminPassword, nil); err != nil {
+			return err
+		}
+	}
+
 	for _, userR := range []types.RoleType{types.Admin, types.Ops} {
 		log.Infof("Adding local user %q to the system", userR.String())
 
+		password := userR.String()
+		if !common.IsEmpty(adminPassword) {
+			var err error
+			if password, err = initialPassword(userR, adminPassword); err != nil {
+				return err
+			}
+		}
+
 		localUser := types.LocalUser{
 			Username: userR.String(),
 			Disable:  false,
-			Password: userR.String(),
+			Password: password,
+			// only the password chosen by the installer needn't be changed
+			MustChangePassword: password != adminPassword,
 			// FirstName, LastName = "" for built-in users
 		}
 
@@ -438,3 +487,18 @@ func AddDefaultUsers() error {
 
 	return nil
 }
+
+// initialPassword returns the initial password of the given built-in user when the admin password is seeded.
+// params:
+//  role: built-in user
+//  adminPassword: initial password of the admin user
+// return values:
+//  string: adminPassword for admin, a random password for others
+//  error: nil if successful, else as returned by common.GenRandomPassword
+func initialPassword(role types.RoleType, adminPassword string) (string, error) {
+	if role == types.Admin {
+		return adminPassword, nil
+	}
+
+	return common.GenRandomPassword()
+}
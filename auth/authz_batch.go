@@ -0,0 +1,511 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the batches of authorization operations (add, update, delete). The operations
+// are planned first: the changes of each of them are computed and validated against the authorizations
+// as left by the previous ones, e.g. the role claim of a principal. Nothing is written unless all of them
+// are valid; the changes are then applied as a single batch, which takes effect entirely or not at all
+// (see db.ApplyAuthorizationChanges).
+
+// operations of a batch of authorizations (see ApplyAuthorizationOperations)
+const (
+	AuthzOpAdd    = "add"
+	AuthzOpUpdate = "update"
+	AuthzOpDelete = "delete"
+)
+
+// AuthorizationOperation is an operation of a batch of authorizations.
+type AuthorizationOperation struct {
+	Op            string // AuthzOpAdd, AuthzOpUpdate or AuthzOpDelete
+	AuthzUUID     string // authorization to be updated or deleted
+	PrincipalName string // principal of the authorization to be added
+	Local         bool   // whether the principal of the authorization to be added is local
+	Role          string // role to be granted; unchanged by an update if empty
+	TenantName    string // tenant the role is granted on; unchanged by an update if empty
+	NotBefore     int64  // unix timestamp the authorization to be added takes effect at; 0 if now
+	ExpiresAt     int64  // unix timestamp the authorization to be added expires at; 0 if never
+	Deny          bool   // whether the authorization to be added denies access to the tenant; Role is ignored
+
+	// resource of the tenant the deny authorization to be added is limited to; the whole tenant if empty
+	Resource types.Resource
+}
+
+// AuthorizationOperationError reports the operation of a batch which failed.
+type AuthorizationOperationError struct {
+	Index int   // position of the failed operation
+	Err   error // why it failed
+
+	// whether the operations were committed before the failure: they all take effect once the
+	// batch is completed (see db.AuthorizationBatchError); none of them was applied otherwise
+	Committed bool
+}
+
+// Error returns the description of the failure.
+func (e *AuthorizationOperationError) Error() string {
+	if !e.Committed {
+		return fmt.Sprintf("operation %d failed: %v", e.Index, e.Err)
+	}
+
+	return fmt.Sprintf("operation %d failed: %v; the operations are committed and will be completed by the next change", e.Index, e.Err)
+}
+
+// authzPlan holds the changes of the authorization operations planned so far.
+type authzPlan struct {
+	changes   []db.AuthorizationChange
+	changeOps []int // operation each change belongs to
+	op        int   // operation being planned
+
+	// authorizations as left by the changes planned: the values written and the UUIDs deleted
+	written map[string]types.Authorization
+	deleted map[string]bool
+
+	// permanent role claim of the principals as left by the changes planned; nil if there is none
+	roleClaims map[string]*types.Authorization
+}
+
+// newAuthzPlan returns an empty plan.
+func newAuthzPlan() *authzPlan {
+	return &authzPlan{
+		written:    map[string]types.Authorization{},
+		deleted:    map[string]bool{},
+		roleClaims: map[string]*types.Authorization{},
+	}
+}
+
+// put plans writing the given authorization.
+func (p *authzPlan) put(a types.Authorization) {
+	p.changes = append(p.changes, db.AuthorizationChange{Put: &a})
+	p.changeOps = append(p.changeOps, p.op)
+	p.written[a.UUID] = a
+	delete(p.deleted, a.UUID)
+
+	if a.ClaimKey == types.RoleClaimKey && !a.IsTimeBound() {
+		p.roleClaims[a.PrincipalName] = &a
+	}
+}
+
+// get looks up an authorization as left by the changes planned.
+// return values:
+//  types.Authorization: the authorization if found
+//  error: nil if found, ErrKeyNotFound if it doesn't exist, otherwise as returned by db.GetAuthorization
+func (p *authzPlan) get(authzUUID string) (types.Authorization, error) {
+	if p.deleted[authzUUID] {
+		return types.Authorization{}, auth_errors.ErrKeyNotFound
+	}
+
+	if a, found := p.written[authzUUID]; found {
+		return a, nil
+	}
+
+	return db.GetAuthorization(authzUUID)
+}
+
+// roleClaim looks up the permanent role claim of a principal as left by the changes planned; the
+// time-bound role claims granted along with time-bound authorizations are left out.
+// return values:
+//  *types.Authorization: the role claim; nil if the principal has none
+//  error: nil if successful, ErrInternal if the principal has several role claims, otherwise as returned
+//         by db.ListAuthorizationsByClaimAndPrincipal
+func (p *authzPlan) roleClaim(principalName string) (*types.Authorization, error) {
+	if a, found := p.roleClaims[principalName]; found {
+		return a, nil
+	}
+
+	all, err := db.ListAuthorizationsByClaimAndPrincipal(types.RoleClaimKey, principalName)
+	if err != nil {
+		log.Error("failed in listing role claim for principal ", principalName, ", error:", err)
+		return nil, err
+	}
+
+	authz := []types.Authorization{}
+	for _, a := range all {
+		if !a.IsTimeBound() {
+			authz = append(authz, a)
+		}
+	}
+
+	switch len(authz) {
+	case 0:
+		p.roleClaims[principalName] = nil
+	case 1:
+		p.roleClaims[principalName] = &authz[0]
+	default:
+		// There should only be one role authz claim, so return error
+		log.Error("multiple role authorizations found, expected 1, found ", len(authz))
+		return nil, auth_errors.ErrInternal
+	}
+
+	return p.roleClaims[principalName], nil
+}
+
+// add plans adding an authorization; see AddAuthorization.
+func (p *authzPlan) add(tenantName string, role types.RoleType, principalName string, isLocal bool, notBefore, expiresAt int64) (types.Authorization, error) {
+	if isLocal && types.Admin.String() == principalName {
+		return types.Authorization{}, auth_errors.ErrIllegalOperation
+	}
+
+	// LDAP users are granted access through their groups; only deny authorizations are given to them
+	if !isLocal && strings.HasPrefix(principalName, types.LdapUserPrincipalPrefix) {
+		return types.Authorization{}, auth_errors.ErrIllegalArguments
+	}
+
+	// Adding authorization is generally a two part operation
+	// - Adding tenant claim
+	// - Adding/updating role claim. This caches "highest" access role available for principal.
+
+	// Short circuit to just adding/updating role claim since we don't care
+	// about tenant specific info for admins
+	if role == types.Admin {
+		return p.raiseRole(role, principalName, isLocal, notBefore, expiresAt)
+	}
+
+	claimStr, err := GenerateClaimKey(types.Tenant(tenantName))
+	if err != nil {
+		log.Error("failed in generating claim:", err)
+		return types.Authorization{}, err
+	}
+
+	tenantAuthz, err := newAuthorization(principalName, isLocal, claimStr, role)
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	tenantAuthz.NotBefore, tenantAuthz.ExpiresAt = notBefore, expiresAt
+	p.put(tenantAuthz)
+
+	if _, err := p.raiseRole(role, principalName, isLocal, notBefore, expiresAt); err != nil {
+		return types.Authorization{}, err
+	}
+
+	return tenantAuthz, nil
+}
+
+// addDeny plans adding a deny authorization; see AddDenyAuthorization.
+func (p *authzPlan) addDeny(tenantName, principalName string, isLocal bool, resource types.Resource, notBefore, expiresAt int64) (types.Authorization, error) {
+	if isLocal && types.Admin.String() == principalName {
+		return types.Authorization{}, auth_errors.ErrIllegalOperation
+	}
+
+	if common.IsEmpty(tenantName) || (common.IsEmpty(resource.Type) && !common.IsEmpty(resource.Name)) {
+		return types.Authorization{}, auth_errors.ErrIllegalArguments
+	}
+
+	claimStr, err := GenerateClaimKey(types.Tenant(tenantName))
+	if err != nil {
+		log.Error("failed in generating claim:", err)
+		return types.Authorization{}, err
+	}
+
+	// no role claim is raised: deny authorizations grant nothing, they carry no claim's value
+	denyAuthz, err := newAuthorization(principalName, isLocal, claimStr, types.Invalid)
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	denyAuthz.ClaimValue = ""
+	denyAuthz.Deny, denyAuthz.ResourceType, denyAuthz.ResourceName = true, resource.Type, resource.Name
+	denyAuthz.NotBefore, denyAuthz.ExpiresAt = notBefore, expiresAt
+	p.put(denyAuthz)
+
+	return denyAuthz, nil
+}
+
+// update plans changing the role and/or tenant of an authorization; see UpdateAuthorization.
+func (p *authzPlan) update(authzUUID, roleStr, tenantName string) (types.Authorization, error) {
+	authz, err := p.get(authzUUID)
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	// don't allow changing claims on the built-in "admin" account
+	if authz.BelongsToBuiltInAdmin() {
+		log.Warn("can't update authorizations on built-in admin user")
+		return types.Authorization{}, auth_errors.ErrIllegalOperation
+	}
+
+	isRoleClaim := authz.ClaimKey == types.RoleClaimKey
+
+	// deny authorizations carry no role; only their tenant can be changed
+	if authz.Deny && !common.IsEmpty(roleStr) {
+		return types.Authorization{}, auth_errors.ErrIllegalArguments
+	}
+
+	if !common.IsEmpty(tenantName) {
+		// the role claim applies to all the tenants
+		if isRoleClaim {
+			return types.Authorization{}, auth_errors.ErrIllegalArguments
+		}
+
+		if authz.ClaimKey, err = GenerateClaimKey(types.Tenant(tenantName)); err != nil {
+			return types.Authorization{}, err
+		}
+	}
+
+	if authz.Deny {
+		p.put(authz)
+		return authz, nil
+	}
+
+	role, err := types.Role(authz.ClaimValue)
+	if !common.IsEmpty(roleStr) {
+		role, err = types.Role(roleStr)
+	}
+
+	// admins are granted access to all the tenants by the role claim
+	if err != nil || (!isRoleClaim && role == types.Admin) {
+		return types.Authorization{}, auth_errors.ErrIllegalArguments
+	}
+
+	authz.ClaimValue = role.String()
+	p.put(authz)
+
+	if !isRoleClaim {
+		if _, err := p.raiseRole(role, authz.PrincipalName, authz.Local, authz.NotBefore, authz.ExpiresAt); err != nil {
+			return types.Authorization{}, err
+		}
+	}
+
+	return authz, nil
+}
+
+// delete plans deleting an authorization; see DeleteAuthorization.
+func (p *authzPlan) delete(authzUUID string) (types.Authorization, error) {
+	authz, err := p.get(authzUUID)
+	if err != nil {
+		log.Warn("failed to get authorization, err: ", err)
+		return types.Authorization{}, err
+	}
+
+	// don't allow deletion of claims on the built-in "admin" account
+	if authz.BelongsToBuiltInAdmin() {
+		log.Warn("can't delete authorizations on built-in admin user")
+		return types.Authorization{}, auth_errors.ErrIllegalOperation
+	}
+
+	p.changes = append(p.changes, db.AuthorizationChange{Delete: authzUUID})
+	p.changeOps = append(p.changeOps, p.op)
+	delete(p.written, authzUUID)
+	p.deleted[authzUUID] = true
+
+	if authz.ClaimKey == types.RoleClaimKey && !authz.IsTimeBound() {
+		p.roleClaims[authz.PrincipalName] = nil
+	}
+
+	return authz, nil
+}
+
+// raiseRole plans adding/updating the role claim of a principal. This claim "caches" the highest
+// privilege role claim for the principal. This authorization is used by APIs that only need to check
+// for role claim (e.g., admin role claim for global object). Update is only performed if role
+// specified is higher privilege than existing role claim for the principal.
+// A role granted for a period of time gets its own role claim with the same validity period, unless
+// the permanent role claim already grants it; that claim expires along with the grant.
+// params:
+//  role: role granted to the principal
+//  principalName: name of the principal
+//  isLocal: true if the named principal is a local user/group, false if ldap group.
+//  notBefore: unix timestamp the grant takes effect at; 0 if now
+//  expiresAt: unix timestamp the grant expires at; 0 if never
+// return values:
+//  types.Authorization: role claim of the principal
+//  error: nil if successful, else as returned by roleClaim
+func (p *authzPlan) raiseRole(role types.RoleType, principalName string, isLocal bool, notBefore, expiresAt int64) (types.Authorization, error) {
+	roleAuthz, err := p.roleClaim(principalName)
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	timeBound := notBefore != 0 || expiresAt != 0
+
+	if roleAuthz != nil {
+		grantedRole, err := types.Role(roleAuthz.ClaimValue)
+		// Invalid claim in authorizations db
+		if err != nil {
+			log.Errorf("illegal role in authorization %#v", roleAuthz)
+			return types.Authorization{}, err
+		}
+
+		// Nothing to do if the role claim grants at least the role
+		if role >= grantedRole {
+			return *roleAuthz, nil
+		}
+
+		// Need to update if role < grantedRole, unless the grant is time-bound
+		if !timeBound {
+			updated := *roleAuthz
+			updated.ClaimValue = role.String()
+			p.put(updated)
+
+			log.Info("updating role claim for principal ", principalName,
+				", previous:", grantedRole.String(), ", updated:", role.String())
+			return updated, nil
+		}
+	}
+
+	// A role authz doesn't exist or doesn't cover the time-bound grant, add one
+	added, err := newAuthorization(principalName, isLocal, types.RoleClaimKey, role)
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	added.NotBefore, added.ExpiresAt = notBefore, expiresAt
+	p.put(added)
+	return added, nil
+}
+
+// apply applies the changes planned.
+// return values:
+//  error: nil if successful, else as returned by db.ApplyAuthorizationChanges
+func (p *authzPlan) apply() error {
+	if len(p.changes) == 0 {
+		return nil
+	}
+
+	return db.ApplyAuthorizationChanges(p.changes)
+}
+
+// newAuthorization returns a new authorization with the given claim for a principal.
+// params:
+//  principalName: name of the principal
+//  isLocal: true if the named principal is a local user/group, false if ldap group.
+//  claimKey: types.RoleClaimKey or the claim key of a tenant
+//  role: role granted by the claim
+// return values:
+//  types.Authorization: the authorization, not written yet
+//  error: nil if successful, else as returned by state.GetStateDriver
+func newAuthorization(principalName string, isLocal bool, claimKey string, role types.RoleType) (types.Authorization, error) {
+	sd, err := state.GetStateDriver()
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	return types.Authorization{
+		CommonState: types.CommonState{
+			StateDriver: sd,
+			ID:          uuid.NewV4().String(),
+		},
+		UUID:          uuid.NewV4().String(),
+		PrincipalName: principalName,
+		Local:         isLocal,
+		ClaimKey:      claimKey,
+		ClaimValue:    role.String(),
+	}, nil
+}
+
+//
+// UpdateAuthorization changes the role and/or the tenant of an authorization.
+// The role claim of the principal is raised if needed, as when adding an
+// authorization; both are written as a batch (see ApplyAuthorizationOperations).
+//
+// Parameters:
+//  authzUUID: UUID of the authorization
+//  role: role to be granted; unchanged if empty
+//  tenantName: tenant the role is granted on; unchanged if empty
+//
+// Return values:
+//  types.Authorization: the authorization updated
+//  error: nil if successful, else
+//    auth_errors.ErrKeyNotFound: if the authorization doesn't exist
+//    auth_errors.ErrIllegalOperation: if the authorization belongs to the
+//      built-in admin user
+//    auth_errors.ErrIllegalArguments: if the role is invalid, admin on a
+//      tenant, a tenant is given for a role claim or a role is given for a
+//      deny authorization
+//    *db.AuthorizationBatchError: if writing the changes fails
+//    auth_errors.ErrKeyModified: if another batch of authorizations could
+//      not be waited for
+//
+func UpdateAuthorization(authzUUID, role, tenantName string) (types.Authorization, error) {
+	defer common.Untrace(common.Trace())
+
+	plan := newAuthzPlan()
+	authz, err := plan.update(authzUUID, role, tenantName)
+	if err != nil {
+		return types.Authorization{}, err
+	}
+
+	if err := plan.apply(); err != nil {
+		return types.Authorization{}, err
+	}
+
+	log.Debugf("successfully updated authorization %#v", authz)
+	return authz, nil
+}
+
+//
+// ApplyAuthorizationOperations applies a batch of authorization operations:
+// the operations are validated first and nothing is written unless they are
+// all valid; they are then written as a single batch, which takes effect
+// entirely or not at all (see db.ApplyAuthorizationChanges).
+//
+// Parameters:
+//  operations: operations to be applied, in order
+//
+// Return values:
+//  []types.Authorization: for each operation, the authorization added,
+//    updated or deleted
+//  error: nil if successful, else *AuthorizationOperationError reporting the
+//    operation which failed, see AddAuthorization, AddDenyAuthorization,
+//    UpdateAuthorization and DeleteAuthorization for the errors of each operation
+//
+func ApplyAuthorizationOperations(operations []AuthorizationOperation) ([]types.Authorization, error) {
+	defer common.Untrace(common.Trace())
+
+	plan := newAuthzPlan()
+	results := []types.Authorization{}
+
+	for i, operation := range operations {
+		plan.op = i
+
+		var authz types.Authorization
+		var err error
+
+		switch {
+		case operation.Op == AuthzOpAdd && operation.Deny:
+			authz, err = plan.addDeny(operation.TenantName, operation.PrincipalName, operation.Local, operation.Resource, operation.NotBefore, operation.ExpiresAt)
+		case operation.Op == AuthzOpAdd:
+			var role types.RoleType
+			if role, err = types.Role(operation.Role); err != nil {
+				err = auth_errors.ErrIllegalArguments
+				break
+			}
+
+			authz, err = plan.add(operation.TenantName, role, operation.PrincipalName, operation.Local, operation.NotBefore, operation.ExpiresAt)
+		case operation.Op == AuthzOpUpdate:
+			authz, err = plan.update(operation.AuthzUUID, operation.Role, operation.TenantName)
+		case operation.Op == AuthzOpDelete:
+			authz, err = plan.delete(operation.AuthzUUID)
+		default:
+			err = auth_errors.ErrIllegalArguments
+		}
+
+		if err != nil {
+			return nil, &AuthorizationOperationError{Index: i, Err: err}
+		}
+
+		results = append(results, authz)
+	}
+
+	err := plan.apply()
+	if batchErr, ok := err.(*db.AuthorizationBatchError); ok {
+		return nil, &AuthorizationOperationError{Index: plan.changeOps[batchErr.Failed], Err: batchErr.Err, Committed: batchErr.Committed}
+	} else if err != nil {
+		return nil, &AuthorizationOperationError{Index: 0, Err: err}
+	}
+
+	log.Debugf("successfully applied %d authorization operations", len(operations))
+	return results, nil
+}
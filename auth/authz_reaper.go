@@ -0,0 +1,78 @@
+package auth
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common/audit"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the reaper of the expired authorizations. They are ignored by the RBAC checks
+// as soon as they expire (see grantedRole); the reaper deletes them from the data store afterwards.
+
+// authzReaperInterval is the delay between two passes of the reaper
+const authzReaperInterval = time.Minute
+
+// authzReaperOnce makes sure a single reaper runs within this instance
+var authzReaperOnce sync.Once
+
+//
+// StartAuthorizationReaper deletes the expired authorizations periodically in
+// the background; it does nothing if the reaper is already started.
+//
+func StartAuthorizationReaper() {
+	authzReaperOnce.Do(func() {
+		go func() {
+			ticker := time.NewTicker(authzReaperInterval)
+			defer ticker.Stop()
+
+			for range ticker.C {
+				reapAuthorizations(time.Now())
+			}
+		}()
+	})
+}
+
+// reapAuthorizations deletes the authorizations which have expired at the given time.
+// params:
+//  now: time the authorizations are checked at
+// return values:
+//  int: number of authorizations deleted
+func reapAuthorizations(now time.Time) int {
+	authorizations, err := db.ListAuthorizations()
+	if err != nil {
+		log.Errorf("Failed to list the authorizations to be reaped: %v", err)
+		return 0
+	}
+
+	reaped := 0
+	for _, a := range authorizations {
+		if !a.IsExpired(now) {
+			continue
+		}
+
+		if err := db.DeleteAuthorization(a.UUID); err != nil {
+			// retried on the next pass
+			log.Errorf("Failed to delete expired authorization %q: %v", a.UUID, err)
+			continue
+		}
+
+		audit.Record("authorization_expired", audit.Fields{
+			"authz_uuid": a.UUID,
+			"principal":  a.PrincipalName,
+			"claim":      a.ClaimKey,
+			"role":       a.ClaimValue,
+			"expires_at": a.ExpiresAt,
+		})
+		reaped++
+	}
+
+	if reaped > 0 {
+		log.Infof("Deleted %d expired authorizations", reaped)
+	}
+
+	return reaped
+}
@@ -0,0 +1,291 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the break-glass emergency access. It doesn't depend on any password nor on the
+// directory: the proxy only holds an Ed25519 public key, the private key is kept offline (e.g. in a
+// vault). A code is the signature of the current challenge by the private key; it can be used once
+// to get a short-lived admin token, after which the access stays disarmed until an admin re-arms it
+// with a new challenge.
+
+const (
+	// BreakGlassTokenValidity is the validity of the admin tokens granted by the break-glass access
+	BreakGlassTokenValidity = 15 * time.Minute
+
+	// BreakGlassUsername is the username carried by the tokens granted by the break-glass access
+	BreakGlassUsername = "break-glass"
+
+	// This claim is only present in tokens granted by the break-glass access; it carries the
+	// generation of the access (see types.BreakGlass) at the time of issuance
+	breakGlassClaimKey = "break_glass"
+
+	// size of the random challenges
+	breakGlassChallengeSize = 32
+)
+
+// breakGlassMutex serializes the uses of the break-glass access within this process; the state is
+// swapped atomically in the data store (see db.SwapBreakGlass) so that a code is only used once even
+// if several proxy instances share the data store
+var breakGlassMutex sync.Mutex
+
+//
+// ArmBreakGlass arms the break-glass access with a new challenge; the codes
+// derived from the previous challenge and the tokens they granted are no
+// longer accepted.
+//
+// Parameters:
+//  armedBy: username of the admin arming the access
+//  publicKey: PEM encoded Ed25519 public key the codes are verified with; the
+//    current key is kept if empty
+//
+// Return values:
+//  *types.BreakGlass: state of the armed access
+//  error: nil if successful, else
+//    auth_errors.ErrIllegalArguments: if the public key is invalid or missing
+//    auth_errors.ErrKeyModified: if the access was changed concurrently
+//    as returned by db.GetBreakGlass or db.SwapBreakGlass
+//
+func ArmBreakGlass(armedBy, publicKey string) (*types.BreakGlass, error) {
+	defer common.Untrace(common.Trace())
+
+	breakGlassMutex.Lock()
+	defer breakGlassMutex.Unlock()
+
+	// current is nil if the access was never armed
+	current, err := db.GetBreakGlass()
+	if err != nil && err != auth_errors.ErrKeyNotFound {
+		return nil, err
+	}
+
+	return armBreakGlass(current, armedBy, publicKey)
+}
+
+//
+// InitBreakGlass arms the break-glass access with the given public key unless
+// it was armed before; it is meant for the initial setup, the access can only
+// be re-armed by an admin afterwards.
+//
+// Parameters:
+//  publicKey: PEM encoded Ed25519 public key the codes are verified with
+//
+// Return values:
+//  *types.BreakGlass: state of the armed access; nil if it was armed before
+//  error: nil if successful, else
+//    auth_errors.ErrIllegalArguments: if the public key is invalid
+//    as returned by db.GetBreakGlass or db.SwapBreakGlass
+//
+func InitBreakGlass(publicKey string) (*types.BreakGlass, error) {
+	breakGlassMutex.Lock()
+	defer breakGlassMutex.Unlock()
+
+	_, err := db.GetBreakGlass()
+	switch err {
+	case nil:
+		log.Warn("Break-glass access was armed before; it can only be re-armed by an admin")
+		return nil, nil
+	case auth_errors.ErrKeyNotFound:
+		breakGlass, err := armBreakGlass(nil, "", publicKey)
+		if err == auth_errors.ErrKeyModified {
+			log.Warn("Break-glass access was armed by another instance; it can only be re-armed by an admin")
+			return nil, nil
+		}
+
+		return breakGlass, err
+	default:
+		return nil, err
+	}
+}
+
+// armBreakGlass swaps the given break-glass access (nil if it was never armed) for the access armed
+// with a new challenge; see ArmBreakGlass. The mutex must be held.
+func armBreakGlass(current *types.BreakGlass, armedBy, publicKey string) (*types.BreakGlass, error) {
+	previous := current
+	if previous == nil {
+		previous = &types.BreakGlass{}
+	}
+
+	if common.IsEmpty(publicKey) {
+		publicKey = previous.PublicKey
+	}
+
+	if _, err := parseBreakGlassPublicKey(publicKey); err != nil {
+		log.Warnf("Invalid break-glass public key: %v", err)
+		return nil, auth_errors.ErrIllegalArguments
+	}
+
+	challenge := make([]byte, breakGlassChallengeSize)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+
+	breakGlass := &types.BreakGlass{
+		PublicKey:  publicKey,
+		Challenge:  base64.RawURLEncoding.EncodeToString(challenge),
+		Armed:      true,
+		Generation: previous.Generation + 1,
+		ArmedBy:    armedBy,
+		ArmedAt:    time.Now().Unix(),
+	}
+
+	if err := db.SwapBreakGlass(current, breakGlass); err != nil {
+		log.Errorf("Failed to arm break-glass access: %v", err)
+		return nil, err
+	}
+
+	audit.Warn("break_glass_armed", audit.Fields{"armed_by": armedBy, "generation": breakGlass.Generation})
+	return breakGlass, nil
+}
+
+//
+// BreakGlassLogin grants a short-lived admin token in exchange for a code
+// derived from the current challenge (see BreakGlassCode). The access is
+// disarmed once a code has been used.
+//
+// Parameters:
+//  code: code derived from the current challenge
+//  source: address the code is used from; recorded in the audit trail
+//
+// Return values:
+//  string: admin token valid for BreakGlassTokenValidity
+//  error: nil if successful, else
+//    auth_errors.ErrAccessDenied: if the access is not armed or the code is
+//      invalid or has just been used
+//    as returned by db.GetBreakGlass or db.SwapBreakGlass
+//
+func BreakGlassLogin(code, source string) (string, error) {
+	defer common.Untrace(common.Trace())
+
+	breakGlassMutex.Lock()
+	defer breakGlassMutex.Unlock()
+
+	breakGlass, err := db.GetBreakGlass()
+	switch {
+	case err == auth_errors.ErrKeyNotFound, err == nil && !breakGlass.Armed:
+		audit.Warn("break_glass_denied", audit.Fields{"source": source, "reason": "not armed"})
+		return "", auth_errors.ErrAccessDenied
+	case err != nil:
+		return "", err
+	}
+
+	if err := verifyBreakGlassCode(breakGlass, code); err != nil {
+		audit.Warn("break_glass_denied", audit.Fields{"source": source, "reason": err.Error()})
+		return "", auth_errors.ErrAccessDenied
+	}
+
+	// disarmed (atomically) before the token is granted so that the code can't be used twice
+	current := *breakGlass
+	now := time.Now()
+	breakGlass.Armed, breakGlass.UsedAt, breakGlass.UsedFrom = false, now.Unix(), source
+	switch err := db.SwapBreakGlass(&current, breakGlass); err {
+	case nil:
+	case auth_errors.ErrKeyModified:
+		audit.Warn("break_glass_denied", audit.Fields{"source": source, "reason": "code used or access re-armed concurrently"})
+		return "", auth_errors.ErrAccessDenied
+	default:
+		log.Errorf("Failed to disarm break-glass access: %v", err)
+		return "", err
+	}
+
+	authZ, err := NewTokenWithClaims([]string{types.Admin.String()})
+	if err != nil {
+		return "", err
+	}
+
+	expiresAt := now.Add(BreakGlassTokenValidity).Unix()
+	authZ.AddClaim("exp", expiresAt)
+	authZ.AddClaim(breakGlassClaimKey, breakGlass.Generation)
+	authZ.AddClaim("username", BreakGlassUsername)
+
+	audit.Alert("break_glass_used", audit.Fields{
+		"source":     source,
+		"generation": breakGlass.Generation,
+		"expires_at": expiresAt,
+	})
+
+	return authZ.Stringify()
+}
+
+//
+// BreakGlassCode derives the code of the given challenge; this is meant to be
+// run offline, where the private key is kept.
+//
+// Parameters:
+//  privateKey: PEM encoded (PKCS #8) Ed25519 private key
+//  challenge: current challenge of the break-glass access
+//
+// Return values:
+//  string: the code
+//  error: nil if successful, else an error telling why the key is invalid
+//
+func BreakGlassCode(privateKey []byte, challenge string) (string, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return "", errors.New("no PEM encoded private key found")
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+
+	ed25519Key, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return "", errors.New("not an Ed25519 private key")
+	}
+
+	return base64.RawURLEncoding.EncodeToString(ed25519.Sign(ed25519Key, []byte(challenge))), nil
+}
+
+// verifyBreakGlassCode checks that the given code was derived from the challenge of the access.
+// return values:
+//  error: nil if the code is valid, else an error telling why it's not
+func verifyBreakGlassCode(breakGlass *types.BreakGlass, code string) error {
+	publicKey, err := parseBreakGlassPublicKey(breakGlass.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(code)
+	if err != nil || !ed25519.Verify(publicKey, []byte(breakGlass.Challenge), signature) {
+		return errors.New("invalid code")
+	}
+
+	return nil
+}
+
+// parseBreakGlassPublicKey parses a PEM encoded (PKIX) Ed25519 public key.
+func parseBreakGlassPublicKey(publicKey string) (ed25519.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicKey))
+	if block == nil {
+		return nil, errors.New("no PEM encoded public key found")
+	}
+
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	ed25519Key, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, errors.New("not an Ed25519 public key")
+	}
+
+	return ed25519Key, nil
+}
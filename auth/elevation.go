@@ -0,0 +1,184 @@
+package auth
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the just-in-time elevation: instead of holding a role permanently, a local
+// user requests it for a limited time and another admin approves or denies the request. Approval
+// adds a time-bound authorization which is deleted by the reaper once it expires.
+
+// MaxElevationDuration is the longest time a role can be requested for
+const MaxElevationDuration = 24 * time.Hour
+
+//
+// RequestElevation records a request of a local user to be granted a role for
+// a limited time; nothing is granted until an admin approves it.
+//
+// Parameters:
+//  requester: username of the local user asking for the role
+//  role: role requested
+//  tenantName: tenant the role is requested on; required for the ops role,
+//    ignored for the admin role
+//  duration: how long the role is granted for once approved
+//  reason: why the requester needs the role
+//
+// Return values:
+//  *types.ElevationRequest: the pending request
+//  error: nil if successful, else
+//    auth_errors.ErrIllegalArguments: if the tenant or the reason is missing
+//      or the duration is out of range
+//    as returned by db.WriteElevationRequest
+//
+func RequestElevation(requester string, role types.RoleType, tenantName string, duration time.Duration, reason string) (*types.ElevationRequest, error) {
+	defer common.Untrace(common.Trace())
+
+	if role == types.Admin {
+		tenantName = ""
+	}
+
+	if (role == types.Ops && common.IsEmpty(tenantName)) || common.IsEmpty(reason) ||
+		duration < time.Second || duration > MaxElevationDuration {
+		return nil, auth_errors.ErrIllegalArguments
+	}
+
+	request := &types.ElevationRequest{
+		ID:              uuid.NewV4().String(),
+		Requester:       requester,
+		Role:            role.String(),
+		TenantName:      tenantName,
+		DurationSeconds: int64(duration / time.Second),
+		Reason:          reason,
+		Status:          types.ElevationPending,
+		CreatedAt:       time.Now().Unix(),
+	}
+
+	if err := db.WriteElevationRequest(request); err != nil {
+		log.Errorf("Failed to write elevation request of %q: %v", requester, err)
+		return nil, err
+	}
+
+	audit.Record("elevation_requested", audit.Fields{
+		"request_id": request.ID,
+		"requester":  requester,
+		"role":       request.Role,
+		"tenant":     tenantName,
+		"duration":   request.DurationSeconds,
+		"reason":     reason,
+	})
+
+	return request, nil
+}
+
+//
+// DecideElevation approves or denies a pending elevation request. Approval
+// grants the role requested for the duration requested, from now on. The
+// request is swapped atomically in the data store (see db.SwapElevationRequest)
+// so that it is decided only once even across the proxy instances; the role is
+// granted once the request is approved, and the request is pending again if
+// granting it fails.
+//
+// Parameters:
+//  id: ID of the request
+//  decider: username of the admin taking the decision; it must not be the
+//    requester
+//  approve: true to approve the request, false to deny it
+//  comment: comment of the decider
+//
+// Return values:
+//  *types.ElevationRequest: the request decided
+//  error: nil if successful, else
+//    auth_errors.ErrKeyNotFound: if the request doesn't exist
+//    auth_errors.ErrAccessDenied: if the decider is the requester
+//    auth_errors.ErrIllegalOperation: if the request was already decided,
+//      possibly concurrently
+//    as returned by AddAuthorization or db.SwapElevationRequest
+//
+func DecideElevation(id, decider string, approve bool, comment string) (*types.ElevationRequest, error) {
+	defer common.Untrace(common.Trace())
+
+	request, err := db.GetElevationRequest(id)
+	if err != nil {
+		return nil, err
+	}
+
+	// nobody approves their own request, even an admin
+	if request.Requester == decider {
+		log.Warnf("%q can't decide its own elevation request %q", decider, id)
+		return nil, auth_errors.ErrAccessDenied
+	}
+
+	if request.Status != types.ElevationPending {
+		return nil, auth_errors.ErrIllegalOperation
+	}
+
+	var role types.RoleType
+	if approve {
+		if role, err = types.Role(request.Role); err != nil {
+			return nil, err
+		}
+	}
+
+	now := time.Now()
+	pending, decided := *request, *request
+	decided.Decider, decided.DecidedAt, decided.Comment = decider, now.Unix(), comment
+	decided.Status = types.ElevationDenied
+	if approve {
+		decided.Status, decided.ExpiresAt = types.ElevationApproved, now.Unix()+request.DurationSeconds
+	}
+
+	// only the decision moving the request out of pending goes on
+	switch err := db.SwapElevationRequest(&pending, &decided); err {
+	case nil:
+	case auth_errors.ErrKeyModified:
+		log.Warnf("Elevation request %q was decided concurrently", id)
+		return nil, auth_errors.ErrIllegalOperation
+	default:
+		log.Errorf("Failed to write decision on elevation request %q: %v", id, err)
+		return nil, err
+	}
+
+	request = &decided
+	if approve {
+		authz, err := AddAuthorization(decided.TenantName, role, decided.Requester, true, 0, decided.ExpiresAt)
+		if err != nil {
+			// the request is pending again so that it can be decided again
+			if err := db.SwapElevationRequest(&decided, &pending); err != nil {
+				log.Errorf("Failed to reset elevation request %q to pending: %v", id, err)
+			}
+
+			return nil, err
+		}
+
+		granted := decided
+		granted.AuthzUUID = authz.UUID
+		if err := db.SwapElevationRequest(&decided, &granted); err != nil {
+			// the role is granted anyway, the authorization expires along with the request
+			log.Errorf("Failed to record authorization %q granted by elevation request %q: %v", authz.UUID, id, err)
+		}
+
+		request = &granted
+	}
+
+	audit.Record("elevation_"+request.Status, audit.Fields{
+		"request_id": id,
+		"requester":  request.Requester,
+		"decider":    decider,
+		"role":       request.Role,
+		"tenant":     request.TenantName,
+		"comment":    comment,
+		"authz_uuid": request.AuthzUUID,
+		"expires_at": request.ExpiresAt,
+	})
+
+	return request, nil
+}
@@ -28,7 +28,7 @@ func FilterAppProfiles(t *Token, body []byte) []byte {
 	filteredAppProfiles := []client.AppProfile{}
 
 	for _, ap := range appProfiles {
-		if err = t.CheckClaims(types.Tenant(ap.TenantName), types.Ops); err == nil {
+		if err = t.CheckClaims(types.Tenant(ap.TenantName), types.Ops, types.Resource{Type: "appProfiles", Name: ap.AppProfileName}); err == nil {
 			filteredAppProfiles = append(filteredAppProfiles, ap)
 		}
 	}
@@ -55,7 +55,7 @@ func FilterEndpointGroups(t *Token, body []byte) []byte {
 	filteredEndpointGroups := []client.EndpointGroup{}
 
 	for _, epg := range endpointGroups {
-		if err = t.CheckClaims(types.Tenant(epg.TenantName), types.Ops); err == nil {
+		if err = t.CheckClaims(types.Tenant(epg.TenantName), types.Ops, types.Resource{Type: "endpointGroups", Name: epg.GroupName}); err == nil {
 			filteredEndpointGroups = append(filteredEndpointGroups, epg)
 		}
 	}
@@ -82,7 +82,7 @@ func FilterExtContractsGroups(t *Token, body []byte) []byte {
 	filteredContractGroups := []client.ExtContractsGroup{}
 
 	for _, cg := range filteredContractGroups {
-		if err = t.CheckClaims(types.Tenant(cg.TenantName), types.Ops); err == nil {
+		if err = t.CheckClaims(types.Tenant(cg.TenantName), types.Ops, types.Resource{Type: "extContractsGroups", Name: cg.ContractsGroupName}); err == nil {
 			filteredContractGroups = append(filteredContractGroups, cg)
 		}
 	}
@@ -109,7 +109,7 @@ func FilterNetProfiles(t *Token, body []byte) []byte {
 	filteredNetprofiles := []client.Netprofile{}
 
 	for _, np := range netprofiles {
-		if err = t.CheckClaims(types.Tenant(np.TenantName), types.Ops); err == nil {
+		if err = t.CheckClaims(types.Tenant(np.TenantName), types.Ops, types.Resource{Type: "netprofiles", Name: np.ProfileName}); err == nil {
 			filteredNetprofiles = append(filteredNetprofiles, np)
 		}
 	}
@@ -137,7 +137,7 @@ func FilterNetworks(t *Token, body []byte) []byte {
 	filteredNetworks := []client.Network{}
 
 	for _, network := range networks {
-		if err = t.CheckClaims(types.Tenant(network.TenantName), types.Ops); err == nil {
+		if err = t.CheckClaims(types.Tenant(network.TenantName), types.Ops, types.Resource{Type: "networks", Name: network.NetworkName}); err == nil {
 			filteredNetworks = append(filteredNetworks, network)
 		}
 	}
@@ -164,7 +164,7 @@ func FilterPolicies(t *Token, body []byte) []byte {
 	filteredPolicies := []client.Policy{}
 
 	for _, p := range policies {
-		if err = t.CheckClaims(types.Tenant(p.TenantName), types.Ops); err == nil {
+		if err = t.CheckClaims(types.Tenant(p.TenantName), types.Ops, types.Resource{Type: "policys", Name: p.PolicyName}); err == nil {
 			filteredPolicies = append(filteredPolicies, p)
 		}
 	}
@@ -178,6 +178,12 @@ func FilterPolicies(t *Token, body []byte) []byte {
 	return result
 }
 
+// RuleKey returns the netmaster key of the given rule (`<tenant>:<policy>:<ruleId>`); rule IDs are only
+// unique within a policy, so deny authorizations name the rules by their key.
+func RuleKey(rule *client.Rule) string {
+	return rule.TenantName + ":" + rule.PolicyName + ":" + rule.RuleID
+}
+
 // FilterRules filters the response from GET /api/v1/rules/
 func FilterRules(t *Token, body []byte) []byte {
 	result := []byte{}
@@ -192,7 +198,7 @@ func FilterRules(t *Token, body []byte) []byte {
 	filteredRules := []client.Rule{}
 
 	for _, r := range rules {
-		if err = t.CheckClaims(types.Tenant(r.TenantName), types.Ops); err == nil {
+		if err = t.CheckClaims(types.Tenant(r.TenantName), types.Ops, types.Resource{Type: "rules", Name: RuleKey(&r)}); err == nil {
 			filteredRules = append(filteredRules, r)
 		}
 	}
@@ -220,7 +226,7 @@ func FilterServiceLBs(t *Token, body []byte) []byte {
 	filteredServiceLBs := []client.ServiceLB{}
 
 	for _, slb := range serviceLBs {
-		if err = t.CheckClaims(types.Tenant(slb.TenantName), types.Ops); err == nil {
+		if err = t.CheckClaims(types.Tenant(slb.TenantName), types.Ops, types.Resource{Type: "serviceLBs", Name: slb.ServiceName}); err == nil {
 			filteredServiceLBs = append(filteredServiceLBs, slb)
 		}
 	}
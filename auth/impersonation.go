@@ -0,0 +1,99 @@
+package auth
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/contiv/auth_proxy/auth/local"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/db"
+)
+
+// This file contains the impersonation of users by admins, e.g. to reproduce what a user sees in the
+// UI. An impersonation token carries the principals of the user, so RBAC is evaluated as for the user,
+// along with an `act` claim identifying the admin; it can't be used on the admin-only endpoints.
+
+const (
+	// ImpersonationTokenValidity is the validity of the impersonation tokens
+	ImpersonationTokenValidity = 30 * time.Minute
+
+	// This claim is only present in impersonation tokens; it identifies the admin acting as the
+	// user (`sub` member, see RFC 8693)
+	actClaimKey = "act"
+)
+
+//
+// Impersonate grants an admin a short-lived token evaluating RBAC as the
+// given local user or as the given set of LDAP principals.
+//
+// Parameters:
+//  actor: username of the admin
+//  username: local user to impersonate; for LDAP principals, the name the
+//    token is issued to (e.g. the LDAP username), only used for display
+//  local: true to impersonate a local user, false for LDAP principals
+//  principals: LDAP principals (groups) to impersonate; ignored for local users
+//  dn: distinguished name of the LDAP user impersonated, if known; the deny
+//    authorizations of the user apply then. Ignored for local users
+//
+// Return values:
+//  string: impersonation token valid for ImpersonationTokenValidity
+//  error: nil if successful, else
+//    auth_errors.ErrUserNotFound: if the local user doesn't exist
+//    auth_errors.ErrIllegalArguments: if no username or LDAP principal is given
+//    as returned by the consecutive func calls
+//
+func Impersonate(actor, username string, isLocal bool, principals []string, dn string) (string, error) {
+	defer common.Untrace(common.Trace())
+
+	if common.IsEmpty(username) || (!isLocal && len(principals) == 0) {
+		return "", auth_errors.ErrIllegalArguments
+	}
+
+	if isLocal {
+		if _, err := db.GetLocalUser(username); err != nil {
+			if err == auth_errors.ErrKeyNotFound {
+				return "", auth_errors.ErrUserNotFound
+			}
+
+			return "", err
+		}
+
+		var err error
+		if principals, err = local.Principals(username); err != nil {
+			return "", err
+		}
+	}
+
+	authZ, err := NewTokenWithClaims(principals)
+	if err != nil {
+		return "", err
+	}
+
+	// the token is revoked along with the sessions of the local user
+	if isLocal {
+		if err := authZ.AddLocalUserClaims(username); err != nil {
+			return "", err
+		}
+	} else if !common.IsEmpty(dn) {
+		authZ.AddUserPrincipalClaim(dn)
+	}
+
+	expiresAt := time.Now().Add(ImpersonationTokenValidity).Unix()
+	authZ.AddClaim("exp", expiresAt)
+	authZ.AddClaim(actClaimKey, map[string]interface{}{"sub": actor})
+	authZ.AddClaim("username", username)
+
+	audit.Warn("impersonation_started", audit.Fields{
+		"actor":      actor,
+		"username":   username,
+		"local":      isLocal,
+		"principals": principals,
+		"expires_at": expiresAt,
+	})
+
+	log.Infof("%q is impersonating %q until %d", actor, username, expiresAt)
+	return authZ.Stringify()
+}
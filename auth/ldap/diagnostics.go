@@ -0,0 +1,327 @@
+package ldap
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// steps of a LDAP configuration test
+const (
+	StepConfiguration = "configuration"
+	StepTCPConnect    = "tcp_connect"
+	StepTLSHandshake  = "tls_handshake"
+	StepServiceBind   = "service_bind"
+	StepUserSearch    = "user_search"
+	StepUserBind      = "user_bind"
+	StepGroups        = "groups"
+)
+
+// TestResult represents the outcome of a LDAP configuration test.
+type TestResult struct {
+	Success bool       `json:"success"` // all the steps succeeded
+	Steps   []TestStep `json:"steps"`
+}
+
+// TestStep represents the outcome of a step of a LDAP configuration test; connection steps
+// are repeated for each server tried.
+type TestStep struct {
+	Step       string            `json:"step"`
+	Server     string            `json:"server,omitempty"`
+	Success    bool              `json:"success"`
+	Skipped    bool              `json:"skipped,omitempty"`
+	Message    string            `json:"message,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	DurationMs float64           `json:"duration_ms"`
+	TLS        *TLSDetails       `json:"tls,omitempty"`        // StepTLSHandshake
+	DN         string            `json:"dn,omitempty"`         // StepUserSearch
+	Attributes map[string]string `json:"attributes,omitempty"` // StepUserSearch
+	Groups     []string          `json:"groups,omitempty"`     // StepGroups
+}
+
+// TLSDetails represents the TLS session established with a server.
+type TLSDetails struct {
+	Version      string               `json:"version"`
+	CipherSuite  string               `json:"cipher_suite"`
+	Certificates []CertificateDetails `json:"certificates"` // chain presented by the server, leaf first
+}
+
+// CertificateDetails represents a certificate presented by a server.
+type CertificateDetails struct {
+	Subject      string    `json:"subject"`
+	Issuer       string    `json:"issuer"`
+	SerialNumber string    `json:"serial_number"`
+	NotBefore    time.Time `json:"not_before"`
+	NotAfter     time.Time `json:"not_after"`
+	DNSNames     []string  `json:"dns_names,omitempty"`
+	IPAddresses  []string  `json:"ip_addresses,omitempty"`
+}
+
+// TestConfiguration tests the given stored LDAP configuration; see `Manager.Test`.
+// params:
+//  name: name of the LDAP configuration
+//  username: user to search for; the user steps are skipped if it is empty
+//  password: password of the user; the user bind is skipped if it is empty
+// return values:
+//  *TestResult: outcome of the steps run
+//  error: ErrKeyNotFound if the configuration doesn't exist or any relevant error
+func TestConfiguration(name, username, password string) (*TestResult, error) {
+	cfg, err := db.GetLdapConfiguration(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := decryptSecrets(cfg); err != nil {
+		return nil, err
+	}
+
+	ldapManager := Manager{Config: *cfg}
+	return ldapManager.Test(username, password), nil
+}
+
+// Test runs the steps of an authentication against the configuration(receiver) one by one and reports
+// the outcome of each of them: TCP connection, TLS handshake, service account bind, user search,
+// user bind and group resolution. Servers are tried in their configured order until a connection is
+// established. Nothing is persisted; the connection pool, user cache and server health are not used.
+// params:
+//  username: user to search for; the user steps are skipped if it is empty
+//  password: password of the user; the user bind is skipped if it is empty
+// return values:
+//  *TestResult: outcome of the steps run; the test stops at the first failing step
+func (lm *Manager) Test(username, password string) *TestResult {
+	result := &TestResult{Steps: []TestStep{}}
+
+	// run runs the given step and records its outcome; fn may fill in the details of the step
+	run := func(step *TestStep, fn func() error) bool {
+		start := time.Now()
+		err := fn()
+		step.DurationMs = float64(time.Since(start)) / float64(time.Millisecond)
+		step.Success = err == nil
+		if err != nil {
+			step.Error = err.Error()
+		}
+
+		result.Steps = append(result.Steps, *step)
+		return step.Success
+	}
+
+	skip := func(name, message string) {
+		result.Steps = append(result.Steps, TestStep{Step: name, Skipped: true, Message: message})
+	}
+
+	var cfg *types.LdapConfiguration
+	if !run(&TestStep{Step: StepConfiguration}, func() (err error) {
+		if len(lm.Config.ServerList()) == 0 {
+			return fmt.Errorf("no servers configured")
+		}
+
+		if _, err := lm.Config.TLSConfig(); err != nil {
+			return err
+		}
+
+		cfg, err = lm.Config.WithSearchDefaults()
+		return err
+	}) {
+		return result
+	}
+
+	var conn *ldap.Conn
+	for _, server := range lm.Config.ServerList() {
+		if conn = lm.testConnect(server, run); conn != nil {
+			break
+		}
+	}
+
+	if conn == nil {
+		return result
+	}
+	defer conn.Close()
+
+	// operations are run through a pool of its own so that the shared pool and its metrics are left alone
+	ldapConn := &pooledConn{
+		conn: conn,
+		pool: &connPool{serviceDN: cfg.ServiceAccountDN, metrics: Metrics{Latency: map[string]*LatencyMetrics{}}},
+	}
+
+	if !run(&TestStep{Step: StepServiceBind, Message: cfg.ServiceAccountDN}, func() error {
+		return ldapConn.Bind(cfg.ServiceAccountDN, cfg.ServiceAccountPassword)
+	}) {
+		return result
+	}
+
+	if common.IsEmpty(username) {
+		skip(StepUserSearch, "no username given")
+		result.Success = true
+		return result
+	}
+
+	var user *ldap.Entry
+	searchStep := &TestStep{Step: StepUserSearch, Message: cfg.UserSearchFilter}
+	if !run(searchStep, func() (err error) {
+		if !cfg.IsValidUsername(username) {
+			return fmt.Errorf("username %q doesn't match the allowed pattern %q", username, cfg.UsernamePattern)
+		}
+
+		if user, err = searchUser(ldapConn, cfg, username); err != nil {
+			return err
+		}
+
+		searchStep.DN = user.DN
+		searchStep.Attributes = userAttributes(cfg, user)
+		return nil
+	}) {
+		return result
+	}
+
+	if common.IsEmpty(password) {
+		skip(StepUserBind, "no password given")
+	} else if !run(&TestStep{Step: StepUserBind}, func() error {
+		if err := ldapConn.Bind(user.DN, password); err != nil {
+			return err
+		}
+
+		// group lookups are performed using the service account
+		return ldapConn.Bind(cfg.ServiceAccountDN, cfg.ServiceAccountPassword)
+	}) {
+		return result
+	}
+
+	groupsStep := &TestStep{Step: StepGroups, Message: cfg.GroupResolution}
+	result.Success = run(groupsStep, func() (err error) {
+		groupsStep.Groups, err = resolveGroups(ldapConn, cfg, user)
+		return err
+	})
+
+	return result
+}
+
+// testConnect establishes a LDAP connection with the given server, running the TCP connection
+// and TLS handshake as separate steps.
+// params:
+//  server: directory server to connect to
+//  run: runs a step and records its outcome; returns whether the step succeeded
+// return values:
+//  *ldap.Conn: connection with the server if the steps succeeded otherwise nil
+func (lm *Manager) testConnect(server types.LdapServer, run func(*TestStep, func() error) bool) *ldap.Conn {
+	address := serverAddress(server)
+	connectTimeout, readTimeout := lm.timeouts()
+
+	var conn net.Conn
+	if !run(&TestStep{Step: StepTCPConnect, Server: address}, func() (err error) {
+		conn, err = net.DialTimeout("tcp", address, connectTimeout)
+		return err
+	}) {
+		return nil
+	}
+
+	if !lm.Config.LDAPS && !lm.Config.StartTLS {
+		ldapConn := ldap.NewConn(conn, false)
+		ldapConn.Start()
+		ldapConn.SetTimeout(readTimeout)
+		return ldapConn
+	}
+
+	// validated along with the configuration
+	tlsConfig, _ := lm.Config.TLSConfig()
+	if common.IsEmpty(tlsConfig.ServerName) {
+		tlsConfig.ServerName = server.Server
+	}
+
+	var ldapConn *ldap.Conn
+	tlsStep := &TestStep{Step: StepTLSHandshake, Server: address}
+
+	// the session is captured once the certificates are verified (or verification is skipped)
+	tlsConfig.VerifyConnection = func(state tls.ConnectionState) error {
+		tlsStep.TLS = tlsDetails(&state)
+		return nil
+	}
+
+	if !run(tlsStep, func() error {
+		if lm.Config.LDAPS {
+			tlsConn := tls.Client(conn, tlsConfig)
+			tlsConn.SetDeadline(time.Now().Add(connectTimeout))
+			if err := tlsConn.Handshake(); err != nil {
+				return err
+			}
+
+			tlsConn.SetDeadline(time.Time{})
+			ldapConn = ldap.NewConn(tlsConn, true)
+			ldapConn.Start()
+			ldapConn.SetTimeout(readTimeout)
+			return nil
+		}
+
+		ldapConn = ldap.NewConn(conn, false)
+		ldapConn.Start()
+		ldapConn.SetTimeout(readTimeout)
+		return ldapConn.StartTLS(tlsConfig)
+	}) {
+		log.Debugf("TLS handshake with %q failed", address)
+		if ldapConn != nil {
+			ldapConn.Close()
+		} else {
+			conn.Close()
+		}
+
+		return nil
+	}
+
+	return ldapConn
+}
+
+// tlsDetails returns the details of the given TLS session.
+func tlsDetails(state *tls.ConnectionState) *TLSDetails {
+	details := &TLSDetails{
+		Version:      tlsVersionName(state.Version),
+		CipherSuite:  tls.CipherSuiteName(state.CipherSuite),
+		Certificates: []CertificateDetails{},
+	}
+
+	for _, certificate := range state.PeerCertificates {
+		details.Certificates = append(details.Certificates, certificateDetails(certificate))
+	}
+
+	return details
+}
+
+// tlsVersionName returns the name of the given TLS version, e.g. "TLS 1.2".
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// certificateDetails returns the details of the given certificate.
+func certificateDetails(certificate *x509.Certificate) CertificateDetails {
+	details := CertificateDetails{
+		Subject:      certificate.Subject.String(),
+		Issuer:       certificate.Issuer.String(),
+		SerialNumber: certificate.SerialNumber.String(),
+		NotBefore:    certificate.NotBefore,
+		NotAfter:     certificate.NotAfter,
+		DNSNames:     certificate.DNSNames,
+	}
+
+	for _, ip := range certificate.IPAddresses {
+		details.IPAddresses = append(details.IPAddresses, ip.String())
+	}
+
+	return details
+}
@@ -0,0 +1,292 @@
+package ldap
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the APIs used by the administrators to browse the directory.
+
+// DirectorySearchLimit is the maximum number of entries returned by a directory search;
+// queries matching more entries need to be narrowed down.
+const DirectorySearchLimit = 1000
+
+// kinds of directory entries
+const (
+	DirectoryGroups = "groups"
+	DirectoryUsers  = "users"
+)
+
+// DirectoryEntry represents a group or user found in the directory.
+//
+// Fields:
+//  DN: distinguished name of the entry
+//  Name: principal name of a group (as used in authorizations) or login name of a user
+//  DisplayName: `displayName` (or `cn`) of the entry
+type DirectoryEntry struct {
+	DN          string `json:"dn"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+// SearchDirectory searches the directory of the given configuration for the groups or users whose
+// name contains the given query.
+// params:
+//  name: name of the LDAP configuration
+//  kind: DirectoryGroups or DirectoryUsers
+//  query: part of the name (principal name, login name, `cn` or `displayName`); all the entries match if it is empty
+// return values:
+//  []DirectoryEntry: matching entries sorted by name
+//  bool: true if there are more than DirectorySearchLimit matching entries (only the first ones are returned)
+//  error: ErrKeyNotFound if the configuration doesn't exist, IllegalArguments if kind is unknown
+//         or any relevant error
+func SearchDirectory(name, kind, query string) ([]DirectoryEntry, bool, error) {
+	if kind != DirectoryGroups && kind != DirectoryUsers {
+		return nil, false, auth_errors.NewError(auth_errors.IllegalArguments, "unknown kind of directory entries "+kind)
+	}
+
+	cfg, err := db.GetLdapConfiguration(name)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := decryptSecrets(cfg); err != nil {
+		return nil, false, err
+	}
+
+	ldapManager := Manager{Config: *cfg}
+	return ldapManager.SearchDirectory(kind, query)
+}
+
+// FindGroup looks up the group with the given principal name in the directories of all the configurations.
+// params:
+//  principalName: principal name of the group; its DN or the value of `GroupNameAttribute`
+// return values:
+//  *DirectoryEntry: group with the given principal name (ignoring case) otherwise nil;
+//                   its `Name` differs from principalName if the case doesn't match
+//  error: ErrLDAPConfigurationNotFound if there are no configurations or any relevant error
+func FindGroup(principalName string) (*DirectoryEntry, error) {
+	configurations, err := db.GetLdapConfigurations()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(configurations) == 0 {
+		return nil, auth_errors.ErrLDAPConfigurationNotFound
+	}
+
+	var found *DirectoryEntry
+	for _, cfg := range configurations {
+		if err := decryptSecrets(cfg); err != nil {
+			return nil, err
+		}
+
+		ldapManager := Manager{Config: *cfg}
+		group, err := ldapManager.FindGroup(principalName)
+		if err != nil {
+			return nil, err
+		}
+
+		// exact matches take precedence
+		if group != nil && (found == nil || group.Name == principalName) {
+			found = group
+		}
+	}
+
+	return found, nil
+}
+
+// SearchDirectory searches the directory for the groups or users whose name contains the given query.
+// params:
+//  kind: DirectoryGroups or DirectoryUsers
+//  query: part of the name (principal name, login name, `cn` or `displayName`); all the entries match if it is empty
+// return values:
+//  []DirectoryEntry: matching entries sorted by name
+//  bool: true if there are more than DirectorySearchLimit matching entries (only the first ones are returned)
+//  error: any relevant error
+func (lm *Manager) SearchDirectory(kind, query string) ([]DirectoryEntry, bool, error) {
+	cfg, err := lm.Config.WithSearchDefaults()
+	if err != nil {
+		return nil, false, err
+	}
+
+	// substring assertion; the query is escaped so that it can't alter the filter
+	substring := "*"
+	if !common.IsEmpty(query) {
+		substring = "*" + ldap.EscapeFilter(query) + "*"
+	}
+
+	var searchRequest *ldap.SearchRequest
+	var nameAttribute string
+	switch kind {
+	case DirectoryGroups:
+		nameAttributes := []string{"cn", "displayName"}
+		if !common.IsEmpty(cfg.GroupNameAttribute) && !strings.EqualFold(cfg.GroupNameAttribute, "cn") {
+			nameAttributes = append(nameAttributes, cfg.GroupNameAttribute)
+		}
+
+		searchRequest = ldap.NewSearchRequest(
+			groupSearchBase(cfg),
+			ldap.ScopeWholeSubtree, ldap.DerefAlways, DirectorySearchLimit+1, 0, false,
+			"(&(objectClass="+cfg.GroupObjectClass+")"+anyOf(nameAttributes, substring)+")",
+			nameAttributes,
+			nil)
+	case DirectoryUsers:
+		nameAttribute = cfg.UsernameAttribute
+		nameAttributes := []string{nameAttribute, "cn", "displayName"}
+
+		searchRequest = ldap.NewSearchRequest(
+			cfg.BaseDN,
+			ldap.ScopeWholeSubtree, ldap.DerefAlways, DirectorySearchLimit+1, 0, false,
+			// users matching the user search filter with any login name
+			"(&"+strings.Replace(cfg.UserSearchFilter, types.LdapUsernamePlaceholder, "*", -1)+anyOf(nameAttributes, substring)+")",
+			nameAttributes,
+			nil)
+	default:
+		return nil, false, auth_errors.NewError(auth_errors.IllegalArguments, "unknown kind of directory entries "+kind)
+	}
+
+	var searchRes *ldap.SearchResult
+	err = getPool(&lm.Config).do(lm, func(ldapConn *pooledConn) (err error) {
+		searchRes, err = ldapConn.Search(searchRequest)
+
+		// the entries received before the size limit was hit are returned along with the error
+		if ldapErr, ok := err.(*ldap.Error); ok && ldapErr.ResultCode == ldap.LDAPResultSizeLimitExceeded {
+			return nil
+		}
+
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("LDAP search operation failed for %s matching %q: %v", kind, query, err)
+		return nil, false, err
+	}
+
+	entries := []DirectoryEntry{}
+	for _, entry := range searchRes.Entries {
+		directoryEntry := DirectoryEntry{DN: entry.DN, DisplayName: entry.GetAttributeValue("displayName")}
+		if common.IsEmpty(directoryEntry.DisplayName) {
+			directoryEntry.DisplayName = entry.GetAttributeValue("cn")
+		}
+
+		if kind == DirectoryGroups {
+			directoryEntry.Name = groupName(cfg, entry)
+		} else {
+			directoryEntry.Name = entry.GetAttributeValue(nameAttribute)
+		}
+
+		entries = append(entries, directoryEntry)
+	}
+
+	truncated := len(entries) > DirectorySearchLimit
+	if truncated {
+		entries = entries[:DirectorySearchLimit]
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Name != entries[j].Name {
+			return entries[i].Name < entries[j].Name
+		}
+
+		return entries[i].DN < entries[j].DN
+	})
+
+	return entries, truncated, nil
+}
+
+// FindGroup looks up the group with the given principal name in the directory.
+// params:
+//  principalName: principal name of the group; its DN or the value of `GroupNameAttribute`
+// return values:
+//  *DirectoryEntry: group with the given principal name (ignoring case) otherwise nil
+//  error: any relevant error
+func (lm *Manager) FindGroup(principalName string) (*DirectoryEntry, error) {
+	cfg, err := lm.Config.WithSearchDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	attributes := []string{"cn", "displayName"}
+	if !common.IsEmpty(cfg.GroupNameAttribute) {
+		attributes = append(attributes, cfg.GroupNameAttribute)
+	}
+
+	var searchRequest *ldap.SearchRequest
+	if common.IsEmpty(cfg.GroupNameAttribute) {
+		// groups are named by their DN
+		if _, err := ldap.ParseDN(principalName); err != nil {
+			return nil, nil
+		}
+
+		searchRequest = ldap.NewSearchRequest(
+			principalName,
+			ldap.ScopeBaseObject, ldap.DerefAlways, 0, 0, false,
+			"(objectClass="+cfg.GroupObjectClass+")",
+			attributes,
+			nil)
+	} else {
+		searchRequest = ldap.NewSearchRequest(
+			groupSearchBase(cfg),
+			ldap.ScopeWholeSubtree, ldap.DerefAlways, 0, 0, false,
+			"(&(objectClass="+cfg.GroupObjectClass+")("+cfg.GroupNameAttribute+"="+ldap.EscapeFilter(principalName)+"))",
+			attributes,
+			nil)
+	}
+
+	var searchRes *ldap.SearchResult
+	err = getPool(&lm.Config).do(lm, func(ldapConn *pooledConn) (err error) {
+		searchRes, err = ldapConn.Search(searchRequest)
+		if ldapErr, ok := err.(*ldap.Error); ok && ldapErr.ResultCode == ldap.LDAPResultNoSuchObject {
+			searchRes, err = &ldap.SearchResult{}, nil
+		}
+
+		return err
+	})
+
+	if err != nil {
+		log.Errorf("LDAP search operation failed for group %q: %v", principalName, err)
+		return nil, err
+	}
+
+	baseDN, err := ldap.ParseDN(groupSearchBase(cfg))
+	if err != nil {
+		return nil, err
+	}
+
+	var found *DirectoryEntry
+	for _, entry := range searchRes.Entries {
+		name := groupName(cfg, entry)
+		if !strings.EqualFold(name, principalName) || !isUnderDN(entry.DN, baseDN) {
+			continue
+		}
+
+		group := &DirectoryEntry{DN: entry.DN, Name: name, DisplayName: entry.GetAttributeValue("displayName")}
+		if common.IsEmpty(group.DisplayName) {
+			group.DisplayName = entry.GetAttributeValue("cn")
+		}
+
+		if found == nil || name == principalName {
+			found = group
+		}
+	}
+
+	return found, nil
+}
+
+// anyOf returns a filter matching the entries having one of the given attributes with the given assertion value.
+func anyOf(attributes []string, value string) string {
+	filter := "(|"
+	for _, attribute := range attributes {
+		filter += "(" + attribute + "=" + value + ")"
+	}
+
+	return filter + ")"
+}
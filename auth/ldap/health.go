@@ -0,0 +1,119 @@
+package ldap
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+)
+
+// This file tracks the health of the directory servers; servers which failed
+// recently are tried last until `serverRetryInterval` elapses.
+
+// serverRetryInterval is the time after which a failed server is tried in its configured order again
+const serverRetryInterval = 30 * time.Second
+
+// ServerHealth represents the health of a directory server as seen by this process
+type ServerHealth struct {
+	Server              string     `json:"server"`
+	Port                uint16     `json:"port"`
+	Healthy             bool       `json:"healthy"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           string     `json:"last_error,omitempty"`
+	LastFailure         *time.Time `json:"last_failure,omitempty"`
+	LastSuccess         *time.Time `json:"last_success,omitempty"`
+}
+
+// health of all the servers keyed by their address (host:port)
+var serverHealth = struct {
+	sync.Mutex
+	servers map[string]*ServerHealth
+}{servers: map[string]*ServerHealth{}}
+
+// serverAddress returns the address (host:port) of the given server
+func serverAddress(server types.LdapServer) string {
+	return net.JoinHostPort(server.Server, strconv.Itoa(int(server.Port)))
+}
+
+// healthRecord returns the health record of the given server; creates it if required.
+// serverHealth lock must be held by the caller.
+func healthRecord(server types.LdapServer) *ServerHealth {
+	address := serverAddress(server)
+	if _, found := serverHealth.servers[address]; !found {
+		serverHealth.servers[address] = &ServerHealth{Server: server.Server, Port: server.Port, Healthy: true}
+	}
+
+	return serverHealth.servers[address]
+}
+
+// recordSuccess marks the given server healthy
+func recordSuccess(server types.LdapServer) {
+	serverHealth.Lock()
+	defer serverHealth.Unlock()
+
+	now := time.Now()
+	record := healthRecord(server)
+	record.Healthy = true
+	record.ConsecutiveFailures = 0
+	record.LastSuccess = &now
+}
+
+// recordFailure marks the given server unhealthy
+func recordFailure(server types.LdapServer, err error) {
+	serverHealth.Lock()
+	defer serverHealth.Unlock()
+
+	now := time.Now()
+	record := healthRecord(server)
+	record.Healthy = false
+	record.ConsecutiveFailures++
+	record.LastError = err.Error()
+	record.LastFailure = &now
+}
+
+// orderServers returns the given servers in the order they should be tried;
+// healthy servers (and the ones due for a retry) keep their configured order and
+// are followed by the servers which failed within the last `serverRetryInterval`.
+func orderServers(servers []types.LdapServer) []types.LdapServer {
+	serverHealth.Lock()
+	defer serverHealth.Unlock()
+
+	preferred := []types.LdapServer{}
+	failed := []types.LdapServer{}
+	for _, server := range servers {
+		record, found := serverHealth.servers[serverAddress(server)]
+		if found && !record.Healthy && time.Since(*record.LastFailure) < serverRetryInterval {
+			failed = append(failed, server)
+			continue
+		}
+
+		preferred = append(preferred, server)
+	}
+
+	return append(preferred, failed...)
+}
+
+// GetServerHealth returns the health of all the servers of the given configuration.
+// params:
+//  cfg: LDAP configuration
+// return values:
+//  []ServerHealth: health of the servers in the configured order; servers
+//                  which weren't contacted yet are reported healthy
+func GetServerHealth(cfg *types.LdapConfiguration) []ServerHealth {
+	serverHealth.Lock()
+	defer serverHealth.Unlock()
+
+	result := []ServerHealth{}
+	for _, server := range cfg.ServerList() {
+		if record, found := serverHealth.servers[serverAddress(server)]; found {
+			result = append(result, *record)
+			continue
+		}
+
+		result = append(result, ServerHealth{Server: server.Server, Port: server.Port, Healthy: true})
+	}
+
+	return result
+}
@@ -3,6 +3,9 @@ package ldap
 import (
 	"crypto/tls"
 	"fmt"
+	"net"
+	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common"
@@ -40,37 +43,143 @@ import (
 //  Attributes: set of attributes to request for inclusion in entries that match the search criteria and are returned to the client.
 //  Controls: yet to figure out what it is; but it's been given a `nil` value everywhere
 
+// tokenGroupsBatchSize is the number of group SIDs looked up in a single search
+const tokenGroupsBatchSize = 100
+
 // Manager provides the implementation of LDAP Manager fields:
 //   Config: LDAP/AD configuration
 type Manager struct {
 	Config types.LdapConfiguration
+
+	fingerprint string // digest of Config if already known (see configFingerprint)
 }
 
-// Authenticate is a helper function which just sets the configuration and calls ldap authentication
+// User represents an authenticated LDAP user.
+//
+// Fields:
+//  DN: distinguished name of the user
+//  Domain: name of the LDAP configuration the user was authenticated against
+//  Groups: principals of the user (names of the LDAP groups the user belongs to)
+//  Attributes: attributes of the user entry mapped by `UserAttributes` of the configuration;
+//              keyed by the claim name
+type User struct {
+	DN         string
+	Domain     string
+	Groups     []string
+	Attributes map[string]string
+}
+
+// Authenticate is a helper function which authenticates the given user using AuthenticateUser.
 // params:
 //  username: username to authenticate
 //  password: password of the user
 // return values:
 //  []string: list of principals (LDAP group names that the user belongs)
-//  ErrLDAPConfigurationNotFound if the config is not found or as returned by ldapManager.Authenticate
+//  error: as returned by AuthenticateUser
 func Authenticate(username, password string) ([]string, error) {
-	cfg, err := db.GetLdapConfiguration()
+	user, err := AuthenticateUser(username, password)
 	if err != nil {
 		return nil, err
 	}
 
-	cfg.ServiceAccountPassword, err = common.Decrypt(cfg.ServiceAccountPassword)
+	return user.Groups, nil
+}
+
+// AuthenticateUser is a helper function which picks the LDAP configurations (domains) for the
+// given username and calls ldap authentication against each of them until one succeeds.
+// Configurations whose username prefixes/suffixes match the username are used (with the
+// prefix/suffix removed); if none match, all the configurations are tried in their order.
+// params:
+//  username: username to authenticate
+//  password: password of the user
+// return values:
+//  *User: the authenticated user with its principals (LDAP group names that the user belongs) and attributes
+//  ErrLDAPConfigurationNotFound if no config is found or as returned by ldapManager.AuthenticateUser
+func AuthenticateUser(username, password string) (*User, error) {
+	configurations, err := db.GetLdapConfigurations()
 	if err != nil {
 		return nil, err
 	}
 
-	if cfg != nil {
+	if len(configurations) == 0 {
+		log.Errorf("LDAP/AD configuration not found")
+		return nil, auth_errors.ErrLDAPConfigurationNotFound
+	}
+
+	var lastErr error
+	userNotFound := false
+	for _, c := range domainCandidates(configurations, username) {
+		cfg := c.cfg
+		if err := decryptSecrets(cfg); err != nil {
+			return nil, err
+		}
+
 		ldapManager := Manager{Config: *cfg}
-		return ldapManager.Authenticate(username, password)
+		user, err := ldapManager.AuthenticateUser(c.username, password)
+		switch {
+		case err == nil:
+			return user, nil
+		case err == auth_errors.ErrUserNotFound:
+			userNotFound = true
+		case auth_errors.HasCode(err, auth_errors.LDAPConnectionFailed):
+			log.Errorf("LDAP configuration %q is not reachable; trying the next one", cfg.Name)
+		default:
+			return nil, err
+		}
+
+		lastErr = err
+	}
+
+	if userNotFound {
+		return nil, auth_errors.ErrUserNotFound
+	}
+
+	return nil, lastErr
+}
+
+// domainCandidate is a configuration a username is looked up in.
+type domainCandidate struct {
+	cfg      *types.LdapConfiguration
+	username string // without the prefix/suffix matched by the configuration
+}
+
+// domainCandidates returns the configurations the given username is looked up in, in order.
+// params:
+//  configurations: all the LDAP configurations in order
+//  username: username given by the client
+// return values:
+//  []domainCandidate: the configurations whose prefix/suffix the username matches;
+//                     all the configurations if it matches none
+func domainCandidates(configurations []*types.LdapConfiguration, username string) []domainCandidate {
+	candidates := []domainCandidate{}
+	for _, cfg := range configurations {
+		if domainUsername, matched := cfg.MatchUsername(username); matched {
+			candidates = append(candidates, domainCandidate{cfg, domainUsername})
+		}
+	}
+
+	if len(candidates) == 0 {
+		for _, cfg := range configurations {
+			candidates = append(candidates, domainCandidate{cfg, username})
+		}
 	}
 
-	log.Errorf("LDAP/AD configuration not found")
-	return nil, auth_errors.ErrLDAPConfigurationNotFound
+	return candidates
+}
+
+// decryptSecrets decrypts the secrets of the given LDAP configuration read from the data store.
+// params:
+//  cfg: LDAP configuration; its secrets are replaced with the decrypted ones
+// return values:
+//  error: as returned by the decryption
+func decryptSecrets(cfg *types.LdapConfiguration) (err error) {
+	cfg.ServiceAccountPassword, err = common.Decrypt(cfg.ServiceAccountPassword)
+	if err != nil {
+		return err
+	}
+
+	cfg.ClientKey, err = common.DecryptEnvelope(cfg.ClientKey)
+	return err
 }
 
 // Authenticate authenticates the given username and password against `AD` using LDAP client
@@ -81,29 +190,142 @@ func Authenticate(username, password string) ([]string, error) {
 //  []string containing LDAP group names of the user on successful authentication else nil
 //  error: nil on successful authentication otherwise ErrLDAPAccessDenied, ErrUserNotFound, etc.
 func (lm *Manager) Authenticate(username, password string) ([]string, error) {
-	// list of attributes to be fetched from the matching records
-	var attributes = []string{
-		"memberof",
+	user, err := lm.AuthenticateUser(username, password)
+	if err != nil {
+		return nil, err
 	}
 
-	// establish a connection with AD server
-	ldapConn, err := lm.connect()
+	return user.Groups, nil
+}
+
+// AuthenticateUser authenticates the given username and password against `AD` using LDAP client
+// params:
+//  username: username to authenticate
+//  password: password of the user
+// return values:
+//  *User: the user with its LDAP group names and attributes on successful authentication else nil
+//  error: nil on successful authentication otherwise ErrLDAPAccessDenied, ErrUserNotFound, etc.
+func (lm *Manager) AuthenticateUser(username, password string) (*User, error) {
+	cfg, err := lm.Config.WithSearchDefaults()
 	if err != nil {
+		log.Errorf("Invalid LDAP search settings: %v", err)
 		return nil, err
 	}
 
-	defer ldapConn.Close()
+	// reject unexpected usernames before talking to the directory
+	if !cfg.IsValidUsername(username) {
+		log.Errorf("Username %q doesn't match the allowed pattern %q", username, cfg.UsernamePattern)
+		return nil, auth_errors.ErrUserNotFound
+	}
+
+	// connections and cached users are shared by the logins using this configuration
+	pool := getPool(&lm.Config)
 
-	// bind AD service account to perform search using the connection established above
-	if err := ldapConn.Bind(lm.Config.ServiceAccountDN, lm.Config.ServiceAccountPassword); err != nil {
-		log.Errorf("LDAP bind operation failed for AD service account %q: %v", lm.Config.ServiceAccountDN, err)
+	var user *User
+	err = pool.do(lm, func(ldapConn *pooledConn) (err error) {
+		user, err = authenticate(ldapConn, cfg, username, password)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debugf("Authorized groups:%#v", user.Groups)
+	log.Info("AD authentication successful")
+
+	return user, nil
+}
+
+// authenticate looks up the given user, verifies the password and resolves the groups of the user;
+// the DN, groups and attributes of the users authenticated recently are taken from the cache.
+// params:
+//  ldapConn: pooled connection bound as the service account
+//  cfg: LDAP configuration with the search settings populated
+//  username: username to authenticate
+//  password: password of the user
+// return values:
+//  *User: the user with its LDAP group names and attributes on successful authentication else nil
+//  error: nil on successful authentication otherwise ErrLDAPAccessDenied, ErrUserNotFound, etc.
+func authenticate(ldapConn *pooledConn, cfg *types.LdapConfiguration, username, password string) (*User, error) {
+	if entry, found := ldapConn.pool.cachedUser(username); found {
+		// the password is always verified by the directory
+		if err := ldapConn.Bind(entry.user.DN, password); err != nil {
+			log.Errorf("LDAP bind operation failed for AD user account: %v", err)
+			if !ldapConn.broken {
+				ldapConn.pool.forgetUser(username)
+			}
+
+			return nil, auth_errors.ErrLDAPAccessDenied
+		}
+
+		log.Debugf("Using the cached DN and groups of %q", username)
+		return entry.user, nil
+	}
+
+	userEntry, err := searchUser(ldapConn, cfg, username)
+	switch {
+	case err == auth_errors.ErrUserNotFound || err == auth_errors.ErrLDAPMultipleEntries:
+		return nil, err
+	case err != nil:
+		return nil, auth_errors.ErrLDAPAccessDenied
+	}
+
+	// validate user `password`
+	adUsername := userEntry.DN                                  // this need not be specified in attribute list; results will always carry DN
+	if err := ldapConn.Bind(adUsername, password); err != nil { // bind using the given username and password
+		log.Errorf("LDAP bind operation failed for AD user account: %v", err)
+		return nil, auth_errors.ErrLDAPAccessDenied
+	}
+
+	// group lookups are performed using the service account
+	if err := ldapConn.Bind(cfg.ServiceAccountDN, cfg.ServiceAccountPassword); err != nil {
+		log.Errorf("LDAP bind operation failed for AD service account %q: %v", cfg.ServiceAccountDN, err)
 		return nil, auth_errors.ErrLDAPAccessDenied
 	}
 
+	// get user AD groups
+	groups, err := resolveGroups(ldapConn, cfg, userEntry)
+	if err != nil {
+		return nil, err
+	}
+
+	user := &User{DN: adUsername, Domain: cfg.Name, Groups: groups, Attributes: userAttributes(cfg, userEntry)}
+	ldapConn.pool.cacheUser(username, user)
+	ldapConn.pool.markValidated(username, user)
+	return user, nil
+}
+
+// searchUser looks up the entry of the given user using the user search filter.
+// params:
+//  ldapConn: pooled LDAP connection bound as the service account
+//  cfg: LDAP configuration with the search settings populated
+//  username: username to search for
+//  extraAttributes: attributes to be fetched in addition to the ones below
+// return values:
+//  *ldap.Entry: entry of the user; it carries `memberOf` values when it is used for group membership
+//               and the values of the mapped user attributes
+//  error: ErrUserNotFound, ErrLDAPMultipleEntries or the error returned by the search
+func searchUser(ldapConn *pooledConn, cfg *types.LdapConfiguration, username string, extraAttributes ...string) (*ldap.Entry, error) {
+	// list of attributes to be fetched from the matching records
+	attributes := append([]string{}, extraAttributes...)
+	if cfg.GroupMembership == types.LdapMemberOf {
+		attributes = append(attributes, types.LdapMemberOf)
+	}
+
+	for _, attribute := range cfg.UserAttributes {
+		attributes = append(attributes, attribute)
+	}
+
+	if len(attributes) == 0 {
+		attributes = []string{"1.1"} // RFC 4511: no attributes; the DN is always returned
+	}
+
 	searchRequest := ldap.NewSearchRequest(
-		lm.Config.BaseDN,
+		cfg.BaseDN,
 		ldap.ScopeWholeSubtree, ldap.DerefAlways, 0, 0, false,
-		"(&(objectClass=user)(sAMAccountName="+username+"))", // query is targeted for user entity
+		// query is targeted for user entity; username is escaped (RFC 4515) so that it can't alter the filter
+		strings.Replace(cfg.UserSearchFilter, types.LdapUsernamePlaceholder, ldap.EscapeFilter(username), -1),
 		attributes,
 		nil)
 
@@ -111,41 +333,184 @@ func (lm *Manager) Authenticate(username, password string) ([]string, error) {
 	searchRes, err := ldapConn.Search(searchRequest)
 	if err != nil {
 		log.Errorf("LDAP search operation failed for %q: %v", username, err)
-		return nil, auth_errors.ErrLDAPAccessDenied
+		return nil, err
 	} else if len(searchRes.Entries) == 0 { // none matched the search criteria
 		log.Errorf("User %q not found in AD server", username)
 		return nil, auth_errors.ErrUserNotFound
 	} else if len(searchRes.Entries) > 1 { // > 1 user found with the given search criteria
-		log.Errorf("Found %q entries while searching for %q", len(searchRes.Entries), username)
+		log.Errorf("Found %d entries while searching for %q", len(searchRes.Entries), username)
 		return nil, auth_errors.ErrLDAPMultipleEntries
 	}
 
-	// validate user `password`
-	adUsername := searchRes.Entries[0].DN                       // this need not be specified in attribute list; results will always carry DN
-	if err := ldapConn.Bind(adUsername, password); err != nil { // bind using the given username and password
-		log.Errorf("LDAP bind operation failed for AD user account: %v", err)
-		return nil, auth_errors.ErrLDAPAccessDenied
+	return searchRes.Entries[0], nil
+}
+
+// userAttributes returns the values of the attributes of the given user entry mapped by `UserAttributes`;
+// attributes the entry doesn't have are left out.
+// params:
+//  cfg: LDAP configuration
+//  user: user entry
+// return values:
+//  map[string]string: attribute values keyed by the claim name
+func userAttributes(cfg *types.LdapConfiguration, user *ldap.Entry) map[string]string {
+	attributes := map[string]string{}
+	for claim, attribute := range cfg.UserAttributes {
+		// attribute descriptions are case insensitive; servers return them as defined in their schema
+		for _, entryAttribute := range user.Attributes {
+			if strings.EqualFold(entryAttribute.Name, attribute) && len(entryAttribute.Values) > 0 {
+				attributes[claim] = entryAttribute.Values[0]
+				break
+			}
+		}
 	}
 
-	// get user AD groups
-	groups, err := lm.getUserGroups(ldapConn, searchRes.Entries[0].GetAttributeValues("memberOf"))
+	return attributes
+}
+
+// resolveGroups resolves all the groups (including the nested ones) of the given user using the
+// configured strategy; LdapGroupsIterative is used if the other strategies fail or find no groups.
+// params:
+//  ldapConn: pooled LDAP connection bound as the service account
+//  cfg: LDAP configuration with the search settings populated
+//  user: user entry; carries `memberOf` values when it is used for group membership
+// return values:
+//  on successful search, array of unique groups that user is part-of otherwise any relevant error
+func resolveGroups(ldapConn *pooledConn, cfg *types.LdapConfiguration, user *ldap.Entry) ([]string, error) {
+	var resolve func(*pooledConn, *types.LdapConfiguration, string) ([]string, error)
+	switch cfg.GroupResolution {
+	case types.LdapGroupsTokenGroups:
+		resolve = getUserTokenGroups
+	case types.LdapGroupsInChain:
+		resolve = getUserGroupsInChain
+	}
+
+	if resolve != nil {
+		groups, err := resolve(ldapConn, cfg, user.DN)
+		switch {
+		case err == nil && len(groups) > 0:
+			return groups, nil
+		case ldapConn.broken:
+			log.Errorf("LDAP search operation failed for groups of %q, error %#v", user.DN, err)
+			return nil, auth_errors.ErrLDAPAccessDenied
+		case err != nil:
+			log.Warnf("Failed to resolve groups of %q using %q: %v; falling back to %q",
+				user.DN, cfg.GroupResolution, err, types.LdapGroupsIterative)
+		default:
+			log.Warnf("No groups found for %q using %q; falling back to %q", user.DN, cfg.GroupResolution, types.LdapGroupsIterative)
+		}
+	}
+
+	if cfg.GroupMembership == types.LdapMemberOf {
+		return getUserGroups(ldapConn, cfg, user.GetAttributeValues(types.LdapMemberOf))
+	}
+
+	return getUserGroupsByMember(ldapConn, cfg, user.DN)
+}
+
+// getUserTokenGroups resolves the groups of the given user using its `tokenGroups` attribute (Active Directory).
+// `tokenGroups` carries the SIDs of all the groups (including the nested and primary ones) of the user;
+// the SIDs are looked up in batches of `tokenGroupsBatchSize`.
+// params:
+//  ldapConn: pooled LDAP connection bound as the service account
+//  cfg: LDAP configuration with the search settings populated
+//  userDN: distinguished name of the user
+// return values:
+//  on successful search, array of unique groups that user is part-of otherwise any relevant error
+func getUserTokenGroups(ldapConn *pooledConn, cfg *types.LdapConfiguration, userDN string) ([]string, error) {
+	// tokenGroups is a constructed attribute; it is returned by base object searches only
+	searchRequest := ldap.NewSearchRequest(
+		userDN,
+		ldap.ScopeBaseObject, ldap.DerefAlways, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"tokenGroups"},
+		nil)
+
+	searchRes, err := ldapConn.Search(searchRequest)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Debugf("Authorized groups:%#v", groups)
-	log.Info("AD authentication successful")
+	if len(searchRes.Entries) != 1 {
+		return nil, fmt.Errorf("found %d entries for %q", len(searchRes.Entries), userDN)
+	}
+
+	sids := searchRes.Entries[0].GetRawAttributeValues("tokenGroups")
+	if len(sids) == 0 {
+		return nil, fmt.Errorf("no tokenGroups returned for %q", userDN)
+	}
 
-	return groups, nil
+	groups := newGroupSet(cfg)
+	for start := 0; start < len(sids); start += tokenGroupsBatchSize {
+		end := start + tokenGroupsBatchSize
+		if end > len(sids) {
+			end = len(sids)
+		}
+
+		filter := ""
+		for _, sid := range sids[start:end] {
+			filter += "(objectSid=" + escapeBinaryFilter(sid) + ")"
+		}
+
+		searchRequest := ldap.NewSearchRequest(
+			groupSearchBase(cfg),
+			ldap.ScopeWholeSubtree, ldap.DerefAlways, 0, 0, false,
+			fmt.Sprintf("(&(objectClass=%s)(|%s))", cfg.GroupObjectClass, filter),
+			groupAttributes(cfg),
+			nil)
+
+		searchRes, err := ldapConn.Search(searchRequest)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range searchRes.Entries {
+			groups.add(entry)
+		}
+	}
+
+	return groups.list(), nil
+}
+
+// getUserGroupsInChain resolves the groups of the given user in a single search using
+// LDAP_MATCHING_RULE_IN_CHAIN (Active Directory); the directory follows the nested `member` values.
+// params:
+//  ldapConn: pooled LDAP connection bound as the service account
+//  cfg: LDAP configuration with the search settings populated
+//  userDN: distinguished name of the user
+// return values:
+//  on successful search, array of unique groups that user is part-of otherwise any relevant error
+func getUserGroupsInChain(ldapConn *pooledConn, cfg *types.LdapConfiguration, userDN string) ([]string, error) {
+	searchRequest := ldap.NewSearchRequest(
+		groupSearchBase(cfg),
+		ldap.ScopeWholeSubtree, ldap.DerefAlways, 0, 0, false,
+		fmt.Sprintf("(&(objectClass=%s)(%s:%s:=%s))",
+			cfg.GroupObjectClass, types.LdapMember, types.LdapMatchingRuleInChain, ldap.EscapeFilter(userDN)),
+		groupAttributes(cfg),
+		nil)
+
+	searchRes, err := ldapConn.Search(searchRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	groups := newGroupSet(cfg)
+	for _, entry := range searchRes.Entries {
+		groups.add(entry)
+	}
+
+	return groups.list(), nil
 }
 
 // getUserGroups performs a nested search on the given first-level user groups to uncover all the groups that the user is part of.
+// This is used with `memberOf` group membership; every group entry lists the groups it belongs to.
+// Nesting is followed up to `GroupMaxDepth` levels (first-level groups are at depth 1).
 // params:
-//  ldapConn: LDAP connection object
+//  ldapConn: pooled LDAP connection bound as the service account
+//  cfg: LDAP configuration with the search settings populated
 //  groups: list of first-level user groups
 // return values:
 //  on successful search, array of unique groups that user is part-of otherwise any relevant error
-func (lm *Manager) getUserGroups(ldapConn *ldap.Conn, groups []string) ([]string, error) {
+func getUserGroups(ldapConn *pooledConn, cfg *types.LdapConfiguration, groups []string) ([]string, error) {
 	if len(groups) == 0 {
 		// this happens when the user is just part of the primary group; we won't attempt to handle this case!
 		// more details here: http://lists.freeradius.org/pipermail/freeradius-users/2012-August/062055.html
@@ -154,76 +519,330 @@ func (lm *Manager) getUserGroups(ldapConn *ldap.Conn, groups []string) ([]string
 	}
 
 	var attributes = []string{
-		"memberof",
+		types.LdapMemberOf,
+	}
+
+	if !common.IsEmpty(cfg.GroupNameAttribute) {
+		attributes = append(attributes, cfg.GroupNameAttribute)
 	}
 
 	// below is a similar implementation of FIFO queue
+	queue := []nestedGroup{}
+	for _, group := range groups {
+		queue = append(queue, nestedGroup{dn: group, depth: 1})
+	}
+
 	processedGroups := make(map[string]bool) // to track processed groups during nested search
+	groupNames := newGroupSet(cfg)           // principal names of the groups found
 
-	for len(groups) > 0 {
-		adGroup := groups[0]
-		groups = groups[1:] // chop the processed groups
-		if processedGroups[adGroup] {
+	for len(queue) > 0 {
+		adGroup := queue[0]
+		queue = queue[1:] // chop the processed groups
+		if processedGroups[adGroup.dn] {
 			continue
 		}
 
-		processedGroups[adGroup] = true
+		processedGroups[adGroup.dn] = true
 
 		// process active directory group `adGroup`; get group's memberOf set. base object search will always return only a single entry (specified by the DN)
 		searchRequest := ldap.NewSearchRequest(
-			adGroup, // distinguished name of the group in the base domain
+			adGroup.dn, // distinguished name of the group in the base domain
 			ldap.ScopeBaseObject, ldap.DerefAlways, 0, 0, false,
-			"(objectClass=group)", // search filter; search is restricted to `group` as we are not focusing on other entities here
+			"(objectClass="+cfg.GroupObjectClass+")", // search filter; search is restricted to groups as we are not focusing on other entities here
 			attributes,
 			nil)
 
 		searchRes, err := ldapConn.Search(searchRequest)
 		if err != nil {
-			log.Errorf("LDAP search operation failed for AD group %q, error %#v", adGroup, err)
+			log.Errorf("LDAP search operation failed for AD group %q, error %#v", adGroup.dn, err)
 			return nil, auth_errors.ErrLDAPAccessDenied
 		}
 
+		if len(searchRes.Entries) == 0 { // not a group of the configured object class
+			log.Debugf("Skipping %q; not an entry of object class %q", adGroup.dn, cfg.GroupObjectClass)
+			continue
+		}
+
 		if len(searchRes.Entries) > 1 { // we should never hit this case!
 			return []string{}, auth_errors.ErrLDAPMultipleEntries
 		}
 
+		groupNames.add(searchRes.Entries[0])
+
+		if cfg.GroupMaxDepth > 0 && adGroup.depth >= cfg.GroupMaxDepth {
+			log.Debugf("Not following the groups of %q; max depth %d reached", adGroup.dn, cfg.GroupMaxDepth)
+			continue
+		}
+
 		// look for possible subgroups to be further processed
-		subGroups := searchRes.Entries[0].GetAttributeValues("memberOf")
+		subGroups := searchRes.Entries[0].GetAttributeValues(types.LdapMemberOf)
 		for _, sGrp := range subGroups {
 			if !processedGroups[sGrp] {
-				groups = append(groups, sGrp)
+				queue = append(queue, nestedGroup{dn: sGrp, depth: adGroup.depth + 1})
 			}
 		}
 	}
 
 	// authorized groups of the user
-	result := []string{}
-	for group := range processedGroups { // all the entries in this map are valid
-		result = append(result, group)
+	return groupNames.list(), nil
+}
+
+// getUserGroupsByMember performs a nested search for the groups which list the user
+// (or one of its groups) in their `member`/`uniqueMember` attribute.
+// Nesting is followed up to `GroupMaxDepth` levels (the groups listing the user are at depth 1).
+// params:
+//  ldapConn: pooled LDAP connection bound as the service account
+//  cfg: LDAP configuration with the search settings populated
+//  userDN: distinguished name of the user
+// return values:
+//  on successful search, array of unique groups that user is part-of otherwise any relevant error
+func getUserGroupsByMember(ldapConn *pooledConn, cfg *types.LdapConfiguration, userDN string) ([]string, error) {
+	// below is a similar implementation of FIFO queue
+	members := []nestedGroup{{dn: userDN, depth: 0}}
+	processedGroups := make(map[string]bool) // to track processed groups during nested search
+	groupNames := newGroupSet(cfg)           // principal names of the groups found
+
+	for len(members) > 0 {
+		member := members[0]
+		members = members[1:]
+
+		searchRequest := ldap.NewSearchRequest(
+			cfg.BaseDN,
+			ldap.ScopeWholeSubtree, ldap.DerefAlways, 0, 0, false,
+			fmt.Sprintf("(&(objectClass=%s)(%s=%s))", cfg.GroupObjectClass, cfg.GroupMembership, ldap.EscapeFilter(member.dn)),
+			groupAttributes(cfg),
+			nil)
+
+		searchRes, err := ldapConn.Search(searchRequest)
+		if err != nil {
+			log.Errorf("LDAP search operation failed for groups of %q, error %#v", member.dn, err)
+			return nil, auth_errors.ErrLDAPAccessDenied
+		}
+
+		for _, entry := range searchRes.Entries {
+			if processedGroups[entry.DN] {
+				continue
+			}
+
+			processedGroups[entry.DN] = true
+			groupNames.add(entry)
+
+			// look for the groups of this group
+			if cfg.GroupMaxDepth == 0 || member.depth+1 < cfg.GroupMaxDepth {
+				members = append(members, nestedGroup{dn: entry.DN, depth: member.depth + 1})
+			}
+		}
+	}
+
+	result := groupNames.list()
+	if len(result) == 0 {
+		log.Debugf("No groups found for %q", userDN)
+		return []string{}, auth_errors.ErrLDAPGroupsNotFound
 	}
 
+	// authorized groups of the user
 	return result, nil
 }
 
-// connect establishes a LDAP connection with the given Active Directory configuration(receiver)
+// nestedGroup is a group (or member) DN queued for the iterative group resolution
+type nestedGroup struct {
+	dn    string
+	depth int
+}
+
+// groupSet collects the principal names of the groups found; only the groups
+// under `GroupBaseDN` are collected if it is configured.
+type groupSet struct {
+	cfg    *types.LdapConfiguration
+	baseDN *ldap.DN
+	names  map[string]bool
+}
+
+// newGroupSet returns an empty group set for the given configuration
+func newGroupSet(cfg *types.LdapConfiguration) *groupSet {
+	groups := &groupSet{cfg: cfg, names: map[string]bool{}}
+	if !common.IsEmpty(cfg.GroupBaseDN) {
+		// the DN is validated along with the search settings
+		groups.baseDN, _ = ldap.ParseDN(cfg.GroupBaseDN)
+	}
+
+	return groups
+}
+
+// add adds the name of the given group entry to the set if the group is under `GroupBaseDN`
+func (gs *groupSet) add(entry *ldap.Entry) {
+	if gs.baseDN != nil && !isUnderDN(entry.DN, gs.baseDN) {
+		log.Debugf("Skipping %q; not under the group base DN %q", entry.DN, gs.cfg.GroupBaseDN)
+		return
+	}
+
+	if name := groupName(gs.cfg, entry); !common.IsEmpty(name) {
+		gs.names[name] = true
+	}
+}
+
+// list returns the names collected so far
+func (gs *groupSet) list() []string {
+	result := []string{}
+	for name := range gs.names { // all the entries in this map are valid
+		result = append(result, name)
+	}
+
+	return result
+}
+
+// isUnderDN checks whether the given DN is the base DN or one of its descendants;
+// attribute types and values are compared case-insensitively.
+func isUnderDN(dn string, baseDN *ldap.DN) bool {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil || len(parsed.RDNs) < len(baseDN.RDNs) {
+		return false
+	}
+
+	offset := len(parsed.RDNs) - len(baseDN.RDNs)
+	for i, rdn := range baseDN.RDNs {
+		other := parsed.RDNs[offset+i]
+		if len(rdn.Attributes) != len(other.Attributes) {
+			return false
+		}
+
+		for j, attribute := range rdn.Attributes {
+			if !strings.EqualFold(strings.TrimSpace(attribute.Type), strings.TrimSpace(other.Attributes[j].Type)) ||
+				!strings.EqualFold(strings.TrimSpace(attribute.Value), strings.TrimSpace(other.Attributes[j].Value)) {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// groupSearchBase returns the base DN of the group searches
+func groupSearchBase(cfg *types.LdapConfiguration) string {
+	if !common.IsEmpty(cfg.GroupBaseDN) {
+		return cfg.GroupBaseDN
+	}
+
+	return cfg.BaseDN
+}
+
+// groupAttributes returns the attributes to be fetched from the group entries
+func groupAttributes(cfg *types.LdapConfiguration) []string {
+	if !common.IsEmpty(cfg.GroupNameAttribute) {
+		return []string{cfg.GroupNameAttribute}
+	}
+
+	return []string{"1.1"} // RFC 4511: no attributes; the DN is always returned
+}
+
+// escapeBinaryFilter escapes every byte of the given binary value (e.g. a SID) for use in a search filter
+func escapeBinaryFilter(value []byte) string {
+	escaped := ""
+	for _, b := range value {
+		escaped += fmt.Sprintf("\\%02x", b)
+	}
+
+	return escaped
+}
+
+// groupName returns the principal name of the given group entry.
+// params:
+//  cfg: LDAP configuration with the search settings populated
+//  entry: group entry
 // return values:
-//  on successful connection with AD, returns a LDAP connection object otherwise ErrLDAPConnectionFailed
+//  string: value of `GroupNameAttribute` if configured otherwise DN of the group
+func groupName(cfg *types.LdapConfiguration, entry *ldap.Entry) string {
+	if common.IsEmpty(cfg.GroupNameAttribute) {
+		return entry.DN
+	}
+
+	return entry.GetAttributeValue(cfg.GroupNameAttribute)
+}
+
+// connect establishes a LDAP connection with one of the servers of the given Active Directory
+// configuration(receiver); servers are tried in their configured order, servers which failed
+// recently are tried last.
+// return values:
+//  on successful connection with AD, returns a LDAP connection object otherwise
+//  an error with code auth_errors.LDAPConnectionFailed describing the last failure
 func (lm *Manager) connect() (*ldap.Conn, error) {
-	ldapConn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", lm.Config.Server, lm.Config.Port))
+	servers := lm.Config.ServerList()
+	if len(servers) == 0 {
+		return nil, auth_errors.ErrLDAPConnectionFailed
+	}
+
+	var err error
+	for _, server := range orderServers(servers) {
+		var ldapConn *ldap.Conn
+		ldapConn, err = lm.connectServer(server)
+		if err == nil {
+			recordSuccess(server)
+			return ldapConn, nil
+		}
+
+		log.Errorf("Failed to connect to AD server %q: %v", serverAddress(server), err)
+		recordFailure(server, err)
+	}
+
+	return nil, auth_errors.NewError(auth_errors.LDAPConnectionFailed, fmt.Sprintf("LDAP/AD connection failed, %v", err))
+}
+
+// connectServer establishes a LDAP connection with the given server
+// params:
+//  server: directory server to connect to
+// return values:
+//  on successful connection, returns a LDAP connection object otherwise any relevant error
+func (lm *Manager) connectServer(server types.LdapServer) (*ldap.Conn, error) {
+	tlsConfig, err := lm.Config.TLSConfig()
 	if err != nil {
-		log.Errorf("Failed to connect to AD server:%v", err)
-		return nil, fmt.Errorf("%v, %v", auth_errors.ErrLDAPConnectionFailed, err)
+		return nil, fmt.Errorf("invalid TLS settings: %v", err)
 	}
 
+	if common.IsEmpty(tlsConfig.ServerName) {
+		tlsConfig.ServerName = server.Server
+	}
+
+	connectTimeout, readTimeout := lm.timeouts()
+	dialer := &net.Dialer{Timeout: connectTimeout}
+
+	var conn net.Conn
+	if lm.Config.LDAPS {
+		// implicit TLS; the timeout covers the handshake as well
+		conn, err = tls.DialWithDialer(dialer, "tcp", serverAddress(server), tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", serverAddress(server))
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	ldapConn := ldap.NewConn(conn, lm.Config.LDAPS)
+	ldapConn.Start()
+	ldapConn.SetTimeout(readTimeout)
+
 	// switch to TLS if specified; this needs to have certs in place
-	// TODO: yet to be tested
 	if lm.Config.StartTLS {
-		err = ldapConn.StartTLS(&tls.Config{InsecureSkipVerify: lm.Config.InsecureSkipVerify})
-		if err != nil {
-			log.Errorf("Failed to initiate TLS with AD server: %v", err)
-			return nil, fmt.Errorf("%v, %v", auth_errors.ErrLDAPConnectionFailed, err)
+		if err := ldapConn.StartTLS(tlsConfig); err != nil {
+			ldapConn.Close()
+			return nil, fmt.Errorf("failed to initiate TLS: %v", err)
 		}
 	}
 
 	return ldapConn, nil
 }
+
+// timeouts returns the connect and read timeouts of the configuration(receiver); defaults are used if they are not set.
+func (lm *Manager) timeouts() (time.Duration, time.Duration) {
+	connectTimeout := time.Duration(types.DefaultLdapConnectTimeout) * time.Second
+	if lm.Config.ConnectTimeout > 0 {
+		connectTimeout = time.Duration(lm.Config.ConnectTimeout) * time.Second
+	}
+
+	readTimeout := time.Duration(types.DefaultLdapReadTimeout) * time.Second
+	if lm.Config.ReadTimeout > 0 {
+		readTimeout = time.Duration(lm.Config.ReadTimeout) * time.Second
+	}
+
+	return connectTimeout, readTimeout
+}
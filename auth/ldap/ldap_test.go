@@ -0,0 +1,1603 @@
+package ldap
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	ldap "github.com/go-ldap/ldap"
+	ber "gopkg.in/asn1-ber.v1"
+	. "gopkg.in/check.v1"
+)
+
+// LDAP result codes used by the stand-in directory
+const (
+	resultSuccess                 = 0
+	resultProtocolError           = 2
+	resultInsufficientAccessRight = 50
+	resultInvalidCredentials      = 49
+
+	startTLSOID = "1.3.6.1.4.1.1466.20037"
+)
+
+type ldapSuite struct{}
+
+var _ = Suite(&ldapSuite{})
+
+var (
+	// entries of an Active Directory like directory
+	adEntries = []*testEntry{
+		{
+			dn:       "cn=svc,ou=users,dc=example,dc=com",
+			password: "svcpass",
+			attributes: map[string][]string{
+				"objectClass": {"top", "person", "user"},
+			},
+		},
+		{
+			dn:       "cn=John Doe,ou=users,dc=example,dc=com",
+			password: "johnpass",
+			attributes: map[string][]string{
+				"objectClass":    {"top", "person", "user"},
+				"sAMAccountName": {"john"},
+				"memberOf":       {"cn=devs,ou=groups,dc=example,dc=com"},
+			},
+		},
+		{
+			dn:       "cn=Lonely,ou=users,dc=example,dc=com",
+			password: "lonelypass",
+			attributes: map[string][]string{
+				"objectClass":    {"top", "person", "user"},
+				"sAMAccountName": {"lonely"},
+			},
+		},
+		{
+			dn: "cn=devs,ou=groups,dc=example,dc=com",
+			attributes: map[string][]string{
+				"objectClass": {"top", "group"},
+				"cn":          {"devs"},
+				"memberOf":    {"cn=eng,ou=groups,dc=example,dc=com"},
+			},
+		},
+		{
+			dn: "cn=eng,ou=groups,dc=example,dc=com",
+			attributes: map[string][]string{
+				"objectClass": {"top", "group"},
+				"cn":          {"eng"},
+			},
+		},
+	}
+
+	// entries of an OpenLDAP like directory
+	openLDAPEntries = []*testEntry{
+		{
+			dn:       "cn=admin,dc=example,dc=org",
+			password: "adminpass",
+			attributes: map[string][]string{
+				"objectClass": {"top", "organizationalRole"},
+			},
+		},
+		{
+			dn:       "uid=alice,ou=people,dc=example,dc=org",
+			password: "alicepass",
+			attributes: map[string][]string{
+				"objectClass": {"top", "person", "inetOrgPerson"},
+				"uid":         {"alice"},
+				"mail":        {"alice@example.org"},
+			},
+		},
+		{
+			dn: "cn=devs,ou=groups,dc=example,dc=org",
+			attributes: map[string][]string{
+				"objectClass": {"top", "groupOfNames"},
+				"cn":          {"devs"},
+				"member":      {"uid=alice,ou=people,dc=example,dc=org"},
+			},
+		},
+		{
+			dn: "cn=eng,ou=groups,dc=example,dc=org",
+			attributes: map[string][]string{
+				"objectClass": {"top", "groupOfNames"},
+				"cn":          {"eng"},
+				"member":      {"cn=devs,ou=groups,dc=example,dc=org"},
+			},
+		},
+		{
+			dn: "cn=ops,ou=groups,dc=example,dc=org",
+			attributes: map[string][]string{
+				"objectClass":  {"top", "groupOfUniqueNames"},
+				"cn":           {"ops"},
+				"uniqueMember": {"uid=alice,ou=people,dc=example,dc=org"},
+			},
+		},
+	}
+)
+
+// testSID returns a binary SID with the given relative ID; it contains bytes which must be escaped in filters.
+func testSID(rid byte) string {
+	return string([]byte{1, 5, 0, 0, 0, 0, 0, 5, 21, 0, 0, 0, 0x28, 0x2a, 0x5c, 0x29, rid, 0, 0, 0})
+}
+
+// entries of an Active Directory like directory with nested groups; all the groups of bob:
+// g1 -> g2 -> g3 and dl1 which is not under ou=groups
+var nestedEntries = []*testEntry{
+	{
+		dn:       "cn=svc,ou=users,dc=corp,dc=com",
+		password: "svcpass",
+		attributes: map[string][]string{
+			"objectClass": {"top", "person", "user"},
+		},
+	},
+	{
+		dn:       "cn=Bob,ou=users,dc=corp,dc=com",
+		password: "bobpass",
+		attributes: map[string][]string{
+			"objectClass":    {"top", "person", "user"},
+			"sAMAccountName": {"bob"},
+			"displayName":    {"Bob Smith"},
+			"mail":           {"bob@corp.com"},
+			"memberOf":       {"cn=g1,ou=groups,dc=corp,dc=com", "cn=dl1,ou=distribution,dc=corp,dc=com"},
+			"tokenGroups":    {testSID(1), testSID(2), testSID(3), testSID(4)},
+		},
+	},
+	{
+		dn:       "cn=Carol,ou=users,dc=corp,dc=com",
+		password: "carolpass",
+		attributes: map[string][]string{
+			"objectClass":    {"top", "person", "user"},
+			"sAMAccountName": {"carol"},
+			"memberOf":       {"cn=g2,ou=groups,dc=corp,dc=com"},
+		},
+	},
+	{
+		dn: "cn=g1,ou=groups,dc=corp,dc=com",
+		attributes: map[string][]string{
+			"objectClass": {"top", "group"},
+			"cn":          {"g1"},
+			"objectSid":   {testSID(1)},
+			"member":      {"cn=Bob,ou=users,dc=corp,dc=com"},
+			"memberOf":    {"cn=g2,ou=groups,dc=corp,dc=com"},
+		},
+	},
+	{
+		dn: "cn=g2,ou=groups,dc=corp,dc=com",
+		attributes: map[string][]string{
+			"objectClass": {"top", "group"},
+			"cn":          {"g2"},
+			"objectSid":   {testSID(2)},
+			"member":      {"cn=g1,ou=groups,dc=corp,dc=com", "cn=Carol,ou=users,dc=corp,dc=com"},
+			"memberOf":    {"cn=g3,ou=groups,dc=corp,dc=com"},
+		},
+	},
+	{
+		dn: "cn=g3,ou=groups,dc=corp,dc=com",
+		attributes: map[string][]string{
+			"objectClass": {"top", "group"},
+			"cn":          {"g3"},
+			"objectSid":   {testSID(3)},
+			"member":      {"cn=g2,ou=groups,dc=corp,dc=com"},
+		},
+	},
+	{
+		dn: "cn=dl1,ou=distribution,dc=corp,dc=com",
+		attributes: map[string][]string{
+			"objectClass": {"top", "group"},
+			"cn":          {"dl1"},
+			"objectSid":   {testSID(4)},
+			"member":      {"cn=Bob,ou=users,dc=corp,dc=com"},
+		},
+	},
+}
+
+// Test hooks gocheck into the standard go test runner
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+// TestActiveDirectoryPreset tests authentication using the default (Active Directory) search settings
+func (s *ldapSuite) TestActiveDirectoryPreset(c *C) {
+	directory := newTestDirectory(c, adEntries)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=com", "cn=svc,ou=users,dc=example,dc=com", "svcpass")}
+
+	groups, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	sort.Strings(groups)
+	c.Assert(groups, DeepEquals, []string{"cn=devs,ou=groups,dc=example,dc=com", "cn=eng,ou=groups,dc=example,dc=com"})
+
+	lm.Config.GroupNameAttribute = "cn"
+	groups, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	sort.Strings(groups)
+	c.Assert(groups, DeepEquals, []string{"devs", "eng"})
+
+	_, err = lm.Authenticate("john", "wrongpass")
+	c.Assert(err, Equals, auth_errors.ErrLDAPAccessDenied)
+
+	_, err = lm.Authenticate("unknown", "johnpass")
+	c.Assert(err, Equals, auth_errors.ErrUserNotFound)
+
+	_, err = lm.Authenticate("lonely", "lonelypass")
+	c.Assert(err, Equals, auth_errors.ErrLDAPGroupsNotFound)
+
+	// OpenLDAP search settings don't match AD entries
+	lm.Config.DirectoryType = types.LdapOpenLDAP
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, Equals, auth_errors.ErrUserNotFound)
+}
+
+// TestOpenLDAPPreset tests authentication using the OpenLDAP search settings
+func (s *ldapSuite) TestOpenLDAPPreset(c *C) {
+	directory := newTestDirectory(c, openLDAPEntries)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=org", "cn=admin,dc=example,dc=org", "adminpass")}
+	lm.Config.DirectoryType = types.LdapOpenLDAP
+
+	groups, err := lm.Authenticate("alice", "alicepass")
+	c.Assert(err, IsNil)
+	sort.Strings(groups)
+	c.Assert(groups, DeepEquals, []string{"cn=devs,ou=groups,dc=example,dc=org", "cn=eng,ou=groups,dc=example,dc=org"})
+
+	lm.Config.GroupNameAttribute = "cn"
+	groups, err = lm.Authenticate("alice", "alicepass")
+	c.Assert(err, IsNil)
+	sort.Strings(groups)
+	c.Assert(groups, DeepEquals, []string{"devs", "eng"})
+
+	// `uniqueMember` based membership
+	lm.Config.GroupObjectClass = "groupOfUniqueNames"
+	lm.Config.GroupMembership = types.LdapUniqueMember
+	groups, err = lm.Authenticate("alice", "alicepass")
+	c.Assert(err, IsNil)
+	c.Assert(groups, DeepEquals, []string{"ops"})
+
+	_, err = lm.Authenticate("alice", "wrongpass")
+	c.Assert(err, Equals, auth_errors.ErrLDAPAccessDenied)
+
+	// `memberOf` is not maintained by this directory
+	lm.Config.GroupObjectClass = ""
+	lm.Config.GroupMembership = types.LdapMemberOf
+	_, err = lm.Authenticate("alice", "alicepass")
+	c.Assert(err, Equals, auth_errors.ErrLDAPGroupsNotFound)
+}
+
+// TestUserSearchSettings tests the user search filter template and username attribute
+func (s *ldapSuite) TestUserSearchSettings(c *C) {
+	directory := newTestDirectory(c, openLDAPEntries)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=org", "cn=admin,dc=example,dc=org", "adminpass")}
+	lm.Config.DirectoryType = types.LdapOpenLDAP
+	lm.Config.GroupNameAttribute = "cn"
+
+	lm.Config.UsernameAttribute = "mail"
+	groups, err := lm.Authenticate("alice@example.org", "alicepass")
+	c.Assert(err, IsNil)
+	c.Assert(len(groups), Equals, 2)
+
+	_, err = lm.Authenticate("alice", "alicepass")
+	c.Assert(err, Equals, auth_errors.ErrUserNotFound)
+
+	lm.Config.UsernameAttribute = ""
+	lm.Config.UserSearchFilter = "(|(uid={username})(mail={username}))"
+	for _, username := range []string{"alice", "alice@example.org"} {
+		groups, err := lm.Authenticate(username, "alicepass")
+		c.Assert(err, IsNil)
+		c.Assert(len(groups), Equals, 2)
+	}
+
+	c.Assert(directory.searched("(|(uid=alice@example.org)(mail=alice@example.org))"), Equals, true)
+
+	// invalid settings are never sent to the server
+	lm.Config.UserSearchFilter = "(uid=alice)"
+	_, err = lm.Authenticate("alice", "alicepass")
+	c.Assert(auth_errors.HasCode(err, auth_errors.IllegalArguments), Equals, true)
+}
+
+// TestHostileUsernames tests that usernames can't alter the user search filter
+func (s *ldapSuite) TestHostileUsernames(c *C) {
+	directory := newTestDirectory(c, adEntries)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=com", "cn=svc,ou=users,dc=example,dc=com", "svcpass")}
+
+	hostileUsernames := []string{
+		"*",
+		"jo*",
+		"*john",
+		"*)(sAMAccountName=*",
+		"john)(|(sAMAccountName=*",
+		"john)(objectClass=*",
+		"*)(|(objectClass=*)",
+		"john)",
+		"(john",
+		"john\\2a",
+		"john\x00",
+		"john ",
+	}
+
+	// the default pattern rejects these before any directory call
+	for _, username := range hostileUsernames {
+		_, err := lm.Authenticate(username, "johnpass")
+		c.Assert(err, Equals, auth_errors.ErrUserNotFound, Commentf("username %q", username))
+	}
+
+	c.Assert(directory.searchCount(), Equals, 0)
+
+	// the unescaped input would have matched every user having a sAMAccountName
+	injected, err := ldap.CompileFilter("(&(objectClass=user)(sAMAccountName=*)(sAMAccountName=*))")
+	c.Assert(err, IsNil)
+	c.Assert(len(directory.search(ldap.ScopeWholeSubtree, "dc=example,dc=com", injected)), Equals, 2)
+
+	// with a permissive pattern, they reach the directory escaped and match nothing
+	lm.Config.UsernamePattern = ".+"
+	for _, username := range hostileUsernames {
+		_, err := lm.Authenticate(username, "johnpass")
+		c.Assert(err, Equals, auth_errors.ErrUserNotFound, Commentf("username %q", username))
+	}
+
+	c.Assert(directory.searchCount(), Equals, len(hostileUsernames))
+	c.Assert(directory.searched(`(&(objectClass=user)(sAMAccountName=\2a\29\28sAMAccountName=\2a))`), Equals, true)
+
+	// only exact matches are returned
+	for _, username := range []string{"joh", "ohn", "john2"} {
+		_, err := lm.Authenticate(username, "johnpass")
+		c.Assert(err, Equals, auth_errors.ErrUserNotFound)
+	}
+
+	groups, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(len(groups), Equals, 2)
+
+	// restrictive pattern
+	lm.Config.UsernamePattern = "[a-z]{5,}"
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, Equals, auth_errors.ErrUserNotFound)
+
+	cfg := &types.LdapConfiguration{}
+	for _, username := range []string{"john", "john.doe", "john_doe-1", "john@example.com", "jöhn", "1john"} {
+		c.Assert(cfg.IsValidUsername(username), Equals, true, Commentf("username %q", username))
+	}
+
+	for _, username := range append(hostileUsernames, "", ".john", "john doe", strings.Repeat("a", 257)) {
+		c.Assert(cfg.IsValidUsername(username), Equals, false, Commentf("username %q", username))
+	}
+}
+
+// TestSearchSettingsDefaults tests `WithSearchDefaults(...)` and `ValidateSearchSettings(...)`
+func (s *ldapSuite) TestSearchSettingsDefaults(c *C) {
+	cfg := &types.LdapConfiguration{}
+	obtained, err := cfg.WithSearchDefaults()
+	c.Assert(err, IsNil)
+	c.Assert(obtained.DirectoryType, Equals, types.LdapActiveDirectory)
+	c.Assert(obtained.UserSearchFilter, Equals, "(&(objectClass=user)(sAMAccountName={username}))")
+	c.Assert(obtained.UsernameAttribute, Equals, "sAMAccountName")
+	c.Assert(obtained.GroupObjectClass, Equals, "group")
+	c.Assert(obtained.GroupMembership, Equals, types.LdapMemberOf)
+	c.Assert(obtained.GroupNameAttribute, Equals, "")
+	c.Assert(obtained.UsernamePattern, Equals, types.DefaultLdapUsernamePattern)
+
+	// the given configuration is left untouched
+	c.Assert(*cfg, DeepEquals, types.LdapConfiguration{})
+
+	cfg = &types.LdapConfiguration{DirectoryType: types.LdapOpenLDAP, GroupNameAttribute: "cn"}
+	obtained, err = cfg.WithSearchDefaults()
+	c.Assert(err, IsNil)
+	c.Assert(obtained.UserSearchFilter, Equals, "(&(objectClass=inetOrgPerson)(uid={username}))")
+	c.Assert(obtained.UsernameAttribute, Equals, "uid")
+	c.Assert(obtained.GroupObjectClass, Equals, "groupOfNames")
+	c.Assert(obtained.GroupMembership, Equals, types.LdapMember)
+	c.Assert(obtained.GroupNameAttribute, Equals, "cn")
+
+	invalidConfigs := []types.LdapConfiguration{
+		{DirectoryType: "novell"},
+		{UserSearchFilter: "uid={username}"},
+		{UserSearchFilter: "(uid=alice)"},
+		{UsernameAttribute: "uid=x"},
+		{GroupObjectClass: "group)(cn=*"},
+		{GroupNameAttribute: "1cn"},
+		{GroupMembership: "memberUid"},
+		{UsernamePattern: "[a-z"},
+	}
+
+	for _, cfg := range invalidConfigs {
+		err := cfg.ValidateSearchSettings()
+		c.Assert(auth_errors.HasCode(err, auth_errors.IllegalArguments), Equals, true)
+
+		_, err = cfg.WithSearchDefaults()
+		c.Assert(err, NotNil)
+	}
+}
+
+// TestLDAPS tests connections using implicit TLS
+func (s *ldapSuite) TestLDAPS(c *C) {
+	ca := newTestCA(c)
+	directory := newTLSTestDirectory(c, adEntries, ca.serverTLSConfig(c, "ldap.example.com", nil), true)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=com", "cn=svc,ou=users,dc=example,dc=com", "svcpass")}
+	lm.Config.LDAPS = true
+
+	// server certificate is not trusted
+	_, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, ErrorMatches, ".*LDAP/AD connection failed.*")
+
+	// trusted, but the certificate is not issued for 127.0.0.1
+	lm.Config.CACertificate = ca.certificate
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, ErrorMatches, ".*LDAP/AD connection failed.*")
+
+	lm.Config.ServerName = "ldap.example.com"
+	groups, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(len(groups), Equals, 2)
+
+	// CA bundle may carry several certificates
+	lm.Config.CACertificate = newTestCA(c).certificate + ca.certificate
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+
+	// plain LDAP isn't served on this port
+	lm.Config.LDAPS = false
+	lm.Config.ReadTimeout = 2
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, NotNil)
+}
+
+// TestStartTLS tests connections upgraded using StartTLS
+func (s *ldapSuite) TestStartTLS(c *C) {
+	ca := newTestCA(c)
+	directory := newTLSTestDirectory(c, adEntries, ca.serverTLSConfig(c, "ldap", []net.IP{net.ParseIP("127.0.0.1")}), false)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=com", "cn=svc,ou=users,dc=example,dc=com", "svcpass")}
+	lm.Config.StartTLS = true
+
+	_, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, ErrorMatches, ".*LDAP/AD connection failed.*")
+
+	// server name defaults to `Server`
+	lm.Config.CACertificate = ca.certificate
+	groups, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(len(groups), Equals, 2)
+
+	lm.Config.ServerName = "ldap.example.com"
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, ErrorMatches, ".*LDAP/AD connection failed.*")
+}
+
+// TestClientCertificate tests directories which require a client certificate
+func (s *ldapSuite) TestClientCertificate(c *C) {
+	ca := newTestCA(c)
+	clientCA := newTestCA(c)
+
+	tlsConfig := ca.serverTLSConfig(c, "ldap.example.com", nil)
+	tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	tlsConfig.ClientCAs = x509.NewCertPool()
+	c.Assert(tlsConfig.ClientCAs.AppendCertsFromPEM([]byte(clientCA.certificate)), Equals, true)
+
+	directory := newTLSTestDirectory(c, adEntries, tlsConfig, true)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=com", "cn=svc,ou=users,dc=example,dc=com", "svcpass")}
+	lm.Config.LDAPS = true
+	lm.Config.CACertificate = ca.certificate
+	lm.Config.ServerName = "ldap.example.com"
+
+	_, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, NotNil)
+
+	// certificate issued by a CA which is not trusted by the server
+	lm.Config.ClientCertificate, lm.Config.ClientKey = ca.issue(c, "auth_proxy", nil, nil)
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, NotNil)
+
+	lm.Config.ClientCertificate, lm.Config.ClientKey = clientCA.issue(c, "auth_proxy", nil, nil)
+	groups, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(len(groups), Equals, 2)
+
+	// key doesn't belong to the certificate
+	_, lm.Config.ClientKey = clientCA.issue(c, "auth_proxy", nil, nil)
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, ErrorMatches, ".*LDAP/AD connection failed.*")
+}
+
+// TestReadTimeout tests that unresponsive directories don't block the authentication
+func (s *ldapSuite) TestReadTimeout(c *C) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	defer listener.Close()
+
+	// accepts the connections, but never responds
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			defer conn.Close()
+		}
+	}()
+
+	lm := Manager{Config: types.LdapConfiguration{
+		Server:           "127.0.0.1",
+		Port:             uint16(listener.Addr().(*net.TCPAddr).Port),
+		BaseDN:           "dc=example,dc=com",
+		ServiceAccountDN: "cn=svc,ou=users,dc=example,dc=com",
+		ReadTimeout:      1,
+	}}
+
+	start := time.Now()
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, Equals, auth_errors.ErrLDAPAccessDenied)
+	c.Assert(time.Since(start) < 5*time.Second, Equals, true)
+}
+
+// TestConnectionSettings tests `ValidateConnectionSettings(...)`
+func (s *ldapSuite) TestConnectionSettings(c *C) {
+	ca := newTestCA(c)
+	certificate, key := ca.issue(c, "auth_proxy", nil, nil)
+	_, otherKey := ca.issue(c, "auth_proxy", nil, nil)
+
+	cfg := &types.LdapConfiguration{
+		Server:            "ldap.example.com",
+		LDAPS:             true,
+		CACertificate:     ca.certificate,
+		ClientCertificate: certificate,
+		ClientKey:         key,
+		ConnectTimeout:    5,
+		ReadTimeout:       5,
+	}
+	c.Assert(cfg.ValidateConnectionSettings(), IsNil)
+
+	// server name is set per server unless it's configured
+	tlsConfig, err := cfg.TLSConfig()
+	c.Assert(err, IsNil)
+	c.Assert(tlsConfig.ServerName, Equals, "")
+	c.Assert(len(tlsConfig.Certificates), Equals, 1)
+
+	cfg.ServerName = "ldap.example.com"
+	tlsConfig, err = cfg.TLSConfig()
+	c.Assert(err, IsNil)
+	c.Assert(tlsConfig.ServerName, Equals, "ldap.example.com")
+	c.Assert(len(tlsConfig.Certificates), Equals, 1)
+
+	invalidConfigs := []types.LdapConfiguration{
+		{LDAPS: true, StartTLS: true},
+		{ConnectTimeout: -1},
+		{ReadTimeout: -1},
+		{CACertificate: "not a certificate"},
+		{CACertificate: key},
+		{ClientCertificate: certificate},
+		{ClientKey: key},
+		{ClientCertificate: certificate, ClientKey: otherKey},
+		{ClientCertificate: key, ClientKey: certificate},
+	}
+
+	for _, cfg := range invalidConfigs {
+		err := cfg.ValidateConnectionSettings()
+		c.Assert(auth_errors.HasCode(err, auth_errors.IllegalArguments), Equals, true)
+	}
+}
+
+// TestServerFailover tests that the servers are tried in order and the failed ones are tried last
+func (s *ldapSuite) TestServerFailover(c *C) {
+	directory := newTestDirectory(c, adEntries)
+	defer directory.close()
+
+	// nothing listens on this port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	down := types.LdapServer{Server: "127.0.0.1", Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+	listener.Close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=com", "cn=svc,ou=users,dc=example,dc=com", "svcpass")}
+	up := types.LdapServer{Server: lm.Config.Server, Port: lm.Config.Port}
+	lm.Config.Server, lm.Config.Port = down.Server, down.Port
+	lm.Config.Servers = []types.LdapServer{up}
+
+	groups, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(len(groups), Equals, 2)
+
+	health := GetServerHealth(&lm.Config)
+	c.Assert(len(health), Equals, 2)
+	c.Assert(health[0].Healthy, Equals, false)
+	c.Assert(health[0].ConsecutiveFailures, Equals, 1)
+	c.Assert(health[0].LastError, Not(Equals), "")
+	c.Assert(health[1].Healthy, Equals, true)
+	c.Assert(health[1].LastSuccess, NotNil)
+
+	// the failed server is tried after the healthy one until the retry interval elapses
+	c.Assert(orderServers(lm.Config.ServerList()), DeepEquals, []types.LdapServer{up, down})
+
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(GetServerHealth(&lm.Config)[0].ConsecutiveFailures, Equals, 1)
+
+	// all the servers are down
+	directory.close()
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(auth_errors.HasCode(err, auth_errors.LDAPConnectionFailed), Equals, true)
+	c.Assert(GetServerHealth(&lm.Config)[0].ConsecutiveFailures, Equals, 2)
+	c.Assert(GetServerHealth(&lm.Config)[1].Healthy, Equals, false)
+}
+
+// TestConnectionPool tests that the service account connections and the authenticated users are reused
+func (s *ldapSuite) TestConnectionPool(c *C) {
+	directory := newTestDirectory(c, adEntries)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=com", "cn=svc,ou=users,dc=example,dc=com", "svcpass")}
+	lm.Config.Name = "pool"
+	defer Invalidate(lm.Config.Name)
+
+	groups, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(len(groups), Equals, 2)
+	searches := directory.searchCount()
+
+	// the connection is reused and the DN/groups are taken from the cache; the password is still verified
+	cachedGroups, err := lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(cachedGroups, DeepEquals, groups)
+	c.Assert(directory.searchCount(), Equals, searches)
+	c.Assert(directory.connectionCount(), Equals, 1)
+
+	_, err = lm.Authenticate("john", "wrongpass")
+	c.Assert(err, Equals, auth_errors.ErrLDAPAccessDenied)
+
+	metrics := GetMetrics(lm.Config.Name)
+	c.Assert(metrics.Pool.Dials, Equals, uint64(1))
+	c.Assert(metrics.Pool.Reuses, Equals, uint64(2))
+	c.Assert(metrics.Pool.Idle, Equals, 1)
+	c.Assert(metrics.Pool.InUse, Equals, 0)
+	c.Assert(metrics.Cache.Hits, Equals, uint64(2))
+	c.Assert(metrics.Cache.Misses, Equals, uint64(1))
+	c.Assert(metrics.Cache.Entries, Equals, 0) // dropped after the failed bind
+	c.Assert(metrics.Latency["search"].Count, Equals, uint64(searches))
+	c.Assert(metrics.Latency["bind"].Errors, Equals, uint64(1))
+
+	// broken connections are replaced
+	directory.dropConnections()
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	c.Assert(directory.connectionCount(), Equals, 2)
+	c.Assert(GetMetrics(lm.Config.Name).Pool.Discards, Equals, uint64(1))
+
+	// configuration change drops the connections and the cache
+	lm.Config.GroupNameAttribute = "cn"
+	groups, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+	sort.Strings(groups)
+	c.Assert(groups, DeepEquals, []string{"devs", "eng"})
+	c.Assert(directory.connectionCount(), Equals, 3)
+	c.Assert(GetMetrics(lm.Config.Name).Cache.Misses, Equals, uint64(1))
+
+	Invalidate(lm.Config.Name)
+	c.Assert(GetMetrics(lm.Config.Name).Pool.Dials, Equals, uint64(0))
+
+	// cache can be disabled
+	lm.Config.CacheTTL = -1
+	for i := 0; i < 2; i++ {
+		_, err = lm.Authenticate("john", "johnpass")
+		c.Assert(err, IsNil)
+	}
+
+	c.Assert(GetMetrics(lm.Config.Name).Cache.Hits, Equals, uint64(0))
+	c.Assert(GetMetrics(lm.Config.Name).Pool.Reuses, Equals, uint64(1))
+
+	// no more than `PoolSize` connections are used at a time
+	lm.Config.PoolSize = 1
+	lm.Config.ConnectTimeout = 1
+	pool := getPool(&lm.Config)
+	pc, err := pool.get(&lm)
+	c.Assert(err, IsNil)
+
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(auth_errors.HasCode(err, auth_errors.LDAPConnectionFailed), Equals, true)
+	c.Assert(GetMetrics(lm.Config.Name).Pool.Exhausted, Equals, uint64(1))
+
+	pool.put(pc)
+	_, err = lm.Authenticate("john", "johnpass")
+	c.Assert(err, IsNil)
+}
+
+// TestNestedGroupResolution tests the group resolution strategies, max depth and group base DN
+func (s *ldapSuite) TestNestedGroupResolution(c *C) {
+	directory := newTestDirectory(c, nestedEntries)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=corp,dc=com", "cn=svc,ou=users,dc=corp,dc=com", "svcpass")}
+	lm.Config.GroupNameAttribute = "cn"
+
+	// authenticate returns the sorted groups and the number of searches made
+	authenticate := func(username, password string) ([]string, int) {
+		searches := directory.searchCount()
+		groups, err := lm.Authenticate(username, password)
+		c.Assert(err, IsNil)
+
+		sort.Strings(groups)
+		return groups, directory.searchCount() - searches
+	}
+
+	// one search per group
+	groups, searches := authenticate("bob", "bobpass")
+	c.Assert(groups, DeepEquals, []string{"dl1", "g1", "g2", "g3"})
+	c.Assert(searches, Equals, 5)
+
+	lm.Config.GroupMaxDepth = 2
+	groups, _ = authenticate("bob", "bobpass")
+	c.Assert(groups, DeepEquals, []string{"dl1", "g1", "g2"})
+
+	lm.Config.GroupMembership = types.LdapMember
+	lm.Config.GroupMaxDepth = 1
+	groups, _ = authenticate("bob", "bobpass")
+	c.Assert(groups, DeepEquals, []string{"dl1", "g1"})
+
+	lm.Config.GroupMaxDepth = 0
+	lm.Config.GroupBaseDN = "OU=Groups, DC=corp, DC=com"
+	groups, _ = authenticate("bob", "bobpass")
+	c.Assert(groups, DeepEquals, []string{"g1", "g2", "g3"})
+
+	// all the groups in a single search
+	lm.Config.GroupMembership = ""
+	lm.Config.GroupBaseDN = ""
+	lm.Config.GroupResolution = types.LdapGroupsInChain
+	groups, searches = authenticate("bob", "bobpass")
+	c.Assert(groups, DeepEquals, []string{"dl1", "g1", "g2", "g3"})
+	c.Assert(searches, Equals, 2)
+
+	lm.Config.GroupBaseDN = "ou=groups,dc=corp,dc=com"
+	groups, searches = authenticate("bob", "bobpass")
+	c.Assert(groups, DeepEquals, []string{"g1", "g2", "g3"})
+	c.Assert(searches, Equals, 2)
+
+	// tokenGroups of the user and a search for the group SIDs
+	lm.Config.GroupBaseDN = ""
+	lm.Config.GroupResolution = types.LdapGroupsTokenGroups
+	groups, searches = authenticate("bob", "bobpass")
+	c.Assert(groups, DeepEquals, []string{"dl1", "g1", "g2", "g3"})
+	c.Assert(searches, Equals, 3)
+
+	// falls back to the iterative resolution if tokenGroups are not returned
+	groups, _ = authenticate("carol", "carolpass")
+	c.Assert(groups, DeepEquals, []string{"g2", "g3"})
+
+	invalidConfigs := []types.LdapConfiguration{
+		{GroupResolution: "recursive"},
+		{GroupMaxDepth: -1},
+		{GroupBaseDN: "groups"},
+	}
+
+	for _, cfg := range invalidConfigs {
+		err := cfg.ValidateSearchSettings()
+		c.Assert(auth_errors.HasCode(err, auth_errors.IllegalArguments), Equals, true)
+	}
+}
+
+// TestConfigurationTest tests the step by step test of a configuration
+func (s *ldapSuite) TestConfigurationTest(c *C) {
+	ca := newTestCA(c)
+	directory := newTLSTestDirectory(c, adEntries, ca.serverTLSConfig(c, "ldap.example.com", nil), false)
+	defer directory.close()
+
+	// nothing listens on this port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+	down := types.LdapServer{Server: "127.0.0.1", Port: uint16(listener.Addr().(*net.TCPAddr).Port)}
+	listener.Close()
+
+	lm := Manager{Config: directory.config("dc=example,dc=com", "cn=svc,ou=users,dc=example,dc=com", "svcpass")}
+	lm.Config.Servers = []types.LdapServer{{Server: lm.Config.Server, Port: lm.Config.Port}}
+	lm.Config.Server, lm.Config.Port = down.Server, down.Port
+	lm.Config.StartTLS = true
+
+	// steps returns the names of the steps run and whether each of them succeeded
+	steps := func(result *TestResult) []string {
+		names := []string{}
+		for _, step := range result.Steps {
+			switch {
+			case step.Skipped:
+				names = append(names, step.Step+":skipped")
+			case step.Success:
+				names = append(names, step.Step)
+			default:
+				names = append(names, step.Step+":failed")
+			}
+		}
+
+		return names
+	}
+
+	// server certificate is not trusted
+	result := lm.Test("john", "johnpass")
+	c.Assert(result.Success, Equals, false)
+	c.Assert(steps(result), DeepEquals, []string{StepConfiguration,
+		StepTCPConnect + ":failed", StepTCPConnect, StepTLSHandshake + ":failed"})
+	c.Assert(result.Steps[3].Error, Matches, ".*certificate.*")
+
+	lm.Config.CACertificate = ca.certificate
+	lm.Config.ServerName = "ldap.example.com"
+	result = lm.Test("john", "johnpass")
+	c.Assert(result.Success, Equals, true)
+	c.Assert(steps(result), DeepEquals, []string{StepConfiguration, StepTCPConnect + ":failed", StepTCPConnect,
+		StepTLSHandshake, StepServiceBind, StepUserSearch, StepUserBind, StepGroups})
+
+	tlsStep := result.Steps[3]
+	c.Assert(tlsStep.TLS, NotNil)
+	c.Assert(tlsStep.TLS.Version, Matches, "TLS 1\\.[23]")
+	c.Assert(len(tlsStep.TLS.Certificates), Equals, 1)
+	c.Assert(tlsStep.TLS.Certificates[0].Subject, Equals, "CN=ldap.example.com")
+	c.Assert(tlsStep.TLS.Certificates[0].DNSNames, DeepEquals, []string{"ldap.example.com"})
+
+	c.Assert(result.Steps[5].DN, Equals, "cn=John Doe,ou=users,dc=example,dc=com")
+	c.Assert(len(result.Steps[7].Groups), Equals, 2)
+
+	// the servers tried by the tests are not marked unhealthy
+	c.Assert(GetServerHealth(&lm.Config)[0].Healthy, Equals, true)
+
+	// only the service account is checked if no username is given
+	result = lm.Test("", "")
+	c.Assert(result.Success, Equals, true)
+	c.Assert(steps(result)[4:], DeepEquals, []string{StepServiceBind, StepUserSearch + ":skipped"})
+
+	// groups are resolved for the users without a password
+	result = lm.Test("john", "")
+	c.Assert(result.Success, Equals, true)
+	c.Assert(steps(result)[5:], DeepEquals, []string{StepUserSearch, StepUserBind + ":skipped", StepGroups})
+
+	result = lm.Test("john", "wrongpass")
+	c.Assert(result.Success, Equals, false)
+	c.Assert(steps(result)[5:], DeepEquals, []string{StepUserSearch, StepUserBind + ":failed"})
+
+	result = lm.Test("nobody", "")
+	c.Assert(steps(result)[5:], DeepEquals, []string{StepUserSearch + ":failed"})
+	c.Assert(result.Steps[5].Error, Equals, auth_errors.ErrUserNotFound.Error())
+
+	result = lm.Test("john*", "")
+	c.Assert(steps(result)[5:], DeepEquals, []string{StepUserSearch + ":failed"})
+	c.Assert(directory.searched("(sAMAccountName=john*)"), Equals, false)
+
+	lm.Config.ServiceAccountPassword = "wrongpass"
+	result = lm.Test("john", "johnpass")
+	c.Assert(steps(result)[4:], DeepEquals, []string{StepServiceBind + ":failed"})
+
+	lm.Config.CACertificate = "not a certificate"
+	result = lm.Test("john", "johnpass")
+	c.Assert(steps(result), DeepEquals, []string{StepConfiguration + ":failed"})
+}
+
+// TestDirectorySearch tests the search for groups and users, and the lookup of groups by principal name
+func (s *ldapSuite) TestDirectorySearch(c *C) {
+	directory := newTestDirectory(c, nestedEntries)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=corp,dc=com", "cn=svc,ou=users,dc=corp,dc=com", "svcpass")}
+	lm.Config.GroupNameAttribute = "cn"
+
+	// names returns the names of the entries found
+	names := func(kind, query string) []string {
+		entries, truncated, err := lm.SearchDirectory(kind, query)
+		c.Assert(err, IsNil)
+		c.Assert(truncated, Equals, false)
+
+		result := []string{}
+		for _, entry := range entries {
+			result = append(result, entry.Name)
+		}
+
+		return result
+	}
+
+	c.Assert(names(DirectoryGroups, ""), DeepEquals, []string{"dl1", "g1", "g2", "g3"})
+	c.Assert(names(DirectoryGroups, "G"), DeepEquals, []string{"g1", "g2", "g3"})
+	c.Assert(names(DirectoryGroups, "*)"), DeepEquals, []string{})
+	c.Assert(names(DirectoryUsers, "o"), DeepEquals, []string{"bob", "carol"})
+	c.Assert(names(DirectoryUsers, "car"), DeepEquals, []string{"carol"})
+
+	entries, _, err := lm.SearchDirectory(DirectoryGroups, "dl")
+	c.Assert(err, IsNil)
+	c.Assert(entries, DeepEquals, []DirectoryEntry{
+		{DN: "cn=dl1,ou=distribution,dc=corp,dc=com", Name: "dl1", DisplayName: "dl1"},
+	})
+
+	_, _, err = lm.SearchDirectory("computers", "")
+	c.Assert(auth_errors.HasCode(err, auth_errors.IllegalArguments), Equals, true)
+
+	group, err := lm.FindGroup("G1")
+	c.Assert(err, IsNil)
+	c.Assert(group.Name, Equals, "g1")
+	c.Assert(group.DN, Equals, "cn=g1,ou=groups,dc=corp,dc=com")
+
+	group, err = lm.FindGroup("g9")
+	c.Assert(err, IsNil)
+	c.Assert(group, IsNil)
+
+	// groups outside the group base DN are not used
+	lm.Config.GroupBaseDN = "ou=groups,dc=corp,dc=com"
+	c.Assert(names(DirectoryGroups, ""), DeepEquals, []string{"g1", "g2", "g3"})
+
+	group, err = lm.FindGroup("dl1")
+	c.Assert(err, IsNil)
+	c.Assert(group, IsNil)
+
+	// groups named by their DN
+	lm.Config.GroupNameAttribute = ""
+	c.Assert(names(DirectoryGroups, "g1"), DeepEquals, []string{"cn=g1,ou=groups,dc=corp,dc=com"})
+
+	group, err = lm.FindGroup("cn=g2,ou=groups,dc=corp,dc=com")
+	c.Assert(err, IsNil)
+	c.Assert(group.Name, Equals, "cn=g2,ou=groups,dc=corp,dc=com")
+
+	for _, principalName := range []string{"g2", "cn=g9,ou=groups,dc=corp,dc=com", "cn=dl1,ou=distribution,dc=corp,dc=com"} {
+		group, err = lm.FindGroup(principalName)
+		c.Assert(err, IsNil)
+		c.Assert(group, IsNil)
+	}
+}
+
+// TestUserAttributes tests the mapping of directory attributes to user attributes
+func (s *ldapSuite) TestUserAttributes(c *C) {
+	directory := newTestDirectory(c, nestedEntries)
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=corp,dc=com", "cn=svc,ou=users,dc=corp,dc=com", "svcpass")}
+	lm.Config.Name = "attributes"
+	lm.Config.GroupNameAttribute = "cn"
+	lm.Config.UserAttributes = map[string]string{"display_name": "displayName", "email": "MAIL", "phone": "telephoneNumber"}
+	defer Invalidate(lm.Config.Name)
+
+	// missing attributes are left out
+	expected := map[string]string{"display_name": "Bob Smith", "email": "bob@corp.com"}
+	for i := 0; i < 2; i++ {
+		user, err := lm.AuthenticateUser("bob", "bobpass")
+		c.Assert(err, IsNil)
+		c.Assert(user.DN, Equals, "cn=Bob,ou=users,dc=corp,dc=com")
+		c.Assert(user.Domain, Equals, lm.Config.Name)
+		c.Assert(user.Attributes, DeepEquals, expected)
+	}
+
+	// the second login is served from the cache
+	c.Assert(GetMetrics(lm.Config.Name).Cache.Hits, Equals, uint64(1))
+
+	user, err := lm.AuthenticateUser("carol", "carolpass")
+	c.Assert(err, IsNil)
+	c.Assert(user.Attributes, DeepEquals, map[string]string{})
+
+	result := lm.Test("bob", "")
+	c.Assert(result.Success, Equals, true)
+	c.Assert(result.Steps[3].Step, Equals, StepUserSearch)
+	c.Assert(result.Steps[3].Attributes, DeepEquals, expected)
+
+	invalidConfigs := []types.LdapConfiguration{
+		{UserAttributes: map[string]string{"Email": "mail"}},
+		{UserAttributes: map[string]string{"": "mail"}},
+		{UserAttributes: map[string]string{"email": ""}},
+		{UserAttributes: map[string]string{"email": "mail)(cn=*"}},
+	}
+
+	for _, cfg := range invalidConfigs {
+		err := cfg.ValidateSearchSettings()
+		c.Assert(auth_errors.HasCode(err, auth_errors.IllegalArguments), Equals, true)
+	}
+}
+
+// TestRevalidation tests the re-validation of the users with active sessions
+func (s *ldapSuite) TestRevalidation(c *C) {
+	directory := newTestDirectory(c, copyEntries(nestedEntries))
+	defer directory.close()
+
+	lm := Manager{Config: directory.config("dc=corp,dc=com", "cn=svc,ou=users,dc=corp,dc=com", "svcpass")}
+	lm.Config.Name = "revalidation"
+	lm.Config.GroupNameAttribute = "cn"
+	lm.Config.RevalidationInterval = 3600
+	defer Invalidate(lm.Config.Name)
+
+	// revalidate expires the outcome of the last re-validation and returns the sorted groups of bob
+	revalidate := func() ([]string, error) {
+		pool := getPool(&lm.Config)
+		pool.mutex.Lock()
+		for _, entry := range pool.validated {
+			entry.expires = time.Now()
+		}
+		pool.mutex.Unlock()
+
+		user, err := lm.Revalidate("bob")
+		if err != nil {
+			return nil, err
+		}
+
+		sort.Strings(user.Groups)
+		return user.Groups, nil
+	}
+
+	// the login counts as a re-validation
+	_, err := lm.AuthenticateUser("bob", "bobpass")
+	c.Assert(err, IsNil)
+
+	searches := directory.searchCount()
+	user, err := lm.Revalidate("bob")
+	c.Assert(err, IsNil)
+	c.Assert(len(user.Groups), Equals, 4)
+	c.Assert(directory.searchCount(), Equals, searches)
+
+	// groups the user has left are gone
+	directory.set("cn=Bob,ou=users,dc=corp,dc=com", "memberOf", "cn=dl1,ou=distribution,dc=corp,dc=com")
+	groups, err := revalidate()
+	c.Assert(err, IsNil)
+	c.Assert(groups, DeepEquals, []string{"dl1"})
+
+	// the next login gets the current groups as well
+	user, err = lm.AuthenticateUser("bob", "bobpass")
+	c.Assert(err, IsNil)
+	c.Assert(user.Groups, DeepEquals, []string{"dl1"})
+
+	// a user who has left all its groups is still valid but can't log in
+	directory.set("cn=Bob,ou=users,dc=corp,dc=com", "memberOf")
+	groups, err = revalidate()
+	c.Assert(err, IsNil)
+	c.Assert(groups, DeepEquals, []string{})
+
+	_, err = lm.AuthenticateUser("bob", "bobpass")
+	c.Assert(err, Equals, auth_errors.ErrLDAPGroupsNotFound)
+
+	directory.set("cn=Bob,ou=users,dc=corp,dc=com", "userAccountControl", "514")
+	_, err = revalidate()
+	c.Assert(err, Equals, auth_errors.ErrLDAPAccountDisabled)
+
+	directory.set("cn=Bob,ou=users,dc=corp,dc=com", "userAccountControl", "512")
+	directory.set("cn=Bob,ou=users,dc=corp,dc=com", "pwdAccountLockedTime", "000001010000Z")
+	_, err = revalidate()
+	c.Assert(err, Equals, auth_errors.ErrLDAPAccountDisabled)
+
+	directory.set("cn=Bob,ou=users,dc=corp,dc=com", "pwdAccountLockedTime")
+	directory.set("cn=Bob,ou=users,dc=corp,dc=com", "sAMAccountName", "robert")
+	_, err = revalidate()
+	c.Assert(err, Equals, auth_errors.ErrUserNotFound)
+
+	// re-validation can be disabled
+	lm.Config.RevalidationInterval = -1
+	user, err = lm.Revalidate("robert")
+	c.Assert(err, IsNil)
+	c.Assert(user, IsNil)
+}
+
+// TestDomainSettings tests `MatchUsername(...)` and `ValidateDomainSettings(...)`
+func (s *ldapSuite) TestDomainSettings(c *C) {
+	cfg := &types.LdapConfiguration{
+		Name:             "emea",
+		Server:           "dc1.emea.example.com",
+		Port:             389,
+		Servers:          []types.LdapServer{{Server: "dc2.emea.example.com", Port: 636}},
+		UsernamePrefixes: []string{"EMEA\\"},
+		UsernameSuffixes: []string{"@emea.example.com"},
+	}
+	c.Assert(cfg.ValidateDomainSettings(), IsNil)
+	c.Assert(cfg.ServerList(), DeepEquals, []types.LdapServer{
+		{Server: "dc1.emea.example.com", Port: 389},
+		{Server: "dc2.emea.example.com", Port: 636},
+	})
+
+	matches := map[string]string{
+		"emea\\john":            "john",
+		"EMEA\\john":            "john",
+		"john@EMEA.example.com": "john",
+	}
+
+	for username, expected := range matches {
+		domainUsername, matched := cfg.MatchUsername(username)
+		c.Assert(matched, Equals, true)
+		c.Assert(domainUsername, Equals, expected)
+	}
+
+	for _, username := range []string{"john", "EMEA\\", "john@apac.example.com"} {
+		domainUsername, matched := cfg.MatchUsername(username)
+		c.Assert(matched, Equals, false)
+		c.Assert(domainUsername, Equals, username)
+	}
+
+	invalidConfigs := []types.LdapConfiguration{
+		{Name: "", Server: "dc1", Port: 389},
+		{Name: "a/b", Server: "dc1", Port: 389},
+		{Name: "emea", Port: 389},
+		{Name: "emea", Server: "dc1", Port: 389, Servers: []types.LdapServer{{Server: "dc2"}}},
+		{Name: "emea", Server: "dc1", Port: 389, Servers: []types.LdapServer{{Port: 389}}},
+		{Name: "emea", Server: "dc1", Port: 389, UsernameSuffixes: []string{""}},
+	}
+
+	for _, cfg := range invalidConfigs {
+		err := cfg.ValidateDomainSettings()
+		c.Assert(auth_errors.HasCode(err, auth_errors.IllegalArguments), Equals, true)
+	}
+}
+
+// testCA is a certificate authority issuing the certificates used by the tests
+type testCA struct {
+	certificate string // PEM encoded
+	template    *x509.Certificate
+	key         *ecdsa.PrivateKey
+}
+
+// newTestCA creates a self-signed certificate authority.
+func newTestCA(c *C) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "auth_proxy test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+
+	certificate := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return &testCA{certificate: certificate, template: template, key: key}
+}
+
+// issue issues a certificate for the given names and returns PEM encoded certificate and key.
+func (ca *testCA) issue(c *C, commonName string, dnsNames []string, ipAddresses []net.IP) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     dnsNames,
+		IPAddresses:  ipAddresses,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.template, &key.PublicKey, ca.key)
+	c.Assert(err, IsNil)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
+// serverTLSConfig returns the TLS configuration of a server using a certificate issued for the given names.
+func (ca *testCA) serverTLSConfig(c *C, dnsName string, ipAddresses []net.IP) *tls.Config {
+	certificate, key := ca.issue(c, dnsName, []string{dnsName}, ipAddresses)
+
+	serverCertificate, err := tls.X509KeyPair([]byte(certificate), []byte(key))
+	c.Assert(err, IsNil)
+
+	return &tls.Config{Certificates: []tls.Certificate{serverCertificate}}
+}
+
+// testEntry represents an entry of the stand-in directory
+type testEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+// testDirectory is a minimal in-process LDAP server which supports simple bind
+// and search requests; just enough to exercise the LDAP manager.
+type testDirectory struct {
+	listener  net.Listener
+	entries   []*testEntry
+	tlsConfig *tls.Config // used for StartTLS
+
+	mutex       sync.Mutex
+	filters     []string   // filters of the search requests received so far
+	connections []net.Conn // connections accepted so far
+}
+
+// newTestDirectory starts a stand-in directory serving the given entries on a random local port.
+func newTestDirectory(c *C, entries []*testEntry) *testDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	directory := &testDirectory{listener: listener, entries: entries}
+	go directory.serve()
+
+	return directory
+}
+
+// newTLSTestDirectory starts a stand-in directory which accepts TLS connections using the
+// given configuration; if `implicitTLS` is false, it accepts plain connections which can be
+// upgraded using StartTLS.
+func newTLSTestDirectory(c *C, entries []*testEntry, tlsConfig *tls.Config, implicitTLS bool) *testDirectory {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, IsNil)
+
+	directory := &testDirectory{listener: listener, entries: entries, tlsConfig: tlsConfig}
+	if implicitTLS {
+		directory.listener = tls.NewListener(listener, tlsConfig)
+		directory.tlsConfig = nil
+	}
+
+	go directory.serve()
+
+	return directory
+}
+
+// config returns a LDAP configuration pointing at the stand-in directory.
+func (d *testDirectory) config(baseDN, serviceAccountDN, serviceAccountPassword string) types.LdapConfiguration {
+	return types.LdapConfiguration{
+		Server:                 "127.0.0.1",
+		Port:                   uint16(d.listener.Addr().(*net.TCPAddr).Port),
+		BaseDN:                 baseDN,
+		ServiceAccountDN:       serviceAccountDN,
+		ServiceAccountPassword: serviceAccountPassword,
+	}
+}
+
+// set replaces the values of the given attribute of the given entry; the attribute is removed if no values are given.
+func (d *testDirectory) set(dn, attribute string, values ...string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	entry := d.find(dn)
+	if len(values) == 0 {
+		delete(entry.attributes, attribute)
+		return
+	}
+
+	entry.attributes[attribute] = values
+}
+
+// copyEntries returns a deep copy of the given entries so that a test can change them.
+func copyEntries(entries []*testEntry) []*testEntry {
+	result := []*testEntry{}
+	for _, entry := range entries {
+		attributes := map[string][]string{}
+		for name, values := range entry.attributes {
+			attributes[name] = append([]string{}, values...)
+		}
+
+		result = append(result, &testEntry{dn: entry.dn, password: entry.password, attributes: attributes})
+	}
+
+	return result
+}
+
+// searched checks whether a search request with the given filter was received.
+func (d *testDirectory) searched(filter string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, f := range d.filters {
+		if f == filter {
+			return true
+		}
+	}
+
+	return false
+}
+
+// searchCount returns the number of search requests received so far.
+func (d *testDirectory) searchCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.filters)
+}
+
+// connectionCount returns the number of connections accepted so far.
+func (d *testDirectory) connectionCount() int {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return len(d.connections)
+}
+
+// dropConnections closes all the connections accepted so far.
+func (d *testDirectory) dropConnections() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, conn := range d.connections {
+		conn.Close()
+	}
+}
+
+func (d *testDirectory) close() {
+	d.listener.Close()
+	d.dropConnections()
+}
+
+func (d *testDirectory) serve() {
+	for {
+		conn, err := d.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		d.mutex.Lock()
+		d.connections = append(d.connections, conn)
+		d.mutex.Unlock()
+
+		go d.handle(conn)
+	}
+}
+
+// handle processes the requests received on the given connection until it is closed or unbound.
+func (d *testDirectory) handle(conn net.Conn) {
+	defer func() { conn.Close() }()
+
+	boundDN := ""
+	for {
+		packet, err := ber.ReadPacket(conn)
+		if err != nil || len(packet.Children) < 2 {
+			return
+		}
+
+		messageID := packet.Children[0].Value.(int64)
+		request := packet.Children[1]
+
+		switch request.Tag {
+		case ldap.ApplicationBindRequest:
+			boundDN = ""
+			code := resultInvalidCredentials
+			if entry := d.find(request.Children[1].Value.(string)); entry != nil {
+				if password := request.Children[2].Data.String(); password != "" && password == entry.password {
+					boundDN = entry.dn
+					code = resultSuccess
+				}
+			}
+
+			d.reply(conn, messageID, ldapResult(ldap.ApplicationBindResponse, code))
+		case ldap.ApplicationSearchRequest:
+			if boundDN == "" {
+				d.reply(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, resultInsufficientAccessRight))
+				continue
+			}
+
+			filter, _ := ldap.DecompileFilter(request.Children[6])
+			d.mutex.Lock()
+			d.filters = append(d.filters, filter)
+			d.mutex.Unlock()
+
+			attributes := []string{}
+			for _, attribute := range request.Children[7].Children {
+				attributes = append(attributes, attribute.Value.(string))
+			}
+
+			baseDN, scope := request.Children[0].Value.(string), request.Children[1].Value.(int64)
+			for _, entry := range d.search(scope, baseDN, request.Children[6]) {
+				d.reply(conn, messageID, entry.encode(attributes))
+			}
+
+			d.reply(conn, messageID, ldapResult(ldap.ApplicationSearchResultDone, resultSuccess))
+		case ldap.ApplicationExtendedRequest:
+			if d.tlsConfig == nil || request.Children[0].Data.String() != startTLSOID {
+				d.reply(conn, messageID, ldapResult(ldap.ApplicationExtendedResponse, resultProtocolError))
+				continue
+			}
+
+			d.reply(conn, messageID, ldapResult(ldap.ApplicationExtendedResponse, resultSuccess))
+			conn = tls.Server(conn, d.tlsConfig)
+		default: // unbind or unsupported operation
+			return
+		}
+	}
+}
+
+// find returns the entry with the given DN or nil if there is none.
+func (d *testDirectory) find(dn string) *testEntry {
+	for _, entry := range d.entries {
+		if strings.EqualFold(entry.dn, dn) {
+			return entry
+		}
+	}
+
+	return nil
+}
+
+// search returns the entries in the given scope matching the given filter.
+func (d *testDirectory) search(scope int64, baseDN string, filter *ber.Packet) []*testEntry {
+	baseDN = strings.ToLower(baseDN)
+
+	result := []*testEntry{}
+	for _, entry := range d.entries {
+		dn := strings.ToLower(entry.dn)
+		inScope := dn == baseDN
+		if scope == ldap.ScopeWholeSubtree {
+			inScope = inScope || strings.HasSuffix(dn, ","+baseDN)
+		}
+
+		if inScope && d.matches(entry, filter) {
+			result = append(result, entry)
+		}
+	}
+
+	return result
+}
+
+// values returns the values of the given attribute of the entry.
+func (e *testEntry) values(attribute string) []string {
+	for name, values := range e.attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+
+	return nil
+}
+
+// matches evaluates the given filter (and, or, not, equality, substrings, presence and
+// LDAP_MATCHING_RULE_IN_CHAIN only) on the entry.
+func (d *testDirectory) matches(e *testEntry, filter *ber.Packet) bool {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if !d.matches(e, child) {
+				return false
+			}
+		}
+
+		return true
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if d.matches(e, child) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterNot:
+		return !d.matches(e, filter.Children[0])
+	case ldap.FilterEqualityMatch:
+		for _, value := range e.values(filter.Children[0].Value.(string)) {
+			if strings.EqualFold(value, filter.Children[1].Value.(string)) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterSubstrings:
+		for _, value := range e.values(filter.Children[0].Value.(string)) {
+			if matchesSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true
+			}
+		}
+
+		return false
+	case ldap.FilterPresent:
+		return len(e.values(filter.Data.String())) > 0
+	case ldap.FilterExtensibleMatch:
+		assertion := map[ber.Tag]string{}
+		for _, child := range filter.Children {
+			assertion[child.Tag] = child.Data.String()
+		}
+
+		// only LDAP_MATCHING_RULE_IN_CHAIN is supported
+		if assertion[ldap.MatchingRuleAssertionMatchingRule] != types.LdapMatchingRuleInChain {
+			return false
+		}
+
+		return d.inChain(e, assertion[ldap.MatchingRuleAssertionType], assertion[ldap.MatchingRuleAssertionMatchValue], map[string]bool{})
+	default:
+		return false
+	}
+}
+
+// inChain checks whether the given DN is a value of the attribute of the entry, or of the
+// entries referred by its values (recursively).
+func (d *testDirectory) inChain(e *testEntry, attribute, dn string, visited map[string]bool) bool {
+	visited[strings.ToLower(e.dn)] = true
+	for _, value := range e.values(attribute) {
+		if strings.EqualFold(value, dn) {
+			return true
+		}
+
+		if nested := d.find(value); nested != nil && !visited[strings.ToLower(nested.dn)] && d.inChain(nested, attribute, dn, visited) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchesSubstrings checks whether the given value matches the initial, any and final substrings.
+func matchesSubstrings(value string, substrings []*ber.Packet) bool {
+	for _, substring := range substrings {
+		s := strings.ToLower(substring.Data.String())
+		switch substring.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, s) {
+				return false
+			}
+
+			value = value[len(s):]
+		case ldap.FilterSubstringsAny:
+			index := strings.Index(value, s)
+			if index < 0 {
+				return false
+			}
+
+			value = value[index+len(s):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, s) {
+				return false
+			}
+
+			value = ""
+		}
+	}
+
+	return true
+}
+
+// encode returns the search result entry carrying the requested attributes.
+func (e *testEntry) encode(attributes []string) *ber.Packet {
+	packet := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Search Result Entry")
+	packet.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, e.dn, "Object Name"))
+
+	partialAttributes := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	for name, values := range e.attributes {
+		requested := len(attributes) == 0
+		for _, attribute := range attributes {
+			requested = requested || strings.EqualFold(attribute, name)
+		}
+
+		if !requested {
+			continue
+		}
+
+		partialAttribute := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		partialAttribute.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, name, "Type"))
+
+		set := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		for _, value := range values {
+			set.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, value, "Value"))
+		}
+
+		partialAttribute.AppendChild(set)
+		partialAttributes.AppendChild(partialAttribute)
+	}
+
+	packet.AppendChild(partialAttributes)
+	return packet
+}
+
+// reply sends the given protocol operation as a response to the message `messageID`.
+func (d *testDirectory) reply(conn net.Conn, messageID int64, operation *ber.Packet) {
+	packet := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	packet.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, messageID, "MessageID"))
+	packet.AppendChild(operation)
+
+	conn.Write(packet.Bytes())
+}
+
+// ldapResult returns a `LDAPResult` of the given application tag and result code.
+func ldapResult(tag ber.Tag, code int) *ber.Packet {
+	result := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "LDAP Result")
+	result.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "Result Code"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Matched DN"))
+	result.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "Diagnostic Message"))
+
+	return result
+}
@@ -0,0 +1,532 @@
+package ldap
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the pool of service account connections and the cache of user DNs
+// and group memberships of each LDAP configuration along with the time each user with an active
+// session was last re-validated. All of them are dropped when the configuration changes.
+
+const (
+	// idle connections are checked (by binding the service account again) before they are reused
+	poolCheckInterval = 30 * time.Second
+
+	// idle connections are closed after this time
+	poolIdleTimeout = 5 * time.Minute
+)
+
+// Metrics represents the usage of the connection pool and cache, and the latency of the
+// directory operations of a LDAP configuration since it was last changed.
+type Metrics struct {
+	Pool    PoolMetrics                `json:"pool"`
+	Cache   CacheMetrics               `json:"cache"`
+	Latency map[string]*LatencyMetrics `json:"latency"` // keyed by operation: connect, bind and search
+}
+
+// PoolMetrics represents the usage of the connection pool.
+type PoolMetrics struct {
+	Size      int    `json:"size"`      // maximum number of connections used at a time
+	Idle      int    `json:"idle"`      // connections waiting to be reused
+	InUse     int    `json:"in_use"`    // connections being used
+	Dials     uint64 `json:"dials"`     // connections established
+	Reuses    uint64 `json:"reuses"`    // idle connections reused
+	Discards  uint64 `json:"discards"`  // connections closed as they were broken, stale or not needed
+	Waits     uint64 `json:"waits"`     // requests which waited for a connection
+	Exhausted uint64 `json:"exhausted"` // requests which gave up waiting for a connection
+}
+
+// CacheMetrics represents the usage of the user DN and group membership cache.
+type CacheMetrics struct {
+	TTL     int    `json:"ttl"` // seconds; 0 if the cache is disabled
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// LatencyMetrics represents the latency of a directory operation.
+type LatencyMetrics struct {
+	Count     uint64  `json:"count"`
+	Errors    uint64  `json:"errors"`
+	AverageMs float64 `json:"average_ms"`
+	MaxMs     float64 `json:"max_ms"`
+
+	total time.Duration
+}
+
+// pooledConn is a connection of the pool; it tracks the state needed to decide whether it can be reused.
+type pooledConn struct {
+	conn     *ldap.Conn
+	pool     *connPool
+	bound    bool // bound as the service account
+	broken   bool // connection failed or timed out
+	reused   bool
+	lastUsed time.Time
+}
+
+// cacheEntry holds the DN, groups and attributes of an authenticated user.
+type cacheEntry struct {
+	user    *User
+	expires time.Time
+}
+
+// connPool is the pool of service account connections and the user cache of a LDAP configuration.
+type connPool struct {
+	fingerprint     string
+	serviceDN       string
+	servicePassword string
+	waitTimeout     time.Duration
+	cacheTTL        time.Duration
+	revalidation    time.Duration
+
+	slots chan struct{} // one per connection being used
+
+	mutex     sync.Mutex
+	closed    bool
+	idle      []*pooledConn
+	users     map[string]*cacheEntry
+	validated map[string]*cacheEntry // users re-validated recently; expires after `revalidation`
+	metrics   Metrics
+}
+
+// pools of all the configurations keyed by configuration name
+var pools = struct {
+	sync.Mutex
+	byName map[string]*connPool
+}{byName: map[string]*connPool{}}
+
+// configFingerprint returns a digest of the given configuration; any change in the configuration changes the digest.
+func configFingerprint(cfg *types.LdapConfiguration) string {
+	data, _ := json.Marshal(cfg)
+	digest := sha256.Sum256(data)
+	return string(digest[:])
+}
+
+// pool returns the pool of the configuration(receiver); see getPool.
+func (lm *Manager) pool() *connPool {
+	if lm.fingerprint == "" {
+		return getPool(&lm.Config)
+	}
+
+	return poolByFingerprint(&lm.Config, lm.fingerprint)
+}
+
+// getPool returns the pool of the given configuration; the existing pool is
+// dropped and a new one is created if the configuration has changed.
+func getPool(cfg *types.LdapConfiguration) *connPool {
+	return poolByFingerprint(cfg, configFingerprint(cfg))
+}
+
+// poolByFingerprint returns the pool of the given configuration whose digest is given; see getPool.
+func poolByFingerprint(cfg *types.LdapConfiguration, fingerprint string) *connPool {
+	pools.Lock()
+	defer pools.Unlock()
+
+	if pool, found := pools.byName[cfg.Name]; found {
+		if pool.fingerprint == fingerprint {
+			return pool
+		}
+
+		log.Infof("LDAP configuration %q has changed; dropping its connections and cache", cfg.Name)
+		pool.shutdown()
+	}
+
+	size := types.DefaultLdapPoolSize
+	if cfg.PoolSize > 0 {
+		size = cfg.PoolSize
+	}
+
+	cacheTTL := time.Duration(types.DefaultLdapCacheTTL) * time.Second
+	if cfg.CacheTTL != 0 {
+		cacheTTL = time.Duration(cfg.CacheTTL) * time.Second
+	}
+
+	revalidation := time.Duration(types.DefaultLdapRevalidationInterval) * time.Second
+	if cfg.RevalidationInterval != 0 {
+		revalidation = time.Duration(cfg.RevalidationInterval) * time.Second
+	}
+
+	waitTimeout := time.Duration(types.DefaultLdapConnectTimeout) * time.Second
+	if cfg.ConnectTimeout > 0 {
+		waitTimeout = time.Duration(cfg.ConnectTimeout) * time.Second
+	}
+
+	pool := &connPool{
+		fingerprint:     fingerprint,
+		serviceDN:       cfg.ServiceAccountDN,
+		servicePassword: cfg.ServiceAccountPassword,
+		waitTimeout:     waitTimeout,
+		cacheTTL:        cacheTTL,
+		revalidation:    revalidation,
+		slots:           make(chan struct{}, size),
+		users:           map[string]*cacheEntry{},
+		validated:       map[string]*cacheEntry{},
+		metrics:         Metrics{Latency: map[string]*LatencyMetrics{}},
+	}
+	pool.metrics.Pool.Size = size
+
+	pools.byName[cfg.Name] = pool
+	return pool
+}
+
+// Invalidate drops the connections and the cached users of the given configuration.
+// This is called when a configuration is added, updated or deleted.
+// params:
+//  name: name of the LDAP configuration
+func Invalidate(name string) {
+	invalidateConfigurations()
+
+	pools.Lock()
+	defer pools.Unlock()
+
+	if pool, found := pools.byName[name]; found {
+		pool.shutdown()
+		delete(pools.byName, name)
+	}
+}
+
+// GetMetrics returns the metrics of the given configuration as seen by this process.
+// params:
+//  name: name of the LDAP configuration
+// return values:
+//  Metrics: usage of the connection pool and cache, and the directory latency;
+//           all zeros if the configuration wasn't used since it was last changed
+func GetMetrics(name string) Metrics {
+	pools.Lock()
+	pool, found := pools.byName[name]
+	pools.Unlock()
+
+	if !found {
+		return Metrics{Latency: map[string]*LatencyMetrics{}}
+	}
+
+	pool.mutex.Lock()
+	defer pool.mutex.Unlock()
+
+	metrics := pool.metrics
+	metrics.Pool.Idle = len(pool.idle)
+	metrics.Pool.InUse = len(pool.slots)
+	metrics.Cache.Entries = len(pool.users)
+	if pool.cacheTTL > 0 {
+		metrics.Cache.TTL = int(pool.cacheTTL / time.Second)
+	}
+
+	metrics.Latency = map[string]*LatencyMetrics{}
+	for operation, latency := range pool.metrics.Latency {
+		l := *latency
+		metrics.Latency[operation] = &l
+	}
+
+	return metrics
+}
+
+// shutdown closes the idle connections and drops the cached users; connections in use are
+// closed when they are returned. pools lock must be held by the caller.
+func (p *connPool) shutdown() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.closed = true
+	for _, pc := range p.idle {
+		pc.conn.Close()
+	}
+
+	p.idle = nil
+	p.users = map[string]*cacheEntry{}
+	p.validated = map[string]*cacheEntry{}
+}
+
+// do runs the given function with a connection bound as the service account.
+// A reused connection which turns out to be broken is replaced by a new connection once.
+// params:
+//  lm: LDAP manager used to establish new connections
+//  fn: function to be run
+// return values:
+//  error: as returned by `get` or `fn`
+func (p *connPool) do(lm *Manager, fn func(*pooledConn) error) error {
+	for attempt := 0; ; attempt++ {
+		pc, err := p.get(lm)
+		if err != nil {
+			return err
+		}
+
+		err = fn(pc)
+		p.put(pc)
+
+		if err != nil && pc.broken && pc.reused && attempt == 0 {
+			log.Infof("Pooled LDAP connection is broken; retrying with a new connection")
+			continue
+		}
+
+		return err
+	}
+}
+
+// get returns an idle connection or establishes a new one; waits for one of the
+// connections in use to be returned if the pool is exhausted.
+func (p *connPool) get(lm *Manager) (*pooledConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		p.mutex.Lock()
+		p.metrics.Pool.Waits++
+		p.mutex.Unlock()
+
+		timer := time.NewTimer(p.waitTimeout)
+		defer timer.Stop()
+
+		select {
+		case p.slots <- struct{}{}:
+		case <-timer.C:
+			p.mutex.Lock()
+			p.metrics.Pool.Exhausted++
+			p.mutex.Unlock()
+
+			log.Errorf("No LDAP connection available after %v", p.waitTimeout)
+			return nil, auth_errors.NewError(auth_errors.LDAPConnectionFailed, "LDAP/AD connection failed, connection pool exhausted")
+		}
+	}
+
+	for pc := p.popIdle(); pc != nil; pc = p.popIdle() {
+		if time.Since(pc.lastUsed) < poolCheckInterval || pc.Bind(p.serviceDN, p.servicePassword) == nil {
+			p.mutex.Lock()
+			p.metrics.Pool.Reuses++
+			p.mutex.Unlock()
+
+			return pc, nil
+		}
+
+		log.Debugf("Discarding stale LDAP connection")
+		p.discard(pc)
+	}
+
+	start := time.Now()
+	conn, err := lm.connect()
+	p.observe("connect", start, err)
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+
+	p.mutex.Lock()
+	p.metrics.Pool.Dials++
+	p.mutex.Unlock()
+
+	// bind AD service account to perform search using the connection established above
+	pc := &pooledConn{conn: conn, pool: p}
+	if err := pc.Bind(p.serviceDN, p.servicePassword); err != nil {
+		log.Errorf("LDAP bind operation failed for AD service account %q: %v", p.serviceDN, err)
+		p.discard(pc)
+		<-p.slots
+		return nil, auth_errors.ErrLDAPAccessDenied
+	}
+
+	return pc, nil
+}
+
+// popIdle returns the most recently used idle connection or nil if there is none;
+// connections which were idle for too long are closed.
+func (p *connPool) popIdle() *pooledConn {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+
+		if time.Since(pc.lastUsed) < poolIdleTimeout {
+			return pc
+		}
+
+		pc.conn.Close()
+		p.metrics.Pool.Discards++
+	}
+
+	return nil
+}
+
+// put returns the given connection to the pool; connections which can't be reused are closed.
+func (p *connPool) put(pc *pooledConn) {
+	defer func() { <-p.slots }()
+
+	if !pc.broken && !pc.bound {
+		// e.g. the user bind failed; bind the service account again so that the connection can be reused
+		pc.Bind(p.serviceDN, p.servicePassword)
+	}
+
+	p.mutex.Lock()
+	reusable := !p.closed && !pc.broken && pc.bound && len(p.idle) < cap(p.slots)
+	if reusable {
+		pc.reused = true
+		pc.lastUsed = time.Now()
+		p.idle = append(p.idle, pc)
+	}
+	p.mutex.Unlock()
+
+	if !reusable {
+		p.discard(pc)
+	}
+}
+
+// discard closes the given connection.
+func (p *connPool) discard(pc *pooledConn) {
+	pc.conn.Close()
+
+	p.mutex.Lock()
+	p.metrics.Pool.Discards++
+	p.mutex.Unlock()
+}
+
+// observe records the latency of a directory operation.
+func (p *connPool) observe(operation string, start time.Time, err error) {
+	elapsed := time.Since(start)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	latency, found := p.metrics.Latency[operation]
+	if !found {
+		latency = &LatencyMetrics{}
+		p.metrics.Latency[operation] = latency
+	}
+
+	latency.Count++
+	if err != nil {
+		latency.Errors++
+	}
+
+	latency.total += elapsed
+	latency.AverageMs = float64(latency.total) / float64(latency.Count) / float64(time.Millisecond)
+	if ms := float64(elapsed) / float64(time.Millisecond); ms > latency.MaxMs {
+		latency.MaxMs = ms
+	}
+}
+
+// cachedUser returns the cache entry of the given user if there is one which hasn't expired.
+func (p *connPool) cachedUser(username string) (*cacheEntry, bool) {
+	if p.cacheTTL <= 0 {
+		return nil, false
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry, found := p.users[username]
+	if found && time.Now().Before(entry.expires) {
+		p.metrics.Cache.Hits++
+		return entry, true
+	}
+
+	delete(p.users, username)
+	p.metrics.Cache.Misses++
+	return nil, false
+}
+
+// cacheUser caches the DN, groups and attributes of the given user; expired entries are dropped on the way.
+func (p *connPool) cacheUser(username string, user *User) {
+	if p.cacheTTL <= 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	now := time.Now()
+	for name, entry := range p.users {
+		if now.After(entry.expires) {
+			delete(p.users, name)
+		}
+	}
+
+	p.users[username] = &cacheEntry{user: user, expires: now.Add(p.cacheTTL)}
+}
+
+// forgetUser drops the cache entry of the given user.
+func (p *connPool) forgetUser(username string) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	delete(p.users, username)
+}
+
+// validatedUser returns the outcome of the last re-validation of the given user if it is still current.
+func (p *connPool) validatedUser(username string) (*cacheEntry, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	entry, found := p.validated[username]
+	if found && time.Now().Before(entry.expires) {
+		return entry, true
+	}
+
+	delete(p.validated, username)
+	return nil, false
+}
+
+// markValidated records the DN, groups and attributes the given user was found with by a login or
+// re-validation; expired entries are dropped on the way.
+func (p *connPool) markValidated(username string, user *User) {
+	if p.revalidation <= 0 {
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.closed {
+		return
+	}
+
+	now := time.Now()
+	for name, entry := range p.validated {
+		if now.After(entry.expires) {
+			delete(p.validated, name)
+		}
+	}
+
+	p.validated[username] = &cacheEntry{user: user, expires: now.Add(p.revalidation)}
+}
+
+// Bind performs a bind with the given DN and password on the connection.
+func (pc *pooledConn) Bind(dn, password string) error {
+	start := time.Now()
+	err := pc.conn.Bind(dn, password)
+	pc.pool.observe("bind", start, err)
+
+	pc.bound = err == nil && dn == pc.pool.serviceDN
+	pc.broken = pc.broken || isConnectionError(err)
+	return err
+}
+
+// Search performs the given search request on the connection.
+func (pc *pooledConn) Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	start := time.Now()
+	searchRes, err := pc.conn.Search(searchRequest)
+	pc.pool.observe("search", start, err)
+
+	pc.broken = pc.broken || isConnectionError(err)
+	return searchRes, err
+}
+
+// isConnectionError checks whether the given error was caused by the connection rather than
+// the directory i.e. no LDAP result was received (network failure, timeout).
+func isConnectionError(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	ldapErr, ok := err.(*ldap.Error)
+	return !ok || ldapErr.ResultCode == ldap.ErrorNetwork
+}
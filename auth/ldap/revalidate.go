@@ -0,0 +1,238 @@
+package ldap
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
+	ldap "github.com/go-ldap/ldap"
+)
+
+// This file contains the re-validation of the LDAP users with active sessions; their groups are
+// resolved at login only, so the directory is checked again periodically while their tokens are used.
+
+// decrypted configurations are read from the data store again after this time even if this process
+// didn't change them (they might have been changed through another instance)
+const configurationsCacheTTL = 30 * time.Second
+
+// configurations caches the decrypted LDAP configurations used to re-validate the users on each request;
+// it is dropped by `Invalidate` when a configuration is changed.
+var configurations = struct {
+	sync.Mutex
+	loaded  time.Time
+	entries []*cachedConfiguration
+}{}
+
+// cachedConfiguration is a decrypted LDAP configuration along with its digest (see configFingerprint).
+type cachedConfiguration struct {
+	cfg         *types.LdapConfiguration
+	fingerprint string
+}
+
+const (
+	// userAccountControl flag of disabled Active Directory accounts
+	adAccountDisable = 0x2
+
+	// attributes telling whether an account is disabled (Active Directory) or locked (OpenLDAP ppolicy)
+	adUserAccountControl     = "userAccountControl"
+	ppolicyAccountLockedTime = "pwdAccountLockedTime"
+)
+
+// Revalidate resolves the directory status and groups of a user with an active session again using
+// the service account. The outcome is kept for `RevalidationInterval` seconds; a login counts as a
+// re-validation. The decrypted configurations are cached (see cachedConfigurations).
+// params:
+//  domain: name of the LDAP configuration the user was authenticated against; if it is empty
+//          (tokens issued before the domain was recorded), the configurations are tried in the
+//          same order as on login
+//  username: username the user logged in with
+// return values:
+//  *User: the user with its current groups and attributes; nil if re-validation is disabled
+//  error: ErrUserNotFound or ErrLDAPMultipleEntries if the user can no longer be identified,
+//         ErrLDAPAccountDisabled if the account is disabled or locked, ErrLDAPConfigurationNotFound
+//         if the configuration was removed, otherwise any relevant error (e.g. directory unreachable)
+func Revalidate(domain, username string) (*User, error) {
+	entries, err := cachedConfigurations()
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := map[*types.LdapConfiguration]string{}
+	cfgs := []*types.LdapConfiguration{}
+	for _, entry := range entries {
+		fingerprints[entry.cfg] = entry.fingerprint
+		cfgs = append(cfgs, entry.cfg)
+	}
+
+	lastErr := auth_errors.ErrLDAPConfigurationNotFound
+	for _, c := range domainCandidates(cfgs, username) {
+		if !common.IsEmpty(domain) && c.cfg.Name != domain {
+			continue
+		}
+
+		ldapManager := Manager{Config: *c.cfg, fingerprint: fingerprints[c.cfg]}
+		user, err := ldapManager.Revalidate(c.username)
+		if err == auth_errors.ErrUserNotFound && common.IsEmpty(domain) {
+			lastErr = err
+			continue
+		}
+
+		return user, err
+	}
+
+	return nil, lastErr
+}
+
+// cachedConfigurations returns the decrypted LDAP configurations in order; they are read from the
+// data store only if they aren't cached or the cache has expired. They must not be modified.
+// return values:
+//  []*cachedConfiguration: decrypted configurations along with their digests
+//  error: as returned by db.GetLdapConfigurations or the decryption
+func cachedConfigurations() ([]*cachedConfiguration, error) {
+	configurations.Lock()
+	defer configurations.Unlock()
+
+	if configurations.entries != nil && time.Since(configurations.loaded) < configurationsCacheTTL {
+		return configurations.entries, nil
+	}
+
+	cfgs, err := db.GetLdapConfigurations()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*cachedConfiguration{}
+	for _, cfg := range cfgs {
+		if err := decryptSecrets(cfg); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, &cachedConfiguration{cfg: cfg, fingerprint: configFingerprint(cfg)})
+	}
+
+	configurations.entries = entries
+	configurations.loaded = time.Now()
+	return entries, nil
+}
+
+// invalidateConfigurations drops the cached configurations; they are read again on the next re-validation.
+func invalidateConfigurations() {
+	configurations.Lock()
+	defer configurations.Unlock()
+
+	configurations.entries = nil
+}
+
+// Revalidate resolves the directory status and groups of the given user again using the service account;
+// the outcome of the last login or re-validation is used if it is younger than `RevalidationInterval`.
+// params:
+//  username: username of the user in the directory
+// return values:
+//  *User: the user with its current groups (possibly none) and attributes; nil if re-validation is disabled
+//  error: ErrUserNotFound, ErrLDAPMultipleEntries, ErrLDAPAccountDisabled or any relevant error
+func (lm *Manager) Revalidate(username string) (*User, error) {
+	cfg, err := lm.Config.WithSearchDefaults()
+	if err != nil {
+		return nil, err
+	}
+
+	pool := lm.pool()
+	if pool.revalidation <= 0 {
+		return nil, nil
+	}
+
+	if entry, found := pool.validatedUser(username); found {
+		return entry.user, nil
+	}
+
+	if !cfg.IsValidUsername(username) {
+		return nil, auth_errors.ErrUserNotFound
+	}
+
+	var user *User
+	err = pool.do(lm, func(ldapConn *pooledConn) (err error) {
+		user, err = revalidate(ldapConn, cfg, username)
+		return err
+	})
+
+	switch {
+	case err == nil:
+	case err == auth_errors.ErrUserNotFound || err == auth_errors.ErrLDAPMultipleEntries || err == auth_errors.ErrLDAPAccountDisabled:
+		// the next login must not be served from the cache either
+		pool.forgetUser(username)
+		return nil, err
+	default:
+		return nil, err
+	}
+
+	// logins are served with the current groups from now on; a user without groups can't log in,
+	// so the next login must resolve the groups again
+	if len(user.Groups) == 0 {
+		pool.forgetUser(username)
+	} else {
+		pool.cacheUser(username, user)
+	}
+	pool.markValidated(username, user)
+	return user, nil
+}
+
+// revalidate looks up the given user and resolves its groups without verifying any password;
+// unlike a login, a user without groups is not an error.
+// params:
+//  ldapConn: pooled connection bound as the service account
+//  cfg: LDAP configuration with the search settings populated
+//  username: username of the user in the directory
+// return values:
+//  *User: the user with its current groups and attributes
+//  error: ErrUserNotFound, ErrLDAPMultipleEntries, ErrLDAPAccountDisabled or any relevant error
+func revalidate(ldapConn *pooledConn, cfg *types.LdapConfiguration, username string) (*User, error) {
+	userEntry, err := searchUser(ldapConn, cfg, username, adUserAccountControl, ppolicyAccountLockedTime)
+	if err != nil {
+		return nil, err
+	}
+
+	if accountDisabled(userEntry) {
+		log.Warnf("Account of %q is disabled or locked", username)
+		return nil, auth_errors.ErrLDAPAccountDisabled
+	}
+
+	// a user who has left all its groups is still a valid user; its session just loses every group
+	groups, err := resolveGroups(ldapConn, cfg, userEntry)
+	switch {
+	case err == auth_errors.ErrLDAPGroupsNotFound:
+		groups = []string{}
+	case err != nil:
+		return nil, err
+	}
+
+	return &User{DN: userEntry.DN, Domain: cfg.Name, Groups: groups, Attributes: userAttributes(cfg, userEntry)}, nil
+}
+
+// IsUnavailable checks whether the given error was caused by the directory being unreachable
+// (connection failure, network error or timeout) rather than by the user or the configuration.
+// params:
+//  err: error returned by `Revalidate`
+// return values:
+//  true if the directory couldn't be reached else false
+func IsUnavailable(err error) bool {
+	if auth_errors.HasCode(err, auth_errors.LDAPConnectionFailed) {
+		return true
+	}
+
+	ldapErr, ok := err.(*ldap.Error)
+	return ok && ldapErr.ResultCode == ldap.ErrorNetwork
+}
+
+// accountDisabled checks whether the given user entry is disabled (Active Directory) or locked (OpenLDAP ppolicy).
+func accountDisabled(user *ldap.Entry) bool {
+	if flags, err := strconv.ParseInt(user.GetAttributeValue(adUserAccountControl), 10, 64); err == nil && flags&adAccountDisable != 0 {
+		return true
+	}
+
+	return !common.IsEmpty(user.GetAttributeValue(ppolicyAccountLockedTime))
+}
@@ -4,6 +4,7 @@ import (
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/db"
 )
 
@@ -12,8 +13,11 @@ import (
 //  username: username to authenticate
 //  password: password of the user
 // return values:
-//  []string containing the `PrincipalName`(username) on successful authentication else nil
-//  error: nil on successful authentication otherwise ErrLocalAuthenticationFailed
+//  []string containing the `PrincipalName`(username) followed by the principals of the user's
+//  local groups on successful authentication else nil
+//  error: nil on successful authentication otherwise ErrLocalAuthenticationFailed;
+//         ErrPasswordChangeRequired if the credentials are valid but the password
+//         has to be changed (flagged by the admin or expired as per the password policy)
 func Authenticate(username, password string) ([]string, error) {
 	user, err := db.GetLocalUser(username)
 	if err != nil {
@@ -34,6 +38,68 @@ func Authenticate(username, password string) ([]string, error) {
 		return nil, auth_errors.ErrAccessDenied
 	}
 
-	// user.Username is the PrincipalName for localuser
-	return []string{user.Username}, nil
+	// rehash the password if the stored hash uses an older algorithm or weaker parameters
+	if common.PasswordHashNeedsUpgrade(user.PasswordHash) {
+		upgradePasswordHash(user, password)
+	}
+
+	passwordPolicy, err := db.GetPasswordPolicy()
+	if err != nil {
+		return nil, err
+	}
+
+	if user.MustChangePassword || passwordPolicy.IsExpired(user.PasswordChangedAt) {
+		log.Debugf("Local user %q has to change the password", username)
+		return nil, auth_errors.ErrPasswordChangeRequired
+	}
+
+	return Principals(user.Username)
+}
+
+// Principals returns the principals of the given local user.
+// params:
+//  username: local username of the user
+// return values:
+//  []string: the username followed by the principals of the local groups the user belongs to
+//  error: as returned by db.GetLocalUserGroups
+func Principals(username string) ([]string, error) {
+	groups, err := db.GetLocalUserGroups(username)
+	if err != nil {
+		return nil, err
+	}
+
+	// username is the PrincipalName for localuser, followed by the principals of its groups
+	principals := []string{username}
+	for _, group := range groups {
+		principals = append(principals, types.LocalGroupPrincipal(group))
+	}
+
+	return principals, nil
+}
+
+// upgradePasswordHash rehashes the given password of the user using the configured algorithm and parameters.
+// The new hash is stored only if the password hash hasn't been changed since the user was read, e.g. by a
+// concurrent password change. Failures are only logged; the user can still login with the existing hash.
+// params:
+//  user: local user whose password hash needs an upgrade
+//  password: plaintext password of the user, already validated against the existing hash
+func upgradePasswordHash(user *types.LocalUser, password string) {
+	passwordHash, err := common.GenPasswordHash(password)
+	if err != nil {
+		log.Warnf("Failed to rehash password of local user %q: %#v", user.Username, err)
+		return
+	}
+
+	// this doesn't count as a password change
+	switch err := db.UpgradeLocalUserPasswordHash(user.Username, user.PasswordHash, passwordHash); err {
+	case nil:
+	case auth_errors.ErrKeyModified:
+		log.Debugf("Local user %q modified meanwhile, password hash not upgraded", user.Username)
+		return
+	default:
+		log.Warnf("Failed to store the rehashed password of local user %q: %#v", user.Username, err)
+		return
+	}
+
+	log.Debugf("Upgraded password hash of local user %q", user.Username)
 }
@@ -1,11 +1,14 @@
 package auth
 
 import (
+	"fmt"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	jwt "github.com/dgrijalva/jwt-go"
 
+	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/db"
@@ -75,9 +78,9 @@ func (authZ *Token) checkRolePolicy(desired types.RoleType) error {
 			continue
 		}
 
-		granted, err := types.Role(authz[0].ClaimValue)
-		if err != nil {
-			log.Debug("malformed authorization, error:", err)
+		granted, found := grantedRole(authz)
+		if !found {
+			log.Debug("no role claim in effect for principal ", p)
 			continue
 		}
 
@@ -98,21 +101,35 @@ func (authZ *Token) checkRolePolicy(desired types.RoleType) error {
 	return auth_errors.ErrUnauthorized
 }
 
+// DenyError reports the deny authorization which denied access to a tenant or a resource of it.
+type DenyError struct {
+	Authorization types.Authorization // the deny authorization in effect
+}
+
+// Error returns the description of the denial.
+func (e *DenyError) Error() string {
+	return fmt.Sprintf("access denied by authorization %s", e.Authorization.UUID)
+}
+
 //
 // checkTenantPolicy checks the authorization token for an explicit claim that
-// allows access to a tenant
+// allows access to a tenant, unless a deny authorization of any principal of
+// the token, or of the LDAP user itself, applies to the tenant or the resource.
 // TODO  add wildcard access to all tenants.
 //
 // Parameters:
 //  (Receiver): authorization token object
 //  tenant: tenant object for which to check policy
 //  desiredAccess: a role/capability that specifies desired level of access.
+//  resource: resource of the tenant to be accessed; empty for the tenant itself
 //
 // Return values:
 //  error: nil if policy check is successful, types.InternalError if claim
-//  statements are malformed, types.UnauthorizedError if unauthorized by policy.
+//  statements are malformed, *DenyError if denied by a deny authorization,
+//  types.UnauthorizedError if unauthorized by policy, ErrReadingFromStore if
+//  the authorizations can't be read.
 //
-func (authZ *Token) checkTenantPolicy(tenant types.Tenant, desiredAccess interface{}) error {
+func (authZ *Token) checkTenantPolicy(tenant types.Tenant, desiredAccess interface{}, resource types.Resource) error {
 
 	// convert the tenant object to a claim string
 	claimStr, err := GenerateClaimKey(tenant)
@@ -137,22 +154,56 @@ func (authZ *Token) checkTenantPolicy(tenant types.Tenant, desiredAccess interfa
 		return err
 	}
 
-	for _, p := range principals {
+	// Deny authorizations take precedence over the claims granting access, whichever
+	// principal they belong to; they are all looked up first. The principal of an
+	// LDAP user only carries deny authorizations.
+	userPrincipal := authZ.UserPrincipal()
+	lookups := principals
+	if !common.IsEmpty(userPrincipal) {
+		lookups = append(append([]string{}, principals...), userPrincipal)
+	}
+
+	now := time.Now()
+	principalsAuthz := map[string][]types.Authorization{}
+	for _, p := range lookups {
 		// Get tenant claim for the principal
 		authz, err := db.ListAuthorizationsByClaimAndPrincipal(claimStr, p)
-		// If not found, ignore error and move on to next principal
-		if err != nil || len(authz) == 0 {
+		// a deny authorization which can't be read must not grant access (fail closed)
+		if err != nil {
+			log.Errorf("failed to look up tenant claims of principal %q: %v", p, err)
+			return err
+		}
+
+		// If not found, move on to next principal
+		if len(authz) == 0 {
 			log.Debug("no tenant claim found for principal ", p)
 			continue
 		}
 
+		for _, a := range authz {
+			if a.IsActive(now) && a.Denies(resource) {
+				return &DenyError{Authorization: a}
+			}
+		}
+
+		if p == userPrincipal {
+			continue
+		}
+
+		principalsAuthz[p] = authz
+	}
+
+	for _, p := range principals {
+		authz, found := principalsAuthz[p]
+		if !found {
+			continue
+		}
+
 		// If this claim is present, value is the role assigned with
 		// the tenant.
-		role, err := types.Role(authz[0].ClaimValue)
-		if err != nil {
-			msg := "malformed claim statement, error:" + err.Error()
-			log.Error(msg)
-			// continue processing
+		role, found := grantedRole(authz)
+		if !found {
+			log.Debug("no tenant claim in effect for principal ", p)
 			continue
 		}
 
@@ -183,3 +234,45 @@ func (authZ *Token) checkTenantPolicy(tenant types.Tenant, desiredAccess interfa
 	log.Debug("access denied for claim:", claimStr)
 	return auth_errors.ErrUnauthorized
 }
+
+//
+// grantedRole returns the highest privilege role granted by the authorizations
+// in effect; the authorizations out of their validity period are ignored.
+//
+// Parameters:
+//  authz: authorizations of a principal for the same claim
+//
+// Return values:
+//  types.RoleType: highest privilege role granted
+//  bool: false if no authorization in effect grants a valid role
+//
+func grantedRole(authz []types.Authorization) (types.RoleType, bool) {
+	now := time.Now()
+
+	var granted types.RoleType
+	found := false
+	for i := range authz {
+		if !authz[i].IsActive(now) {
+			log.Debug("ignoring authorization out of its validity period ", authz[i].UUID)
+			continue
+		}
+
+		// deny authorizations grant nothing
+		if authz[i].Deny {
+			continue
+		}
+
+		role, err := types.Role(authz[i].ClaimValue)
+		if err != nil {
+			log.Error("malformed claim statement, error:", err)
+			continue
+		}
+
+		// lower values grant more privileges
+		if !found || role < granted {
+			granted, found = role, true
+		}
+	}
+
+	return granted, found
+}
@@ -0,0 +1,153 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	jwt "github.com/dgrijalva/jwt-go"
+
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// This file contains the down-scoping of tokens: a valid token is exchanged for a narrower one, e.g.
+// to be handed to a script, limited to a subset of tenants, a subset of HTTP methods and/or a shorter
+// lifetime. The restrictions only ever add up to the authorizations of the user; a scoped token can
+// be down-scoped further but never widened.
+
+const (
+	// This claim is only present in down-scoped tokens; it carries the tenants (`tenants` member)
+	// and the HTTP methods (`methods` member) the token is limited to, an absent member meaning
+	// no restriction
+	scopeClaimKey = "scope"
+
+	scopeTenantsKey = "tenants"
+	scopeMethodsKey = "methods"
+)
+
+// scopeMethods are the HTTP methods a token can be limited to
+var scopeMethods = map[string]bool{
+	http.MethodGet:    true,
+	http.MethodPost:   true,
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+//
+// DownscopeToken exchanges a valid token for a narrower one carrying the same
+// principals, limited to the given tenants, HTTP methods and lifetime.
+//
+// Parameters:
+//  authZ: token to be down-scoped
+//  tenants: tenants the new token is limited to; those of the token if empty
+//  methods: HTTP methods the new token is limited to; those of the token if empty
+//  lifetime: lifetime of the new token, capped by the expiration of the token;
+//    the expiration of the token is kept if zero
+//
+// Return values:
+//  string: the down-scoped token
+//  error: nil if successful, else
+//    auth_errors.ErrIllegalArguments: if no restriction is given, a method is
+//      not supported, the lifetime is negative or the restrictions would widen
+//      those of the token
+//    as returned by Stringify
+//
+func DownscopeToken(authZ *Token, tenants, methods []string, lifetime time.Duration) (string, error) {
+	defer common.Untrace(common.Trace())
+
+	if (len(tenants) == 0 && len(methods) == 0 && lifetime == 0) || lifetime < 0 {
+		return "", auth_errors.ErrIllegalArguments
+	}
+
+	for i, method := range methods {
+		methods[i] = strings.ToUpper(method)
+		if !scopeMethods[methods[i]] {
+			return "", auth_errors.ErrIllegalArguments
+		}
+	}
+
+	for _, tenant := range tenants {
+		if common.IsEmpty(tenant) {
+			return "", auth_errors.ErrIllegalArguments
+		}
+	}
+
+	tenants, ok := narrowScope(authZ.ScopedTenants(), tenants)
+	if !ok {
+		return "", auth_errors.ErrIllegalArguments
+	}
+
+	methods, ok = narrowScope(authZ.ScopedMethods(), methods)
+	if !ok {
+		return "", auth_errors.ErrIllegalArguments
+	}
+
+	// the new token carries the claims of the token (principals, session, impersonation, etc.) so
+	// that it is revoked and re-validated along with it
+	scoped := &Token{tkn: jwt.New(jwt.SigningMethodHS256)}
+	for key, value := range authZ.tkn.Claims.(jwt.MapClaims) {
+		scoped.AddClaim(key, value)
+	}
+
+	expiresAt := authZ.ExpiresAt()
+	if lifetime > 0 {
+		if exp := time.Now().Add(lifetime).Unix(); exp < expiresAt {
+			expiresAt = exp
+		}
+	}
+
+	scope := map[string]interface{}{}
+	if tenants != nil {
+		scope[scopeTenantsKey] = tenants
+	}
+
+	if methods != nil {
+		scope[scopeMethodsKey] = methods
+	}
+
+	scoped.AddClaim("exp", expiresAt)
+	scoped.AddClaim(scopeClaimKey, scope)
+
+	audit.Record("token_downscoped", audit.Fields{
+		"username":   authZ.Username(),
+		"actor":      authZ.Actor(),
+		"tenants":    tenants,
+		"methods":    methods,
+		"expires_at": expiresAt,
+	})
+
+	log.Debugf("Token of %q down-scoped to tenants %v, methods %v until %d", authZ.Username(), tenants, methods, expiresAt)
+	return scoped.Stringify()
+}
+
+// narrowScope returns the restriction of a down-scoped token on one dimension (tenants or methods).
+// params:
+//  current: current restriction of the token; nil if there is none
+//  requested: requested restriction; the current one is kept if empty
+// return values:
+//  []string: the restriction of the down-scoped token; nil if there is none
+//  bool: false if the requested restriction is wider than the current one
+func narrowScope(current, requested []string) ([]string, bool) {
+	if len(requested) == 0 {
+		return current, true
+	}
+
+	if current != nil {
+		allowed := map[string]bool{}
+		for _, c := range current {
+			allowed[c] = true
+		}
+
+		for _, r := range requested {
+			if !allowed[r] {
+				return nil, false
+			}
+		}
+	}
+
+	return requested, true
+}
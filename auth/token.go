@@ -8,6 +8,9 @@ import (
 	log "github.com/Sirupsen/logrus"
 	jwt "github.com/dgrijalva/jwt-go"
 
+	"github.com/contiv/auth_proxy/auth/ldap"
+	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/db"
@@ -25,6 +28,28 @@ const (
 
 	// This claim is only added to the token, and is not part of authorization db
 	principalsClaimKey = "principals"
+
+	// This claim is only present in tokens issued to local users who have to
+	// change their password before they can do anything else
+	mustChangePasswordClaimKey = "must_change_password"
+
+	// These claims are only present in tokens issued to local users; session
+	// carries the session generation of the user at the time of issuance
+	localUserClaimKey = "local"
+	sessionClaimKey   = "session"
+
+	// This claim carries the user attributes (e.g. display name, email) obtained
+	// from the directory or the local user record; it's omitted if there are none
+	attributesClaimKey = "attributes"
+
+	// This claim is only present in tokens issued to LDAP users; it carries the name
+	// of the LDAP configuration the user was authenticated against
+	domainClaimKey = "domain"
+
+	// This claim is only present in tokens issued to LDAP users; it carries the principal
+	// of the user itself (see types.LdapUserPrincipal), which deny authorizations are
+	// matched against along with the principals of its groups
+	userPrincipalClaimKey = "user_principal"
 )
 
 // Token represents the JSON Web Token which carries the authorization details
@@ -78,8 +103,8 @@ func NewTokenWithClaims(principals []string) (*Token, error) {
 // key="principals" to the token.
 //
 // Value of this claim is used to find authorization claims of associated principals at runtime.
-// If this list changes (e.g., if user's ldap group membership changes), user needs to re-authenticate
-// to get updated access.
+// Groups a LDAP user has left are dropped from this list when the user is re-validated (see revalidate);
+// groups the user has joined since require the user to re-authenticate to get updated access.
 //
 // params:
 //  principals: security principals associated with a user
@@ -123,9 +148,9 @@ func (authZ *Token) AddRoleClaim(principal string) error {
 		return nil
 
 	default:
-		grantedRole, err := types.Role(authz[0].ClaimValue)
-		// Invalid claim in authorizations db, skip over
-		if err != nil {
+		grantedRole, found := grantedRole(authz)
+		// No valid claim in effect in authorizations db, skip over
+		if !found {
 			return nil
 		}
 
@@ -156,6 +181,35 @@ func (authZ *Token) AddRoleClaim(principal string) error {
 	return nil
 }
 
+// AddLocalUserClaims marks the token as issued to the given local user and
+// adds the user's current session generation to it. Once the session generation
+// of the user changes (e.g. on password change), the token is no longer accepted.
+// params:
+//  username: of the local user the token is issued to
+// return values:
+//  error: nil if successful, else as returned by db.GetLocalUser
+func (authZ *Token) AddLocalUserClaims(username string) error {
+	user, err := db.GetLocalUser(username)
+	if err != nil {
+		return err
+	}
+
+	authZ.AddClaim(localUserClaimKey, true)
+	authZ.AddClaim(sessionClaimKey, user.SessionGeneration)
+	return nil
+}
+
+// AddAttributesClaim adds the given user attributes to the token.
+// params:
+//  attributes: user attributes keyed by their claim name; nothing is added if empty
+func (authZ *Token) AddAttributesClaim(attributes map[string]string) {
+	if len(attributes) == 0 {
+		return
+	}
+
+	authZ.AddClaim(attributesClaimKey, attributes)
+}
+
 // AddClaim adds a claim to an existing authorization token object. A claim is
 // a key value pair, where key is a string which encodes the object, such as a
 // role, tenant, etc. Since Add is called on a map, it also serves to update the claim.
@@ -237,7 +291,23 @@ func ParseToken(tokenStr string) (*Token, error) {
 			return nil, fmt.Errorf("Invalid token: %#v", err)
 		}
 
-		return &Token{tkn: token}, nil
+		authZ := &Token{tkn: token}
+		revoked, err := authZ.isRevoked()
+		if err != nil {
+			log.Errorf("Error checking token revocation %#v", err)
+			return nil, fmt.Errorf("Error checking token revocation %#v", err)
+		}
+
+		if revoked {
+			log.Warnf("Revoked token for user %q", authZ.Username())
+			return nil, fmt.Errorf("Revoked token")
+		}
+
+		if err := authZ.revalidate(); err != nil {
+			return nil, err
+		}
+
+		return authZ, nil
 
 	case *jwt.ValidationError: // something was wrong during the validation
 		log.Errorf("Error validating access token %#v", err)
@@ -249,6 +319,362 @@ func ParseToken(tokenStr string) (*Token, error) {
 	}
 }
 
+// isRevoked checks if the token was issued to a local user whose sessions have been revoked since,
+// or who has been deleted since, or granted by the break-glass access which has been re-armed since.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  bool: true if the token has been revoked else false
+//  error: nil if the check could be performed, else as returned by db.GetLocalUser or db.GetBreakGlass
+func (authZ *Token) isRevoked() (bool, error) {
+	if generation, ok := authZ.tkn.Claims.(jwt.MapClaims)[breakGlassClaimKey].(float64); ok {
+		breakGlass, err := db.GetBreakGlass()
+		if err == auth_errors.ErrKeyNotFound {
+			return true, nil
+		} else if err != nil {
+			return false, err
+		}
+
+		return int(generation) != breakGlass.Generation, nil
+	}
+
+	if !authZ.IsLocalUser() {
+		return false, nil
+	}
+
+	user, err := db.GetLocalUser(authZ.Username())
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			// the user has been deleted
+			return true, nil
+		}
+
+		return false, err
+	}
+
+	// JSON numbers are decoded as float64
+	session, ok := authZ.tkn.Claims.(jwt.MapClaims)[sessionClaimKey].(float64)
+	return !ok || int(session) != user.SessionGeneration, nil
+}
+
+// revalidate checks the directory status and groups of the LDAP user the token was issued to (see
+// ldap.Revalidate); local users and restricted tokens are left alone. The groups the user is no longer
+// a member of are dropped from the principals, which downgrades the access granted by the token.
+// The token is still accepted if the directory can't be reached.
+// params:
+// (Receiver): authorization token object; its principals and role claims are updated
+// return values:
+//  error: nil if the token can be used, else an error telling why the session is revoked
+func (authZ *Token) revalidate() error {
+	if authZ.IsLocalUser() || authZ.MustChangePassword() || authZ.IsBreakGlass() || authZ.IsImpersonation() {
+		return nil
+	}
+
+	username := authZ.Username()
+	user, err := ldap.Revalidate(authZ.Domain(), username)
+	switch err {
+	case nil:
+	case auth_errors.ErrUserNotFound, auth_errors.ErrLDAPMultipleEntries,
+		auth_errors.ErrLDAPAccountDisabled, auth_errors.ErrLDAPConfigurationNotFound:
+		audit.Warn("session_revoked", audit.Fields{"username": username, "domain": authZ.Domain(), "reason": err.Error()})
+		return fmt.Errorf("Revoked token: %v", err)
+	default:
+		// only an unreachable directory keeps the session (fail open); anything else fails the request
+		if ldap.IsUnavailable(err) {
+			log.Warnf("Failed to re-validate LDAP user %q; keeping the session: %v", username, err)
+			return nil
+		}
+
+		log.Errorf("Failed to re-validate LDAP user %q: %v", username, err)
+		return fmt.Errorf("Failed to re-validate token: %v", err)
+	}
+
+	if user == nil { // re-validation is disabled
+		return nil
+	}
+
+	member := map[string]bool{}
+	for _, group := range user.Groups {
+		member[group] = true
+	}
+
+	principals := []string{}
+	removed := []string{}
+	for _, principal := range authZ.Principals() {
+		if member[principal] {
+			principals = append(principals, principal)
+		} else {
+			removed = append(removed, principal)
+		}
+	}
+
+	if len(removed) == 0 {
+		return nil
+	}
+
+	audit.Warn("session_downgraded", audit.Fields{"username": username, "domain": authZ.Domain(), "removed_principals": removed})
+
+	authZ.AddPrincipalsClaim(principals)
+	delete(authZ.tkn.Claims.(jwt.MapClaims), types.RoleClaimKey)
+	for _, principal := range principals {
+		authZ.AddRoleClaim(principal)
+	}
+
+	return nil
+}
+
+// IsLocalUser checks if the token was issued to a local user.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  true if the token belongs to a local user else false (LDAP user)
+func (authZ *Token) IsLocalUser() bool {
+	local, ok := authZ.tkn.Claims.(jwt.MapClaims)[localUserClaimKey].(bool)
+	return ok && local
+}
+
+// IsBreakGlass checks if the token was granted by the break-glass access.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  true if the token was granted by the break-glass access else false
+func (authZ *Token) IsBreakGlass() bool {
+	_, ok := authZ.tkn.Claims.(jwt.MapClaims)[breakGlassClaimKey]
+	return ok
+}
+
+// IsImpersonation checks if the token was issued to an admin impersonating a user.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  true if the token is an impersonation token else false
+func (authZ *Token) IsImpersonation() bool {
+	_, ok := authZ.tkn.Claims.(jwt.MapClaims)[actClaimKey]
+	return ok
+}
+
+// Actor returns the username of the admin impersonating the user of the token.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  string: `sub` member of the act claim; "" if the token is not an impersonation token
+func (authZ *Token) Actor() string {
+	var actor interface{}
+	switch act := authZ.tkn.Claims.(jwt.MapClaims)[actClaimKey].(type) {
+	case map[string]interface{}:
+		actor = act["sub"]
+	}
+
+	sub, _ := actor.(string)
+	return sub
+}
+
+// IsScoped checks if the token was down-scoped to a subset of tenants and/or HTTP methods.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  true if the token is a down-scoped token else false
+func (authZ *Token) IsScoped() bool {
+	_, ok := authZ.tkn.Claims.(jwt.MapClaims)[scopeClaimKey]
+	return ok
+}
+
+// ScopedTenants returns the tenants a down-scoped token is limited to.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  []string: tenants of the scope claim; nil if the token is not limited to some tenants
+func (authZ *Token) ScopedTenants() []string {
+	return authZ.scope(scopeTenantsKey)
+}
+
+// ScopedMethods returns the HTTP methods a down-scoped token is limited to.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  []string: methods of the scope claim; nil if the token is not limited to some methods
+func (authZ *Token) ScopedMethods() []string {
+	return authZ.scope(scopeMethodsKey)
+}
+
+// AllowsMethod checks if the scope of the token allows the given HTTP method.
+// params:
+// (Receiver): authorization token object
+//  method: HTTP method of the request
+// return values:
+//  true if the token is not limited to some methods or the method is one of them else false
+func (authZ *Token) AllowsMethod(method string) bool {
+	methods := authZ.ScopedMethods()
+	if methods == nil {
+		return true
+	}
+
+	for _, m := range methods {
+		if m == method {
+			return true
+		}
+	}
+
+	return false
+}
+
+// allowsTenant checks if the scope of the token allows the given tenant.
+func (authZ *Token) allowsTenant(tenant types.Tenant) bool {
+	tenants := authZ.ScopedTenants()
+	if tenants == nil {
+		return true
+	}
+
+	for _, t := range tenants {
+		if t == string(tenant) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scope returns a member of the scope claim; nil if it's not present.
+func (authZ *Token) scope(key string) []string {
+	scope, _ := authZ.tkn.Claims.(jwt.MapClaims)[scopeClaimKey].(map[string]interface{})
+
+	switch values := scope[key].(type) {
+	case []string:
+		return values
+	case []interface{}:
+		result := []string{}
+		for _, v := range values {
+			if s, ok := v.(string); ok {
+				result = append(result, s)
+			}
+		}
+
+		return result
+	}
+
+	return nil
+}
+
+// Username returns the name of the user the token was issued to.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  string: username claim of the token; "" if it's not present
+func (authZ *Token) Username() string {
+	username, _ := authZ.tkn.Claims.(jwt.MapClaims)["username"].(string)
+	return username
+}
+
+// Attributes returns the user attributes carried by the token.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  map[string]string: user attributes keyed by their claim name; empty if there are none
+func (authZ *Token) Attributes() map[string]string {
+	attributes := map[string]string{}
+
+	// parsed tokens carry the claim as a generic map
+	switch v := authZ.tkn.Claims.(jwt.MapClaims)[attributesClaimKey].(type) {
+	case map[string]string:
+		for name, value := range v {
+			attributes[name] = value
+		}
+	case map[string]interface{}:
+		for name, value := range v {
+			if s, ok := value.(string); ok {
+				attributes[name] = s
+			}
+		}
+	}
+
+	return attributes
+}
+
+// Domain returns the name of the LDAP configuration the user of the token was authenticated against.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  string: domain claim of the token; "" for local users and tokens issued before it was recorded
+func (authZ *Token) Domain() string {
+	domain, _ := authZ.tkn.Claims.(jwt.MapClaims)[domainClaimKey].(string)
+	return domain
+}
+
+// AddUserPrincipalClaim adds the principal of the LDAP user with the given DN to the token.
+// params:
+// (Receiver): authorization token object
+//  dn: distinguished name of the LDAP user
+func (authZ *Token) AddUserPrincipalClaim(dn string) {
+	authZ.AddClaim(userPrincipalClaimKey, types.LdapUserPrincipal(dn))
+}
+
+// UserPrincipal returns the principal of the LDAP user the token was issued to.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  string: user principal claim of the token; "" for local users and tokens issued before it was recorded
+func (authZ *Token) UserPrincipal() string {
+	principal, _ := authZ.tkn.Claims.(jwt.MapClaims)[userPrincipalClaimKey].(string)
+	return principal
+}
+
+// Principals returns the principals the token was issued with.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  []string: principals claim of the token; empty if it's not present
+func (authZ *Token) Principals() []string {
+	principalsStr, _ := authZ.tkn.Claims.(jwt.MapClaims)[principalsClaimKey].(string)
+	if common.IsEmpty(principalsStr) {
+		return []string{}
+	}
+
+	return strings.Split(principalsStr, ",")
+}
+
+// Role returns the role granted by the token.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  string: role claim of the token; "" if it's not present
+func (authZ *Token) Role() string {
+	role, _ := authZ.tkn.Claims.(jwt.MapClaims)[types.RoleClaimKey].(string)
+	return role
+}
+
+// ExpiresAt returns the expiration time of the token.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  int64: `exp` claim of the token as unix timestamp; 0 if it's not present
+func (authZ *Token) ExpiresAt() int64 {
+	switch exp := authZ.tkn.Claims.(jwt.MapClaims)["exp"].(type) {
+	case int64:
+		return exp
+	case float64:
+		return int64(exp)
+	}
+
+	return 0
+}
+
+// MustChangePassword checks if the token was issued to a user who has to change the password.
+// Such a token carries no principals and must not be accepted by any endpoint other than
+// the one used to change the password.
+// params:
+// (Receiver): authorization token object
+// return values:
+//  true if the token is restricted to changing the password else false
+func (authZ *Token) MustChangePassword() bool {
+	v, found := authZ.tkn.Claims.(jwt.MapClaims)[mustChangePasswordClaimKey]
+	if !found {
+		return false
+	}
+
+	mustChange, ok := v.(bool)
+	return ok && mustChange
+}
+
 // IsSuperuser checks if the token belongs to a superuser (i.e. `admin` in our
 // system). It queries the authorization database to obtain this information.
 // params:
@@ -281,10 +707,10 @@ func (authZ *Token) IsSuperuser() bool {
 			continue
 		}
 
-		// If not a valid role, ignore error and move on to next principal
-		r, err := types.Role(authz[0].ClaimValue)
-		if err != nil {
-			log.Error("invalid role claim found for principal ", p)
+		// If no valid role in effect, move on to next principal
+		r, found := grantedRole(authz)
+		if !found {
+			log.Debug("no role claim in effect for principal ", p)
 			continue
 		}
 
@@ -303,15 +729,19 @@ func (authZ *Token) IsSuperuser() bool {
 //
 // CheckClaims checks for specific claims in an authorization token object.
 // These claims are evaluated based on object type, such as for a tenant or
-// for a role, and an associated policy.
+// for a role, and an associated policy. Down-scoped tokens are also limited
+// to the tenants of their scope.
 //
 // Parameters:
 //  (Receiver): authorization token object that should be carrying appropriate claims.
 //  objects: claim targets. These can be specific objects, such as tenants or networks
-//    or specific types, such as a role.
+//    or specific types, such as a role. A tenant is followed by the desired access
+//    and optionally by the types.Resource of the tenant to be accessed, which deny
+//    authorizations limited to a resource are checked against.
 //
 // Return values:
 //  error: nil if successful, else
+//    *DenyError: if a deny authorization denies access to a tenant or resource
 //    errors.ErrUnauthorized: if authorization claim for a particular object is not
 //    present, or if claims for a particular object type are not supported.
 //
@@ -333,7 +763,29 @@ func (authZ *Token) CheckClaims(objects ...interface{}) error {
 		case types.Tenant:
 			tenant := v.(types.Tenant)
 			i++
-			if err := authZ.checkTenantPolicy(tenant, objects[i]); err != nil {
+			desiredAccess := objects[i]
+
+			resource := types.Resource{}
+			if i+1 < len(objects) {
+				if r, ok := objects[i+1].(types.Resource); ok {
+					resource = r
+					i++
+				}
+			}
+
+			// a down-scoped token only reaches the tenants of its scope, whatever the authorizations
+			if !authZ.allowsTenant(tenant) {
+				log.Debug("tenant ", tenant, " is out of the scope of the token")
+				return auth_errors.ErrUnauthorized
+			}
+
+			// admins reach every tenant; only down-scoped admin tokens get here, the others
+			// are not subject to tenant checks
+			if authZ.IsScoped() && authZ.checkRolePolicy(types.Admin) == nil {
+				continue
+			}
+
+			if err := authZ.checkTenantPolicy(tenant, desiredAccess, resource); err != nil {
 				return err
 			}
 
@@ -0,0 +1,86 @@
+package audit
+
+import (
+	"os"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// This package records security relevant events (password changes, etc.)
+// in the audit trail. The audit trail is kept apart from the regular logs
+// so that it can be shipped and retained separately.
+
+// Fields represents the details of an audit event
+type Fields log.Fields
+
+var (
+	mutex  sync.Mutex
+	logger = newLogger()
+)
+
+// newLogger returns the logger used for the audit trail; by default, events are written to stderr.
+func newLogger() *log.Logger {
+	l := log.New()
+	l.Out = os.Stderr
+	l.Formatter = &log.JSONFormatter{}
+	l.Level = log.InfoLevel
+
+	return l
+}
+
+// SetOutputFile makes the audit trail go to the given file; events are appended to the existing content.
+// params:
+//  path: of the audit log file
+// return values:
+//  error: nil on success otherwise as returned by os.OpenFile
+func SetOutputFile(path string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger.Out = f
+	return nil
+}
+
+// Record records the given event in the audit trail.
+// params:
+//  event: name of the event; e.g. `password_changed`
+//  fields: details of the event; e.g. username
+func Record(event string, fields Fields) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger.WithFields(log.Fields(fields)).WithField("event", event).Info("audit")
+}
+
+// Warn records the given event in the audit trail with warning level;
+// this is meant for events that need attention, e.g. failed attempts.
+// params:
+//  event: name of the event
+//  fields: details of the event
+func Warn(event string, fields Fields) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger.WithFields(log.Fields(fields)).WithField("event", event).Warn("audit")
+}
+
+// Alert records the given event in the audit trail with error level and
+// repeats it in the regular logs; this is meant for events that must be
+// looked into right away, e.g. use of the break-glass access.
+// params:
+//  event: name of the event
+//  fields: details of the event
+func Alert(event string, fields Fields) {
+	log.WithFields(log.Fields(fields)).Errorf("SECURITY ALERT: %s", event)
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	logger.WithFields(log.Fields(fields)).WithField("event", event).Error("audit")
+}
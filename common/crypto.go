@@ -1,6 +1,8 @@
 package common
 
 import (
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
@@ -9,6 +11,7 @@ import (
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
+	"strings"
 
 	"golang.org/x/crypto/bcrypt"
 
@@ -22,16 +25,31 @@ const (
 	//   - strong enough that it won't be considered weak any time soon
 	//   - doesn't take an egregious amount of time to generate hashes
 	cost = 13
+
+	// separates the encrypted key and the ciphertext in `EncryptEnvelope` output;
+	// not part of the base64 alphabet
+	envelopeSeparator = "."
 )
 
-// GenPasswordHash generates a hash from the provided password.
+// GenPasswordHash generates a hash from the provided password using the
+// configured algorithm and parameters (see SetPasswordHashParams).
 // params:
 //  password: plaintext password string
 // return values:
-//  []byte: hash of password
+//  []byte: hash of password, prefixed with its format
 //  error: nil if successful, otherwise the error from bcrypt.GenerateFromPassword()
+//         or from generating the argon2id salt
 func GenPasswordHash(password string) ([]byte, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), cost)
+	params := getPasswordHashParams()
+
+	var hash []byte
+	var err error
+	if params.Algorithm == Argon2idAlgorithm {
+		hash, err = genArgon2idHash(password, params)
+	} else {
+		hash, err = bcrypt.GenerateFromPassword([]byte(password), params.BcryptCost)
+	}
+
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -41,17 +59,36 @@ func GenPasswordHash(password string) ([]byte, error) {
 }
 
 // ValidatePassword returns true if the supplied password's hash matches
-// the correct password's hash, false otherwise.
+// the correct password's hash, false otherwise. The algorithm is determined
+// from the format of the given hash.
 // params:
 //  password: plaintext password from the user
 //  passwordHash: hash to compare the password against
 // return values:
 //  bool: true if the password matches the hash, otherwise false
 func ValidatePassword(password string, passwordHash []byte) bool {
+	if isArgon2idHash(passwordHash) {
+		return validateArgon2idHash(password, passwordHash)
+	}
+
 	// nil result means the password matched the hash
 	return nil == bcrypt.CompareHashAndPassword(passwordHash, []byte(password))
 }
 
+// GenRandomPassword generates a random password which is hard to guess.
+// return values:
+//  string: random password; 32 characters long
+//  error: nil if successful, otherwise the error from rand.Read()
+func GenRandomPassword() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
 // Encrypt encrypts the given string with the RSA public key.
 // params:
 //   data: String to be encrypted + encoded
@@ -117,6 +154,102 @@ func Decrypt(data string) (string, error) {
 
 }
 
+// EncryptEnvelope encrypts the given string which could be larger than what
+// RSA can encrypt directly (e.g. PEM encoded private keys). The data is encrypted
+// with a random AES-256-GCM key which is in turn encrypted using `Encrypt`.
+// params:
+//   data: String to be encrypted + encoded
+// return values:
+//  string: <encrypted key>.<nonce + ciphertext>, both base64 encoded
+//  error: nil if the encryption succeeds, else the appropriate failure
+func EncryptEnvelope(data string) (string, error) {
+	if IsEmpty(data) {
+		return data, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	encryptedKey, err := Encrypt(base64.StdEncoding.EncodeToString(key))
+	if err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(data), nil)
+	return encryptedKey + envelopeSeparator + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// DecryptEnvelope decrypts the given string which was encrypted using `EncryptEnvelope`.
+// params:
+//   data: String to decode + decrypt
+// return values:
+//  string: Decrypted text
+//  error: nil if the decryption succeeds, else the appropriate failure
+func DecryptEnvelope(data string) (string, error) {
+	if IsEmpty(data) {
+		return data, nil
+	}
+
+	parts := strings.SplitN(data, envelopeSeparator, 2)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("Invalid envelope format")
+	}
+
+	encodedKey, err := Decrypt(parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("Invalid envelope format")
+	}
+
+	decrypted, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		log.Debugf("AES-GCM decryption failed: %#v", err)
+		return "", err
+	}
+
+	return string(decrypted), nil
+}
+
+// newGCM returns AES-GCM cipher using the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
 // getPrivateKey gets the private key from the .key file
 // return values:
 //  *rsa.PrivateKey: RSA private key, which also contains the public key for encryption
@@ -134,7 +267,7 @@ func getPrivateKey() (*rsa.PrivateKey, error) {
 
 	pemData, err := ioutil.ReadFile(keyFile)
 	if err != nil {
-		log.Debugf("Error reading pem file: ", err)
+		log.Debugf("Error reading pem file: %v", err)
 		return nil, err
 	}
 
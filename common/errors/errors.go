@@ -36,6 +36,10 @@ const (
 	LDAPGroupsNotFound
 	LDAPMultipleEntries
 	LocalAuthenticationFailed
+	PasswordPolicyViolation
+	PasswordChangeRequired
+	LDAPAccountDisabled
+	KeyModified
 
 	// N.B. Add all new error codes above this line.  All error codes >=
 	// LastError are invalid.
@@ -131,6 +135,15 @@ var ErrLDAPMultipleEntries = NewError(LDAPMultipleEntries, "Expected single entr
 // ErrLocalAuthenticationFailed used when local authentication fails
 var ErrLocalAuthenticationFailed = NewError(LocalAuthenticationFailed, "Local authentication failed")
 
+// ErrPasswordChangeRequired used when the credentials are valid but the user has to change the password before doing anything else
+var ErrPasswordChangeRequired = NewError(PasswordChangeRequired, "Password change required")
+
+// ErrLDAPAccountDisabled used when the LDAP/AD account of a user is disabled or locked
+var ErrLDAPAccountDisabled = NewError(LDAPAccountDisabled, "LDAP/AD account is disabled")
+
+// ErrKeyModified used when a compare-and-swap fails because the key was modified since it was read
+var ErrKeyModified = NewError(KeyModified, "key was modified concurrently")
+
 //
 // AuthError describes an error response message
 //
@@ -170,3 +183,18 @@ func (ae *AuthError) Error() string {
 func NewError(code int, message string) error {
 	return &AuthError{code, message}
 }
+
+//
+// HasCode checks whether the given error is an AuthError with the given code
+//
+// Parameters:
+//  err: error to be checked
+//  code: expected error code
+//
+// Return values:
+//  bool: true if err is an AuthError carrying the code, false otherwise
+//
+func HasCode(err error, code int) bool {
+	authErr, ok := err.(*AuthError)
+	return ok && authErr.Code == code
+}
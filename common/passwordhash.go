@@ -0,0 +1,200 @@
+package common
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+// This file contains the password hashing algorithms and their parameters.
+//
+// Stored password hashes carry their format as prefix:
+//   bcrypt:   $2a$<cost>$<salt+hash>
+//   argon2id: $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<hash>
+// so hashes generated with any algorithm or parameters keep validating after
+// the configuration changes.
+
+const (
+	// BcryptAlgorithm hashes passwords using bcrypt
+	BcryptAlgorithm = "bcrypt"
+
+	// Argon2idAlgorithm hashes passwords using argon2id
+	Argon2idAlgorithm = "argon2id"
+
+	argon2idPrefix = "$argon2id$"
+	argon2SaltLen  = 16
+	argon2KeyLen   = 32
+)
+
+// PasswordHashParams represents the algorithm and parameters used to hash new passwords.
+//
+// Fields:
+//  Algorithm: BcryptAlgorithm or Argon2idAlgorithm
+//  BcryptCost: bcrypt cost; used with BcryptAlgorithm
+//  Argon2Time: number of passes over the memory; used with Argon2idAlgorithm
+//  Argon2Memory: memory in KiB; used with Argon2idAlgorithm
+//  Argon2Threads: degree of parallelism; used with Argon2idAlgorithm
+type PasswordHashParams struct {
+	Algorithm     string
+	BcryptCost    int
+	Argon2Time    uint32
+	Argon2Memory  uint32
+	Argon2Threads uint8
+}
+
+var (
+	hashParamsMutex sync.RWMutex
+	hashParams      = DefaultPasswordHashParams()
+)
+
+// DefaultPasswordHashParams returns the parameters used when nothing else is configured.
+func DefaultPasswordHashParams() PasswordHashParams {
+	return PasswordHashParams{
+		Algorithm:     BcryptAlgorithm,
+		BcryptCost:    cost,
+		Argon2Time:    3,
+		Argon2Memory:  64 * 1024,
+		Argon2Threads: 2,
+	}
+}
+
+// SetPasswordHashParams sets the algorithm and parameters used to hash new passwords.
+// params:
+//  params: password hashing algorithm and parameters
+// return values:
+//  error: nil on success, auth_errors.ErrIllegalArguments if the parameters are invalid
+func SetPasswordHashParams(params PasswordHashParams) error {
+	switch params.Algorithm {
+	case BcryptAlgorithm:
+		if params.BcryptCost < bcrypt.MinCost || params.BcryptCost > bcrypt.MaxCost {
+			return auth_errors.ErrIllegalArguments
+		}
+	case Argon2idAlgorithm:
+		if params.Argon2Time == 0 || params.Argon2Memory < 8*uint32(params.Argon2Threads) || params.Argon2Threads == 0 {
+			return auth_errors.ErrIllegalArguments
+		}
+	default:
+		return auth_errors.ErrIllegalArguments
+	}
+
+	hashParamsMutex.Lock()
+	defer hashParamsMutex.Unlock()
+
+	hashParams = params
+	return nil
+}
+
+// getPasswordHashParams returns the algorithm and parameters used to hash new passwords.
+func getPasswordHashParams() PasswordHashParams {
+	hashParamsMutex.RLock()
+	defer hashParamsMutex.RUnlock()
+
+	return hashParams
+}
+
+// PasswordHashNeedsUpgrade checks if the given hash was generated using a different
+// algorithm or weaker parameters than the ones configured at present.
+// params:
+//  passwordHash: stored password hash
+// return values:
+//  bool: true if the password should be rehashed, otherwise false
+func PasswordHashNeedsUpgrade(passwordHash []byte) bool {
+	params := getPasswordHashParams()
+
+	if isArgon2idHash(passwordHash) {
+		if params.Algorithm != Argon2idAlgorithm {
+			return true
+		}
+
+		time, memory, threads, _, _, err := decodeArgon2idHash(passwordHash)
+		if err != nil {
+			return true
+		}
+
+		return time < params.Argon2Time || memory < params.Argon2Memory || threads < params.Argon2Threads
+	}
+
+	if params.Algorithm != BcryptAlgorithm {
+		return true
+	}
+
+	hashCost, err := bcrypt.Cost(passwordHash)
+	return err != nil || hashCost < params.BcryptCost
+}
+
+// genArgon2idHash generates an argon2id hash of the given password in its encoded form.
+// params:
+//  password: plaintext password string
+//  params: argon2id parameters
+// return values:
+//  []byte: encoded hash of password
+//  error: nil if successful, otherwise the error from rand.Read()
+func genArgon2idHash(password string, params PasswordHashParams) ([]byte, error) {
+	salt := make([]byte, argon2SaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, params.Argon2Time, params.Argon2Memory, params.Argon2Threads, argon2KeyLen)
+
+	return []byte(fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+		params.Argon2Memory, params.Argon2Time, params.Argon2Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))), nil
+}
+
+// validateArgon2idHash returns true if the supplied password matches the encoded argon2id hash.
+func validateArgon2idHash(password string, passwordHash []byte) bool {
+	time, memory, threads, salt, key, err := decodeArgon2idHash(passwordHash)
+	if err != nil {
+		return false
+	}
+
+	other := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(key, other) == 1
+}
+
+// isArgon2idHash checks if the given hash is an encoded argon2id hash.
+func isArgon2idHash(passwordHash []byte) bool {
+	return bytes.HasPrefix(passwordHash, []byte(argon2idPrefix))
+}
+
+// decodeArgon2idHash decodes the parameters, salt and key from the encoded argon2id hash.
+func decodeArgon2idHash(passwordHash []byte) (uint32, uint32, uint8, []byte, []byte, error) {
+	// "", "argon2id", "v=19", "m=..,t=..,p=..", salt, key
+	parts := strings.Split(string(passwordHash), "$")
+	if len(parts) != 6 {
+		return 0, 0, 0, nil, nil, fmt.Errorf("invalid argon2id hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return 0, 0, 0, nil, nil, fmt.Errorf("unsupported argon2id version %q", parts[2])
+	}
+
+	var time, memory uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return 0, 0, 0, nil, nil, fmt.Errorf("invalid argon2id parameters %q", parts[3])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return 0, 0, 0, nil, nil, err
+	}
+
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return 0, 0, 0, nil, nil, fmt.Errorf("invalid argon2id key")
+	}
+
+	return time, memory, threads, salt, key, nil
+}
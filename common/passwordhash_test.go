@@ -0,0 +1,136 @@
+package common
+
+import (
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+	. "gopkg.in/check.v1"
+)
+
+type passwordHashSuite struct{}
+
+var _ = Suite(&passwordHashSuite{})
+
+// cheap parameters keep the tests fast
+var (
+	testBcryptParams = PasswordHashParams{
+		Algorithm:  BcryptAlgorithm,
+		BcryptCost: bcrypt.MinCost,
+	}
+
+	testArgon2idParams = PasswordHashParams{
+		Algorithm:     Argon2idAlgorithm,
+		Argon2Time:    1,
+		Argon2Memory:  64,
+		Argon2Threads: 1,
+	}
+)
+
+func Test(t *testing.T) {
+	TestingT(t)
+}
+
+// TearDownTest restores the default password hashing parameters.
+func (s *passwordHashSuite) TearDownTest(c *C) {
+	c.Assert(SetPasswordHashParams(DefaultPasswordHashParams()), IsNil)
+}
+
+// TestArgon2idRoundTrip tests that argon2id hashes are encoded with their parameters and validate
+func (s *passwordHashSuite) TestArgon2idRoundTrip(c *C) {
+	c.Assert(SetPasswordHashParams(testArgon2idParams), IsNil)
+
+	hash, err := GenPasswordHash("secret")
+	c.Assert(err, IsNil)
+	c.Assert(isArgon2idHash(hash), Equals, true)
+
+	time, memory, threads, salt, key, err := decodeArgon2idHash(hash)
+	c.Assert(err, IsNil)
+	c.Assert(time, Equals, testArgon2idParams.Argon2Time)
+	c.Assert(memory, Equals, testArgon2idParams.Argon2Memory)
+	c.Assert(threads, Equals, testArgon2idParams.Argon2Threads)
+	c.Assert(len(salt), Equals, argon2SaltLen)
+	c.Assert(len(key), Equals, argon2KeyLen)
+
+	c.Assert(ValidatePassword("secret", hash), Equals, true)
+	c.Assert(ValidatePassword("wrong", hash), Equals, false)
+
+	// salted: the same password hashes differently
+	other, err := GenPasswordHash("secret")
+	c.Assert(err, IsNil)
+	c.Assert(string(other), Not(Equals), string(hash))
+}
+
+// TestLegacyBcryptHash tests that bcrypt hashes keep validating once argon2id is configured
+func (s *passwordHashSuite) TestLegacyBcryptHash(c *C) {
+	c.Assert(SetPasswordHashParams(testBcryptParams), IsNil)
+
+	hash, err := GenPasswordHash("secret")
+	c.Assert(err, IsNil)
+	c.Assert(isArgon2idHash(hash), Equals, false)
+
+	c.Assert(SetPasswordHashParams(testArgon2idParams), IsNil)
+	c.Assert(ValidatePassword("secret", hash), Equals, true)
+	c.Assert(ValidatePassword("wrong", hash), Equals, false)
+}
+
+// TestPasswordHashNeedsUpgrade tests that hashes of another algorithm or weaker parameters are upgraded
+func (s *passwordHashSuite) TestPasswordHashNeedsUpgrade(c *C) {
+	c.Assert(SetPasswordHashParams(testBcryptParams), IsNil)
+	bcryptHash, err := GenPasswordHash("secret")
+	c.Assert(err, IsNil)
+	c.Assert(PasswordHashNeedsUpgrade(bcryptHash), Equals, false)
+
+	c.Assert(SetPasswordHashParams(testArgon2idParams), IsNil)
+	argon2idHash, err := GenPasswordHash("secret")
+	c.Assert(err, IsNil)
+	c.Assert(PasswordHashNeedsUpgrade(argon2idHash), Equals, false)
+	c.Assert(PasswordHashNeedsUpgrade(bcryptHash), Equals, true)
+
+	// stronger parameters
+	params := testArgon2idParams
+	params.Argon2Time++
+	c.Assert(SetPasswordHashParams(params), IsNil)
+	c.Assert(PasswordHashNeedsUpgrade(argon2idHash), Equals, true)
+
+	params = testBcryptParams
+	params.BcryptCost++
+	c.Assert(SetPasswordHashParams(params), IsNil)
+	c.Assert(PasswordHashNeedsUpgrade(bcryptHash), Equals, true)
+	c.Assert(PasswordHashNeedsUpgrade(argon2idHash), Equals, true)
+}
+
+// TestMalformedPasswordHash tests that malformed hashes never validate and are upgraded
+func (s *passwordHashSuite) TestMalformedPasswordHash(c *C) {
+	c.Assert(SetPasswordHashParams(testArgon2idParams), IsNil)
+
+	for _, hash := range []string{
+		"",
+		"plaintext",
+		"$argon2id$",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"$argon2id$v=18$m=64,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=x,t=1,p=1$c2FsdA$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$!!!$a2V5",
+		"$argon2id$v=19$m=64,t=1,p=1$c2FsdA$",
+	} {
+		c.Assert(ValidatePassword("secret", []byte(hash)), Equals, false, Commentf("hash %q", hash))
+		c.Assert(PasswordHashNeedsUpgrade([]byte(hash)), Equals, true, Commentf("hash %q", hash))
+	}
+
+	_, _, _, _, _, err := decodeArgon2idHash([]byte("$argon2id$v=19$m=64,t=1,p=1$c2FsdA$"))
+	c.Assert(err, NotNil)
+}
+
+// TestSetPasswordHashParams tests that invalid parameters are rejected
+func (s *passwordHashSuite) TestSetPasswordHashParams(c *C) {
+	for _, params := range []PasswordHashParams{
+		{Algorithm: "md5"},
+		{Algorithm: BcryptAlgorithm, BcryptCost: bcrypt.MinCost - 1},
+		{Algorithm: BcryptAlgorithm, BcryptCost: bcrypt.MaxCost + 1},
+		{Algorithm: Argon2idAlgorithm, Argon2Memory: 64, Argon2Threads: 1},
+		{Algorithm: Argon2idAlgorithm, Argon2Time: 1, Argon2Memory: 64},
+		{Algorithm: Argon2idAlgorithm, Argon2Time: 1, Argon2Memory: 4, Argon2Threads: 1},
+	} {
+		c.Assert(SetPasswordHashParams(params), NotNil, Commentf("params %+v", params))
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"encoding/json"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
@@ -28,7 +29,10 @@ const (
 var DatastoreDirectories = []string{
 	AuthZDir,
 	AuthProxyDir + "/local_users",
+	AuthProxyDir + "/local_groups",
+	AuthProxyDir + "/ldap_configurations",
 	AuthProxyDir + "/principals",
+	AuthProxyDir + "/elevation_requests",
 }
 
 //
@@ -63,6 +67,17 @@ var DatastoreDirectories = []string{
 //  ClaimKey: string encoding of the claim's key associated with the authorization
 //  ClaimValue: string encoding of the claim's value associated with the
 //    authorization
+//  NotBefore: unix timestamp the authorization takes effect at; 0 if it is in effect
+//    from its creation
+//  ExpiresAt: unix timestamp the authorization expires at; 0 if it never expires.
+//    Expired authorizations are ignored and eventually deleted.
+//  Deny: true if the authorization denies access to the tenant of the claim's key
+//    instead of granting it; deny authorizations take precedence over the others
+//    and carry no claim's value
+//  ResourceType: netmaster resource (e.g. networks) a deny authorization is limited
+//    to; the whole tenant is denied if empty
+//  ResourceName: name of the resource a deny authorization is limited to; all the
+//    resources of the type are denied if empty
 //
 type Authorization struct {
 	CommonState
@@ -71,6 +86,24 @@ type Authorization struct {
 	Local         bool   `json:"local"`
 	ClaimKey      string `json:"claimKey"`
 	ClaimValue    string `json:"claimValue"`
+	NotBefore     int64  `json:"not_before,omitempty"`
+	ExpiresAt     int64  `json:"expires_at,omitempty"`
+	Deny          bool   `json:"deny,omitempty"`
+	ResourceType  string `json:"resource_type,omitempty"`
+	ResourceName  string `json:"resource_name,omitempty"`
+}
+
+//
+// Resource identifies a netmaster resource of a tenant, e.g. the network
+// `n1`, which deny authorizations can be limited to.
+//
+// Fields:
+//  Type: netmaster resource, e.g. networks, endpointGroups
+//  Name: name of the resource, e.g. the network name
+//
+type Resource struct {
+	Type string
+	Name string
 }
 
 //
@@ -116,6 +149,46 @@ func (a *Authorization) BelongsToBuiltInAdmin() bool {
 	return a.Local && Admin.String() == a.PrincipalName
 }
 
+//
+// Denies determines if the authz is a deny authorization applying to the
+// given resource of its tenant; an empty resource stands for the tenant itself,
+// which only deny authorizations of the whole tenant apply to.
+//
+func (a *Authorization) Denies(resource Resource) bool {
+	switch {
+	case !a.Deny:
+		return false
+	case a.ResourceType == "":
+		return true
+	case a.ResourceType != resource.Type:
+		return false
+	}
+
+	return a.ResourceName == "" || a.ResourceName == resource.Name
+}
+
+//
+// IsTimeBound determines if the authz is only in effect for a period of time.
+//
+func (a *Authorization) IsTimeBound() bool {
+	return a.NotBefore != 0 || a.ExpiresAt != 0
+}
+
+//
+// IsExpired determines if the authz has expired at the given time.
+//
+func (a *Authorization) IsExpired(now time.Time) bool {
+	return a.ExpiresAt != 0 && now.Unix() >= a.ExpiresAt
+}
+
+//
+// IsActive determines if the authz is in effect at the given time, i.e. it
+// has taken effect and has not expired.
+//
+func (a *Authorization) IsActive(now time.Time) bool {
+	return now.Unix() >= a.NotBefore && !a.IsExpired(now)
+}
+
 //
 // Write adds an authz instance to the authz dir in the KV store
 //
@@ -0,0 +1,389 @@
+package types
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	ldap "github.com/go-ldap/ldap"
+)
+
+const (
+	// LdapActiveDirectory is the directory type of Microsoft Active Directory
+	LdapActiveDirectory = "active_directory"
+
+	// LdapOpenLDAP is the directory type of OpenLDAP and other RFC 4519 based
+	// directories like 389-DS and FreeIPA
+	LdapOpenLDAP = "openldap"
+
+	// LdapMemberOf resolves group membership using the `memberOf` attribute of the user
+	LdapMemberOf = "memberOf"
+
+	// LdapMember resolves group membership using the `member` attribute of the group
+	LdapMember = "member"
+
+	// LdapUniqueMember resolves group membership using the `uniqueMember` attribute of the group
+	LdapUniqueMember = "uniqueMember"
+
+	// LdapGroupsIterative resolves nested groups level by level; one search per group (or member)
+	LdapGroupsIterative = "iterative"
+
+	// LdapGroupsTokenGroups resolves nested groups using the `tokenGroups` attribute of the
+	// user (Active Directory); the group SIDs are looked up in a single search
+	LdapGroupsTokenGroups = "token_groups"
+
+	// LdapGroupsInChain resolves nested groups in a single search using LDAP_MATCHING_RULE_IN_CHAIN (Active Directory)
+	LdapGroupsInChain = "in_chain"
+
+	// LdapMatchingRuleInChain is the OID of LDAP_MATCHING_RULE_IN_CHAIN
+	LdapMatchingRuleInChain = "1.2.840.113556.1.4.1941"
+
+	// LdapUsernamePlaceholder is replaced with the (escaped) username in `UserSearchFilter`
+	LdapUsernamePlaceholder = "{username}"
+
+	// DefaultLdapUsernamePattern allows letters, digits and `.`, `_`, `@`, `-` (but not
+	// as the first character); this covers sAMAccountName, uid and userPrincipalName values
+	DefaultLdapUsernamePattern = `[\p{L}\p{N}][\p{L}\p{N}._@-]{0,255}`
+
+	// DefaultLdapConnectTimeout is the number of seconds to wait for a directory connection
+	DefaultLdapConnectTimeout = 10
+
+	// DefaultLdapReadTimeout is the number of seconds to wait for a directory response
+	DefaultLdapReadTimeout = 30
+
+	// DefaultLdapPoolSize is the maximum number of service account connections used at a time
+	DefaultLdapPoolSize = 10
+
+	// DefaultLdapCacheTTL is the number of seconds for which the DN and groups of a user are cached
+	DefaultLdapCacheTTL = 60
+
+	// DefaultLdapRevalidationInterval is the number of seconds after which the directory status
+	// and groups of a LDAP user with an active session are resolved again
+	DefaultLdapRevalidationInterval = 300
+
+	// DefaultLdapConfigurationName is the name of the LDAP configuration added without a name
+	DefaultLdapConfigurationName = "default"
+)
+
+// ldapDirectoryPreset holds the search settings of a directory type
+type ldapDirectoryPreset struct {
+	userObjectClass   string
+	usernameAttribute string
+	groupObjectClass  string
+	groupMembership   string
+}
+
+var (
+	ldapDirectoryPresets = map[string]ldapDirectoryPreset{
+		LdapActiveDirectory: {
+			userObjectClass:   "user",
+			usernameAttribute: "sAMAccountName",
+			groupObjectClass:  "group",
+			groupMembership:   LdapMemberOf,
+		},
+		LdapOpenLDAP: {
+			userObjectClass:   "inetOrgPerson",
+			usernameAttribute: "uid",
+			groupObjectClass:  "groupOfNames",
+			groupMembership:   LdapMember,
+		},
+	}
+
+	// attribute descriptions and object class names (RFC 4512 `descr`)
+	ldapDescrRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9-]*$`)
+
+	// names of the LDAP configurations; these are used in the data store path and URLs
+	ldapNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+	// names of the claims the user attributes are mapped to
+	userAttributeClaimRegex = regexp.MustCompile(`^[a-z][a-z0-9_]{0,63}$`)
+)
+
+// ServerList returns the servers of the configuration in the failover order;
+// the primary server (`Server`, `Port`) followed by `Servers`.
+func (cfg *LdapConfiguration) ServerList() []LdapServer {
+	servers := []LdapServer{}
+	if !common.IsEmpty(cfg.Server) {
+		servers = append(servers, LdapServer{Server: cfg.Server, Port: cfg.Port})
+	}
+
+	return append(servers, cfg.Servers...)
+}
+
+// MatchUsername checks whether the given username carries one of the username prefixes
+// or suffixes of the configuration (compared case-insensitively).
+// params:
+//  username: username given by the client
+// return values:
+//  string: username without the matching prefix/suffix; the given username if none matched
+//  bool: true if a prefix or suffix matched, false otherwise
+func (cfg *LdapConfiguration) MatchUsername(username string) (string, bool) {
+	lowerUsername := strings.ToLower(username)
+
+	for _, prefix := range cfg.UsernamePrefixes {
+		if len(username) > len(prefix) && strings.HasPrefix(lowerUsername, strings.ToLower(prefix)) {
+			return username[len(prefix):], true
+		}
+	}
+
+	for _, suffix := range cfg.UsernameSuffixes {
+		if len(username) > len(suffix) && strings.HasSuffix(lowerUsername, strings.ToLower(suffix)) {
+			return username[:len(username)-len(suffix)], true
+		}
+	}
+
+	return username, false
+}
+
+// ValidateDomainSettings checks the name, servers and username prefixes/suffixes of the configuration.
+// return values:
+//  error: nil if the settings can be used, otherwise an error with
+//         code auth_errors.IllegalArguments describing the problem
+func (cfg *LdapConfiguration) ValidateDomainSettings() error {
+	if !ldapNameRegex.MatchString(cfg.Name) {
+		return illegalLdapSetting("invalid configuration name %q", cfg.Name)
+	}
+
+	servers := cfg.ServerList()
+	if len(servers) == 0 || common.IsEmpty(cfg.Server) {
+		return illegalLdapSetting("primary server is not set")
+	}
+
+	for _, server := range servers {
+		if common.IsEmpty(server.Server) || server.Port == 0 {
+			return illegalLdapSetting("invalid server/port details %q:%d", server.Server, server.Port)
+		}
+	}
+
+	for _, affix := range append(append([]string{}, cfg.UsernamePrefixes...), cfg.UsernameSuffixes...) {
+		if common.IsEmpty(affix) {
+			return illegalLdapSetting("username prefixes/suffixes must not be empty")
+		}
+	}
+
+	return nil
+}
+
+// WithSearchDefaults returns a copy of the configuration where the empty search
+// settings are populated from the preset of its directory type.
+// return values:
+//  *LdapConfiguration: configuration with all the search settings (except the optional
+//                      `GroupNameAttribute`) populated
+//  error: as returned by ValidateSearchSettings
+func (cfg *LdapConfiguration) WithSearchDefaults() (*LdapConfiguration, error) {
+	if err := cfg.ValidateSearchSettings(); err != nil {
+		return nil, err
+	}
+
+	result := *cfg
+	if common.IsEmpty(result.DirectoryType) {
+		result.DirectoryType = LdapActiveDirectory
+	}
+
+	preset := ldapDirectoryPresets[result.DirectoryType]
+
+	if common.IsEmpty(result.UserSearchFilter) {
+		usernameAttribute := preset.usernameAttribute
+		if !common.IsEmpty(result.UsernameAttribute) {
+			usernameAttribute = result.UsernameAttribute
+		}
+
+		result.UserSearchFilter = fmt.Sprintf("(&(objectClass=%s)(%s=%s))",
+			preset.userObjectClass, usernameAttribute, LdapUsernamePlaceholder)
+	}
+
+	if common.IsEmpty(result.UsernameAttribute) {
+		result.UsernameAttribute = preset.usernameAttribute
+	}
+
+	if common.IsEmpty(result.GroupObjectClass) {
+		result.GroupObjectClass = preset.groupObjectClass
+	}
+
+	if common.IsEmpty(result.GroupMembership) {
+		result.GroupMembership = preset.groupMembership
+	}
+
+	if common.IsEmpty(result.UsernamePattern) {
+		result.UsernamePattern = DefaultLdapUsernamePattern
+	}
+
+	if common.IsEmpty(result.GroupResolution) {
+		result.GroupResolution = LdapGroupsIterative
+	}
+
+	return &result, nil
+}
+
+// ValidateSearchSettings checks the user and group search settings of the configuration.
+// Empty settings are valid; they are populated from the directory preset.
+// return values:
+//  error: nil if the settings can be used, otherwise an error with
+//         code auth_errors.IllegalArguments describing the problem
+func (cfg *LdapConfiguration) ValidateSearchSettings() error {
+	if !common.IsEmpty(cfg.DirectoryType) {
+		if _, found := ldapDirectoryPresets[cfg.DirectoryType]; !found {
+			return illegalLdapSetting("unknown directory type %q; expected %q or %q",
+				cfg.DirectoryType, LdapActiveDirectory, LdapOpenLDAP)
+		}
+	}
+
+	if !common.IsEmpty(cfg.UserSearchFilter) {
+		filter := strings.TrimSpace(cfg.UserSearchFilter)
+		if !strings.HasPrefix(filter, "(") || !strings.HasSuffix(filter, ")") {
+			return illegalLdapSetting("user search filter must be enclosed in parentheses")
+		}
+
+		if !strings.Contains(filter, LdapUsernamePlaceholder) {
+			return illegalLdapSetting("user search filter must contain %q", LdapUsernamePlaceholder)
+		}
+	}
+
+	attributes := map[string]string{
+		"username attribute":   cfg.UsernameAttribute,
+		"group object class":   cfg.GroupObjectClass,
+		"group name attribute": cfg.GroupNameAttribute,
+	}
+
+	for setting, value := range attributes {
+		if !common.IsEmpty(value) && !ldapDescrRegex.MatchString(value) {
+			return illegalLdapSetting("invalid %s %q", setting, value)
+		}
+	}
+
+	if !common.IsEmpty(cfg.UsernamePattern) {
+		if _, err := usernameRegexp(cfg.UsernamePattern); err != nil {
+			return illegalLdapSetting("invalid username pattern %q: %v", cfg.UsernamePattern, err)
+		}
+	}
+
+	switch cfg.GroupMembership {
+	case "", LdapMemberOf, LdapMember, LdapUniqueMember:
+	default:
+		return illegalLdapSetting("unknown group membership %q; expected %q, %q or %q",
+			cfg.GroupMembership, LdapMemberOf, LdapMember, LdapUniqueMember)
+	}
+
+	switch cfg.GroupResolution {
+	case "", LdapGroupsIterative, LdapGroupsTokenGroups, LdapGroupsInChain:
+	default:
+		return illegalLdapSetting("unknown group resolution %q; expected %q, %q or %q",
+			cfg.GroupResolution, LdapGroupsIterative, LdapGroupsTokenGroups, LdapGroupsInChain)
+	}
+
+	if cfg.GroupMaxDepth < 0 {
+		return illegalLdapSetting("group max depth must not be negative")
+	}
+
+	if !common.IsEmpty(cfg.GroupBaseDN) {
+		if _, err := ldap.ParseDN(cfg.GroupBaseDN); err != nil {
+			return illegalLdapSetting("invalid group base DN %q: %v", cfg.GroupBaseDN, err)
+		}
+	}
+
+	for claim, attribute := range cfg.UserAttributes {
+		if !userAttributeClaimRegex.MatchString(claim) {
+			return illegalLdapSetting("invalid user attribute claim name %q; expected lower case letters, digits and underscores", claim)
+		}
+
+		if !ldapDescrRegex.MatchString(attribute) {
+			return illegalLdapSetting("invalid user attribute %q", attribute)
+		}
+	}
+
+	return nil
+}
+
+// IsValidUsername checks whether the given username matches the username pattern.
+// Usernames which don't match are never sent to the directory server.
+// params:
+//  username: username given by the client
+// return values:
+//  bool: true if the whole username matches `UsernamePattern` (or DefaultLdapUsernamePattern
+//        if it is empty), false otherwise
+func (cfg *LdapConfiguration) IsValidUsername(username string) bool {
+	pattern := cfg.UsernamePattern
+	if common.IsEmpty(pattern) {
+		pattern = DefaultLdapUsernamePattern
+	}
+
+	usernameRegex, err := usernameRegexp(pattern)
+	if err != nil {
+		return false
+	}
+
+	return usernameRegex.MatchString(username)
+}
+
+// usernameRegexp compiles the given username pattern; the pattern is anchored so that it
+// has to match the whole username.
+func usernameRegexp(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// ValidateConnectionSettings checks the TLS, timeout and pool settings of the configuration.
+// `ClientKey` is expected to be in plaintext.
+// return values:
+//  error: nil if the settings can be used, otherwise an error with
+//         code auth_errors.IllegalArguments describing the problem
+func (cfg *LdapConfiguration) ValidateConnectionSettings() error {
+	if cfg.LDAPS && cfg.StartTLS {
+		return illegalLdapSetting("LDAPS and StartTLS can't be used together")
+	}
+
+	if cfg.ConnectTimeout < 0 || cfg.ReadTimeout < 0 {
+		return illegalLdapSetting("timeouts must not be negative")
+	}
+
+	if cfg.PoolSize < 0 {
+		return illegalLdapSetting("pool size must not be negative")
+	}
+
+	_, err := cfg.TLSConfig()
+	return err
+}
+
+// TLSConfig returns the TLS configuration used to connect to the directory servers.
+// `ClientKey` is expected to be in plaintext.
+// return values:
+//  *tls.Config: TLS configuration built from the CA bundle, server name and client certificate;
+//               `ServerName` is empty unless configured, the address of each server is used then
+//  error: nil on success, otherwise an error with code auth_errors.IllegalArguments
+//         if the certificates or the key can't be parsed
+func (cfg *LdapConfiguration) TLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if !common.IsEmpty(cfg.CACertificate) {
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM([]byte(cfg.CACertificate)) {
+			return nil, illegalLdapSetting("no valid PEM encoded certificate found in the CA certificate bundle")
+		}
+	}
+
+	if common.IsEmpty(cfg.ClientCertificate) != common.IsEmpty(cfg.ClientKey) {
+		return nil, illegalLdapSetting("client certificate and key must be given together")
+	}
+
+	if !common.IsEmpty(cfg.ClientCertificate) {
+		certificate, err := tls.X509KeyPair([]byte(cfg.ClientCertificate), []byte(cfg.ClientKey))
+		if err != nil {
+			return nil, illegalLdapSetting("invalid client certificate/key: %v", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+
+	return tlsConfig, nil
+}
+
+// illegalLdapSetting returns an IllegalArguments error with the given message.
+func illegalLdapSetting(format string, args ...interface{}) error {
+	return auth_errors.NewError(auth_errors.IllegalArguments, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,161 @@
+package types
+
+import (
+	"fmt"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+)
+
+const (
+	// MaxPasswordHistoryCount is the highest number of previous passwords
+	// that can be remembered for a local user.
+	MaxPasswordHistoryCount = 24
+)
+
+// PasswordPolicy represents the rules that local user passwords must follow.
+// It is enforced whenever a local user is created or a password is changed.
+//
+// Fields:
+//  MinLength: minimum number of characters in the password; 0 means no limit
+//  RequireUppercase: password must contain at least one uppercase letter
+//  RequireLowercase: password must contain at least one lowercase letter
+//  RequireDigit: password must contain at least one digit
+//  RequireSpecial: password must contain at least one character which is neither a letter nor a digit
+//  DenyList: passwords that are never accepted (compared case-insensitively),
+//            e.g. commonly used passwords
+//  DisallowUsername: password must not contain the username (compared case-insensitively)
+//  HistoryCount: number of previous passwords that cannot be reused
+//  MaxAgeDays: number of days after which the password expires and must be
+//              changed on the next login; 0 means passwords never expire
+type PasswordPolicy struct {
+	MinLength        int      `json:"min_length"`
+	RequireUppercase bool     `json:"require_uppercase"`
+	RequireLowercase bool     `json:"require_lowercase"`
+	RequireDigit     bool     `json:"require_digit"`
+	RequireSpecial   bool     `json:"require_special"`
+	DenyList         []string `json:"deny_list"`
+	DisallowUsername bool     `json:"disallow_username"`
+	HistoryCount     int      `json:"history_count"`
+	MaxAgeDays       int      `json:"max_age_days"`
+}
+
+// DefaultPasswordPolicy returns the policy that is in effect when no policy
+// has been configured. It accepts any non-empty password.
+func DefaultPasswordPolicy() *PasswordPolicy {
+	return &PasswordPolicy{DenyList: []string{}}
+}
+
+// Validate checks if the policy itself is sane.
+// return values:
+//  error: nil if the policy can be used, otherwise auth_errors.ErrIllegalArguments
+func (p *PasswordPolicy) Validate() error {
+	if p.MinLength < 0 || p.MaxAgeDays < 0 {
+		return auth_errors.ErrIllegalArguments
+	}
+
+	if p.HistoryCount < 0 || p.HistoryCount > MaxPasswordHistoryCount {
+		return auth_errors.ErrIllegalArguments
+	}
+
+	return nil
+}
+
+// Check checks the given password against the policy.
+// params:
+//  username: of the user whose password is being set
+//  password: new plaintext password
+//  history: hashes of the current and previous passwords of the user, most recent first
+// return values:
+//  error: nil if the password complies with the policy, otherwise an error
+//         with code auth_errors.PasswordPolicyViolation describing the violation
+func (p *PasswordPolicy) Check(username, password string, history [][]byte) error {
+	if common.IsEmpty(password) {
+		return policyViolation("password must not be empty")
+	}
+
+	if len([]rune(password)) < p.MinLength {
+		return policyViolation(fmt.Sprintf("password must be at least %d characters long", p.MinLength))
+	}
+
+	var upper, lower, digit, special bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case !unicode.IsLetter(r):
+			special = true
+		}
+	}
+
+	switch {
+	case p.RequireUppercase && !upper:
+		return policyViolation("password must contain an uppercase letter")
+	case p.RequireLowercase && !lower:
+		return policyViolation("password must contain a lowercase letter")
+	case p.RequireDigit && !digit:
+		return policyViolation("password must contain a digit")
+	case p.RequireSpecial && !special:
+		return policyViolation("password must contain a special character")
+	}
+
+	for _, denied := range p.DenyList {
+		if strings.EqualFold(password, denied) {
+			return policyViolation("password is too common")
+		}
+	}
+
+	if p.DisallowUsername && !common.IsEmpty(username) &&
+		strings.Contains(strings.ToLower(password), strings.ToLower(username)) {
+		return policyViolation("password must not contain the username")
+	}
+
+	if p.HistoryCount > 0 {
+		for i, hash := range history {
+			if i >= p.HistoryCount {
+				break
+			}
+
+			if len(hash) > 0 && common.ValidatePassword(password, hash) {
+				return policyViolation(fmt.Sprintf("password must not be one of the last %d passwords", p.HistoryCount))
+			}
+		}
+	}
+
+	return nil
+}
+
+// IsExpired checks if a password which was last changed at `changedAt`
+// (unix timestamp) has expired as per the policy. Passwords with an unknown
+// change time (0) never expire.
+func (p *PasswordPolicy) IsExpired(changedAt int64) bool {
+	if p.MaxAgeDays == 0 || changedAt == 0 {
+		return false
+	}
+
+	maxAge := time.Duration(p.MaxAgeDays) * 24 * time.Hour
+	return time.Since(time.Unix(changedAt, 0)) > maxAge
+}
+
+// policyViolation returns an error carrying the PasswordPolicyViolation code and the given message.
+func policyViolation(msg string) error {
+	return auth_errors.NewError(auth_errors.PasswordPolicyViolation, msg)
+}
+
+// PasswordHashes returns the hashes of the current and the previous passwords
+// of the user, most recent first.
+func (u *LocalUser) PasswordHashes() [][]byte {
+	hashes := [][]byte{}
+	if len(u.PasswordHash) > 0 {
+		hashes = append(hashes, u.PasswordHash)
+	}
+
+	return append(hashes, u.PasswordHistory...)
+}
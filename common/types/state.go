@@ -31,7 +31,16 @@ type StateDriver interface {
 	// could be removed, since it is not used directly for now
 	Read(key string) ([]byte, error)
 	ReadAll(baseKey string) ([][]byte, error)
+	// ReadAllWithIndex is ReadAll which also returns the index of the KV store the values were
+	// read at; the changes made since can be watched with WatchAllStateUntil.
+	ReadAllWithIndex(baseKey string) ([][]byte, uint64, error)
 	Write(key string, value []byte) error
+	// CompareAndSwap writes the value only if the current value of the key is prevValue
+	// (or the key doesn't exist if prevValue is nil); it fails with ErrKeyModified otherwise.
+	CompareAndSwap(key string, prevValue, value []byte) error
+	// CompareAndDelete removes the key only if its current value is prevValue; it fails with
+	// ErrKeyModified otherwise, including if the key doesn't exist.
+	CompareAndDelete(key string, prevValue []byte) error
 	Clear(key string) error
 	WatchAll(baseKey string, chValueChanges chan [2][]byte) error
 
@@ -39,6 +48,8 @@ type StateDriver interface {
 		unmarshal func([]byte, interface{}) error) error
 	ReadAllState(baseKey string, stateType State,
 		unmarshal func([]byte, interface{}) error) ([]State, error)
+	ReadAllStateWithIndex(baseKey string, stateType State,
+		unmarshal func([]byte, interface{}) error) ([]State, uint64, error)
 	WriteState(key string, value State,
 		marshal func(interface{}) ([]byte, error)) error
 	// WatchAllState returns changes to a state from the point watch is started.
@@ -49,5 +60,11 @@ type StateDriver interface {
 	// updates. Revisit if this enhancement is needed.
 	WatchAllState(baseKey string, stateType State,
 		unmarshal func([]byte, interface{}) error, chStateChanges chan WatchState) error
+	// WatchAllStateUntil is WatchAllState which returns the changes made after afterIndex (see
+	// ReadAllStateWithIndex), so that none is missed between a read and the watch, and stops
+	// watching, and returns nil, once chStop is closed; the errors of the underlying watch are
+	// returned rather than retried.
+	WatchAllStateUntil(baseKey string, afterIndex uint64, stateType State,
+		unmarshal func([]byte, interface{}) error, chStateChanges chan WatchState, chStop chan struct{}) error
 	ClearState(key string) error
 }
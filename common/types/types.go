@@ -1,6 +1,8 @@
 package types
 
 import (
+	"strings"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common/errors"
 )
@@ -64,37 +66,272 @@ func Role(roleStr string) (RoleType, error) {
 //  LastName: of the user
 //  Password: of the user. Not stored anywhere. Used only for updates.
 //  Disable: if authorizations for this local user is disabled.
+//  MustChangePassword: if set, the user cannot do anything but change the password.
 //  PasswordHash: of the password string.
+//  PasswordHistory: hashes of the previous passwords, most recent first.
+//  PasswordChangedAt: unix timestamp of the last password change; 0 if unknown.
+//  SessionGeneration: incremented to revoke the tokens issued to the user so far.
 //
 type LocalUser struct {
-	Username     string `json:"username"`
-	Password     string `json:"password,omitempty"`
-	FirstName    string `json:"first_name"`
-	LastName     string `json:"last_name"`
-	Disable      bool   `json:"disable"`
-	PasswordHash []byte `json:"password_hash,omitempty"`
+	Username           string   `json:"username"`
+	Password           string   `json:"password,omitempty"`
+	FirstName          string   `json:"first_name"`
+	LastName           string   `json:"last_name"`
+	Disable            bool     `json:"disable"`
+	MustChangePassword bool     `json:"must_change_password,omitempty"`
+	PasswordHash       []byte   `json:"password_hash,omitempty"`
+	PasswordHistory    [][]byte `json:"password_history,omitempty"`
+	PasswordChangedAt  int64    `json:"password_changed_at,omitempty"`
+	SessionGeneration  int      `json:"session_generation,omitempty"`
 }
 
-// LdapConfiguration represents the LDAP/AD configuration.
-// All the connection to LDAP/AD is established using this details.
+// LocalGroupPrincipalPrefix is prefixed to the name of a local group to form its
+// `PrincipalName`; this keeps local group principals apart from local usernames.
+const LocalGroupPrincipalPrefix = "local_group:"
+
+// LdapUserPrincipalPrefix is prefixed to the DN of an LDAP user to form its `PrincipalName`; the
+// principal of an LDAP user only carries deny authorizations, access is granted to its groups.
+const LdapUserPrincipalPrefix = "ldap_user:"
+
+// LocalGroup information
+//
+// Fields:
+//  Name: of the group. Read only field. Must be unique.
+//  Description: of the group
+//  Members: usernames of the local users that belong to the group
+//
+type LocalGroup struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description"`
+	Members     []string `json:"members"`
+}
+
+// LocalGroupPrincipal returns the `PrincipalName` of the given local group.
+func LocalGroupPrincipal(groupName string) string {
+	return LocalGroupPrincipalPrefix + groupName
+}
+
+// LdapUserPrincipal returns the `PrincipalName` of the LDAP user with the given DN; DNs are
+// compared case-insensitively.
+func LdapUserPrincipal(dn string) string {
+	return LdapUserPrincipalPrefix + strings.ToLower(dn)
+}
+
+// Principal records the identity of a user who has logged in; it is updated on every login.
+//
+// Fields:
+//  Username: login name of the user
+//  Local: true for local users, false for LDAP users
+//  Domain: name of the LDAP configuration the user was authenticated against
+//  DN: distinguished name of the LDAP user
+//  Attributes: user attributes carried in the token; mapped by `LdapConfiguration.UserAttributes`
+//              for LDAP users, `display_name` of local users is made of their first and last name
+//  LastLogin: unix timestamp of the last successful login
+//
+type Principal struct {
+	Username   string            `json:"username"`
+	Local      bool              `json:"local"`
+	Domain     string            `json:"domain,omitempty"`
+	DN         string            `json:"dn,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+	LastLogin  int64             `json:"last_login"`
+}
+
+// PrincipalID returns the ID of the principal record of the given user; the records of
+// local and LDAP users with the same name are kept apart.
+func PrincipalID(username string, local bool) string {
+	if local {
+		return "local:" + username
+	}
+
+	return "ldap:" + username
+}
+
+// statuses of an elevation request
+const (
+	ElevationPending  = "pending"  // waiting for an admin's decision
+	ElevationApproved = "approved" // the role was granted until `ExpiresAt`
+	ElevationDenied   = "denied"   // nothing was granted
+)
+
+// ElevationRequest is a request of a local user to be granted a role for a limited time (just-in-time
+// elevation); the role is granted once another admin approves the request.
+//
+// Fields:
+//  ID: unique ID of the request
+//  Requester: username of the local user asking for the role
+//  Role: role requested
+//  TenantName: tenant the role is requested on; empty for the admin role
+//  DurationSeconds: how long the role is granted for once approved
+//  Reason: why the requester needs the role
+//  Status: ElevationPending, ElevationApproved or ElevationDenied
+//  CreatedAt: unix timestamp of the request
+//  Decider: username of the admin who approved or denied the request
+//  DecidedAt: unix timestamp of the decision
+//  Comment: comment of the decider
+//  AuthzUUID: time-bound authorization created on approval
+//  ExpiresAt: unix timestamp the granted role expires at
+//
+type ElevationRequest struct {
+	ID              string `json:"id"`
+	Requester       string `json:"requester"`
+	Role            string `json:"role"`
+	TenantName      string `json:"tenantName,omitempty"`
+	DurationSeconds int64  `json:"duration_seconds"`
+	Reason          string `json:"reason"`
+	Status          string `json:"status"`
+	CreatedAt       int64  `json:"created_at"`
+	Decider         string `json:"decider,omitempty"`
+	DecidedAt       int64  `json:"decided_at,omitempty"`
+	Comment         string `json:"comment,omitempty"`
+	AuthzUUID       string `json:"authzUUID,omitempty"`
+	ExpiresAt       int64  `json:"expires_at,omitempty"`
+}
+
+// BreakGlass holds the break-glass emergency access: a one-time code, derived offline from a
+// private key held in a vault, grants a short-lived admin token when nobody can log in otherwise.
+//
+// Fields:
+//  PublicKey: PEM encoded Ed25519 public key the codes are verified with
+//  Challenge: random value the next code is derived from; renewed every time the access is armed
+//  Armed: true if a code can be used; false once one was used, until an admin re-arms the access
+//  Generation: incremented every time the access is armed; the tokens granted before are revoked
+//  ArmedBy: username of the admin who armed the access; empty if it was armed by the initial setup
+//  ArmedAt: unix timestamp the access was armed at
+//  UsedAt: unix timestamp the last code was used at
+//  UsedFrom: address the last code was used from
+//
+type BreakGlass struct {
+	PublicKey  string `json:"public_key"`
+	Challenge  string `json:"challenge"`
+	Armed      bool   `json:"armed"`
+	Generation int    `json:"generation"`
+	ArmedBy    string `json:"armed_by,omitempty"`
+	ArmedAt    int64  `json:"armed_at,omitempty"`
+	UsedAt     int64  `json:"used_at,omitempty"`
+	UsedFrom   string `json:"used_from,omitempty"`
+}
+
+// LdapServer represents a LDAP/AD server.
 //
 // Fields:
 //  Server: FQDN or IP address of LDAP/AD server
 //  Port: listening port of LDAP/AD server
+type LdapServer struct {
+	Server string `json:"server"`
+	Port   uint16 `json:"port"`
+}
+
+// LdapConfiguration represents the LDAP/AD configuration of a domain.
+// All the connection to LDAP/AD is established using this details.
+//
+// Fields:
+//  Name: unique name of the configuration (domain); DefaultLdapConfigurationName if it is empty
+//  Server: FQDN or IP address of the primary LDAP/AD server
+//  Port: listening port of the primary LDAP/AD server
+//  Servers: failover servers; these are tried in the given order when the primary server
+//           (or the preceding failover servers) can't be reached
+//  Order: configurations are tried in the ascending order of this value (and name)
+//  UsernamePrefixes: usernames starting with one of these (e.g. `CORP\`) are authenticated
+//                    against this configuration only; the prefix is removed from the username
+//  UsernameSuffixes: usernames ending with one of these (e.g. `@corp.example.com`) are
+//                    authenticated against this configuration only; the suffix is removed
+//                    from the username
 //  BaseDN: Distinguished name for base entity.
 //          E.g., ou=eng,dc=auth,dc=com. All search queries will be scope to this BaseDN.
 //  ServiceAccountDN: DN of the service account. auth_proxy will use this
 //                    account to communicate with LDAP/AD. Hence this account
 //                    must have appropriate privileges, specifically for lookup.
 //  ServiceAccountPassword: of the service account
+//  StartTLS: upgrade the plain connection to TLS using the StartTLS extended operation
+//  InsecureSkipVerify: don't verify the certificate of the server (testing only)
+//  LDAPS: connect using TLS right away (implicit TLS, usually port 636); can't be used with StartTLS
+//  CACertificate: PEM encoded bundle of CA certificates used to verify the server;
+//                 the system roots are used if it is empty
+//  ServerName: name used to verify the server certificates; defaults to the address of each server
+//  ClientCertificate: PEM encoded client certificate presented to the server (optional)
+//  ClientKey: PEM encoded private key of `ClientCertificate`; it is never returned
+//  ConnectTimeout: seconds to wait for the connection (including TLS handshake) to be established;
+//                  DefaultLdapConnectTimeout is used if it is 0
+//  ReadTimeout: seconds to wait for the response of each request; DefaultLdapReadTimeout is used if it is 0
+//  PoolSize: maximum number of service account connections used at a time;
+//            DefaultLdapPoolSize is used if it is 0
+//  CacheTTL: seconds for which the DN and groups of an authenticated user are cached; the password is
+//            still verified by the directory. DefaultLdapCacheTTL is used if it is 0, negative disables the cache
+//  RevalidationInterval: seconds after which the directory status and groups of a user with an active
+//                        session are resolved again using the service account; sessions of users who
+//                        are no longer found or are disabled are revoked, and groups the user has left
+//                        are dropped from the session. DefaultLdapRevalidationInterval is used if it is 0,
+//                        negative disables the re-validation
+//  DirectoryType: kind of the directory server (LdapActiveDirectory or LdapOpenLDAP);
+//                 the search settings below default to the preset of this type.
+//                 Active Directory is assumed if it is empty.
+//  UserSearchFilter: filter used to find the user entry; LdapUsernamePlaceholder
+//                    is replaced with the username, e.g. (&(objectClass=person)(uid={username}))
+//  UsernameAttribute: attribute holding the login name, e.g. sAMAccountName or uid.
+//                     It is used to build the user search filter when none is given.
+//  GroupObjectClass: object class of the group entries, e.g. group or groupOfNames
+//  GroupMembership: how group membership is resolved; LdapMemberOf reads the `memberOf`
+//                   attribute of the user and group entries, LdapMember/LdapUniqueMember
+//                   search for the groups listing the user (or group) DN in that attribute
+//  GroupNameAttribute: attribute of the group entry used as the principal name;
+//                      the group DN is used if it is empty
+//  GroupResolution: how nested groups are resolved; LdapGroupsIterative (default) searches
+//                   level by level, LdapGroupsTokenGroups and LdapGroupsInChain (Active Directory)
+//                   resolve all the groups at once and fall back to LdapGroupsIterative
+//  GroupMaxDepth: maximum nesting depth followed by LdapGroupsIterative; 0 means unlimited
+//  GroupBaseDN: only the groups under this DN are returned (optional)
+//  UserAttributes: attributes of the user entry carried in the token and the user info, keyed by
+//                  the claim name, e.g. {"display_name": "displayName", "email": "mail"}
+//  UsernamePattern: regular expression that the whole username must match before
+//                   any directory lookup; DefaultLdapUsernamePattern is used if it is empty
 type LdapConfiguration struct {
-	Server                 string `json:"server"`
-	Port                   uint16 `json:"port"`
-	BaseDN                 string `json:"base_dn"`
-	ServiceAccountDN       string `json:"service_account_dn"`
-	ServiceAccountPassword string `json:"service_account_password,omitempty"`
-	StartTLS               bool   `json:"start_tls"`
-	InsecureSkipVerify     bool   `json:"insecure_skip_verify"`
+	Name                   string            `json:"name"`
+	Server                 string            `json:"server"`
+	Port                   uint16            `json:"port"`
+	Servers                []LdapServer      `json:"servers,omitempty"`
+	Order                  int               `json:"order,omitempty"`
+	UsernamePrefixes       []string          `json:"username_prefixes,omitempty"`
+	UsernameSuffixes       []string          `json:"username_suffixes,omitempty"`
+	BaseDN                 string            `json:"base_dn"`
+	ServiceAccountDN       string            `json:"service_account_dn"`
+	ServiceAccountPassword string            `json:"service_account_password,omitempty"`
+	StartTLS               bool              `json:"start_tls"`
+	InsecureSkipVerify     bool              `json:"insecure_skip_verify"`
+	LDAPS                  bool              `json:"ldaps,omitempty"`
+	CACertificate          string            `json:"ca_certificate,omitempty"`
+	ServerName             string            `json:"server_name,omitempty"`
+	ClientCertificate      string            `json:"client_certificate,omitempty"`
+	ClientKey              string            `json:"client_key,omitempty"`
+	ConnectTimeout         int               `json:"connect_timeout,omitempty"`
+	ReadTimeout            int               `json:"read_timeout,omitempty"`
+	PoolSize               int               `json:"pool_size,omitempty"`
+	CacheTTL               int               `json:"cache_ttl,omitempty"`
+	RevalidationInterval   int               `json:"revalidation_interval,omitempty"`
+	DirectoryType          string            `json:"directory_type,omitempty"`
+	UserSearchFilter       string            `json:"user_search_filter,omitempty"`
+	UsernameAttribute      string            `json:"username_attribute,omitempty"`
+	GroupObjectClass       string            `json:"group_object_class,omitempty"`
+	GroupMembership        string            `json:"group_membership,omitempty"`
+	GroupNameAttribute     string            `json:"group_name_attribute,omitempty"`
+	GroupResolution        string            `json:"group_resolution,omitempty"`
+	GroupMaxDepth          int               `json:"group_max_depth,omitempty"`
+	GroupBaseDN            string            `json:"group_base_dn,omitempty"`
+	UserAttributes         map[string]string `json:"user_attributes,omitempty"`
+	UsernamePattern        string            `json:"username_pattern,omitempty"`
+}
+
+// LdapConfigurationTest represents a request to test a LDAP/AD configuration;
+// the configuration need not be saved.
+//
+// Fields:
+//  LdapConfiguration: configuration to be tested; its secrets are given in plain text
+//  Username: user looked up in the directory (optional)
+//  Password: password of the user; the user bind is skipped if it is empty
+type LdapConfigurationTest struct {
+	LdapConfiguration
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
 }
 
 //
@@ -115,10 +352,13 @@ type KVStoreConfig struct {
 // Fields:
 //   Curr: current state for a key in the KV store
 //   Prec: previous state for a key in the KV store
+//   Index: index of the KV store the change was made at; the changes of a
+//     watch are received in this order
 //
 type WatchState struct {
-	Curr State
-	Prev State
+	Curr  State
+	Prev  State
+	Index uint64
 }
 
 //
@@ -13,17 +13,21 @@ import (
 
 //
 // InsertAuthorization is a convenience function to add a new entry
-// to the authz dir
+// to the authz dir; an existing entry with the same UUID is replaced.
+// The authorization is written along with its index keys as a batch
+// (see ApplyAuthorizationChanges).
 //
 func InsertAuthorization(a *types.Authorization) error {
 	defer common.Untrace(common.Trace())
 	log.Debug("creating authorization:", a)
-	return a.Write()
+
+	return ApplyAuthorizationChanges([]AuthorizationChange{{Put: a}})
 }
 
 //
 // GetAuthorization is a convenience function to look up an
-// authorization entry by its UUID.
+// authorization entry by its UUID; it is served from the
+// authorization cache when the cache is in sync.
 //
 func GetAuthorization(UUID string) (types.Authorization, error) {
 	defer common.Untrace(common.Trace())
@@ -34,6 +38,15 @@ func GetAuthorization(UUID string) (types.Authorization, error) {
 		return a, err
 	}
 
+	if cached, found, synced := authorizationCache.get(UUID); synced {
+		if !found {
+			return a, auth_errors.ErrKeyNotFound
+		}
+
+		cached.StateDriver = sd
+		return cached, nil
+	}
+
 	a.StateDriver = sd
 	err = a.Read(UUID)
 	return a, err
@@ -41,26 +54,53 @@ func GetAuthorization(UUID string) (types.Authorization, error) {
 
 //
 // DeleteAuthorization is a convenience function to remove
-// an authz from the authz dir
+// an authz from the authz dir along with its index keys
 //
 func DeleteAuthorization(ID string) error {
 	defer common.Untrace(common.Trace())
 
 	log.Debug("deleting authorization:", ID)
 
-	a := types.Authorization{}
-	a.UUID = ID
-	sd, err := state.GetStateDriver()
-	if err != nil {
+	err := ApplyAuthorizationChanges([]AuthorizationChange{{Delete: ID}})
+	if batchErr, ok := err.(*AuthorizationBatchError); ok && batchErr.Err == auth_errors.ErrKeyNotFound {
+		return nil
+	}
+
+	return err
+}
+
+// deleteAuthorizations deletes the authorizations listed by the given function as a single batch; they
+// are listed again if one of them has been deleted meanwhile.
+// params:
+//  list: lists the authorizations to be deleted
+// return values:
+//  error: nil on success otherwise as returned by list or ApplyAuthorizationChanges
+func deleteAuthorizations(list func() ([]types.Authorization, error)) error {
+	for {
+		authorizations, err := list()
+		if err != nil {
+			return err
+		}
+
+		changes := []AuthorizationChange{}
+		for _, a := range authorizations {
+			changes = append(changes, AuthorizationChange{Delete: a.UUID})
+		}
+
+		err = ApplyAuthorizationChanges(changes)
+		if batchErr, ok := err.(*AuthorizationBatchError); ok && batchErr.Err == auth_errors.ErrKeyNotFound {
+			log.Debugf("authorization deleted meanwhile, listing the authorizations again")
+			continue
+		}
+
 		return err
 	}
-	a.StateDriver = sd
-	return a.Clear()
 }
 
 //
 // ListAuthorizations looks up all authorizations in
-// authz dir
+// authz dir; they are served from the authorization cache
+// when the cache is in sync.
 //
 // Return Values:
 //  []types.Authorization: slice containing authorization instances
@@ -71,22 +111,39 @@ func ListAuthorizations() (
 	[]types.Authorization, error) {
 	defer common.Untrace(common.Trace())
 
-	a := &types.Authorization{}
 	sd, err := state.GetStateDriver()
 	if err != nil {
 		return nil, err
 	}
+
+	if list, synced := cachedAuthorizations("", func(*types.Authorization) bool { return true }); synced {
+		return list, nil
+	}
+
+	list, _, err := readAuthorizations(sd)
+	return list, err
+}
+
+// readAuthorizations reads all the authorizations from the authz dir.
+// params:
+//  sd: data store driver object
+// return values:
+//  []types.Authorization: slice containing authorization instances
+//  uint64: index of the data store the authorizations were read at; the changes made since can be watched
+//  error: nil on success otherwise ErrReadingFromStore
+func readAuthorizations(sd types.StateDriver) ([]types.Authorization, uint64, error) {
+	a := &types.Authorization{}
 	(*a).StateDriver = sd
 
 	list := []types.Authorization{}
-	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
+	allAuthZList, index, err := a.StateDriver.ReadAllStateWithIndex(types.AuthZDir, a, json.Unmarshal)
 	if err != nil {
 		if err == auth_errors.ErrKeyNotFound {
-			return list, nil
+			return list, index, nil
 		}
 
 		log.Error("failed to ReadAllState, err:", err)
-		return nil, auth_errors.ErrReadingFromStore
+		return nil, 0, auth_errors.ErrReadingFromStore
 	}
 
 	for _, auth := range allAuthZList {
@@ -96,12 +153,34 @@ func ListAuthorizations() (
 		}
 	}
 
-	return list, nil
+	return list, index, nil
+}
+
+// cachedAuthorizations looks up the authorizations matching the given filter in the authorization cache.
+// params:
+//  principal: restricts the lookup to the authorizations of this principal unless it is empty
+//  matches: filter of the authorizations
+// return values:
+//  []types.Authorization: authorizations found
+//  bool: whether the cache is in sync; the KV store must be read otherwise
+func cachedAuthorizations(principal string, matches func(*types.Authorization) bool) ([]types.Authorization, bool) {
+	sd, err := state.GetStateDriver()
+	if err != nil {
+		return nil, false
+	}
+
+	list, synced := authorizationCache.list(principal, matches)
+	for i := range list {
+		list[i].StateDriver = sd
+	}
+
+	return list, synced
 }
 
 //
 // ListAuthorizationsByPrincipal looks up all authorizations in
-// authz dir for the specific principal (subject).
+// authz dir for the specific principal (subject) using the authorization
+// cache, or the principal index when the cache is not in sync.
 //
 // Parameters:
 //  ID: of the principal for whom authorizations need to be returned
@@ -115,41 +194,20 @@ func ListAuthorizationsByPrincipal(pName string) (
 	[]types.Authorization, error) {
 	defer common.Untrace(common.Trace())
 
-	a := &types.Authorization{}
-	sd, err := state.GetStateDriver()
-	if err != nil {
-		return nil, err
-	}
-	(*a).StateDriver = sd
-
-	match := []types.Authorization{}
-
-	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
-	if err != nil {
-		if err == auth_errors.ErrKeyNotFound {
-			return match, nil
-		}
-
-		log.Error("failed to ReadAllState, err:", err)
-		return nil, auth_errors.ErrReadingFromStore
+	matches := func(a *types.Authorization) bool {
+		return a.PrincipalName == pName
 	}
 
-	for _, auth := range allAuthZList {
-		tmp, ok := auth.(*types.Authorization)
-		if ok {
-			if tmp.PrincipalName == pName {
-				match = append(match, *tmp)
-
-			}
-		}
+	if list, synced := cachedAuthorizations(pName, matches); synced {
+		return list, nil
 	}
 
-	return match, nil
+	return listIndexedAuthorizations(authzIndexPath(authzIndexByPrincipal, pName), matches)
 }
 
 //
 // DeleteAuthorizationsByPrincipal deletes all authorizations in
-// in the KV store for the specific principal (subject).
+// in the KV store for the specific principal (subject) as a batch.
 //
 // Parameters:
 //  ID: of the principal whose authorizations need to be removed
@@ -161,44 +219,15 @@ func ListAuthorizationsByPrincipal(pName string) (
 func DeleteAuthorizationsByPrincipal(pName string) error {
 	defer common.Untrace(common.Trace())
 
-	a := &types.Authorization{}
-	sd, err := state.GetStateDriver()
-	if err != nil {
-		return err
-	}
-	(*a).StateDriver = sd
-
-	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
-	if err == auth_errors.ErrKeyNotFound {
-		return nil
-	} else if err != nil {
-		log.Error("failed to ReadAllState, err:", err)
-		return auth_errors.ErrReadingFromStore
-	}
-
-	for _, auth := range allAuthZList {
-		tmp, ok := auth.(*types.Authorization)
-		if ok {
-			if tmp.PrincipalName == pName {
-
-				// record UUID so that its key path
-				// can be determined
-				a.UUID = tmp.UUID
-				err = a.Clear()
-				if err != nil {
-					log.Error("failed to delete authorization, err:", err)
-					return err
-				}
-			}
-		}
-	}
-
-	return err
+	return deleteAuthorizations(func() ([]types.Authorization, error) {
+		return ListAuthorizationsByPrincipal(pName)
+	})
 }
 
 //
 // ListAuthorizationsByClaim looks up all authorizations in the
-// authz dir that contains a claim key
+// authz dir that contains a claim key using the authorization cache,
+// or the claim index when the cache is not in sync
 //
 // Parameters:
 //  claim: claim string (object) for which authorizations are being searched.
@@ -213,39 +242,38 @@ func ListAuthorizationsByClaim(claim string) (
 
 	defer common.Untrace(common.Trace())
 
-	a := &types.Authorization{}
-	sd, err := state.GetStateDriver()
-	if err != nil {
-		return nil, err
+	matches := func(a *types.Authorization) bool {
+		return a.ClaimKey == claim
 	}
-	(*a).StateDriver = sd
 
-	match := []types.Authorization{}
+	if list, synced := cachedAuthorizations("", matches); synced {
+		return list, nil
+	}
 
-	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
-	if err != nil {
-		if err == auth_errors.ErrKeyNotFound {
-			return match, nil
-		}
+	return listIndexedAuthorizations(authzIndexPath(authzIndexByClaim, claim), matches)
+}
 
-		log.Error("failed to ReadAllState, err:", err)
-		return nil, auth_errors.ErrReadingFromStore
-	}
+//
+// ListAuthorizationsByTenant looks up all authorizations in the
+// authz dir granting access to a tenant
+//
+// Parameters:
+//  tenantName: name of the tenant for which authorizations are being searched.
+//
+// Return Values:
+//  []types.Authorization: slice containing authorizations
+//  error: Any error encountered when reading from the KV store
+//         nil if operation is successful
+//
+func ListAuthorizationsByTenant(tenantName string) (
+	[]types.Authorization, error) {
 
-	for _, auth := range allAuthZList {
-		tmp, ok := auth.(*types.Authorization)
-		if ok {
-			if tmp.ClaimKey == claim {
-				match = append(match, *tmp)
-			}
-		}
-	}
-	return match, nil
+	return ListAuthorizationsByClaim(types.TenantClaimKey + tenantName)
 }
 
 //
 // DeleteAuthorizationsByClaim deletes all authorizations in the
-// authz dir in the KV store that contain the chosen claim
+// authz dir in the KV store that contain the chosen claim as a batch
 //
 // Parameters:
 //  claim: claim string (object) for which authorizations are being searched.
@@ -258,40 +286,15 @@ func DeleteAuthorizationsByClaim(claim string) error {
 
 	defer common.Untrace(common.Trace())
 
-	a := &types.Authorization{}
-	sd, err := state.GetStateDriver()
-	if err != nil {
-		return err
-	}
-	(*a).StateDriver = sd
-
-	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
-	if err != nil {
-		log.Error("failed to ReadAllState, err:", err)
-		return auth_errors.ErrReadingFromStore
-	}
-
-	for _, auth := range allAuthZList {
-		tmp, ok := auth.(*types.Authorization)
-		if ok {
-			if tmp.ClaimKey == claim {
-				// record UUID so that its key path
-				// can be determined
-				a.UUID = tmp.UUID
-				err = a.Clear()
-				if err != nil {
-					log.Error("failed to delete authorization, err:", err)
-					return err
-				}
-			}
-		}
-	}
-	return err
+	return deleteAuthorizations(func() ([]types.Authorization, error) {
+		return ListAuthorizationsByClaim(claim)
+	})
 }
 
 //
 // ListAuthorizationsByClaimAndPrincipal looks up all authorizations in
-// the KV store for a specific claim and principal
+// the KV store for a specific claim and principal using the authorization
+// cache, or the principal and claim index when the cache is not in sync
 //
 // Parameters:
 //  claim: claim string for which authorizations are being searched.
@@ -307,33 +310,85 @@ func ListAuthorizationsByClaimAndPrincipal(claim string, principal string) (
 
 	defer common.Untrace(common.Trace())
 
-	a := &types.Authorization{}
-	sd, err := state.GetStateDriver()
-	if err != nil {
-		return nil, err
+	matches := func(a *types.Authorization) bool {
+		return (a.ClaimKey == claim) && (a.PrincipalName == principal)
 	}
-	(*a).StateDriver = sd
 
-	match := []types.Authorization{}
+	if list, synced := cachedAuthorizations(principal, matches); synced {
+		return list, nil
+	}
 
-	allAuthZList, err := a.StateDriver.ReadAllState(types.AuthZDir, a, json.Unmarshal)
-	if err != nil {
-		if err == auth_errors.ErrKeyNotFound {
-			return match, nil
-		}
+	return listIndexedAuthorizations(authzIndexPath(authzIndexByPrincipalAndClaim, principal, claim), matches)
+}
 
-		log.Error("failed to ReadAllState, err:", err)
-		return nil, auth_errors.ErrReadingFromStore
+// AuthorizationFilter selects authorizations; empty fields match all the authorizations.
+type AuthorizationFilter struct {
+	PrincipalName string // principal of the authorizations (local groups: see types.LocalGroupPrincipal)
+	Local         *bool  // whether the principal is local (local user or group) or an LDAP group
+	Role          string // role granted (claim value)
+	TenantName    string // tenant the role is granted on
+}
+
+// matches tells whether the given authorization is selected by the filter(receiver).
+func (f *AuthorizationFilter) matches(a *types.Authorization) bool {
+	switch {
+	case f.PrincipalName != "" && a.PrincipalName != f.PrincipalName:
+		return false
+	case f.Local != nil && a.Local != *f.Local:
+		return false
+	case f.Role != "" && a.ClaimValue != f.Role:
+		return false
+	case f.TenantName != "" && a.ClaimKey != types.TenantClaimKey+f.TenantName:
+		return false
 	}
 
-	for _, auth := range allAuthZList {
-		tmp, ok := auth.(*types.Authorization)
-		if ok {
-			if (tmp.ClaimKey == claim) && (tmp.PrincipalName == principal) {
-				match = append(match, *tmp)
-			}
+	return true
+}
+
+//
+// ListAuthorizationsPage looks up a page of the authorizations matching
+// a filter, sorted by UUID. The authorization cache is used when it is in
+// sync; otherwise the principal or claim index is read when the filter
+// selects a principal or a tenant, the index of all the authorizations if
+// not. The index is read at once: it holds the authorizations themselves.
+//
+// Parameters:
+//  filter: selects the authorizations
+//  limit: maximum number of authorizations returned; no limit if <= 0
+//  after: cursor of the page; UUID of the last authorization of the
+//         previous page, empty for the first page
+//
+// Return Values:
+//  []types.Authorization: page of authorizations
+//  string: cursor of the next page; empty on the last page
+//  error: Any error encountered when reading from the KV store
+//         nil if operation is successful
+//
+func ListAuthorizationsPage(filter AuthorizationFilter, limit int, after string) (
+	[]types.Authorization, string, error) {
+
+	defer common.Untrace(common.Trace())
+
+	matches := func(a *types.Authorization) bool {
+		return a.UUID > after && filter.matches(a)
+	}
+
+	list, synced := cachedAuthorizations(filter.PrincipalName, matches)
+	if !synced {
+		indexPath := authzIndexPath(authzIndexAll)
+		switch {
+		case filter.PrincipalName != "":
+			indexPath = authzIndexPath(authzIndexByPrincipal, filter.PrincipalName)
+		case filter.TenantName != "":
+			indexPath = authzIndexPath(authzIndexByClaim, types.TenantClaimKey+filter.TenantName)
 		}
+
+		return pageIndexedAuthorizations(indexPath, matches, limit, after)
+	}
+
+	if limit <= 0 || len(list) <= limit {
+		return list, "", nil
 	}
 
-	return match, nil
+	return list[:limit], list[limit-1].UUID, nil
 }
@@ -0,0 +1,375 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the batches of authorization changes. The data store offers no multi-key
+// transactions (etcd v2 API), so a batch is written through a single document, the batch key:
+//
+//  1. the batch key is created with compare-and-swap; it doubles as the lock of the authorization
+//     writes of all the proxy instances, which all go through a batch
+//  2. the changes are validated against the authorizations as they are then, and the batch key is
+//     swapped to the committed batch: the changes along with the values they replace. This is the
+//     commit point; nothing is written before it.
+//  3. the changes are applied in order; each of them can be applied again with the same outcome,
+//     index keys included
+//  4. the batch key is removed
+//
+// A batch key left unchanged for authzBatchTimeout was abandoned by its writer (e.g. the instance
+// stopped or the data store failed while applying it): it is completed if it was committed, and
+// discarded otherwise, by the next batch or at startup (see EnsureAuthorizationIndexes). Readers can
+// see the changes of a batch being applied; they can't see some changes of a batch for good. The
+// repairs of the indexes hold the batch key as well (see repairAuthorizationIndexes).
+
+var (
+	// time after which an unchanged batch key is considered abandoned by its writer
+	authzBatchTimeout = 15 * time.Second
+
+	// how often a batch waiting for the batch key checks it
+	authzBatchPollInterval = 100 * time.Millisecond
+)
+
+// AuthorizationChange is a change of a batch applied by ApplyAuthorizationChanges; either Put or
+// Delete is set.
+type AuthorizationChange struct {
+	Put    *types.Authorization // authorization to be added or replaced
+	Delete string               // UUID of the authorization to be deleted
+}
+
+// AuthorizationBatchError reports the change of a batch which failed. Nothing was written unless the
+// batch was committed; a committed batch is completed by the next batch or at startup.
+type AuthorizationBatchError struct {
+	Failed    int   // position of the change which failed
+	Err       error // why it failed
+	Committed bool  // whether the batch was committed, i.e. all its changes take effect
+}
+
+// Error returns the description of the failure.
+func (e *AuthorizationBatchError) Error() string {
+	if !e.Committed {
+		return fmt.Sprintf("change %d failed: %v; nothing was written", e.Failed, e.Err)
+	}
+
+	return fmt.Sprintf("change %d failed: %v; the batch is committed and will be completed by the next change", e.Failed, e.Err)
+}
+
+// authzBatch is the document of the batch key.
+type authzBatch struct {
+	ID        string             `json:"id"`        // unique ID of the batch
+	Committed bool               `json:"committed"` // whether the changes are to be applied
+	Changes   []authzBatchChange `json:"changes,omitempty"`
+}
+
+// authzBatchChange is a change of a committed batch along with the value it replaces.
+type authzBatchChange struct {
+	Put      *types.Authorization `json:"put,omitempty"`
+	Delete   string               `json:"delete,omitempty"`
+	Previous *types.Authorization `json:"previous,omitempty"` // nil if the authorization didn't exist
+}
+
+//
+// ApplyAuthorizationChanges applies the given changes to the authz dir, in
+// order, as a single batch: either all of them take effect or none does.
+// Deleting an authorization which doesn't exist fails the batch. Batches
+// (of all the proxy instances) are applied one at a time; a batch waits for
+// the one being applied.
+//
+// Parameters:
+//  changes: changes to be applied
+//
+// Return Values:
+//  error: nil if all the changes were applied,
+//         *AuthorizationBatchError if one of them failed,
+//         auth_errors.ErrKeyModified if another batch could not be waited for,
+//         otherwise any error encountered before the batch was committed
+//
+func ApplyAuthorizationChanges(changes []AuthorizationChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	sd, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	id := uuid.NewV4().String()
+	locked, err := lockAuthorizationBatch(sd, id, true)
+	if err != nil {
+		return err
+	}
+
+	batch, err := planAuthorizationBatch(sd, id, changes)
+	if err != nil {
+		unlockAuthorizationBatch(sd, locked)
+		return err
+	}
+
+	committed, err := json.Marshal(batch)
+	if err != nil {
+		unlockAuthorizationBatch(sd, locked)
+		return err
+	}
+
+	if err := sd.CompareAndSwap(GetPath(RootAuthzBatch), locked, committed); err != nil {
+		// ErrKeyModified: the batch was taken as abandoned and discarded; nothing was written
+		log.Errorf("Failed to commit authorization batch %q: %v", id, err)
+		return err
+	}
+
+	if failed, err := completeAuthorizationBatch(sd, batch, committed); err != nil {
+		return &AuthorizationBatchError{Failed: failed, Err: err, Committed: true}
+	}
+
+	return nil
+}
+
+// lockAuthorizationBatch creates the batch key of a new batch, waiting for the batch being applied if
+// there is one.
+// params:
+//  sd: data store driver object
+//  id: unique ID of the new batch
+//  wait: whether to wait for the batch being applied; ErrKeyModified is returned right away otherwise
+// return values:
+//  []byte: value of the batch key
+//  error: nil on success, ErrKeyModified if the batch key is still taken after waiting for it,
+//         otherwise as returned by the state driver
+func lockAuthorizationBatch(sd types.StateDriver, id string, wait bool) ([]byte, error) {
+	locked, err := json.Marshal(&authzBatch{ID: id})
+	if err != nil {
+		return nil, err
+	}
+
+	// enough for a batch to be applied, and for an abandoned one to be completed
+	deadline := time.Now().Add(3 * authzBatchTimeout)
+	for {
+		err := sd.CompareAndSwap(GetPath(RootAuthzBatch), nil, locked)
+		if err != auth_errors.ErrKeyModified {
+			return locked, err
+		}
+
+		if !wait {
+			return nil, err
+		}
+
+		if time.Now().After(deadline) {
+			log.Errorf("Timed out waiting for the authorization batch being applied")
+			return nil, auth_errors.ErrKeyModified
+		}
+
+		if err := waitAuthorizationBatch(sd); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// unlockAuthorizationBatch removes the batch key of a batch which was not committed.
+// params:
+//  sd: data store driver object
+//  locked: value of the batch key
+func unlockAuthorizationBatch(sd types.StateDriver, locked []byte) {
+	// ErrKeyModified: the batch was taken as abandoned and discarded already
+	if err := sd.CompareAndDelete(GetPath(RootAuthzBatch), locked); err != nil && err != auth_errors.ErrKeyModified {
+		log.Warnf("Failed to remove the authorization batch key, it is discarded after %v: %v", authzBatchTimeout, err)
+	}
+}
+
+// waitAuthorizationBatch waits until the batch key is removed or changes. A batch key left unchanged
+// for authzBatchTimeout was abandoned by its writer: the batch is completed if it was committed and
+// discarded otherwise.
+// params:
+//  sd: data store driver object
+// return values:
+//  error: nil on success, otherwise as returned by the state driver or completeAuthorizationBatch
+func waitAuthorizationBatch(sd types.StateDriver) error {
+	var seen []byte
+	since := time.Now()
+
+	for {
+		raw, err := sd.Read(GetPath(RootAuthzBatch))
+		switch {
+		case err == auth_errors.ErrKeyNotFound:
+			return nil
+		case err != nil:
+			log.Errorf("Failed to read the authorization batch key: %v", err)
+			return err
+		case seen == nil:
+			seen = raw
+		case !bytes.Equal(raw, seen):
+			return nil
+		case time.Since(since) >= authzBatchTimeout:
+			return recoverAuthorizationBatch(sd, raw)
+		}
+
+		time.Sleep(authzBatchPollInterval)
+	}
+}
+
+// recoverAuthorizationBatch completes or discards a batch abandoned by its writer.
+// params:
+//  sd: data store driver object
+//  raw: value of the batch key
+// return values:
+//  error: nil on success, otherwise as returned by the state driver or completeAuthorizationBatch
+func recoverAuthorizationBatch(sd types.StateDriver, raw []byte) error {
+	batch := &authzBatch{}
+	if err := json.Unmarshal(raw, batch); err != nil {
+		log.Errorf("Failed to unmarshal the authorization batch key: %v", err)
+		return err
+	}
+
+	if !batch.Committed {
+		log.Warnf("Discarding authorization batch %q abandoned before it was committed", batch.ID)
+		if err := sd.CompareAndDelete(GetPath(RootAuthzBatch), raw); err != nil && err != auth_errors.ErrKeyModified {
+			return err
+		}
+
+		return nil
+	}
+
+	log.Warnf("Completing authorization batch %q abandoned by its writer", batch.ID)
+	_, err := completeAuthorizationBatch(sd, batch, raw)
+	return err
+}
+
+// planAuthorizationBatch validates the given changes against the authorizations as they are, and as
+// left by the previous changes, and records the values they replace.
+// params:
+//  sd: data store driver object
+//  id: unique ID of the batch
+//  changes: changes to be applied
+// return values:
+//  *authzBatch: committed batch
+//  error: nil on success, otherwise *AuthorizationBatchError; ErrKeyNotFound if the authorization to
+//         be deleted doesn't exist
+func planAuthorizationBatch(sd types.StateDriver, id string, changes []AuthorizationChange) (*authzBatch, error) {
+	batch := &authzBatch{ID: id, Committed: true}
+
+	// authorizations as left by the changes planned; nil if deleted
+	current := map[string]*types.Authorization{}
+
+	for i, change := range changes {
+		uuid := change.Delete
+		if change.Put != nil {
+			uuid = change.Put.UUID
+		}
+
+		previous, found := current[uuid]
+		if !found {
+			var err error
+			if previous, err = readAuthorization(sd, uuid); err != nil {
+				return nil, &AuthorizationBatchError{Failed: i, Err: err}
+			}
+		}
+
+		if change.Put == nil && previous == nil {
+			return nil, &AuthorizationBatchError{Failed: i, Err: auth_errors.ErrKeyNotFound}
+		}
+
+		batch.Changes = append(batch.Changes, authzBatchChange{Put: change.Put, Delete: change.Delete, Previous: previous})
+		current[uuid] = change.Put
+	}
+
+	return batch, nil
+}
+
+// readAuthorization reads the current value of an authorization.
+// params:
+//  sd: data store driver object
+//  uuid: UUID of the authorization
+// return values:
+//  *types.Authorization: current value; nil if the authorization doesn't exist
+//  error: nil on success, otherwise as returned by the state driver
+func readAuthorization(sd types.StateDriver, uuid string) (*types.Authorization, error) {
+	a := &types.Authorization{}
+	a.StateDriver = sd
+	if err := a.Read(uuid); err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, nil
+		}
+
+		log.Errorf("Failed to read authorization %q: %v", uuid, err)
+		return nil, err
+	}
+
+	a.StateDriver = nil
+	return a, nil
+}
+
+// completeAuthorizationBatch applies the changes of a committed batch and removes the batch key.
+// params:
+//  sd: data store driver object
+//  batch: committed batch
+//  committed: value of the batch key
+// return values:
+//  int: position of the change which failed
+//  error: nil on success, otherwise as returned by applyAuthorizationChange; the batch key is left
+//         to be completed again
+func completeAuthorizationBatch(sd types.StateDriver, batch *authzBatch, committed []byte) (int, error) {
+	for i, change := range batch.Changes {
+		if err := applyAuthorizationChange(sd, change); err != nil {
+			log.Errorf("Failed to apply change %d of authorization batch %q, it is completed after %v: %v",
+				i, batch.ID, authzBatchTimeout, err)
+			return i, err
+		}
+	}
+
+	// ErrKeyModified: the batch was completed by another instance as well
+	if err := sd.CompareAndDelete(GetPath(RootAuthzBatch), committed); err != nil && err != auth_errors.ErrKeyModified {
+		// harmless: applying the batch again changes nothing
+		log.Warnf("Failed to remove the key of authorization batch %q: %v", batch.ID, err)
+	}
+
+	return 0, nil
+}
+
+// applyAuthorizationChange applies a change of a committed batch along with the index keys of the
+// authorization; applying it again has the same outcome.
+// params:
+//  sd: data store driver object
+//  change: change to be applied
+// return values:
+//  error: nil on success otherwise as returned by the state driver
+func applyAuthorizationChange(sd types.StateDriver, change authzBatchChange) error {
+	if change.Put == nil {
+		a := types.Authorization{UUID: change.Delete}
+		a.StateDriver = sd
+		if err := a.Clear(); err != nil && err != auth_errors.ErrKeyNotFound {
+			return err
+		}
+
+		authorizationCache.delete(change.Delete)
+		return unindexAuthorization(sd, change.Previous, nil)
+	}
+
+	a := *change.Put
+	a.StateDriver = sd
+	if err := indexAuthorization(sd, &a); err != nil {
+		return err
+	}
+
+	if err := a.Write(); err != nil {
+		return err
+	}
+
+	// the cache is updated by the watch as well; this makes the change visible to this instance right away
+	authorizationCache.put(a)
+
+	// the principal or claim of the replaced value might differ
+	if change.Previous != nil {
+		return unindexAuthorization(sd, change.Previous, &a)
+	}
+
+	return nil
+}
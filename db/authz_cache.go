@@ -0,0 +1,531 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the in-memory cache of the authorizations. Once started, it holds all the
+// authorizations and is kept up to date by watching the authz dir, so that the RBAC checks don't
+// read the data store. The watch starts at the index of the data store the authorizations were loaded
+// at, so that no change made in between is lost. Lookups go to the data store whenever the cache is not
+// in sync, i.e. before it is loaded and while the watch is broken. The periodic reloads double as a
+// liveness check of the watch: a watch which has missed changes is replaced by a new one.
+
+const (
+	// the cache is reloaded periodically to correct changes missed by the watch
+	authzCacheResyncInterval = 5 * time.Minute
+
+	// delay before a failed load or a broken watch is retried
+	authzCacheRetryInterval = 5 * time.Second
+)
+
+// states of the authorization cache
+const (
+	AuthzCacheDisabled = "disabled" // not started (e.g. initial setup)
+	AuthzCacheLoading  = "loading"  // started, not loaded yet
+	AuthzCacheSynced   = "synced"   // lookups are served from the cache
+	AuthzCacheFallback = "fallback" // the watch or the load failed; lookups go to the data store
+)
+
+// AuthorizationCacheStatus represents the state of the authorization cache.
+type AuthorizationCacheStatus struct {
+	State            string `json:"state"`
+	Authorizations   int    `json:"authorizations"`
+	SyncedAt         int64  `json:"synced_at,omitempty"`        // last full load, unix timestamp
+	LastEventAt      int64  `json:"last_event_at,omitempty"`    // last change received from the watch, unix timestamp
+	WatchStartedAt   int64  `json:"watch_started_at,omitempty"` // start of the current watch, unix timestamp
+	WatchAlive       bool   `json:"watch_alive"`                // the watch is running and has missed no change so far
+	StalenessSeconds int64  `json:"staleness_seconds"`          // 0 while the watch is alive, else time since the last full load
+	Corrections      uint64 `json:"corrections"`                // changes missed by the watch, corrected by the periodic reloads
+	Error            string `json:"error,omitempty"`            // why the cache fell back to the data store or the watch was restarted
+}
+
+// authzCache holds the authorizations by UUID along with an index by principal.
+type authzCache struct {
+	mutex          sync.RWMutex
+	state          string
+	byUUID         map[string]types.Authorization
+	byPrincipal    map[string]map[string]bool // principal name -> authorization UUIDs
+	syncedAt       time.Time
+	lastEventAt    time.Time
+	watchStartedAt time.Time
+	watchAlive     bool
+	corrections    uint64
+	err            string
+
+	// changes made up to this index of the data store are loaded; the watch doesn't apply them again
+	loadedIndex uint64
+
+	// authorizations changed by the last reload: the watch has missed their changes unless it delivers them
+	unconfirmed map[string]bool
+}
+
+// authorizationCache is the cache used by the lookups of this package
+var authorizationCache = newAuthzCache()
+
+// newAuthzCache returns an empty cache which is not started.
+func newAuthzCache() *authzCache {
+	return &authzCache{
+		state:       AuthzCacheDisabled,
+		byUUID:      map[string]types.Authorization{},
+		byPrincipal: map[string]map[string]bool{},
+		unconfirmed: map[string]bool{},
+	}
+}
+
+//
+// StartAuthorizationCache loads all the authorizations into memory and keeps
+// them up to date by watching the authz dir in the background; it does nothing
+// if the cache is already started. Lookups go to the KV store until the cache
+// is loaded.
+//
+// Return Values:
+//  error: Any error encountered when getting the state driver
+//         nil if the cache is started
+//
+func StartAuthorizationCache() error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	authorizationCache.mutex.Lock()
+	defer authorizationCache.mutex.Unlock()
+
+	if authorizationCache.state != AuthzCacheDisabled {
+		return nil
+	}
+
+	authorizationCache.state = AuthzCacheLoading
+	go authorizationCache.run(stateDrv)
+	return nil
+}
+
+//
+// GetAuthorizationCacheStatus returns the state of the authorization cache.
+//
+// Return Values:
+//  *AuthorizationCacheStatus: state of the cache and how stale it might be
+//
+func GetAuthorizationCacheStatus() *AuthorizationCacheStatus {
+	return authorizationCache.status()
+}
+
+// run loads the authorizations and watches the authz dir from the index of the data store they were
+// loaded at, applying the changes to the cache. The watch is restarted, after the cache is loaded
+// again, if it fails or if a periodic reload finds changes it has missed. The previous watch is
+// always stopped first.
+// params:
+//  stateDrv: data store driver object
+func (ac *authzCache) run(stateDrv types.StateDriver) {
+	resync := time.NewTicker(authzCacheResyncInterval)
+	defer resync.Stop()
+
+	for {
+		index, err := ac.load(stateDrv)
+		if err != nil {
+			time.Sleep(authzCacheRetryInterval)
+			continue
+		}
+
+		changes := make(chan types.WatchState, 64)
+		stop := make(chan struct{})
+		watchErr := make(chan error, 1)
+		go func() {
+			watchErr <- stateDrv.WatchAllStateUntil(types.AuthZDir, index, &types.Authorization{}, json.Unmarshal, changes, stop)
+		}()
+		ac.watchStarted()
+
+		// reloads the cache; false if the watch has missed changes and must be restarted
+		var reload <-chan time.Time
+		check := func() bool {
+			missed, err := ac.resync(stateDrv)
+			switch {
+			case err != nil:
+				reload = time.After(authzCacheRetryInterval)
+			case missed > 0:
+				// the cache is correct again, but the watch can't be trusted anymore
+				ac.watchFailed(fmt.Errorf("watch of the authorizations missed %d changes", missed), false)
+				return false
+			}
+
+			return true
+		}
+
+	watching:
+		for {
+			select {
+			case change := <-changes:
+				if !ac.apply(change) {
+					// e.g. the whole authz dir was removed
+					reload = time.After(0)
+					break
+				}
+
+				// the lookups go to the indexes while the cache is not in sync
+				uuid := changedAuthorization(change)
+				if err := repairAuthorizationIndex(stateDrv, uuid); err != nil && err != auth_errors.ErrKeyModified {
+					log.Warnf("Failed to repair the index keys of authorization %q: %v", uuid, err)
+				}
+			case <-reload:
+				reload = nil
+				if !check() {
+					break watching
+				}
+			case <-resync.C:
+				if !check() {
+					break watching
+				}
+			case err := <-watchErr:
+				ac.watchFailed(fmt.Errorf("watch of the authorizations stopped: %v", err), true)
+				break watching
+			}
+		}
+
+		close(stop)
+		time.Sleep(authzCacheRetryInterval)
+	}
+}
+
+// watchStarted records the start of a new watch.
+func (ac *authzCache) watchStarted() {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	ac.watchStartedAt = time.Now()
+	ac.watchAlive = true
+}
+
+// watchFailed records the failure of the watch, which is going to be restarted.
+// params:
+//  err: why the watch failed
+//  fallback: whether the lookups must go to the data store until the cache is loaded again
+func (ac *authzCache) watchFailed(err error, fallback bool) {
+	if fallback {
+		ac.fallback(err)
+	} else {
+		log.Errorf("Restarting the watch of the authorization cache: %v", err)
+	}
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	ac.watchAlive = false
+	ac.err = err.Error()
+}
+
+// load replaces the content of the cache with the authorizations read from the data store; they are kept
+// up to date by a new watch.
+// params:
+//  stateDrv: data store driver object
+// return values:
+//  uint64: index of the data store the authorizations were read at; the new watch starts from there
+//  error: nil on success otherwise as returned by read
+func (ac *authzCache) load(stateDrv types.StateDriver) (uint64, error) {
+	authorizations, index, err := ac.read(stateDrv)
+	if err != nil {
+		return 0, err
+	}
+
+	ac.replace(authorizations, index, true)
+	return index, nil
+}
+
+// resync replaces the content of the cache with the authorizations read from the data store while the
+// watch keeps running, and tells whether the watch has missed changes (see replace).
+// params:
+//  stateDrv: data store driver object
+// return values:
+//  int: number of changes missed by the watch
+//  error: nil on success otherwise as returned by read
+func (ac *authzCache) resync(stateDrv types.StateDriver) (int, error) {
+	authorizations, index, err := ac.read(stateDrv)
+	if err != nil {
+		return 0, err
+	}
+
+	return ac.replace(authorizations, index, false), nil
+}
+
+// read reads the authorizations from the data store and repairs the index keys which differ from them
+// (see repairAuthorizationIndexes).
+// params:
+//  stateDrv: data store driver object
+// return values:
+//  []types.Authorization: authorizations read
+//  uint64: index of the data store they were read at
+//  error: nil on success otherwise as returned by readAuthorizations; the cache falls back
+//         to the data store until it is loaded
+func (ac *authzCache) read(stateDrv types.StateDriver) ([]types.Authorization, uint64, error) {
+	authorizations, index, err := readAuthorizations(stateDrv)
+	if err != nil {
+		ac.fallback(fmt.Errorf("failed to load the authorizations: %v", err))
+		return nil, 0, err
+	}
+
+	// retried on the next load; ErrKeyModified: a batch is being applied
+	if err := repairAuthorizationIndexes(stateDrv, authorizations, false); err != nil && err != auth_errors.ErrKeyModified {
+		log.Warnf("Failed to repair the index keys of the authorizations: %v", err)
+	}
+
+	return authorizations, index, nil
+}
+
+// replace replaces the content of the cache with the given authorizations and marks it as synced; the
+// changes made up to the index they were read at are not applied again when the watch delivers them.
+// The watch may not have delivered yet the changes of the entries which differ from the cached ones,
+// e.g. writes in flight: they are left unconfirmed until it delivers a change of them. The entries
+// still unconfirmed by the next reload are the changes the watch has missed.
+// params:
+//  authorizations: authorizations read from the data store
+//  index: index of the data store they were read at
+//  newWatch: true if a new watch starts from this index; the previous watch is not checked then
+// return values:
+//  int: number of changes missed by the watch, left unconfirmed since the previous reload
+func (ac *authzCache) replace(authorizations []types.Authorization, index uint64, newWatch bool) int {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	previous := ac.byUUID
+	ac.byUUID = map[string]types.Authorization{}
+	ac.byPrincipal = map[string]map[string]bool{}
+	for _, a := range authorizations {
+		ac.add(a)
+	}
+
+	missed := 0
+	unconfirmed := map[string]bool{}
+	if !newWatch {
+		missed = len(ac.unconfirmed)
+		for uuid, a := range ac.byUUID {
+			if old, found := previous[uuid]; !found || !reflect.DeepEqual(old, a) {
+				unconfirmed[uuid] = true
+			}
+		}
+
+		for uuid := range previous {
+			if _, found := ac.byUUID[uuid]; !found {
+				unconfirmed[uuid] = true
+			}
+		}
+
+		if missed > 0 {
+			log.Warnf("The watch missed %d changes of the authorizations corrected by the previous reload", missed)
+			ac.corrections += uint64(missed)
+		}
+	}
+
+	ac.unconfirmed = unconfirmed
+	ac.loadedIndex = index
+	ac.state = AuthzCacheSynced
+	ac.syncedAt = time.Now()
+	if ac.watchAlive {
+		ac.err = ""
+	}
+
+	return missed
+}
+
+// fallback makes the lookups go to the data store until the cache is loaded again.
+func (ac *authzCache) fallback(err error) {
+	log.Errorf("Authorization cache falling back to the data store: %v", err)
+
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	ac.state = AuthzCacheFallback
+	ac.err = err.Error()
+}
+
+// apply applies a change received from the watch, unless it was made before the cache was loaded.
+// params:
+//  change: current and previous value of the authorization; Curr is nil if it was deleted
+// return values:
+//  bool: false if the change doesn't refer to an authorization and the cache must be reloaded
+func (ac *authzCache) apply(change types.WatchState) bool {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	ac.lastEventAt = time.Now()
+
+	curr, _ := change.Curr.(*types.Authorization)
+	uuid := changedAuthorization(change)
+	if uuid == "" {
+		return false
+	}
+
+	// the watch delivers the changes of this authorization
+	delete(ac.unconfirmed, uuid)
+
+	// the change is already loaded
+	if change.Index <= ac.loadedIndex {
+		return true
+	}
+
+	ac.remove(uuid)
+	if curr != nil {
+		ac.add(*curr)
+	}
+
+	return true
+}
+
+// changedAuthorization returns the UUID of the authorization changed; empty if the change doesn't refer
+// to an authorization.
+func changedAuthorization(change types.WatchState) string {
+	if curr, ok := change.Curr.(*types.Authorization); ok && curr != nil {
+		return curr.UUID
+	}
+
+	if prev, ok := change.Prev.(*types.Authorization); ok && prev != nil {
+		return prev.UUID
+	}
+
+	return ""
+}
+
+// put adds or replaces an authorization written by this instance (see applyAuthorizationChange).
+func (ac *authzCache) put(a types.Authorization) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	if ac.state == AuthzCacheDisabled {
+		return
+	}
+
+	ac.remove(a.UUID)
+	ac.add(a)
+}
+
+// delete removes an authorization deleted by this instance (see applyAuthorizationChange).
+func (ac *authzCache) delete(uuid string) {
+	ac.mutex.Lock()
+	defer ac.mutex.Unlock()
+
+	ac.remove(uuid)
+}
+
+// add adds the given authorization; the mutex must be held for writing.
+func (ac *authzCache) add(a types.Authorization) {
+	// the state driver is not compared nor needed by the callers
+	a.StateDriver = nil
+	ac.byUUID[a.UUID] = a
+
+	if _, found := ac.byPrincipal[a.PrincipalName]; !found {
+		ac.byPrincipal[a.PrincipalName] = map[string]bool{}
+	}
+	ac.byPrincipal[a.PrincipalName][a.UUID] = true
+}
+
+// remove removes the authorization having the given UUID; the mutex must be held for writing.
+func (ac *authzCache) remove(uuid string) {
+	a, found := ac.byUUID[uuid]
+	if !found {
+		return
+	}
+
+	delete(ac.byUUID, uuid)
+	delete(ac.byPrincipal[a.PrincipalName], uuid)
+	if len(ac.byPrincipal[a.PrincipalName]) == 0 {
+		delete(ac.byPrincipal, a.PrincipalName)
+	}
+}
+
+// get looks up an authorization by its UUID.
+// return values:
+//  types.Authorization: the authorization if found
+//  bool: whether it was found
+//  bool: whether the cache is synced; the data store must be read otherwise
+func (ac *authzCache) get(uuid string) (types.Authorization, bool, bool) {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+
+	if ac.state != AuthzCacheSynced {
+		return types.Authorization{}, false, false
+	}
+
+	a, found := ac.byUUID[uuid]
+	return a, found, true
+}
+
+// list returns the cached authorizations, sorted by UUID, which match the given filter.
+// params:
+//  principal: restricts the lookup to the authorizations of this principal unless it is empty
+//  matches: filter of the authorizations
+// return values:
+//  []types.Authorization: authorizations found
+//  bool: whether the cache is synced; the data store must be read otherwise
+func (ac *authzCache) list(principal string, matches func(*types.Authorization) bool) ([]types.Authorization, bool) {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+
+	if ac.state != AuthzCacheSynced {
+		return nil, false
+	}
+
+	uuids := []string{}
+	if principal != "" {
+		for uuid := range ac.byPrincipal[principal] {
+			uuids = append(uuids, uuid)
+		}
+	} else {
+		for uuid := range ac.byUUID {
+			uuids = append(uuids, uuid)
+		}
+	}
+	sort.Strings(uuids)
+
+	match := []types.Authorization{}
+	for _, uuid := range uuids {
+		a := ac.byUUID[uuid]
+		if matches(&a) {
+			match = append(match, a)
+		}
+	}
+
+	return match, true
+}
+
+// status returns the state of the cache.
+func (ac *authzCache) status() *AuthorizationCacheStatus {
+	ac.mutex.RLock()
+	defer ac.mutex.RUnlock()
+
+	status := &AuthorizationCacheStatus{
+		State:          ac.state,
+		Authorizations: len(ac.byUUID),
+		Corrections:    ac.corrections,
+		Error:          ac.err,
+	}
+
+	if !ac.syncedAt.IsZero() {
+		status.SyncedAt = ac.syncedAt.Unix()
+	}
+
+	// changes are applied as they happen while the watch is alive
+	if !ac.syncedAt.IsZero() && !(ac.watchAlive && ac.state == AuthzCacheSynced) {
+		status.StalenessSeconds = int64(time.Since(ac.syncedAt) / time.Second)
+	}
+
+	if !ac.lastEventAt.IsZero() {
+		status.LastEventAt = ac.lastEventAt.Unix()
+	}
+
+	if !ac.watchStartedAt.IsZero() {
+		status.WatchStartedAt = ac.watchStartedAt.Unix()
+		status.WatchAlive = ac.watchAlive
+	}
+
+	return status
+}
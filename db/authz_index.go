@@ -0,0 +1,410 @@
+package db
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"path"
+	"sort"
+
+	log "github.com/Sirupsen/logrus"
+	uuid "github.com/satori/go.uuid"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the secondary indexes of the authorizations. They let the lookups by
+// principal and/or claim read only the relevant authorizations instead of the whole authz dir.
+//
+// "Schema" of the index keys; the value of each key is a copy of the authorization, so that a
+// lookup reads nothing but its index:
+//
+//  /[RootAuthzIndex]/principal/{principal}/{AuthZID}
+//  /[RootAuthzIndex]/claim/{claim key}/{AuthZID}
+//  /[RootAuthzIndex]/principal_claim/{principal}/{claim key}/{AuthZID}
+//  /[RootAuthzIndex]/all/{AuthZID}
+//
+// Principal names and claim keys are base64 (URL alphabet) encoded as they may contain `/`.
+// Tenant authorizations are indexed by their claim key `tenant:{tenant name}`.
+//
+// An authorization and its index keys are written by the same batch (see ApplyAuthorizationChanges),
+// which is completed even if its writer fails half way through; while a batch is applied, the lookups
+// may return the value an authorization had before it. The previous releases write no index keys at
+// all, which matters while the proxy instances are upgraded one by one: the index keys which differ
+// from the authorizations, i.e. missing, outdated or left behind by a deletion, are repaired at startup
+// (EnsureAuthorizationIndexes), on every load of the authorization cache and as soon as the watch of
+// the cache reports the change. Repairs hold the batch key, so that they don't overlap with batches.
+
+// kinds of authorization indexes
+const (
+	authzIndexAll                 = "all" // all the authorizations, listed by page
+	authzIndexByPrincipal         = "principal"
+	authzIndexByClaim             = "claim"
+	authzIndexByPrincipalAndClaim = "principal_claim"
+)
+
+// authzIndexPath returns the data store path of an index holding the authorizations having the given
+// values (principal and/or claim key).
+func authzIndexPath(kind string, values ...string) string {
+	strs := []string{RootAuthzIndex, kind}
+	for _, value := range values {
+		strs = append(strs, base64.RawURLEncoding.EncodeToString([]byte(value)))
+	}
+
+	return GetPath(strs...)
+}
+
+// authzIndexKeys returns the index keys of the given authorization, in the order they are written;
+// the key of the index of all the authorizations comes last, as the repairs compare it with the
+// authorizations (see staleAuthorizationIndexes).
+func authzIndexKeys(a *types.Authorization) []string {
+	return []string{
+		path.Join(authzIndexPath(authzIndexByPrincipal, a.PrincipalName), a.UUID),
+		path.Join(authzIndexPath(authzIndexByClaim, a.ClaimKey), a.UUID),
+		path.Join(authzIndexPath(authzIndexByPrincipalAndClaim, a.PrincipalName, a.ClaimKey), a.UUID),
+		path.Join(authzIndexPath(authzIndexAll), a.UUID),
+	}
+}
+
+// indexAuthorization writes the index keys of the given authorization.
+// params:
+//  stateDrv: data store driver object
+//  a: authorization to be indexed
+// return values:
+//  error: nil on success otherwise as returned by the state driver
+func indexAuthorization(stateDrv types.StateDriver, a *types.Authorization) error {
+	value, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range authzIndexKeys(a) {
+		if err := stateDrv.Write(key, value); err != nil {
+			log.Errorf("Failed to write authorization index key %q: %v", key, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexAuthorization removes the index keys of the given authorization, except the ones it shares
+// with the value replacing it.
+// params:
+//  stateDrv: data store driver object
+//  a: authorization to be removed from the indexes
+//  kept: value replacing the authorization; nil if it is deleted
+// return values:
+//  error: nil on success otherwise as returned by the state driver
+func unindexAuthorization(stateDrv types.StateDriver, a, kept *types.Authorization) error {
+	keptKeys := map[string]bool{}
+	if kept != nil {
+		for _, key := range authzIndexKeys(kept) {
+			keptKeys[key] = true
+		}
+	}
+
+	for _, key := range authzIndexKeys(a) {
+		if keptKeys[key] {
+			continue
+		}
+
+		if err := stateDrv.Clear(key); err != nil && err != auth_errors.ErrKeyNotFound {
+			log.Errorf("Failed to clear authorization index key %q: %v", key, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readIndex reads the authorizations held by the given index.
+// params:
+//  stateDrv: data store driver object
+//  indexPath: data store path of the index (see authzIndexPath)
+// return values:
+//  []types.Authorization: authorizations of the index, in no particular order
+//  error: nil on success otherwise ErrReadingFromStore
+func readIndex(stateDrv types.StateDriver, indexPath string) ([]types.Authorization, error) {
+	list := []types.Authorization{}
+
+	// the trailing separator keeps consul from listing the indexes sharing the prefix
+	values, err := stateDrv.ReadAll(indexPath + "/")
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return list, nil
+		}
+
+		log.Error("failed to read authorization index, err:", err)
+		return nil, auth_errors.ErrReadingFromStore
+	}
+
+	for _, value := range values {
+		a := types.Authorization{}
+		if err := json.Unmarshal(value, &a); err != nil {
+			log.Error("failed to unmarshal authorization index key, err:", err)
+			return nil, auth_errors.ErrReadingFromStore
+		}
+
+		a.StateDriver = stateDrv
+		list = append(list, a)
+	}
+
+	return list, nil
+}
+
+// listIndexedAuthorizations looks up the authorizations held by the given index.
+// params:
+//  indexPath: data store path of the index (see authzIndexPath)
+//  matches: filter of the authorizations
+// return values:
+//  []types.Authorization: authorizations found in the index
+//  error: nil on success otherwise ErrReadingFromStore
+func listIndexedAuthorizations(indexPath string, matches func(*types.Authorization) bool) ([]types.Authorization, error) {
+	list, _, err := pageIndexedAuthorizations(indexPath, matches, 0, "")
+	return list, err
+}
+
+// pageIndexedAuthorizations looks up a page of the authorizations held by the given index, sorted by
+// UUID; the index is read at once.
+// params:
+//  indexPath: data store path of the index (see authzIndexPath)
+//  matches: filter of the authorizations
+//  limit: maximum number of authorizations returned; no limit if <= 0
+//  after: UUID of the last authorization of the previous page, empty for the first page
+// return values:
+//  []types.Authorization: page of authorizations found in the index
+//  string: cursor of the next page; empty on the last page
+//  error: nil on success otherwise ErrReadingFromStore
+func pageIndexedAuthorizations(indexPath string, matches func(*types.Authorization) bool, limit int, after string) (
+	[]types.Authorization, string, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, "", err
+	}
+
+	indexed, err := readIndex(stateDrv, indexPath)
+	if err != nil {
+		return nil, "", err
+	}
+
+	match := []types.Authorization{}
+	for i := range indexed {
+		if indexed[i].UUID > after && matches(&indexed[i]) {
+			match = append(match, indexed[i])
+		}
+	}
+
+	sort.Slice(match, func(i, j int) bool {
+		return match[i].UUID < match[j].UUID
+	})
+
+	if limit <= 0 || len(match) <= limit {
+		return match, "", nil
+	}
+
+	return match[:limit], match[limit-1].UUID, nil
+}
+
+//
+// EnsureAuthorizationIndexes completes the authorization batch abandoned by
+// its writer, if any, and repairs the index keys which differ from the
+// authorizations, e.g. missing for the authorizations written by a previous
+// release. This must be called before the authorizations are looked up.
+//
+// Return Values:
+//  error: Any error encountered when reading or writing the KV store
+//         nil if operation is successful
+//
+func EnsureAuthorizationIndexes() error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	if err := waitAuthorizationBatch(stateDrv); err != nil {
+		return err
+	}
+
+	authorizations, _, err := readAuthorizations(stateDrv)
+	if err != nil {
+		return err
+	}
+
+	return repairAuthorizationIndexes(stateDrv, authorizations, true)
+}
+
+// authzIndexRepair is an authorization whose index keys differ from it.
+type authzIndexRepair struct {
+	current *types.Authorization // authorization; nil if it doesn't exist
+	indexed *types.Authorization // value held by the index of all the authorizations; nil if none
+}
+
+// repair rewrites the index keys of the authorization(receiver).
+// params:
+//  stateDrv: data store driver object
+// return values:
+//  error: nil on success otherwise as returned by the state driver
+func (r *authzIndexRepair) repair(stateDrv types.StateDriver) error {
+	if r.current != nil {
+		if err := indexAuthorization(stateDrv, r.current); err != nil {
+			return err
+		}
+	}
+
+	if r.indexed != nil {
+		return unindexAuthorization(stateDrv, r.indexed, r.current)
+	}
+
+	return nil
+}
+
+// sameAuthorization tells whether the given authorizations, either of which may be nil, are the same.
+func sameAuthorization(a, b *types.Authorization) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	x, y := *a, *b
+	x.StateDriver, y.StateDriver = nil, nil
+	return x == y
+}
+
+// staleAuthorizationIndexes compares the given authorizations with the index of all the
+// authorizations; the index keys are written in order, so the other indexes are up to date if it is.
+// params:
+//  stateDrv: data store driver object
+//  authorizations: all the authorizations
+// return values:
+//  []authzIndexRepair: authorizations whose index keys differ from them
+//  error: nil on success otherwise ErrReadingFromStore
+func staleAuthorizationIndexes(stateDrv types.StateDriver, authorizations []types.Authorization) ([]authzIndexRepair, error) {
+	indexed, err := readIndex(stateDrv, authzIndexPath(authzIndexAll))
+	if err != nil {
+		return nil, err
+	}
+
+	byUUID := map[string]*types.Authorization{}
+	for i := range indexed {
+		byUUID[indexed[i].UUID] = &indexed[i]
+	}
+
+	repairs := []authzIndexRepair{}
+	for i := range authorizations {
+		current := &authorizations[i]
+		if !sameAuthorization(current, byUUID[current.UUID]) {
+			repairs = append(repairs, authzIndexRepair{current: current, indexed: byUUID[current.UUID]})
+		}
+
+		delete(byUUID, current.UUID)
+	}
+
+	// left behind by a deletion
+	for _, a := range byUUID {
+		repairs = append(repairs, authzIndexRepair{indexed: a})
+	}
+
+	return repairs, nil
+}
+
+// repairAuthorizationIndexes repairs the index keys which differ from the given authorizations; the
+// authorizations are read again once the batch key is held.
+// params:
+//  stateDrv: data store driver object
+//  authorizations: all the authorizations
+//  wait: whether to wait for the batch being applied, if any; ErrKeyModified is returned otherwise
+// return values:
+//  error: nil on success otherwise as returned by readAuthorizations, lockAuthorizationBatch or the state driver
+func repairAuthorizationIndexes(stateDrv types.StateDriver, authorizations []types.Authorization, wait bool) error {
+	repairs, err := staleAuthorizationIndexes(stateDrv, authorizations)
+	if err != nil || len(repairs) == 0 {
+		return err
+	}
+
+	locked, err := lockAuthorizationBatch(stateDrv, uuid.NewV4().String(), wait)
+	if err != nil {
+		return err
+	}
+	defer unlockAuthorizationBatch(stateDrv, locked)
+
+	if authorizations, _, err = readAuthorizations(stateDrv); err != nil {
+		return err
+	}
+
+	if repairs, err = staleAuthorizationIndexes(stateDrv, authorizations); err != nil {
+		return err
+	}
+
+	for i := range repairs {
+		if err := repairs[i].repair(stateDrv); err != nil {
+			return err
+		}
+	}
+
+	if len(repairs) > 0 {
+		log.Infof("Repaired the index keys of %d authorizations written by a previous release", len(repairs))
+	}
+
+	return nil
+}
+
+// readIndexedAuthorization reads an authorization along with the value held by the index of all the
+// authorizations.
+// params:
+//  stateDrv: data store driver object
+//  authzUUID: UUID of the authorization
+// return values:
+//  authzIndexRepair: the authorization and its indexed value
+//  error: nil on success otherwise as returned by the state driver
+func readIndexedAuthorization(stateDrv types.StateDriver, authzUUID string) (authzIndexRepair, error) {
+	current, err := readAuthorization(stateDrv, authzUUID)
+	if err != nil {
+		return authzIndexRepair{}, err
+	}
+
+	value, err := stateDrv.Read(path.Join(authzIndexPath(authzIndexAll), authzUUID))
+	switch err {
+	case nil:
+	case auth_errors.ErrKeyNotFound:
+		return authzIndexRepair{current: current}, nil
+	default:
+		return authzIndexRepair{}, err
+	}
+
+	indexed := &types.Authorization{}
+	if err := json.Unmarshal(value, indexed); err != nil {
+		return authzIndexRepair{}, err
+	}
+
+	return authzIndexRepair{current: current, indexed: indexed}, nil
+}
+
+// repairAuthorizationIndex repairs the index keys of an authorization reported by the watch if they
+// differ from it, e.g. it was written or deleted by a previous release. The repair is left to the next
+// load of the authorization cache while a batch is applied.
+// params:
+//  stateDrv: data store driver object
+//  authzUUID: UUID of the authorization
+// return values:
+//  error: nil on success, ErrKeyModified if a batch is being applied, otherwise as returned by
+//         the state driver
+func repairAuthorizationIndex(stateDrv types.StateDriver, authzUUID string) error {
+	r, err := readIndexedAuthorization(stateDrv, authzUUID)
+	if err != nil || sameAuthorization(r.current, r.indexed) {
+		return err
+	}
+
+	locked, err := lockAuthorizationBatch(stateDrv, uuid.NewV4().String(), false)
+	if err != nil {
+		return err
+	}
+	defer unlockAuthorizationBatch(stateDrv, locked)
+
+	if r, err = readIndexedAuthorization(stateDrv, authzUUID); err != nil || sameAuthorization(r.current, r.indexed) {
+		return err
+	}
+
+	log.Infof("Repairing the index keys of authorization %q written by a previous release", authzUUID)
+	return r.repair(stateDrv)
+}
@@ -1,6 +1,11 @@
 package db
 
 import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/state"
 	. "gopkg.in/check.v1"
@@ -170,3 +175,309 @@ func (s *dbSuite) TestListAuthorizationsByClaimAndPrincipal(c *C) {
 
 	c.Assert(len(aList), Equals, 0)
 }
+
+// TestAuthorizationIndexes tests that the lookups only use the index keys of the authorizations
+func (s *dbSuite) TestAuthorizationIndexes(c *C) {
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+
+	// principal names may contain path separators
+	a3 := types.Authorization{
+		CommonState:   commonState,
+		UUID:          "5555",
+		PrincipalName: "CN=devs/ops,OU=groups,DC=example,DC=com",
+		ClaimKey:      types.TenantClaimKey + "Tenant1",
+		ClaimValue:    "devops",
+	}
+
+	c.Assert(InsertAuthorization(&a1), IsNil)
+	c.Assert(InsertAuthorization(&a3), IsNil)
+
+	aList, err := ListAuthorizationsByClaimAndPrincipal(a3.ClaimKey, a3.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a3})
+
+	aList, err = ListAuthorizationsByTenant("Tenant1")
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a3})
+
+	// replacing an authorization moves it to the indexes of its new principal
+	a3.PrincipalName = "ops"
+	c.Assert(InsertAuthorization(&a3), IsNil)
+
+	aList, err = ListAuthorizationsByPrincipal("CN=devs/ops,OU=groups,DC=example,DC=com")
+	c.Assert(err, IsNil)
+	c.Assert(len(aList), Equals, 0)
+
+	aList, err = ListAuthorizationsByPrincipal("ops")
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a3})
+
+	// authorizations written without index keys are not found until the indexes are repaired
+	c.Assert(a2.Write(), IsNil)
+	aList, err = ListAuthorizationsByPrincipal(a2.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(len(aList), Equals, 1)
+
+	c.Assert(EnsureAuthorizationIndexes(), IsNil)
+	aList, err = ListAuthorizationsByPrincipal(a2.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(len(aList), Equals, 2)
+
+	// authorizations written by a previous release since, e.g. during a rolling upgrade, are indexed
+	// when they are scanned again or reported by the watch
+	a4 := a2
+	a4.UUID = "6666"
+	a4.PrincipalName = "rolling"
+	c.Assert(a4.Write(), IsNil)
+	c.Assert(EnsureAuthorizationIndexes(), IsNil)
+
+	a5 := a4
+	a5.UUID = "7777"
+	c.Assert(a5.Write(), IsNil)
+	c.Assert(repairAuthorizationIndex(stateDrv, a5.UUID), IsNil)
+
+	aList, err = ListAuthorizationsByPrincipal("rolling")
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a4, a5})
+
+	// so are their updates and deletions
+	a5.ClaimValue = types.Admin.String()
+	c.Assert(a5.Write(), IsNil)
+	c.Assert(repairAuthorizationIndex(stateDrv, a5.UUID), IsNil)
+	c.Assert(a4.Clear(), IsNil)
+	c.Assert(repairAuthorizationIndex(stateDrv, a4.UUID), IsNil)
+
+	aList, err = ListAuthorizationsByPrincipal("rolling")
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a5})
+
+	// index keys left behind by a deletion are removed when the indexes are repaired
+	c.Assert(a1.Clear(), IsNil)
+	c.Assert(EnsureAuthorizationIndexes(), IsNil)
+	aList, err = ListAuthorizationsByPrincipal(a1.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a2})
+
+	_, err = stateDrv.Read(authzIndexPath(authzIndexByPrincipal, a1.PrincipalName) + "/" + a1.UUID)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	// the index keys are not repaired while a batch is applied
+	c.Assert(a2.Clear(), IsNil)
+	c.Assert(stateDrv.Write(GetPath(RootAuthzBatch), []byte(`{"id":"pending","committed":false}`)), IsNil)
+	c.Assert(repairAuthorizationIndex(stateDrv, a2.UUID), Equals, auth_errors.ErrKeyModified)
+	c.Assert(stateDrv.Clear(GetPath(RootAuthzBatch)), IsNil)
+	c.Assert(repairAuthorizationIndex(stateDrv, a2.UUID), IsNil)
+
+	aList, err = ListAuthorizationsByPrincipal(a2.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(len(aList), Equals, 0)
+}
+
+// TestAuthorizationCache tests applying the changes watched to the authorization cache
+func (s *dbSuite) TestAuthorizationCache(c *C) {
+	ac := newAuthzCache()
+	byPrincipal := func(a *types.Authorization) bool { return a.PrincipalName == a1.PrincipalName }
+
+	// lookups go to the data store until the cache is loaded
+	_, synced := ac.list(a1.PrincipalName, byPrincipal)
+	c.Assert(synced, Equals, false)
+
+	ac.replace([]types.Authorization{a2, a1}, 10, true)
+	aList, synced := ac.list(a1.PrincipalName, byPrincipal)
+	c.Assert(synced, Equals, true)
+	c.Assert(len(aList), Equals, 2)
+	c.Assert(aList[0].UUID, Equals, a1.UUID)
+
+	// an update moving the authorization to another principal
+	moved := a2
+	moved.PrincipalName = "4444"
+	c.Assert(ac.apply(types.WatchState{Curr: &moved, Prev: &a2, Index: 11}), Equals, true)
+
+	aList, _ = ac.list(a1.PrincipalName, byPrincipal)
+	c.Assert(len(aList), Equals, 1)
+	aList, _ = ac.list("4444", func(*types.Authorization) bool { return true })
+	c.Assert(len(aList), Equals, 1)
+
+	// a delete
+	c.Assert(ac.apply(types.WatchState{Prev: &a1, Index: 12}), Equals, true)
+	_, found, synced := ac.get(a1.UUID)
+	c.Assert(synced, Equals, true)
+	c.Assert(found, Equals, false)
+
+	// events not referring to an authorization require a reload
+	c.Assert(ac.apply(types.WatchState{Index: 13}), Equals, false)
+
+	// a reload is not checked against the changes the watch has yet to deliver
+	ac.watchStarted()
+	c.Assert(ac.replace([]types.Authorization{a1, moved}, 20, false), Equals, 0)
+	_, found, _ = ac.get(a1.UUID)
+	c.Assert(found, Equals, true)
+
+	// which are not applied again once delivered
+	c.Assert(ac.apply(types.WatchState{Prev: &a1, Index: 15}), Equals, true)
+	_, found, _ = ac.get(a1.UUID)
+	c.Assert(found, Equals, true)
+
+	// the changes the watch doesn't deliver before the next reload are missed
+	c.Assert(ac.replace([]types.Authorization{moved}, 30, false), Equals, 0)
+	c.Assert(ac.replace([]types.Authorization{moved}, 40, false), Equals, 1)
+	status := ac.status()
+	c.Assert(status.State, Equals, AuthzCacheSynced)
+	c.Assert(status.Authorizations, Equals, 1)
+	c.Assert(status.Corrections, Equals, uint64(1))
+	c.Assert(status.WatchAlive, Equals, true)
+	c.Assert(status.StalenessSeconds, Equals, int64(0))
+
+	// a watch which has missed changes is restarted; the cache stays in sync meanwhile
+	ac.watchFailed(errors.New("missed changes"), false)
+	status = ac.status()
+	c.Assert(status.State, Equals, AuthzCacheSynced)
+	c.Assert(status.WatchAlive, Equals, false)
+	c.Assert(status.Error, Equals, "missed changes")
+
+	ac.fallback(auth_errors.ErrReadingFromStore)
+	_, synced = ac.list("", func(*types.Authorization) bool { return true })
+	c.Assert(synced, Equals, false)
+	c.Assert(ac.status().State, Equals, AuthzCacheFallback)
+}
+
+// TestApplyAuthorizationChanges tests that nothing is written by a batch which fails before it is committed
+func (s *dbSuite) TestApplyAuthorizationChanges(c *C) {
+	c.Assert(InsertAuthorization(&a2), IsNil)
+
+	updated := a2
+	updated.ClaimValue = types.Admin.String()
+
+	err := ApplyAuthorizationChanges([]AuthorizationChange{
+		{Put: &a1},
+		{Put: &updated},
+		{Delete: "missing"},
+	})
+	batchErr, ok := err.(*AuthorizationBatchError)
+	c.Assert(ok, Equals, true)
+	c.Assert(batchErr.Failed, Equals, 2)
+	c.Assert(batchErr.Err, Equals, auth_errors.ErrKeyNotFound)
+	c.Assert(batchErr.Committed, Equals, false)
+
+	_, err = GetAuthorization(a1.UUID)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	a, err := GetAuthorization(a2.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(a, Equals, a2)
+
+	c.Assert(ApplyAuthorizationChanges([]AuthorizationChange{{Put: &updated}, {Delete: a2.UUID}}), IsNil)
+	_, err = GetAuthorization(a2.UUID)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+	_, err = stateDrv.Read(GetPath(RootAuthzBatch))
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+}
+
+// TestAbandonedAuthorizationBatch tests that a batch abandoned by its writer is completed if it was
+// committed, and discarded otherwise
+func (s *dbSuite) TestAbandonedAuthorizationBatch(c *C) {
+	defer func(timeout time.Duration) { authzBatchTimeout = timeout }(authzBatchTimeout)
+	authzBatchTimeout = 200 * time.Millisecond
+
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+
+	// abandoned before it was committed: nothing is written
+	c.Assert(stateDrv.Write(GetPath(RootAuthzBatch), []byte(`{"id":"abandoned","committed":false}`)), IsNil)
+	c.Assert(InsertAuthorization(&a2), IsNil)
+
+	aList, err := ListAuthorizationsByPrincipal(a1.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a2})
+
+	// abandoned half way through: the authorization is written along with its index keys
+	planned, err := planAuthorizationBatch(stateDrv, "abandoned", []AuthorizationChange{{Put: &a1}, {Delete: a2.UUID}})
+	c.Assert(err, IsNil)
+	committed, err := json.Marshal(planned)
+	c.Assert(err, IsNil)
+	c.Assert(stateDrv.Write(GetPath(RootAuthzBatch), committed), IsNil)
+	c.Assert(a1.Write(), IsNil)
+
+	c.Assert(EnsureAuthorizationIndexes(), IsNil)
+	aList, err = ListAuthorizationsByPrincipal(a1.PrincipalName)
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a1})
+
+	_, err = stateDrv.Read(GetPath(RootAuthzBatch))
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	c.Assert(DeleteAuthorization(a1.UUID), IsNil)
+}
+
+// TestListAuthorizationsPage tests filtering and paging the authorizations
+func (s *dbSuite) TestListAuthorizationsPage(c *C) {
+	c.Assert(InsertAuthorization(&a1), IsNil)
+	c.Assert(InsertAuthorization(&a2), IsNil)
+
+	local := false
+	aList, next, err := ListAuthorizationsPage(AuthorizationFilter{PrincipalName: a1.PrincipalName, Local: &local}, 1, "")
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a1})
+	c.Assert(next, Equals, a1.UUID)
+
+	aList, next, err = ListAuthorizationsPage(AuthorizationFilter{PrincipalName: a1.PrincipalName}, 1, next)
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a2})
+	c.Assert(next, Equals, "")
+
+	aList, _, err = ListAuthorizationsPage(AuthorizationFilter{Role: a1.ClaimValue}, 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(aList), Equals, 2)
+
+	// without principal nor tenant, the page is read from the index of all the authorizations
+	aList, next, err = ListAuthorizationsPage(AuthorizationFilter{Role: a1.ClaimValue}, 1, a1.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(aList, DeepEquals, []types.Authorization{a2})
+	c.Assert(next, Equals, "")
+
+	local = true
+	aList, _, err = ListAuthorizationsPage(AuthorizationFilter{Local: &local}, 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(aList), Equals, 0)
+}
+
+// TestTimeBoundAuthorization tests that the validity period of an authz is stored
+func (s *dbSuite) TestTimeBoundAuthorization(c *C) {
+	now := time.Now()
+
+	a := a1
+	a.NotBefore, a.ExpiresAt = now.Unix()-10, now.Unix()+10
+	c.Assert(InsertAuthorization(&a), IsNil)
+
+	stored, err := GetAuthorization(a.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(stored.NotBefore, Equals, a.NotBefore)
+	c.Assert(stored.ExpiresAt, Equals, a.ExpiresAt)
+	c.Assert(stored.IsActive(now), Equals, true)
+	c.Assert(stored.IsActive(now.Add(-time.Minute)), Equals, false)
+	c.Assert(stored.IsExpired(now.Add(time.Minute)), Equals, true)
+
+	c.Assert(DeleteAuthorization(a.UUID), IsNil)
+}
+
+// TestDenyAuthorization tests that a deny authz and the resource it is limited to are stored
+func (s *dbSuite) TestDenyAuthorization(c *C) {
+	a := a1
+	a.ClaimValue, a.Deny, a.ResourceType, a.ResourceName = "", true, "networks", "n1"
+	c.Assert(InsertAuthorization(&a), IsNil)
+
+	stored, err := GetAuthorization(a.UUID)
+	c.Assert(err, IsNil)
+	c.Assert(stored.Deny, Equals, true)
+	c.Assert(stored.ResourceType, Equals, a.ResourceType)
+	c.Assert(stored.ResourceName, Equals, a.ResourceName)
+	c.Assert(stored.Denies(types.Resource{Type: "networks", Name: "n1"}), Equals, true)
+	c.Assert(stored.Denies(types.Resource{Type: "networks", Name: "n2"}), Equals, false)
+	c.Assert(stored.Denies(types.Resource{}), Equals, false)
+
+	c.Assert(DeleteAuthorization(a.UUID), IsNil)
+}
@@ -0,0 +1,93 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the APIs to store the state of the break-glass emergency access.
+
+// GetBreakGlass retrieves the state of the break-glass access from the data store.
+// return values:
+//  *types.BreakGlass: reference to the state of the break-glass access
+//  error: auth_errors.ErrKeyNotFound if the access was never armed or any relevant error
+func GetBreakGlass() (*types.BreakGlass, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	rawData, err := stateDrv.Read(GetPath(RootBreakGlass))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read break-glass access from data store: %#v", err)
+	}
+
+	breakGlass := &types.BreakGlass{}
+	if err := json.Unmarshal(rawData, breakGlass); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal break-glass access %#v", err)
+	}
+
+	return breakGlass, nil
+}
+
+// SwapBreakGlass replaces the state of the break-glass access in the data store (/auth_proxy/break_glass) only if it hasn't changed
+// since it was read; this makes the use of a code atomic across the proxy instances sharing the data store.
+// params:
+//  current: state of the access as returned by GetBreakGlass; nil if the access was never armed
+//  breakGlass: state to be written to the data store
+// return values:
+//  error: nil on success, auth_errors.ErrKeyModified if the state has changed in the meantime
+//         otherwise any relevant error
+func SwapBreakGlass(current, breakGlass *types.BreakGlass) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	rawData, err := stateDrv.Read(GetPath(RootBreakGlass))
+	switch {
+	case err == auth_errors.ErrKeyNotFound:
+		rawData = nil
+	case err != nil:
+		return fmt.Errorf("Failed to read break-glass access from data store: %#v", err)
+	}
+
+	// the raw value is swapped; it must still be the state the caller has read
+	if (rawData == nil) != (current == nil) {
+		return auth_errors.ErrKeyModified
+	}
+
+	if rawData != nil {
+		stored := &types.BreakGlass{}
+		if err := json.Unmarshal(rawData, stored); err != nil {
+			return fmt.Errorf("Failed to unmarshal break-glass access %#v", err)
+		}
+
+		if *stored != *current {
+			return auth_errors.ErrKeyModified
+		}
+	}
+
+	val, err := json.Marshal(breakGlass)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal break-glass access %#v: %#v", breakGlass, err)
+	}
+
+	if err := stateDrv.CompareAndSwap(GetPath(RootBreakGlass), rawData, val); err != nil {
+		if err == auth_errors.ErrKeyModified {
+			return err
+		}
+
+		return fmt.Errorf("Failed to write break-glass access to data store: %#v", err)
+	}
+
+	return nil
+}
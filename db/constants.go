@@ -10,8 +10,17 @@ import (
 
 // various data store paths.
 var (
-	RootLocalUsers        = "local_users"
-	RootLdapConfiguration = "ldap_configuration"
+	RootLocalUsers         = "local_users"
+	RootLocalUserIndex     = "local_user_index" // index of the local users, listed by page
+	RootLocalGroups        = "local_groups"
+	RootLdapConfiguration  = "ldap_configuration" // used by the previous releases; migrated on access
+	RootLdapConfigurations = "ldap_configurations"
+	RootPasswordPolicy     = "password_policy"
+	RootPrincipals         = "principals"
+	RootAuthzIndex         = "authz_index" // secondary indexes of the authorizations
+	RootAuthzBatch         = "authz_batch" // batch of authorization changes being applied
+	RootElevationRequests  = "elevation_requests"
+	RootBreakGlass         = "break_glass"
 )
 
 // GetPath joins the given list of strings using path separator with `root` data store path.
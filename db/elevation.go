@@ -0,0 +1,162 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/contiv/auth_proxy/common"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the APIs to store the elevation requests and the decisions taken on them.
+
+// GetElevationRequests returns the elevation requests matching the given filters, oldest first.
+// params:
+//  requester: username of the requester; all the requesters if empty
+//  status: status of the requests; all the statuses if empty
+// return values:
+//  []*types.ElevationRequest: slice of elevation requests
+//  error: as returned by consecutive func calls
+func GetElevationRequests(requester, status string) ([]*types.ElevationRequest, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	requests := []*types.ElevationRequest{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootElevationRequests))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return requests, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch elevation requests from data store")
+	}
+
+	for _, data := range rawData {
+		request := &types.ElevationRequest{}
+		if err := json.Unmarshal(data, request); err != nil {
+			return nil, err
+		}
+
+		if (!common.IsEmpty(requester) && request.Requester != requester) || (!common.IsEmpty(status) && request.Status != status) {
+			continue
+		}
+
+		requests = append(requests, request)
+	}
+
+	sort.Slice(requests, func(i, j int) bool {
+		if requests[i].CreatedAt != requests[j].CreatedAt {
+			return requests[i].CreatedAt < requests[j].CreatedAt
+		}
+
+		return requests[i].ID < requests[j].ID
+	})
+
+	return requests, nil
+}
+
+// GetElevationRequest looks up an elevation request in `/auth_proxy/elevation_requests` path.
+// params:
+//  id: ID of the request
+// return values:
+//  *types.ElevationRequest: reference to the request fetched from data store
+//  error: auth_errors.ErrKeyNotFound if the request doesn't exist or any relevant error
+func GetElevationRequest(id string) (*types.ElevationRequest, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	rawData, err := stateDrv.Read(GetPath(RootElevationRequests, id))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read elevation request %q data from store: %#v", id, err)
+	}
+
+	request := &types.ElevationRequest{}
+	if err := json.Unmarshal(rawData, request); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal elevation request %q info %#v", id, err)
+	}
+
+	return request, nil
+}
+
+// WriteElevationRequest adds or updates an elevation request in `/auth_proxy/elevation_requests` path.
+// params:
+//  request: elevation request to be written
+// return values:
+//  error: nil on success otherwise any relevant error
+func WriteElevationRequest(request *types.ElevationRequest) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal elevation request %#v: %#v", request, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootElevationRequests, request.ID), val); err != nil {
+		return fmt.Errorf("Failed to write elevation request to data store: %#v", err)
+	}
+
+	return nil
+}
+
+// SwapElevationRequest replaces an elevation request in `/auth_proxy/elevation_requests` path only if it hasn't
+// changed since it was read; this makes deciding a request atomic across the proxy instances sharing the data store.
+// params:
+//  current: request as returned by GetElevationRequest
+//  request: request to be written; it must have the same ID
+// return values:
+//  error: nil on success, auth_errors.ErrKeyModified if the request has changed or was removed in the meantime
+//         otherwise any relevant error
+func SwapElevationRequest(current, request *types.ElevationRequest) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	key := GetPath(RootElevationRequests, request.ID)
+	rawData, err := stateDrv.Read(key)
+	switch {
+	case err == auth_errors.ErrKeyNotFound:
+		return auth_errors.ErrKeyModified
+	case err != nil:
+		return fmt.Errorf("Failed to read elevation request %q data from store: %#v", request.ID, err)
+	}
+
+	// the raw value is swapped; it must still be the request the caller has read
+	stored := &types.ElevationRequest{}
+	if err := json.Unmarshal(rawData, stored); err != nil {
+		return fmt.Errorf("Failed to unmarshal elevation request %q info %#v", request.ID, err)
+	}
+
+	if *stored != *current {
+		return auth_errors.ErrKeyModified
+	}
+
+	val, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal elevation request %#v: %#v", request, err)
+	}
+
+	if err := stateDrv.CompareAndSwap(key, rawData, val); err != nil {
+		if err == auth_errors.ErrKeyModified {
+			return err
+		}
+
+		return fmt.Errorf("Failed to write elevation request to data store: %#v", err)
+	}
+
+	return nil
+}
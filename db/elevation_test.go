@@ -0,0 +1,60 @@
+package db
+
+import (
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestElevationRequests tests writing and listing elevation requests
+func (s *dbSuite) TestElevationRequests(c *C) {
+	first := &types.ElevationRequest{ID: "e1", Requester: "aaa", Role: "admin", Status: types.ElevationPending, CreatedAt: 2}
+	second := &types.ElevationRequest{ID: "e2", Requester: "bbb", Role: "admin", Status: types.ElevationPending, CreatedAt: 1}
+	c.Assert(WriteElevationRequest(first), IsNil)
+	c.Assert(WriteElevationRequest(second), IsNil)
+
+	obtained, err := GetElevationRequest("e1")
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, first)
+
+	_, err = GetElevationRequest("e3")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	// oldest first
+	requests, err := GetElevationRequests("", "")
+	c.Assert(err, IsNil)
+	c.Assert(requests, DeepEquals, []*types.ElevationRequest{second, first})
+
+	first.Status = types.ElevationDenied
+	c.Assert(WriteElevationRequest(first), IsNil)
+
+	requests, err = GetElevationRequests("", types.ElevationPending)
+	c.Assert(err, IsNil)
+	c.Assert(requests, DeepEquals, []*types.ElevationRequest{second})
+
+	requests, err = GetElevationRequests("aaa", "")
+	c.Assert(err, IsNil)
+	c.Assert(requests, DeepEquals, []*types.ElevationRequest{first})
+}
+
+// TestSwapElevationRequest tests `SwapElevationRequest(...)`
+func (s *dbSuite) TestSwapElevationRequest(c *C) {
+	pending := &types.ElevationRequest{ID: "e1", Requester: "aaa", Role: "admin", Status: types.ElevationPending, CreatedAt: 1}
+	c.Assert(WriteElevationRequest(pending), IsNil)
+
+	approved := *pending
+	approved.Status, approved.Decider = types.ElevationApproved, "bbb"
+	c.Assert(SwapElevationRequest(pending, &approved), IsNil)
+
+	// a concurrent decision on the pending request fails
+	denied := *pending
+	denied.Status, denied.Decider = types.ElevationDenied, "ccc"
+	c.Assert(SwapElevationRequest(pending, &denied), Equals, auth_errors.ErrKeyModified)
+
+	obtained, err := GetElevationRequest("e1")
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, &approved)
+
+	missing := &types.ElevationRequest{ID: "e2", Status: types.ElevationPending}
+	c.Assert(SwapElevationRequest(missing, missing), Equals, auth_errors.ErrKeyModified)
+}
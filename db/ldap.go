@@ -3,46 +3,167 @@ package db
 import (
 	"encoding/json"
 	"fmt"
+	"sort"
 
+	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/state"
 )
 
-// getLdapConfiguration helper function to retrieve LDAP configuration from the data store.
-// It also decrypts the encrypted password obtained from store.
+// This file contains all LDAP configuration management APIs.
+// Every configuration (domain) is stored under `/auth_proxy/ldap_configurations/<name>`.
+
+// migrateLdapConfiguration helper function to move the configuration stored by the
+// previous releases (/auth_proxy/ldap_configuration) to `/auth_proxy/ldap_configurations/default`.
 // params:
 //  stateDrv: data store driver object
+// return values:
+//  error: nil if there is nothing to migrate or on successful migration, otherwise any relevant error
+func migrateLdapConfiguration(stateDrv types.StateDriver) error {
+	rawData, err := stateDrv.Read(GetPath(RootLdapConfiguration))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil
+		}
+
+		return fmt.Errorf("Failed to read ldap setting from data store: %#v", err)
+	}
+
+	ldapConfiguration := &types.LdapConfiguration{}
+	if err := json.Unmarshal(rawData, ldapConfiguration); err != nil {
+		return fmt.Errorf("Failed to unmarshal ldap setting %#v: %#v", rawData, err)
+	}
+
+	if common.IsEmpty(ldapConfiguration.Name) {
+		ldapConfiguration.Name = types.DefaultLdapConfigurationName
+	}
+
+	// secrets are already encrypted; write the object as is
+	if err := writeLdapConfiguration(stateDrv, ldapConfiguration); err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(GetPath(RootLdapConfiguration)); err != nil {
+		return fmt.Errorf("Failed to clear LDAP setting from data store: %#v", err)
+	}
+
+	log.Infof("Migrated LDAP configuration to %q", GetPath(RootLdapConfigurations, ldapConfiguration.Name))
+	return nil
+}
+
+// getLdapConfiguration helper function to retrieve the given LDAP configuration from the data store.
+// Secrets (service account password, client key) are returned as stored i.e. encrypted.
+// params:
+//  stateDrv: data store driver object
+//  name: name of the LDAP configuration
+// return values:
 //  *types.LdapConfiguration: reference to LDAP configuration object
 //  error: nil on successful fetch otherwise anything as returned
 //         by consecutive calls or any relevant custom error
-func getLdapConfiguration(stateDrv types.StateDriver) (*types.LdapConfiguration, error) {
-	rawData, err := stateDrv.Read(GetPath(RootLdapConfiguration))
+func getLdapConfiguration(stateDrv types.StateDriver, name string) (*types.LdapConfiguration, error) {
+	if err := migrateLdapConfiguration(stateDrv); err != nil {
+		return nil, err
+	}
+
+	rawData, err := stateDrv.Read(GetPath(RootLdapConfigurations, name))
 	if err != nil {
 		if err == auth_errors.ErrKeyNotFound {
 			return nil, err
 		}
 
-		return nil, fmt.Errorf("Failed to read ldap setting from data store: %#v", err)
+		return nil, fmt.Errorf("Failed to read ldap setting %q from data store: %#v", name, err)
 	}
 
 	ldapConfiguration := &types.LdapConfiguration{}
-	if err := json.Unmarshal(rawData, &ldapConfiguration); err != nil {
+	if err := json.Unmarshal(rawData, ldapConfiguration); err != nil {
 		return nil, fmt.Errorf("Failed to unmarshal ldap setting %#v: %#v", rawData, err)
 	}
 
 	return ldapConfiguration, nil
 }
 
+// writeLdapConfiguration helper function to write the given LDAP configuration to the data store.
+// params:
+//  stateDrv: data store driver object
+//  ldapConfiguration: LDAP configuration object to be written
+// return values:
+//  error: nil on success otherwise any relevant error
+func writeLdapConfiguration(stateDrv types.StateDriver, ldapConfiguration *types.LdapConfiguration) error {
+	val, err := json.Marshal(ldapConfiguration)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal LDAP configuration %#v, %#v", ldapConfiguration, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootLdapConfigurations, ldapConfiguration.Name), val); err != nil {
+		return fmt.Errorf("Failed to write LDAP setting to data store: %#v", err)
+	}
+
+	return nil
+}
+
+// GetLdapConfigurations retrieves all the LDAP configurations from the data store.
+// return values:
+//  []*types.LdapConfiguration: LDAP configurations sorted by their `Order` and then name
+//  error: as returned by consecutive func calls
+func GetLdapConfigurations() ([]*types.LdapConfiguration, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := migrateLdapConfiguration(stateDrv); err != nil {
+		return nil, err
+	}
+
+	configurations := []*types.LdapConfiguration{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootLdapConfigurations))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return configurations, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch LDAP configurations from data store")
+	}
+
+	for _, data := range rawData {
+		ldapConfiguration := &types.LdapConfiguration{}
+		if err := json.Unmarshal(data, ldapConfiguration); err != nil {
+			return nil, err
+		}
+
+		configurations = append(configurations, ldapConfiguration)
+	}
+
+	sort.Slice(configurations, func(i, j int) bool {
+		if configurations[i].Order != configurations[j].Order {
+			return configurations[i].Order < configurations[j].Order
+		}
+
+		return configurations[i].Name < configurations[j].Name
+	})
+
+	return configurations, nil
+}
+
 // UpdateLdapConfiguration updates the existing LDAP configuration with the new configuration given.
 // params:
-//  ldapConfiguration: representation of the LDAP configuration to be updated to data store
+//  ldapConfiguration: representation of the LDAP configuration to be updated to data store;
+//                     the configuration to be updated is identified by its name
 // return values:
 //  error: nil on successful update, otherwise anything as returned
 //         by the consecutive function calls or any relevant custom error
 func UpdateLdapConfiguration(ldapConfiguration *types.LdapConfiguration) error {
-	err := DeleteLdapConfiguration()
+	if ldapConfiguration == nil {
+		return fmt.Errorf("Invalid LDAP configuration")
+	}
+
+	if common.IsEmpty(ldapConfiguration.Name) {
+		ldapConfiguration.Name = types.DefaultLdapConfigurationName
+	}
+
+	err := DeleteLdapConfiguration(ldapConfiguration.Name)
 	switch err {
 	case nil:
 		return AddLdapConfiguration(ldapConfiguration)
@@ -54,41 +175,47 @@ func UpdateLdapConfiguration(ldapConfiguration *types.LdapConfiguration) error {
 
 }
 
-// GetLdapConfiguration retrieves LDAP configuration from the data store.
+// GetLdapConfiguration retrieves the given LDAP configuration from the data store.
+// params:
+//  name: name of the LDAP configuration
 // return values:
 //  *types.LdapConfiguration: reference to the LDAP configuration fetched from data store
 //  error: as returned by `state.GetStateDriver/getLdapConfiguration`
-func GetLdapConfiguration() (*types.LdapConfiguration, error) {
+func GetLdapConfiguration(name string) (*types.LdapConfiguration, error) {
 	stateDrv, err := state.GetStateDriver()
 	if err != nil {
 		return nil, err
 	}
 
-	return getLdapConfiguration(stateDrv)
+	return getLdapConfiguration(stateDrv, name)
 }
 
-// DeleteLdapConfiguration deletes LDAP configuration from the data store.
+// DeleteLdapConfiguration deletes the given LDAP configuration from the data store.
+// params:
+//  name: name of the LDAP configuration
 // return values:
-//  error: nil on successful deletion of `/auth_proxy/ldap_configuration`
+//  error: nil on successful deletion of `/auth_proxy/ldap_configurations/<name>`
 //         otherwise any error as returned by consecutive function calls or relevant custom error
-func DeleteLdapConfiguration() error {
+func DeleteLdapConfiguration(name string) error {
 	stateDrv, err := state.GetStateDriver()
 	if err != nil {
 		return err
 	}
 
-	if _, err := getLdapConfiguration(stateDrv); err != nil {
+	if _, err := getLdapConfiguration(stateDrv, name); err != nil {
 		return err
 	}
 
-	if err := stateDrv.Clear(GetPath(RootLdapConfiguration)); err != nil {
+	if err := stateDrv.Clear(GetPath(RootLdapConfigurations, name)); err != nil {
 		return fmt.Errorf("Failed to clear LDAP setting from data store: %#v", err)
 	}
 
 	return nil
 }
 
-// AddLdapConfiguration adds the given LDAP configuration to the data store (/auth_proxy/ldap_configuration).
+// AddLdapConfiguration adds the given LDAP configuration to the data store (/auth_proxy/ldap_configurations/<name>).
+// Configurations without a name are added as types.DefaultLdapConfigurationName.
+// Service account password and client key are encrypted before they are stored.
 // params:
 //  ldapConfiguration: representation of the LDAP configuration to be added to data store
 // return values:
@@ -100,7 +227,11 @@ func AddLdapConfiguration(ldapConfiguration *types.LdapConfiguration) error {
 		return err
 	}
 
-	_, err = getLdapConfiguration(stateDrv)
+	if common.IsEmpty(ldapConfiguration.Name) {
+		ldapConfiguration.Name = types.DefaultLdapConfigurationName
+	}
+
+	_, err = getLdapConfiguration(stateDrv, ldapConfiguration.Name)
 	switch err {
 	case nil:
 		return auth_errors.ErrKeyExists
@@ -110,16 +241,12 @@ func AddLdapConfiguration(ldapConfiguration *types.LdapConfiguration) error {
 			return fmt.Errorf("Failed to encrypt LDAP service account password: %#v", err)
 		}
 
-		val, err := json.Marshal(ldapConfiguration)
+		ldapConfiguration.ClientKey, err = common.EncryptEnvelope(ldapConfiguration.ClientKey)
 		if err != nil {
-			return fmt.Errorf("Failed to marshal LDAP configuration %#v, %#v", ldapConfiguration, err)
-		}
-
-		if err := stateDrv.Write(GetPath(RootLdapConfiguration), val); err != nil {
-			return fmt.Errorf("Failed to write LDAP setting to data store: %#v", err)
+			return fmt.Errorf("Failed to encrypt LDAP client key: %#v", err)
 		}
 
-		return nil
+		return writeLdapConfiguration(stateDrv, ldapConfiguration)
 	default:
 		return err
 	}
@@ -1,8 +1,10 @@
 package db
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/contiv/auth_proxy/common"
@@ -24,28 +26,113 @@ func GetLocalUsers() ([]*types.LocalUser, error) {
 		return nil, err
 	}
 
-	users := []*types.LocalUser{}
 	rawData, err := stateDrv.ReadAll(GetPath(RootLocalUsers))
 	if err != nil {
 		if err == auth_errors.ErrKeyNotFound {
-			return users, nil
+			return []*types.LocalUser{}, nil
 		}
 
 		return nil, fmt.Errorf("Couldn't fetch users from data store")
 	}
 
+	return decodeLocalUsers(rawData, func(*types.LocalUser) bool { return true })
+}
+
+// decodeLocalUsers decodes the given local users, leaving out the ones which don't match the given filter.
+// params:
+//  rawData: local users as read from the data store
+//  matches: filter of the local users
+// return values:
+//  []*types.LocalUser: slice of local users
+//  error: as returned by json.Unmarshal
+func decodeLocalUsers(rawData [][]byte, matches func(*types.LocalUser) bool) ([]*types.LocalUser, error) {
+	users := []*types.LocalUser{}
 	for _, data := range rawData {
 		localUser := &types.LocalUser{}
 		if err := json.Unmarshal(data, localUser); err != nil {
 			return nil, err
 		}
 
-		users = append(users, localUser)
+		if matches(localUser) {
+			users = append(users, localUser)
+		}
 	}
 
 	return users, nil
 }
 
+// LocalUserFilter selects local users; empty fields match all the users.
+type LocalUserFilter struct {
+	Prefix   string // prefix of the username
+	Disabled *bool  // whether the user is disabled
+}
+
+// ListLocalUsers looks up a page of the local users matching a filter, sorted by username.
+// The usernames are read from the local user index; only the users of the page, and the ones
+// left out by the filter on the way, are read.
+// params:
+//  filter: selects the users
+//  limit: maximum number of users returned; no limit if <= 0
+//  after: cursor of the page; username of the last user of the previous page, empty for the first page
+// return values:
+//  []*types.LocalUser: page of local users
+//  string: cursor of the next page; empty on the last page
+//  error: as returned by consecutive func calls
+func ListLocalUsers(filter LocalUserFilter, limit int, after string) ([]*types.LocalUser, string, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, "", err
+	}
+
+	usernames, err := listIndexedUsernames(stateDrv)
+	if err != nil {
+		return nil, "", err
+	}
+
+	matches := func(user *types.LocalUser) bool {
+		return filter.Disabled == nil || user.Disable == *filter.Disabled
+	}
+
+	// read the users in order until the page is full; one more user tells whether there is a next page
+	users := []*types.LocalUser{}
+	usernames = pageUsernames(usernames, filter.Prefix, after)
+	for len(usernames) > 0 && (limit <= 0 || len(users) <= limit) {
+		count := len(usernames)
+		if limit > 0 && count > limit+1-len(users) {
+			count = limit + 1 - len(users)
+		}
+
+		rawData := [][]byte{}
+		for _, username := range usernames[:count] {
+			data, err := stateDrv.Read(GetPath(RootLocalUsers, username))
+			if err != nil {
+				if err == auth_errors.ErrKeyNotFound {
+					// being added or left behind by a failed removal
+					continue
+				}
+
+				return nil, "", fmt.Errorf("Couldn't fetch users from data store")
+			}
+
+			rawData = append(rawData, data)
+		}
+
+		page, err := decodeLocalUsers(rawData, matches)
+		if err != nil {
+			return nil, "", err
+		}
+
+		users = append(users, page...)
+		usernames = usernames[count:]
+	}
+
+	if limit <= 0 || len(users) <= limit {
+		return users, "", nil
+	}
+
+	return users[:limit], users[limit-1].Username, nil
+}
+
 // GetLocalUser looks up a user entry in `/auth_proxy/local_users` path.
 // params:
 //  username:string; name of the user to be fetched
@@ -95,12 +182,19 @@ func UpdateLocalUser(username string, user *types.LocalUser) error {
 	case nil:
 		// generate password hash only if the password is not empty, otherwise use the existing hash
 		if !common.IsEmpty(user.Password) {
+			// remember the replaced password so that it can't be reused
+			if err := updatePasswordHistory(stateDrv, user); err != nil {
+				return err
+			}
+
 			user.PasswordHash, err = common.GenPasswordHash(user.Password)
 
 			if err != nil {
 				log.Debugf("Failed to create password hash for user %q: %#v", user.Username, err)
 				return err
 			}
+
+			user.PasswordChangedAt = time.Now().Unix()
 		}
 
 		// raw password will never be stored in the store
@@ -115,8 +209,9 @@ func UpdateLocalUser(username string, user *types.LocalUser) error {
 			return fmt.Errorf("Failed to write local user info. to data store: %#v", err)
 		}
 
-		// not to let the user know about password hash
+		// not to let the user know about password hashes
 		user.PasswordHash = []byte{}
+		user.PasswordHistory = nil
 
 		return nil
 	case auth_errors.ErrKeyNotFound:
@@ -128,6 +223,47 @@ func UpdateLocalUser(username string, user *types.LocalUser) error {
 
 }
 
+// UpgradeLocalUserPasswordHash replaces the password hash of a local user with the given hash of the
+// same password, unless the password hash has been changed meanwhile; nothing else is changed.
+// params:
+//  username: of the user whose password hash is upgraded
+//  current: password hash the new one was generated from
+//  upgraded: new password hash
+// return values:
+//  error: auth_errors.ErrKeyModified if the password hash or the user has been changed meanwhile,
+//         auth_errors.ErrKeyNotFound if the user doesn't exist, or any relevant error from state driver
+func UpgradeLocalUserPasswordHash(username string, current, upgraded []byte) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	key := GetPath(RootLocalUsers, username)
+
+	rawData, err := stateDrv.Read(key)
+	if err != nil {
+		return err
+	}
+
+	user := &types.LocalUser{}
+	if err := json.Unmarshal(rawData, user); err != nil {
+		return fmt.Errorf("Failed to unmarshal local user %q info %#v", username, err)
+	}
+
+	if !bytes.Equal(user.PasswordHash, current) {
+		return auth_errors.ErrKeyModified
+	}
+
+	user.PasswordHash = upgraded
+	val, err := json.Marshal(user)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal user %#v: %#v", user, err)
+	}
+
+	// fails if the user has been updated since it was read
+	return stateDrv.CompareAndSwap(key, rawData, val)
+}
+
 // DeleteLocalUser removes a local user from `/auth_proxy/local_users`
 // Built-in admin and ops local users cannot be deleted.
 // params:
@@ -157,12 +293,22 @@ func DeleteLocalUser(username string) error {
 		return err
 	}
 
+	// the user no longer belongs to any group
+	if err := deleteLocalUserFromGroups(stateDrv, username); err != nil {
+		return err
+	}
+
 	if err := stateDrv.Clear(GetPath(RootLocalUsers, username)); err != nil {
 		// XXX: If this fails, data store will be in inconsistent state
 		return fmt.Errorf("Failed to clear %q from store: %#v", username, err)
 	}
 
-	return nil
+	// removed after the user; see local_index.go
+	if err := stateDrv.Clear(localUserIndexKey(username)); err != nil && err != auth_errors.ErrKeyNotFound {
+		return fmt.Errorf("Failed to clear %q from the local user index: %#v", username, err)
+	}
+
+	return deletePrincipal(stateDrv, types.PrincipalID(username, true))
 }
 
 // AddLocalUser adds a new user entry to /auth_proxy/local_users/.
@@ -191,6 +337,8 @@ func AddLocalUser(user *types.LocalUser) error {
 			return err
 		}
 
+		user.PasswordChangedAt = time.Now().Unix()
+
 		// raw password will never be stored in the store
 		user.Password = ""
 
@@ -199,6 +347,11 @@ func AddLocalUser(user *types.LocalUser) error {
 			return fmt.Errorf("Failed to marshal user %#v: %#v", user, err)
 		}
 
+		// written before the user; see local_index.go
+		if err := stateDrv.Write(localUserIndexKey(user.Username), []byte(user.Username)); err != nil {
+			return fmt.Errorf("Failed to add %q to the local user index: %#v", user.Username, err)
+		}
+
 		if err := stateDrv.Write(key, val); err != nil {
 			return fmt.Errorf("Failed to write local user info. to data store: %#v", err)
 		}
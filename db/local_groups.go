@@ -0,0 +1,487 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains all local group management APIs.
+
+// GetLocalGroups returns all defined local groups.
+// return values:
+//  []*types.LocalGroup: slice of local groups
+//  error: as returned by consecutive func calls
+func GetLocalGroups() ([]*types.LocalGroup, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	return getLocalGroups(stateDrv)
+}
+
+// getLocalGroups helper function to read all local groups from the data store.
+// params:
+//  stateDrv: data store driver object
+// return values:
+//  []*types.LocalGroup: slice of local groups
+//  error: as returned by consecutive func calls
+func getLocalGroups(stateDrv types.StateDriver) ([]*types.LocalGroup, error) {
+	groups := []*types.LocalGroup{}
+	rawData, err := stateDrv.ReadAll(GetPath(RootLocalGroups))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return groups, nil
+		}
+
+		return nil, fmt.Errorf("Couldn't fetch groups from data store")
+	}
+
+	for _, data := range rawData {
+		localGroup := &types.LocalGroup{}
+		if err := json.Unmarshal(data, localGroup); err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, localGroup)
+	}
+
+	return groups, nil
+}
+
+// GetLocalGroup looks up a group entry in `/auth_proxy/local_groups` path.
+// params:
+//  name: name of the group to be fetched
+// return values:
+//  *types.LocalGroup: reference to local group object fetched from data store
+//  error: auth_errors.ErrKeyNotFound if the group doesn't exist or as returned by consecutive func calls
+func GetLocalGroup(name string) (*types.LocalGroup, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	return getLocalGroup(stateDrv, name)
+}
+
+// getLocalGroup helper function to read the given local group from the data store.
+// params:
+//  stateDrv: data store driver object
+//  name: name of the group to be fetched
+// return values:
+//  *types.LocalGroup: reference to local group object fetched from data store
+//  error: auth_errors.ErrKeyNotFound if the group doesn't exist or any relevant error
+func getLocalGroup(stateDrv types.StateDriver, name string) (*types.LocalGroup, error) {
+	rawData, err := stateDrv.Read(GetPath(RootLocalGroups, name))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read local group %q data from store: %#v", name, err)
+	}
+
+	localGroup := &types.LocalGroup{}
+	if err := json.Unmarshal(rawData, localGroup); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal local group %q info %#v", name, err)
+	}
+
+	return localGroup, nil
+}
+
+// marshalLocalGroup helper function to encode the given local group for the data store.
+// params:
+//  group: local group object to be written
+// return values:
+//  []byte: encoded group
+//  error: nil on success otherwise the marshalling error
+func marshalLocalGroup(group *types.LocalGroup) ([]byte, error) {
+	if group.Members == nil {
+		group.Members = []string{}
+	}
+
+	val, err := json.Marshal(group)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to marshal group %#v: %#v", group, err)
+	}
+
+	return val, nil
+}
+
+// updateLocalGroup helper function to read-modify-write the given local group; the group is written
+// with compare-and-swap and the update is retried as long as the group is modified concurrently, so
+// that concurrent updates (e.g. membership changes) are not lost.
+// params:
+//  stateDrv: data store driver object
+//  name: name of the group to be updated
+//  update: changes the group; returns false if there is nothing to write, or an error to give up
+// return values:
+//  *types.LocalGroup: updated group
+//  error: auth_errors.ErrKeyNotFound if the group doesn't exist, the error returned by update
+//         or any relevant error
+func updateLocalGroup(stateDrv types.StateDriver, name string, update func(*types.LocalGroup) (bool, error)) (*types.LocalGroup, error) {
+	key := GetPath(RootLocalGroups, name)
+
+	for {
+		rawData, err := stateDrv.Read(key)
+		if err != nil {
+			if err == auth_errors.ErrKeyNotFound {
+				return nil, err
+			}
+
+			return nil, fmt.Errorf("Failed to read local group %q data from store: %#v", name, err)
+		}
+
+		group := &types.LocalGroup{}
+		if err := json.Unmarshal(rawData, group); err != nil {
+			return nil, fmt.Errorf("Failed to unmarshal local group %q info %#v", name, err)
+		}
+
+		changed, err := update(group)
+		if err != nil || !changed {
+			return group, err
+		}
+
+		val, err := marshalLocalGroup(group)
+		if err != nil {
+			return nil, err
+		}
+
+		switch err := stateDrv.CompareAndSwap(key, rawData, val); err {
+		case nil:
+			return group, nil
+		case auth_errors.ErrKeyModified:
+			log.Debugf("Local group %q modified concurrently, retrying", name)
+		default:
+			return nil, fmt.Errorf("Failed to write local group info. to data store: %#v", err)
+		}
+	}
+}
+
+// AddLocalGroup adds a new group entry to /auth_proxy/local_groups/.
+// params:
+//  group: *types.LocalGroup object that should be added to the data store
+// return Values:
+//  error: auth_errors.ErrKeyExists if the group already exists,
+//         auth_errors.ErrUserNotFound if any of the members is not a local user
+//         or any relevant error from state driver
+func AddLocalGroup(group *types.LocalGroup) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	key := GetPath(RootLocalGroups, group.Name)
+	_, err = stateDrv.Read(key)
+
+	switch err {
+	case nil:
+		return auth_errors.ErrKeyExists
+	case auth_errors.ErrKeyNotFound:
+		members := []string{}
+		for _, username := range group.Members {
+			if err := checkLocalUserExists(stateDrv, username); err != nil {
+				return err
+			}
+
+			members = appendMember(members, username)
+		}
+
+		// authorizations left behind by a failed deletion of a group with the same name aren't inherited
+		if err := DeleteAuthorizationsByPrincipal(types.LocalGroupPrincipal(group.Name)); err != nil {
+			return err
+		}
+
+		group.Members = members
+		val, err := marshalLocalGroup(group)
+		if err != nil {
+			return err
+		}
+
+		// fails if the group has been added concurrently
+		switch err := stateDrv.CompareAndSwap(key, nil, val); err {
+		case nil:
+			return nil
+		case auth_errors.ErrKeyModified:
+			return auth_errors.ErrKeyExists
+		default:
+			return fmt.Errorf("Failed to write local group info. to data store: %#v", err)
+		}
+	default:
+		return err
+	}
+}
+
+// UpdateLocalGroup updates the description of an existing group in /auth_proxy/local_groups/<name>.
+// Membership is managed using AddLocalGroupMember/DeleteLocalGroupMember.
+// params:
+//  name: of the group that requires update
+//  description: new description of the group
+// return values:
+//  *types.LocalGroup: updated group
+//  error: auth_errors.ErrKeyNotFound if the group doesn't exist or any relevant error
+func UpdateLocalGroup(name, description string) (*types.LocalGroup, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	return updateLocalGroup(stateDrv, name, func(group *types.LocalGroup) (bool, error) {
+		group.Description = description
+		return true, nil
+	})
+}
+
+// DeleteLocalGroup removes a local group from `/auth_proxy/local_groups`
+// along with the authorizations granted to it. The sessions of its members are
+// revoked as their tokens carry the group. The group is removed first so that
+// an existing group never misses some of its authorizations; the ones left behind
+// by a failure are removed when a group with the same name is added.
+// params:
+//  name: group to be removed from the system
+// return values:
+//  error: auth_errors.ErrKeyNotFound if the group doesn't exist or any relevant error from the consecutive func calls
+func DeleteLocalGroup(name string) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	key := GetPath(RootLocalGroups, name)
+
+	// handles `ErrKeyNotFound`
+	group, err := getLocalGroup(stateDrv, name)
+	if err != nil {
+		return err
+	}
+
+	if err := stateDrv.Clear(key); err != nil {
+		return fmt.Errorf("Failed to clear %q from store: %#v", name, err)
+	}
+
+	// delete the associated group authorization
+	if err := DeleteAuthorizationsByPrincipal(types.LocalGroupPrincipal(name)); err != nil {
+		return err
+	}
+
+	for _, member := range group.Members {
+		if err := revokeLocalUserSessions(stateDrv, member); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddLocalGroupMember adds the given local user to the group.
+// params:
+//  name: of the group
+//  username: of the local user to be added
+// return values:
+//  *types.LocalGroup: updated group
+//  error: auth_errors.ErrKeyNotFound if the group doesn't exist, auth_errors.ErrUserNotFound
+//         if the user doesn't exist or any relevant error
+func AddLocalGroupMember(name, username string) (*types.LocalGroup, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := getLocalGroup(stateDrv, name); err != nil {
+		return nil, err
+	}
+
+	if err := checkLocalUserExists(stateDrv, username); err != nil {
+		return nil, err
+	}
+
+	return updateLocalGroup(stateDrv, name, func(group *types.LocalGroup) (bool, error) {
+		group.Members = appendMember(group.Members, username)
+		return true, nil
+	})
+}
+
+// DeleteLocalGroupMember removes the given local user from the group and
+// revokes the sessions of the user, as its tokens carry the group.
+// params:
+//  name: of the group
+//  username: of the local user to be removed
+// return values:
+//  *types.LocalGroup: updated group
+//  error: auth_errors.ErrKeyNotFound if the group doesn't exist, auth_errors.ErrUserNotFound
+//         if the user is not a member or any relevant error
+func DeleteLocalGroupMember(name, username string) (*types.LocalGroup, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	group, err := updateLocalGroup(stateDrv, name, func(group *types.LocalGroup) (bool, error) {
+		members, found := removeMember(group.Members, username)
+		if !found {
+			return false, auth_errors.ErrUserNotFound
+		}
+
+		group.Members = members
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := revokeLocalUserSessions(stateDrv, username); err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// GetLocalUserGroups returns the names of the local groups the given user belongs to.
+// params:
+//  username: of the local user
+// return values:
+//  []string: names of the groups
+//  error: as returned by consecutive func calls
+func GetLocalUserGroups(username string) ([]string, error) {
+	groups, err := GetLocalGroups()
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, group := range groups {
+		for _, member := range group.Members {
+			if member == username {
+				names = append(names, group.Name)
+				break
+			}
+		}
+	}
+
+	return names, nil
+}
+
+// deleteLocalUserFromGroups removes the given user from all the groups it belongs to.
+// params:
+//  stateDrv: data store driver object
+//  username: of the local user
+// return values:
+//  error: nil on success otherwise any relevant error
+func deleteLocalUserFromGroups(stateDrv types.StateDriver, username string) error {
+	groups, err := getLocalGroups(stateDrv)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groups {
+		if _, found := removeMember(group.Members, username); !found {
+			continue
+		}
+
+		_, err := updateLocalGroup(stateDrv, group.Name, func(group *types.LocalGroup) (bool, error) {
+			members, found := removeMember(group.Members, username)
+			group.Members = members
+			return found, nil
+		})
+		if err != nil && err != auth_errors.ErrKeyNotFound {
+			log.Debugf("Failed to remove user %q from group %q: %#v", username, group.Name, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeLocalUserSessions increments the session generation of the given local user so that the tokens
+// issued to the user so far are no longer accepted; nothing is done if the user doesn't exist.
+// params:
+//  stateDrv: data store driver object
+//  username: of the local user
+// return values:
+//  error: nil on success otherwise any relevant error
+func revokeLocalUserSessions(stateDrv types.StateDriver, username string) error {
+	key := GetPath(RootLocalUsers, username)
+
+	// retried as long as the user is updated concurrently
+	for {
+		rawData, err := stateDrv.Read(key)
+		if err != nil {
+			if err == auth_errors.ErrKeyNotFound {
+				return nil
+			}
+
+			return err
+		}
+
+		user := &types.LocalUser{}
+		if err := json.Unmarshal(rawData, user); err != nil {
+			return fmt.Errorf("Failed to unmarshal local user %q info %#v", username, err)
+		}
+
+		user.SessionGeneration++
+		val, err := json.Marshal(user)
+		if err != nil {
+			return fmt.Errorf("Failed to marshal user %#v: %#v", user, err)
+		}
+
+		switch err := stateDrv.CompareAndSwap(key, rawData, val); err {
+		case nil:
+			return nil
+		case auth_errors.ErrKeyModified:
+			log.Debugf("Local user %q modified while revoking its sessions, retrying", username)
+		default:
+			log.Debugf("Failed to revoke the sessions of local user %q: %#v", username, err)
+			return err
+		}
+	}
+}
+
+// checkLocalUserExists checks if the given local user exists in the data store.
+// return values:
+//  error: nil if the user exists, auth_errors.ErrUserNotFound if not, otherwise any relevant error
+func checkLocalUserExists(stateDrv types.StateDriver, username string) error {
+	if _, err := stateDrv.Read(GetPath(RootLocalUsers, username)); err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return auth_errors.ErrUserNotFound
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// appendMember appends the given username to the members unless it's already there.
+func appendMember(members []string, username string) []string {
+	for _, member := range members {
+		if member == username {
+			return members
+		}
+	}
+
+	return append(members, username)
+}
+
+// removeMember removes the given username from the members.
+// return values:
+//  []string: remaining members
+//  bool: true if the username was a member, otherwise false
+func removeMember(members []string, username string) ([]string, bool) {
+	remaining := []string{}
+	found := false
+	for _, member := range members {
+		if member == username {
+			found = true
+			continue
+		}
+
+		remaining = append(remaining, member)
+	}
+
+	return remaining, found
+}
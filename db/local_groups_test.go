@@ -0,0 +1,173 @@
+package db
+
+import (
+	"sort"
+	"sync"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+	. "gopkg.in/check.v1"
+)
+
+// TestAddLocalGroup tests `AddLocalGroup(...)`
+func (s *dbSuite) TestAddLocalGroup(c *C) {
+	s.TestAddLocalUser(c)
+
+	group := &types.LocalGroup{Name: "devs", Members: []string{"aaa", "bbb", "aaa"}}
+	c.Assert(AddLocalGroup(group), IsNil)
+
+	// duplicate members are ignored
+	obtained, err := GetLocalGroup("devs")
+	c.Assert(err, IsNil)
+	c.Assert(obtained.Members, DeepEquals, []string{"aaa", "bbb"})
+
+	// add existing group
+	c.Assert(AddLocalGroup(group), Equals, auth_errors.ErrKeyExists)
+
+	// members must be local users
+	for _, username := range invalidUsers {
+		group := &types.LocalGroup{Name: "ops_team", Members: []string{username}}
+		c.Assert(AddLocalGroup(group), Equals, auth_errors.ErrUserNotFound)
+	}
+
+	_, err = GetLocalGroup("ops_team")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	groups, err := GetLocalGroups()
+	c.Assert(err, IsNil)
+	c.Assert(len(groups), Equals, 1)
+}
+
+// TestLocalGroupMembership tests adding and removing local group members
+func (s *dbSuite) TestLocalGroupMembership(c *C) {
+	s.TestAddLocalUser(c)
+
+	for _, name := range []string{"devs", "testers"} {
+		c.Assert(AddLocalGroup(&types.LocalGroup{Name: name}), IsNil)
+
+		group, err := AddLocalGroupMember(name, "aaa")
+		c.Assert(err, IsNil)
+		c.Assert(group.Members, DeepEquals, []string{"aaa"})
+	}
+
+	_, err := AddLocalGroupMember("devs", "xxx")
+	c.Assert(err, Equals, auth_errors.ErrUserNotFound)
+
+	_, err = AddLocalGroupMember("xxx", "aaa")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	groups, err := GetLocalUserGroups("aaa")
+	c.Assert(err, IsNil)
+	sort.Strings(groups)
+	c.Assert(groups, DeepEquals, []string{"devs", "testers"})
+
+	group, err := DeleteLocalGroupMember("testers", "aaa")
+	c.Assert(err, IsNil)
+	c.Assert(group.Members, DeepEquals, []string{})
+
+	// the sessions of the member removed are revoked
+	user, err := GetLocalUser("aaa")
+	c.Assert(err, IsNil)
+	c.Assert(user.SessionGeneration, Equals, 1)
+
+	c.Assert(DeleteLocalGroup("devs"), IsNil)
+
+	user, err = GetLocalUser("aaa")
+	c.Assert(err, IsNil)
+	c.Assert(user.SessionGeneration, Equals, 2)
+
+	c.Assert(AddLocalGroup(&types.LocalGroup{Name: "devs"}), IsNil)
+	_, err = AddLocalGroupMember("devs", "aaa")
+	c.Assert(err, IsNil)
+
+	_, err = DeleteLocalGroupMember("testers", "aaa")
+	c.Assert(err, Equals, auth_errors.ErrUserNotFound)
+
+	groups, err = GetLocalUserGroups("aaa")
+	c.Assert(err, IsNil)
+	c.Assert(groups, DeepEquals, []string{"devs"})
+
+	// concurrent membership changes are not lost
+	var wg sync.WaitGroup
+	for _, user := range newUsers[1:] {
+		wg.Add(1)
+		go func(username string) {
+			defer wg.Done()
+			_, err := AddLocalGroupMember("devs", username)
+			c.Check(err, IsNil)
+		}(user.Username)
+	}
+	wg.Wait()
+
+	group, err = GetLocalGroup("devs")
+	c.Assert(err, IsNil)
+	c.Assert(len(group.Members), Equals, len(newUsers))
+
+	for _, user := range newUsers[1:] {
+		_, err = DeleteLocalGroupMember("devs", user.Username)
+		c.Assert(err, IsNil)
+	}
+
+	// deleting the user removes it from its groups
+	c.Assert(DeleteLocalUser("aaa"), IsNil)
+
+	group, err = GetLocalGroup("devs")
+	c.Assert(err, IsNil)
+	c.Assert(group.Members, DeepEquals, []string{})
+}
+
+// TestDeleteLocalGroup tests `DeleteLocalGroup(...)`
+func (s *dbSuite) TestDeleteLocalGroup(c *C) {
+	c.Assert(AddLocalGroup(&types.LocalGroup{Name: "devs"}), IsNil)
+
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+
+	a := types.Authorization{
+		CommonState: types.CommonState{
+			ID:          "0000",
+			StateDriver: stateDrv,
+		},
+		UUID:          "devs",
+		PrincipalName: types.LocalGroupPrincipal("devs"),
+		Local:         true,
+		ClaimKey:      "tenant: Tenant2",
+		ClaimValue:    "devops",
+	}
+	c.Assert(InsertAuthorization(&a), IsNil)
+
+	// this deletes the associated authZs
+	c.Assert(DeleteLocalGroup("devs"), IsNil)
+
+	_, err = GetAuthorization(a.UUID)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	_, err = GetLocalGroup("devs")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	c.Assert(DeleteLocalGroup("devs"), Equals, auth_errors.ErrKeyNotFound)
+
+	// authorizations left behind by a failed deletion are not inherited by a new group with the same name
+	c.Assert(InsertAuthorization(&a), IsNil)
+	c.Assert(AddLocalGroup(&types.LocalGroup{Name: "devs"}), IsNil)
+
+	_, err = GetAuthorization(a.UUID)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+}
+
+// TestUpdateLocalGroup tests `UpdateLocalGroup(...)`
+func (s *dbSuite) TestUpdateLocalGroup(c *C) {
+	c.Assert(AddLocalGroup(&types.LocalGroup{Name: "devs"}), IsNil)
+
+	group, err := UpdateLocalGroup("devs", "Developers")
+	c.Assert(err, IsNil)
+	c.Assert(group.Description, Equals, "Developers")
+
+	group, err = GetLocalGroup("devs")
+	c.Assert(err, IsNil)
+	c.Assert(group.Description, Equals, "Developers")
+
+	_, err = UpdateLocalGroup("xxx", "")
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+}
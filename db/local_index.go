@@ -0,0 +1,127 @@
+package db
+
+import (
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the index of the local users. Listing it returns the usernames only, so that a
+// page of users reads the users of the page rather than all of them.
+//
+// "Schema" of the index keys; the value of each key is the username:
+//
+//  /[RootLocalUserIndex]/{username}
+//
+// The data store offers no multi-key transactions; the index key of a user is written before and
+// removed after the user itself so that a user is never missing from the index. Readers skip the
+// index keys of users which don't exist (being added, or left behind by a failure half way through);
+// EnsureLocalUserIndex removes them.
+
+// localUserIndexKey returns the index key of the given user.
+func localUserIndexKey(username string) string {
+	return GetPath(RootLocalUserIndex, username)
+}
+
+// listIndexedUsernames reads the usernames found in the local user index, sorted.
+// params:
+//  stateDrv: data store driver object
+// return values:
+//  []string: sorted usernames
+//  error: nil on success otherwise ErrReadingFromStore
+func listIndexedUsernames(stateDrv types.StateDriver) ([]string, error) {
+	usernames := []string{}
+
+	// the trailing separator keeps consul from listing the keys sharing the prefix
+	rawData, err := stateDrv.ReadAll(GetPath(RootLocalUserIndex) + "/")
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return usernames, nil
+		}
+
+		log.Error("failed to read local user index, err:", err)
+		return nil, auth_errors.ErrReadingFromStore
+	}
+
+	for _, data := range rawData {
+		usernames = append(usernames, string(data))
+	}
+
+	sort.Strings(usernames)
+
+	return usernames, nil
+}
+
+//
+// EnsureLocalUserIndex adds the local users missing from the local user index,
+// e.g. written by the previous releases, and removes the index keys of the users
+// which don't exist. This must be called before the local users are listed.
+//
+// Return Values:
+//  error: Any error encountered when reading or writing the KV store
+//         nil if operation is successful
+//
+func EnsureLocalUserIndex() error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	users, err := GetLocalUsers()
+	if err != nil {
+		return err
+	}
+
+	usernames, err := listIndexedUsernames(stateDrv)
+	if err != nil {
+		return err
+	}
+
+	indexed := map[string]bool{}
+	for _, username := range usernames {
+		indexed[username] = true
+	}
+
+	for _, user := range users {
+		if indexed[user.Username] {
+			delete(indexed, user.Username)
+			continue
+		}
+
+		log.Infof("Adding local user %q to the local user index", user.Username)
+		if err := stateDrv.Write(localUserIndexKey(user.Username), []byte(user.Username)); err != nil {
+			return err
+		}
+	}
+
+	for username := range indexed {
+		log.Debugf("removing index key of deleted local user %q", username)
+		if err := stateDrv.Clear(localUserIndexKey(username)); err != nil && err != auth_errors.ErrKeyNotFound {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// pageUsernames returns the usernames following the given cursor which have the given prefix.
+func pageUsernames(usernames []string, prefix, after string) []string {
+	start := sort.SearchStrings(usernames, after)
+	if start < len(usernames) && usernames[start] == after {
+		start++
+	}
+
+	page := []string{}
+	for _, username := range usernames[start:] {
+		if strings.HasPrefix(username, prefix) {
+			page = append(page, username)
+		}
+	}
+
+	return page
+}
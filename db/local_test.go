@@ -301,6 +301,45 @@ func (s *dbSuite) TestGetLocalUsers(c *C) {
 
 }
 
+// TestListLocalUsers tests paging the local users over the local user index
+func (s *dbSuite) TestListLocalUsers(c *C) {
+	s.TestAddLocalUser(c)
+	s.addBuiltInUsers(c)
+
+	users, next, err := ListLocalUsers(LocalUserFilter{}, 2, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(users), Equals, 2)
+	c.Assert(users[0].Username, Equals, "aaa")
+	c.Assert(next, Equals, users[1].Username)
+
+	disabled := true
+	users, next, err = ListLocalUsers(LocalUserFilter{Disabled: &disabled}, 2, next)
+	c.Assert(err, IsNil)
+	c.Assert(len(users), Equals, 2)
+	c.Assert(users[0].Username, Equals, "bbb")
+	c.Assert(users[1].Username, Equals, "ccc")
+	c.Assert(next, Equals, "")
+
+	// users missing from the index (previous releases) are added at startup
+	stateDrv, err := state.GetStateDriver()
+	c.Assert(err, IsNil)
+	c.Assert(stateDrv.Clear(localUserIndexKey("bbb")), IsNil)
+	c.Assert(stateDrv.Write(localUserIndexKey("zzz"), []byte("zzz")), IsNil)
+
+	users, _, err = ListLocalUsers(LocalUserFilter{Prefix: "bbb"}, 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(users), Equals, 0)
+
+	c.Assert(EnsureLocalUserIndex(), IsNil)
+
+	users, _, err = ListLocalUsers(LocalUserFilter{}, 0, "")
+	c.Assert(err, IsNil)
+	c.Assert(len(users), Equals, len(newUsers)+len(builtInUsers))
+
+	_, err = stateDrv.Read(localUserIndexKey("zzz"))
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+}
+
 func (s *dbSuite) TestUpdateBuiltInUsers(c *C) {
 	s.addBuiltInUsers(c)
 
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// getPasswordPolicy helper function to retrieve the password policy from the data store.
+// params:
+//  stateDrv: data store driver object
+// return values:
+//  *types.PasswordPolicy: reference to the configured password policy or
+//                         the default policy if none is configured
+//  error: nil on successful fetch otherwise anything as returned
+//         by consecutive calls or any relevant custom error
+func getPasswordPolicy(stateDrv types.StateDriver) (*types.PasswordPolicy, error) {
+	rawData, err := stateDrv.Read(GetPath(RootPasswordPolicy))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return types.DefaultPasswordPolicy(), nil
+		}
+
+		return nil, fmt.Errorf("Failed to read password policy from data store: %#v", err)
+	}
+
+	passwordPolicy := types.DefaultPasswordPolicy()
+	if err := json.Unmarshal(rawData, passwordPolicy); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal password policy %#v: %#v", rawData, err)
+	}
+
+	return passwordPolicy, nil
+}
+
+// GetPasswordPolicy retrieves the password policy from the data store.
+// return values:
+//  *types.PasswordPolicy: reference to the configured password policy or
+//                         the default policy if none is configured
+//  error: as returned by `state.GetStateDriver/getPasswordPolicy`
+func GetPasswordPolicy() (*types.PasswordPolicy, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	return getPasswordPolicy(stateDrv)
+}
+
+// UpdatePasswordPolicy replaces the password policy in the data store (/auth_proxy/password_policy).
+// params:
+//  passwordPolicy: policy to be written to the data store
+// return values:
+//  error: nil on successful update, auth_errors.ErrIllegalArguments if the policy is invalid,
+//         otherwise anything as returned by the consecutive function calls or any relevant custom error
+func UpdatePasswordPolicy(passwordPolicy *types.PasswordPolicy) error {
+	if passwordPolicy == nil {
+		return auth_errors.ErrIllegalArguments
+	}
+
+	if err := passwordPolicy.Validate(); err != nil {
+		return err
+	}
+
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(passwordPolicy)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal password policy %#v: %#v", passwordPolicy, err)
+	}
+
+	if err := stateDrv.Write(GetPath(RootPasswordPolicy), val); err != nil {
+		return fmt.Errorf("Failed to write password policy to data store: %#v", err)
+	}
+
+	return nil
+}
+
+// updatePasswordHistory pushes the current password hash of the user onto
+// its password history and trims the history to what the policy requires.
+// params:
+//  stateDrv: data store driver object
+//  user: local user whose password is about to be replaced
+// return values:
+//  error: as returned by getPasswordPolicy
+func updatePasswordHistory(stateDrv types.StateDriver, user *types.LocalUser) error {
+	passwordPolicy, err := getPasswordPolicy(stateDrv)
+	if err != nil {
+		return err
+	}
+
+	history := user.PasswordHashes()
+	if len(history) > passwordPolicy.HistoryCount {
+		history = history[:passwordPolicy.HistoryCount]
+	}
+
+	if len(history) == 0 {
+		history = nil
+	}
+
+	user.PasswordHistory = history
+	return nil
+}
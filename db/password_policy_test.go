@@ -0,0 +1,76 @@
+package db
+
+import (
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestGetPasswordPolicy tests that the default policy is returned when no policy is configured
+func (s *dbSuite) TestGetPasswordPolicy(c *C) {
+	passwordPolicy, err := GetPasswordPolicy()
+	c.Assert(err, IsNil)
+	c.Assert(passwordPolicy, DeepEquals, types.DefaultPasswordPolicy())
+}
+
+// TestUpdatePasswordPolicy tests `UpdatePasswordPolicy(...)`
+func (s *dbSuite) TestUpdatePasswordPolicy(c *C) {
+	passwordPolicy := &types.PasswordPolicy{
+		MinLength:        8,
+		RequireDigit:     true,
+		DenyList:         []string{"password1"},
+		DisallowUsername: true,
+		HistoryCount:     2,
+		MaxAgeDays:       90,
+	}
+
+	c.Assert(UpdatePasswordPolicy(passwordPolicy), IsNil)
+
+	obtained, err := GetPasswordPolicy()
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, passwordPolicy)
+
+	// invalid policies
+	c.Assert(UpdatePasswordPolicy(nil), Equals, auth_errors.ErrIllegalArguments)
+	c.Assert(UpdatePasswordPolicy(&types.PasswordPolicy{MinLength: -1}), Equals, auth_errors.ErrIllegalArguments)
+	c.Assert(UpdatePasswordPolicy(&types.PasswordPolicy{HistoryCount: types.MaxPasswordHistoryCount + 1}), Equals, auth_errors.ErrIllegalArguments)
+
+	// existing policy is left untouched
+	obtained, err = GetPasswordPolicy()
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, passwordPolicy)
+}
+
+// TestPasswordHistory tests that the previous password hashes are remembered as per the policy
+func (s *dbSuite) TestPasswordHistory(c *C) {
+	c.Assert(UpdatePasswordPolicy(&types.PasswordPolicy{DenyList: []string{}, HistoryCount: 2}), IsNil)
+
+	user := types.LocalUser{Username: "aaa", Password: "first"}
+	c.Assert(AddLocalUser(&user), IsNil)
+
+	for _, password := range []string{"second", "third", "fourth"} {
+		user, err := GetLocalUser("aaa")
+		c.Assert(err, IsNil)
+
+		user.Password = password
+		c.Assert(UpdateLocalUser("aaa", user), IsNil)
+		c.Assert(len(user.PasswordHistory), Equals, 0)
+	}
+
+	user2, err := GetLocalUser("aaa")
+	c.Assert(err, IsNil)
+	c.Assert(user2.PasswordChangedAt, Not(Equals), int64(0))
+	c.Assert(len(user2.PasswordHistory), Equals, 2)
+
+	passwordPolicy, err := GetPasswordPolicy()
+	c.Assert(err, IsNil)
+
+	// current and the last remembered password cannot be reused
+	for _, password := range []string{"fourth", "third"} {
+		err := passwordPolicy.Check("aaa", password, user2.PasswordHashes())
+		c.Assert(auth_errors.HasCode(err, auth_errors.PasswordPolicyViolation), Equals, true)
+	}
+
+	// older passwords have been forgotten
+	c.Assert(passwordPolicy.Check("aaa", "first", user2.PasswordHashes()), IsNil)
+}
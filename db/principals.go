@@ -0,0 +1,90 @@
+package db
+
+import (
+	"encoding/json"
+	"fmt"
+
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/state"
+)
+
+// This file contains the APIs to record the users who have logged in.
+
+// GetPrincipal looks up the principal record of the given user in `/auth_proxy/principals` path.
+// params:
+//  username: login name of the user
+//  local: true for local users, false for LDAP users
+// return values:
+//  *types.Principal: reference to the principal record fetched from data store
+//  error: auth_errors.ErrKeyNotFound if the user never logged in or any relevant error
+func GetPrincipal(username string, local bool) (*types.Principal, error) {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return nil, err
+	}
+
+	id := types.PrincipalID(username, local)
+	rawData, err := stateDrv.Read(GetPath(RootPrincipals, id))
+	if err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("Failed to read principal %q data from store: %#v", id, err)
+	}
+
+	principal := &types.Principal{}
+	if err := json.Unmarshal(rawData, principal); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal principal %q info %#v", id, err)
+	}
+
+	return principal, nil
+}
+
+// UpdatePrincipal adds or replaces the principal record of a user in `/auth_proxy/principals`.
+// params:
+//  principal: principal record to be written to the data store
+// return values:
+//  error: nil on success otherwise any relevant error
+func UpdatePrincipal(principal *types.Principal) error {
+	stateDrv, err := state.GetStateDriver()
+	if err != nil {
+		return err
+	}
+
+	val, err := json.Marshal(principal)
+	if err != nil {
+		return fmt.Errorf("Failed to marshal principal %#v: %#v", principal, err)
+	}
+
+	id := types.PrincipalID(principal.Username, principal.Local)
+	if err := stateDrv.Write(GetPath(RootPrincipals, id), val); err != nil {
+		return fmt.Errorf("Failed to write principal info. to data store: %#v", err)
+	}
+
+	return nil
+}
+
+// deletePrincipal helper function to remove the given principal record from the data store.
+// params:
+//  stateDrv: data store driver object
+//  id: ID of the principal record (see types.PrincipalID)
+// return values:
+//  error: nil if the record was removed or doesn't exist otherwise any relevant error
+func deletePrincipal(stateDrv types.StateDriver, id string) error {
+	key := GetPath(RootPrincipals, id)
+	if _, err := stateDrv.Read(key); err != nil {
+		if err == auth_errors.ErrKeyNotFound {
+			return nil
+		}
+
+		return err
+	}
+
+	if err := stateDrv.Clear(key); err != nil {
+		return fmt.Errorf("Failed to clear principal %q from store: %#v", id, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,45 @@
+package db
+
+import (
+	auth_errors "github.com/contiv/auth_proxy/common/errors"
+	"github.com/contiv/auth_proxy/common/types"
+	. "gopkg.in/check.v1"
+)
+
+// TestPrincipals tests `UpdatePrincipal(...)` and `GetPrincipal(...)`
+func (s *dbSuite) TestPrincipals(c *C) {
+	s.TestAddLocalUser(c)
+
+	_, err := GetPrincipal("aaa", true)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	local := &types.Principal{Username: "aaa", Local: true, LastLogin: 1500000000}
+	c.Assert(UpdatePrincipal(local), IsNil)
+
+	ldap := &types.Principal{
+		Username:   "aaa",
+		Domain:     types.DefaultLdapConfigurationName,
+		DN:         "CN=aaa,CN=Users,DC=example,DC=com",
+		Attributes: map[string]string{"display_name": "A. Aaa", "email": "aaa@example.com"},
+		LastLogin:  1500000001,
+	}
+	c.Assert(UpdatePrincipal(ldap), IsNil)
+
+	// records of local and LDAP users with the same name are kept apart
+	obtained, err := GetPrincipal("aaa", true)
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, local)
+
+	obtained, err = GetPrincipal("aaa", false)
+	c.Assert(err, IsNil)
+	c.Assert(obtained, DeepEquals, ldap)
+
+	// record of a deleted local user is removed along with the user
+	c.Assert(DeleteLocalUser("aaa"), IsNil)
+
+	_, err = GetPrincipal("aaa", true)
+	c.Assert(err, Equals, auth_errors.ErrKeyNotFound)
+
+	_, err = GetPrincipal("aaa", false)
+	c.Assert(err, IsNil)
+}
@@ -1,14 +1,20 @@
 package main
 
 import (
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/blang/semver"
 	"github.com/contiv/auth_proxy/auth"
 	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
+	"github.com/contiv/auth_proxy/db"
 	"github.com/contiv/auth_proxy/proxy"
 	"github.com/contiv/auth_proxy/state"
 
@@ -18,17 +24,30 @@ import (
 const (
 	// DefaultVersion is the version string used when a BUILD_VERSION is not passed to the build.
 	DefaultVersion = "devbuild"
+
+	// AdminPasswordEnvVar is the environment variable the initial admin password can be passed in
+	AdminPasswordEnvVar = "AUTH_PROXY_ADMIN_PASSWORD"
 )
 
 var (
 	// flags
-	dataStoreAddress string // address of the data store used by netmaster
-	debug            bool   // if set, log level is set to `debug`
-	listenAddress    string // address we listen on
-	netmasterAddress string // address of the netmaster we proxy to
-	initialSetup     bool   // if set, run the initial proxy setup (adding default users, etc.)
-	tlsKeyFile       string // path to TLS key
-	tlsCertificate   string // path to TLS certificate
+	adminPasswordFile string // path of the file holding the initial admin password
+	auditLogFile      string // path of the audit log file
+	argon2Memory      uint   // argon2id memory in KiB
+	argon2Threads     uint   // argon2id degree of parallelism
+	argon2Time        uint   // argon2id number of passes
+	bcryptCost        int    // bcrypt cost
+	breakGlassKeyFile string // path of the public key the break-glass access is armed with on initial setup
+	breakGlassSignKey string // path of the private key the break-glass code is derived with
+	breakGlassChall   string // challenge the break-glass code is derived from
+	dataStoreAddress  string // address of the data store used by netmaster
+	debug             bool   // if set, log level is set to `debug`
+	listenAddress     string // address we listen on
+	netmasterAddress  string // address of the netmaster we proxy to
+	passwordHashAlgo  string // algorithm used to hash new passwords
+	initialSetup      bool   // if set, run the initial proxy setup (adding default users, etc.)
+	tlsKeyFile        string // path to TLS key
+	tlsCertificate    string // path to TLS certificate
 
 	// ProgramName is used in logging output and the X-Forwarded-By header.
 	ProgramName = "Auth Proxy"
@@ -38,11 +57,42 @@ var (
 	ProgramVersion = DefaultVersion
 )
 
+// initialAdminPassword returns the initial password of the admin user as given by
+// --admin-password-file or the AdminPasswordEnvVar environment variable; "" if neither is set.
+func initialAdminPassword() (string, error) {
+	if !common.IsEmpty(adminPasswordFile) {
+		data, err := ioutil.ReadFile(adminPasswordFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read admin password file: %s", err.Error())
+		}
+
+		password := strings.TrimSpace(string(data))
+		if common.IsEmpty(password) {
+			return "", errors.New("admin password file is empty")
+		}
+
+		return password, nil
+	}
+
+	return strings.TrimSpace(os.Getenv(AdminPasswordEnvVar)), nil
+}
+
 func performInitialSetup() {
 	log.Println("Performing initial setup")
 
-	log.Println("Adding default users with default passwords")
-	if err := auth.AddDefaultUsers(); err != nil {
+	adminPassword, err := initialAdminPassword()
+	if err != nil {
+		log.Fatalln(err)
+		os.Exit(1)
+	}
+
+	if common.IsEmpty(adminPassword) {
+		log.Println("Adding default users with default passwords; they must be changed on the first login")
+	} else {
+		log.Println("Adding default users with the given admin password")
+	}
+
+	if err := auth.AddDefaultUsers(adminPassword); err != nil {
 		log.Fatalln(err)
 		// exit with a non-zero error code.
 		// this can be used by installers, etc. to determine whether the
@@ -50,10 +100,51 @@ func performInitialSetup() {
 		os.Exit(1)
 	}
 
+	if !common.IsEmpty(breakGlassKeyFile) {
+		publicKey, err := ioutil.ReadFile(breakGlassKeyFile)
+		if err != nil {
+			log.Fatalln("Failed to read break-glass public key file:", err)
+			os.Exit(1)
+		}
+
+		breakGlass, err := auth.InitBreakGlass(string(publicKey))
+		if err != nil {
+			log.Fatalln("Failed to arm the break-glass access:", err)
+			os.Exit(1)
+		}
+
+		if breakGlass != nil {
+			log.Println("Break-glass access is armed")
+		}
+	}
+
 	log.Println("Initial setup is complete.  Exiting.")
 	os.Exit(0)
 }
 
+// printBreakGlassCode prints the break-glass code derived from --break-glass-challenge with the
+// private key of --break-glass-private-key-file.
+func printBreakGlassCode() {
+	privateKey, err := ioutil.ReadFile(breakGlassSignKey)
+	if err != nil {
+		log.Fatalln("Failed to read break-glass private key file:", err)
+		os.Exit(1)
+	}
+
+	if common.IsEmpty(breakGlassChall) {
+		log.Fatalln("--break-glass-challenge is required")
+		os.Exit(1)
+	}
+
+	code, err := auth.BreakGlassCode(privateKey, breakGlassChall)
+	if err != nil {
+		log.Fatalln("Failed to derive the break-glass code:", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(code)
+}
+
 func processFlags() {
 	// TODO: add a flag for LDAP host + port
 
@@ -63,6 +154,30 @@ func processFlags() {
 		false,
 		"if set, run the initial proxy setup (adding default users, etc.)",
 	)
+	flag.StringVar(
+		&adminPasswordFile,
+		"admin-password-file",
+		"",
+		"path of the file holding the initial admin password; used with --initial-setup (also see "+AdminPasswordEnvVar+")",
+	)
+	flag.StringVar(
+		&breakGlassKeyFile,
+		"break-glass-public-key-file",
+		"",
+		"path of the PEM encoded Ed25519 public key the break-glass access is armed with; used with --initial-setup, ignored if the access was armed before",
+	)
+	flag.StringVar(
+		&breakGlassSignKey,
+		"break-glass-private-key-file",
+		"",
+		"path of the PEM encoded Ed25519 private key; if set, the break-glass code of --break-glass-challenge is printed and the program exits",
+	)
+	flag.StringVar(
+		&breakGlassChall,
+		"break-glass-challenge",
+		"",
+		"current challenge of the break-glass access; used with --break-glass-private-key-file",
+	)
 	flag.StringVar(
 		&listenAddress,
 		"listen-address",
@@ -93,6 +208,42 @@ func processFlags() {
 		false,
 		"if set, log level is set to debug",
 	)
+	flag.StringVar(
+		&auditLogFile,
+		"audit-log-file",
+		"",
+		"path of the file security events are recorded in; defaults to stderr",
+	)
+	flag.StringVar(
+		&passwordHashAlgo,
+		"password-hash-algorithm",
+		common.DefaultPasswordHashParams().Algorithm,
+		"algorithm used to hash local user passwords ("+common.BcryptAlgorithm+" or "+common.Argon2idAlgorithm+"); existing hashes are upgraded on login",
+	)
+	flag.IntVar(
+		&bcryptCost,
+		"bcrypt-cost",
+		common.DefaultPasswordHashParams().BcryptCost,
+		"bcrypt cost used to hash local user passwords",
+	)
+	flag.UintVar(
+		&argon2Time,
+		"argon2-time",
+		uint(common.DefaultPasswordHashParams().Argon2Time),
+		"number of argon2id passes used to hash local user passwords",
+	)
+	flag.UintVar(
+		&argon2Memory,
+		"argon2-memory",
+		uint(common.DefaultPasswordHashParams().Argon2Memory),
+		"argon2id memory (in KiB) used to hash local user passwords",
+	)
+	flag.UintVar(
+		&argon2Threads,
+		"argon2-threads",
+		uint(common.DefaultPasswordHashParams().Argon2Threads),
+		"argon2id parallelism used to hash local user passwords",
+	)
 	flag.StringVar(
 		&dataStoreAddress,
 		"data-store-address",
@@ -192,12 +343,53 @@ func main() {
 		log.SetLevel(log.DebugLevel)
 	}
 
+	// derive the break-glass code offline; nothing else is needed
+	if !common.IsEmpty(breakGlassSignKey) {
+		printBreakGlassCode()
+		return
+	}
+
+	if !common.IsEmpty(auditLogFile) {
+		if err := audit.SetOutputFile(auditLogFile); err != nil {
+			log.Fatalln("Failed to open audit log file:", err)
+			return
+		}
+	}
+
+	if argon2Time > math.MaxUint32 || argon2Memory > math.MaxUint32 || argon2Threads > math.MaxUint8 {
+		log.Fatalln("Invalid argon2id parameters")
+		return
+	}
+
+	if err := common.SetPasswordHashParams(common.PasswordHashParams{
+		Algorithm:     passwordHashAlgo,
+		BcryptCost:    bcryptCost,
+		Argon2Time:    uint32(argon2Time),
+		Argon2Memory:  uint32(argon2Memory),
+		Argon2Threads: uint8(argon2Threads),
+	}); err != nil {
+		log.Fatalln("Invalid password hashing algorithm/parameters:", err)
+		return
+	}
+
 	// Initialize data store
 	if err := state.InitializeStateDriver(dataStoreAddress); err != nil {
 		log.Fatalln(err)
 		return
 	}
 
+	// index the authorizations written by the previous releases
+	if err := db.EnsureAuthorizationIndexes(); err != nil {
+		log.Fatalln("Failed to build the authorization indexes:", err)
+		return
+	}
+
+	// index the local users written by the previous releases
+	if err := db.EnsureLocalUserIndex(); err != nil {
+		log.Fatalln("Failed to build the local user index:", err)
+		return
+	}
+
 	// if --initial-setup is specified, just perform setup and exit immediately
 	if initialSetup {
 		performInitialSetup()
@@ -209,6 +401,15 @@ func main() {
 		return
 	}
 
+	// serve the authorization lookups from memory
+	if err := db.StartAuthorizationCache(); err != nil {
+		log.Fatalln("Failed to start the authorization cache:", err)
+		return
+	}
+
+	// delete the time-bound authorizations once they expire
+	auth.StartAuthorizationReaper()
+
 	if err := common.Global().Set("tls_key_file", tlsKeyFile); err != nil {
 		log.Fatalln(err)
 		return
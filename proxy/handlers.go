@@ -3,13 +3,17 @@ package proxy
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strconv"
 
 	"github.com/contiv/auth_proxy/auth"
 	"github.com/contiv/auth_proxy/common"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
 	"github.com/gorilla/mux"
 
 	log "github.com/Sirupsen/logrus"
@@ -30,6 +34,7 @@ func serverError(w http.ResponseWriter, err error) {
 }
 
 // loginHandler handles the login request and returns auth token with user capabilities
+// if the user has to change the password, the token is only accepted by the change password endpoint
 // it can return various HTTP status codes:
 //     200 (authorization succeeded)
 //     400 (username and/or password were not provided)
@@ -65,10 +70,168 @@ func loginHandler(w http.ResponseWriter, req *http.Request) {
 
 	log.Debugf("Token String %q", tokenStr)
 
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		serverError(w, errors.New("Failed to parse the generated token: "+err.Error()))
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
-	writeJSONResponse(w, LoginResponse{Token: tokenStr})
+	writeJSONResponse(w, LoginResponse{Token: tokenStr, MustChangePassword: token.MustChangePassword()})
+}
+
+// changePasswordHandler lets a local user change their own password. It accepts any valid token
+// of a local user, including the restricted token handed out when the password has to be changed.
+// All other sessions of the user are revoked; a new token for the caller is returned.
+// it can return various HTTP status codes:
+//     200 (password changed; response carries the new token)
+//     400 (passwords were not provided/password policy violation/LDAP user)
+//     401 (missing or invalid token)
+//     403 (current password is incorrect/user is disabled/impersonation or down-scoped token)
+//     500 (something broke)
+func changePasswordHandler(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	tokenStr, err := getTokenFromHeader(req)
+	if err != nil {
+		authError(w, http.StatusUnauthorized, "Empty auth token")
+		return
+	}
+
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		authError(w, http.StatusUnauthorized, "Bad token")
+		return
+	}
+
+	if token.IsImpersonation() {
+		authError(w, http.StatusForbidden, "Password cannot be changed while impersonating a user")
+		return
+	}
+
+	if token.IsScoped() {
+		authError(w, http.StatusForbidden, "Password cannot be changed with a down-scoped token")
+		return
+	}
+
+	if !token.IsLocalUser() {
+		authError(w, http.StatusBadRequest, "Password of LDAP/AD users cannot be changed here; please change it in the directory")
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	cpReq := &changePasswordReq{}
+	if err := json.Unmarshal(body, cpReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal passwords from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := changePasswordHelper(token.Username(), cpReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// downscopeTokenHandler exchanges the caller's token for a narrower one limited to a subset of tenants,
+// a subset of HTTP methods and/or a shorter lifetime, e.g. to be handed to a script.
+// it can return various HTTP status codes:
+//     200 (the response contains the down-scoped token)
+//     400 (no restriction given, unsupported method, negative lifetime or restriction wider than the token's)
+//     401 (missing or invalid token)
+//     403 (the token can only be used to change the password)
+//     500 (something broke)
+func downscopeTokenHandler(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	isValid, token := isTokenValid(req.Header.Get("X-Auth-Token"), w)
+	if !isValid {
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	downscopeReq := &downscopeReq{}
+	if err := json.Unmarshal(body, downscopeReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal scope from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := downscopeTokenHelper(token, downscopeReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// accessDecisionHandler tells whether the caller's token grants access to a tenant or to a resource
+// of it and why, e.g. which deny authorization denied access; admins can check the access of a user
+// by impersonating the user. Query parameters:
+//     tenant: tenant the access is checked on; required
+//     resource_type: netmaster resource (e.g. networks) the access is checked on; optional
+//     resource_name: name of the resource the access is checked on (rules: <tenant>:<policy>:<ruleId>); optional
+// it can return various HTTP status codes:
+//     200 (the decision)
+//     400 (tenant missing)
+//     401 (missing or invalid token)
+//     403 (the token can only be used to change the password)
+//     500 (something broke)
+func accessDecisionHandler(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	isValid, token := isTokenValid(req.Header.Get("X-Auth-Token"), w)
+	if !isValid {
+		return
+	}
+
+	query := req.URL.Query()
+	tenant := query.Get("tenant")
+	if common.IsEmpty(tenant) {
+		authError(w, http.StatusBadRequest, "Tenant must be provided")
+		return
+	}
+
+	resource := types.Resource{Type: query.Get("resource_type"), Name: query.Get("resource_name")}
+	statusCode, resp := accessDecisionHelper(token, types.Tenant(tenant), resource)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// whoAmIHandler returns the details of the caller's session: username, role, principals and
+// user attributes carried by the token along with the last login of the user.
+// it can return various HTTP status codes:
+//     200 (details of the session)
+//     401 (missing or invalid token)
+//     500 (something broke)
+func whoAmIHandler(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	tokenStr, err := getTokenFromHeader(req)
+	if err != nil {
+		authError(w, http.StatusUnauthorized, "Empty auth token")
+		return
+	}
+
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		authError(w, http.StatusUnauthorized, "Bad token")
+		return
+	}
+
+	statusCode, resp := whoAmIHelper(token)
+	processStatusCodes(statusCode, resp, w)
 }
 
+const (
+	// defaultPageLimit is the number of items returned per page if the request doesn't specify one
+	defaultPageLimit = 50
+
+	// maxPageLimit is the maximum number of items returned per page
+	maxPageLimit = 500
+)
+
 const (
 	// StatusHealthy is used to indicate a healthy response
 	StatusHealthy = "healthy"
@@ -106,6 +269,9 @@ type HealthCheckResponse struct {
 	NetmasterHealth *NetmasterHealthCheckResponse `json:"netmaster"`
 	Status          string                        `json:"status"`
 	Version         string                        `json:"version"`
+
+	// the proxy stays healthy while the cache falls back to the data store
+	AuthorizationCache *db.AuthorizationCacheStatus `json:"authorization_cache"`
 }
 
 // MarkUnhealthy marks the proxy as being unhealthy
@@ -138,6 +304,7 @@ func healthCheckHandler(config *Config) func(http.ResponseWriter, *http.Request)
 		}
 
 		hcr.NetmasterHealth = nhcr
+		hcr.AuthorizationCache = db.GetAuthorizationCacheStatus()
 
 		//
 		// prepare the response
@@ -200,6 +367,36 @@ func adminOnly(handler func(http.ResponseWriter, *http.Request)) func(http.Respo
 			return
 		}
 
+		// restricted tokens can only be used to change the password
+		if token.MustChangePassword() {
+			log.Error("unauthorized: caller has to change the password first")
+
+			httpStatus := http.StatusForbidden
+			httpResponse := []byte(auth_errors.ErrPasswordChangeRequired.(*auth_errors.AuthError).Message)
+			processStatusCodes(httpStatus, httpResponse, w)
+			return
+		}
+
+		// an admin impersonating a user acts with the privileges of the user, never with its own
+		if token.IsImpersonation() {
+			log.Errorf("unauthorized: %q is impersonating %q", token.Actor(), token.Username())
+
+			httpStatus := http.StatusForbidden
+			httpResponse := []byte("access denied: impersonation tokens can't be used on admin endpoints")
+			processStatusCodes(httpStatus, httpResponse, w)
+			return
+		}
+
+		// down-scoped tokens are limited to the tenants and methods of their scope
+		if token.ScopedTenants() != nil || !token.AllowsMethod(req.Method) {
+			log.Errorf("unauthorized: request is out of the scope of the token of %q", token.Username())
+
+			httpStatus := http.StatusForbidden
+			httpResponse := []byte("access denied: request is out of the scope of the token")
+			processStatusCodes(httpStatus, httpResponse, w)
+			return
+		}
+
 		// Check that caller has admin privileges
 		if !token.IsSuperuser() {
 			// TODO: log the violator's details here
@@ -210,6 +407,7 @@ func adminOnly(handler func(http.ResponseWriter, *http.Request)) func(http.Respo
 			httpStatus := http.StatusForbidden
 			httpResponse := []byte("access denied")
 			processStatusCodes(httpStatus, httpResponse, w)
+			return
 		}
 
 		// if there were no errors, call the handler we wrapped
@@ -256,7 +454,8 @@ func deleteLocalUser(w http.ResponseWriter, req *http.Request) {
 	processStatusCodes(statusCode, resp, w)
 }
 
-// updateLocalUser updates the existing user with the given details.
+// updateLocalUser updates the existing user with the given details; the fields
+// left out of the request are not changed.
 // it can return various HTTP status codes:
 //    204 (NoContent; update was successful)
 //    404 (NotFound; user not found)
@@ -270,7 +469,7 @@ func updateLocalUser(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	userUpdateReq := &types.LocalUser{}
+	userUpdateReq := &localUserUpdateReq{}
 	if err := json.Unmarshal(body, userUpdateReq); err != nil {
 		serverError(w, errors.New("Failed to unmarshal user info. from request body: "+err.Error()))
 		return
@@ -280,12 +479,32 @@ func updateLocalUser(w http.ResponseWriter, req *http.Request) {
 	processStatusCodes(statusCode, resp, w)
 }
 
-// getLocalUsers returns all the local users available in the system
+// getLocalUsers returns the local users available in the system matching the query parameters:
+//    prefix: prefix of the username
+//    disabled: true for the disabled users, false for the enabled ones
+//    limit, next: size and cursor of the page; all the users are returned as a plain list if
+//                 neither is given, otherwise a ListLocalUsersReply is returned
 // it can return various HTTP status codes:
 //    200 (OK; fetch was successful)
+//    400 (BadRequest; invalid query parameter)
 //    500 (internal server error)
 func getLocalUsers(w http.ResponseWriter, req *http.Request) {
-	statusCode, resp := getLocalUsersHelper()
+	query := req.URL.Query()
+
+	disabled, err := boolQueryParameter(query, "disabled")
+	if err != nil {
+		processStatusCodes(http.StatusBadRequest, []byte(err.Error()), w)
+		return
+	}
+
+	limit, err := listPageLimit(query)
+	if err != nil {
+		processStatusCodes(http.StatusBadRequest, []byte(err.Error()), w)
+		return
+	}
+
+	filter := db.LocalUserFilter{Prefix: query.Get("prefix"), Disabled: disabled}
+	statusCode, resp := getLocalUsersHelper(filter, limit, query.Get("next"))
 	processStatusCodes(statusCode, resp, w)
 }
 
@@ -301,6 +520,161 @@ func getLocalUser(w http.ResponseWriter, req *http.Request) {
 	processStatusCodes(statusCode, resp, w)
 }
 
+// getPasswordPolicy returns the password policy that applies to local users
+// it can return various HTTP status codes:
+//    200 (OK; fetch was successful)
+//    500 (internal server error)
+func getPasswordPolicy(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := getPasswordPolicyHelper()
+	processStatusCodes(statusCode, resp, w)
+}
+
+// updatePasswordPolicy replaces the password policy that applies to local users.
+// the policy is enforced whenever a local user is added or a password is changed.
+// it can return various HTTP status codes:
+//    200 (OK; update was successful)
+//    400 (BadRequest; invalid policy)
+//    500 (internal server error)
+func updatePasswordPolicy(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	passwordPolicy := &types.PasswordPolicy{}
+	if err := json.Unmarshal(body, passwordPolicy); err != nil {
+		serverError(w, errors.New("Failed to unmarshal password policy from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := updatePasswordPolicyHelper(passwordPolicy)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// Local group management handler functions
+// These actions can only be performed by administrators.
+// They are protected at the router by the adminOnly() function above.
+
+// addLocalGroup adds a new local group to the system.
+// it can return various HTTP status codes:
+//    201 (Created; group added to the system)
+//    400 (BadRequest; group exists in the system already/member is not a local user)
+//    500 (internal server error)
+func addLocalGroup(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	groupCreateReq := &types.LocalGroup{}
+	if err := json.Unmarshal(body, groupCreateReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal group info. from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := addLocalGroupHelper(groupCreateReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteLocalGroup deletes the given group and its authorizations from the system;
+// the tokens issued to its members are no longer accepted.
+// it can return various HTTP status codes:
+//    204 (NoContent; group deleted from the system)
+//    404 (NotFound; group not found)
+//    500 (internal server error)
+func deleteLocalGroup(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	statusCode, resp := deleteLocalGroupHelper(vars["name"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// updateLocalGroup updates the description of the given group.
+// it can return various HTTP status codes:
+//    200 (OK; update was successful)
+//    404 (NotFound; group not found)
+//    500 (internal server error)
+func updateLocalGroup(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	groupUpdateReq := &localGroupUpdateReq{}
+	if err := json.Unmarshal(body, groupUpdateReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal group info. from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := updateLocalGroupHelper(vars["name"], groupUpdateReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getLocalGroups returns all the local groups available in the system
+// it can return various HTTP status codes:
+//    200 (OK; fetch was successful)
+//    500 (internal server error)
+func getLocalGroups(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := getLocalGroupsHelper()
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getLocalGroup returns the details of the given group
+// it can return various HTTP status codes:
+//  200 (OK; fetch was successful)
+//  404 (NotFound; group not found)
+//  500 (internal server error)
+func getLocalGroup(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	statusCode, resp := getLocalGroupHelper(vars["name"])
+	processStatusCodes(statusCode, resp, w)
+}
+
+// addLocalGroupMember adds a local user to the given group.
+// it can return various HTTP status codes:
+//    200 (OK; user added to the group)
+//    400 (BadRequest; user not found)
+//    404 (NotFound; group not found)
+//    500 (internal server error)
+func addLocalGroupMember(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	memberReq := &localGroupMemberReq{}
+	if err := json.Unmarshal(body, memberReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal member info. from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := addLocalGroupMemberHelper(vars["name"], memberReq.Username)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteLocalGroupMember removes a local user from the given group; the tokens
+// issued to the user are no longer accepted.
+// it can return various HTTP status codes:
+//    200 (OK; user removed from the group)
+//    400 (BadRequest; user is not a member of the group)
+//    404 (NotFound; group not found)
+//    500 (internal server error)
+func deleteLocalGroupMember(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	statusCode, resp := deleteLocalGroupMemberHelper(vars["name"], vars["username"])
+	processStatusCodes(statusCode, resp, w)
+}
+
 // Authorization handler functions
 // These actions can only be performed by administrators.
 // They are protected at the router by the adminOnly() function above.
@@ -309,7 +683,9 @@ func getLocalUser(w http.ResponseWriter, req *http.Request) {
 // addAuthorization adds an authorization
 // Returns these HTTP status codes:
 //    201 (authz added)
-//    400 (attempted to add authorization to built-in local admin user)
+//    400 (attempted to add authorization to built-in local admin user/local group not found/
+//         LDAP group not found when validation is requested/illegal resource of a deny authorization)
+//    409 (authorizations changed concurrently)
 //    500 (internal server error)
 //
 func addAuthorization(w http.ResponseWriter, req *http.Request) {
@@ -335,41 +711,25 @@ func addAuthorization(w http.ResponseWriter, req *http.Request) {
 	}
 
 	// input validation
-	if common.IsEmpty(addAuthzReq.PrincipalName) {
-		log.Warnf("principal name missing from authorization: %#v", addAuthzReq)
-
-		httpStatus = http.StatusBadRequest
-		httpResponse = []byte("principal name is missing")
-
-		processStatusCodes(httpStatus, httpResponse, w)
-		return
-	}
-
-	role, err := types.Role(addAuthzReq.Role)
-	if err != nil {
-		log.Warnf("illegal role specified in authorization: %#v", addAuthzReq)
-
-		httpStatus = http.StatusBadRequest
-		httpResponse = []byte("illegal role specified")
-
+	operation, httpStatus, httpResponse := addAuthorizationOperation(addAuthzReq)
+	if httpStatus != 0 {
 		processStatusCodes(httpStatus, httpResponse, w)
 		return
 	}
 
-	// If role specific is ops, a tenant name must be specified
-	if role == types.Ops && common.IsEmpty(addAuthzReq.TenantName) {
-		log.Warnf("ops role without specifying tenant in authorization: %#v", addAuthzReq)
-
-		httpStatus = http.StatusBadRequest
-		httpResponse = []byte("ops role requires a tenant to be specified")
-
-		processStatusCodes(httpStatus, httpResponse, w)
-		return
+	// invoke helper to add authz
+	var authz types.Authorization
+	if operation.Deny {
+		authz, err = auth.AddDenyAuthorization(operation.TenantName,
+			operation.PrincipalName, operation.Local, operation.Resource, operation.NotBefore, operation.ExpiresAt)
+	} else {
+		// validated along with the request
+		role, _ := types.Role(operation.Role)
+
+		authz, err = auth.AddAuthorization(operation.TenantName,
+			role, operation.PrincipalName, operation.Local, operation.NotBefore, operation.ExpiresAt)
 	}
 
-	// invoke helper to add authz
-	authz, err := auth.AddAuthorization(addAuthzReq.TenantName,
-		role, addAuthzReq.PrincipalName, addAuthzReq.Local)
 	switch err {
 	case nil:
 
@@ -378,46 +738,101 @@ func addAuthorization(w http.ResponseWriter, req *http.Request) {
 		// convert authorization reply to JSON
 		jsonAuthz, err := json.Marshal(getAuthzReply)
 		if err != nil {
-
 			log.Error("failed to marshal authorization, err:", err)
 			httpStatus = http.StatusInternalServerError
-			httpResponse = []byte(auth_errors.ErrPartialFailureToAddAuthz.Error())
-
-			// clean up created authorization
-			err = auth.DeleteAuthorization(authz.UUID)
-			if err != nil {
-				log.Error("Failed to delete authz after partially failed ",
-					" authz creation, Manual cleanup from KV store needed!")
-			}
-			processStatusCodes(httpStatus, httpResponse, w)
-			return
+			httpResponse = []byte(err.Error())
+			break
 		}
 		httpStatus = http.StatusCreated
 		httpResponse = jsonAuthz
-	case auth_errors.ErrIllegalOperation:
+	case auth_errors.ErrIllegalOperation, auth_errors.ErrIllegalArguments:
 		httpStatus = http.StatusBadRequest
 		httpResponse = []byte(err.Error())
+	case auth_errors.ErrKeyModified:
+		httpStatus = http.StatusConflict
+		httpResponse = []byte("authorizations are being changed concurrently; try again")
 	default:
 
 		httpStatus = http.StatusInternalServerError
-		httpResponse = []byte(auth_errors.ErrUnauthorized.Error())
+		httpResponse = authzBatchFailure(err, auth_errors.ErrPartialFailureToAddAuthz, auth_errors.ErrUnauthorized)
 	}
 
 	// process status codes
 	processStatusCodes(httpStatus, httpResponse, w)
 }
 
-// deleteAuthorization deletes an authorization
-func deleteAuthorization(w http.ResponseWriter, req *http.Request) {
-
+//
+// updateAuthorization changes the role and/or tenant of an authorization
+// Returns these HTTP status codes:
+//    200 (authz updated)
+//    400 (illegal role/tenant or authorization of the built-in local admin user)
+//    404 (authz not found)
+//    500 (internal server error)
+//
+func updateAuthorization(w http.ResponseWriter, req *http.Request) {
 	defer common.Untrace(common.Trace())
 
-	var httpStatus int
-	var httpResponse []byte
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Warn("failed to parse request body for updating authorization, err:", err)
+		serverError(w, auth_errors.ErrParsingRequest)
+		return
+	}
 
-	// retrieve authz UUID from URL
-	vars := mux.Vars(req)
-	authzUUID := vars["authzUUID"]
+	updateAuthzReq := &UpdateAuthorizationRequest{}
+	if err := json.Unmarshal(body, updateAuthzReq); err != nil {
+		log.Warn("failed to unmarshal authorization, err:", err)
+		serverError(w, auth_errors.ErrUnmarshalingBody)
+		return
+	}
+
+	statusCode, resp := updateAuthorizationHelper(mux.Vars(req)["authzUUID"], updateAuthzReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+//
+// bulkAuthorizations applies a list of add, update and delete operations on
+// authorizations; they are validated all or nothing, then written as a single
+// batch which takes effect entirely or not at all
+// Returns these HTTP status codes:
+//    200 (all the operations applied)
+//    400 (invalid operation; nothing applied)
+//    404 (authz to be updated or deleted not found; nothing applied)
+//    409 (authorizations changed concurrently; nothing applied)
+//    500 (internal server error; the results tell whether the operations are pending)
+//
+func bulkAuthorizations(w http.ResponseWriter, req *http.Request) {
+	defer common.Untrace(common.Trace())
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		log.Warn("failed to parse request body for bulk authorizations, err:", err)
+		serverError(w, auth_errors.ErrParsingRequest)
+		return
+	}
+
+	bulkAuthzReq := &BulkAuthorizationRequest{}
+	if err := json.Unmarshal(body, bulkAuthzReq); err != nil {
+		log.Warn("failed to unmarshal bulk authorizations, err:", err)
+		serverError(w, auth_errors.ErrUnmarshalingBody)
+		return
+	}
+
+	statusCode, resp := bulkAuthorizationsHelper(bulkAuthzReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// deleteAuthorization deletes an authorization
+func deleteAuthorization(w http.ResponseWriter, req *http.Request) {
+
+	defer common.Untrace(common.Trace())
+
+	var httpStatus int
+	var httpResponse []byte
+
+	// retrieve authz UUID from URL
+	vars := mux.Vars(req)
+	authzUUID := vars["authzUUID"]
 
 	// invoke helper to delete authz
 	err := auth.DeleteAuthorization(authzUUID)
@@ -431,6 +846,9 @@ func deleteAuthorization(w http.ResponseWriter, req *http.Request) {
 	case auth_errors.ErrIllegalOperation:
 		httpStatus = http.StatusBadRequest
 		httpResponse = []byte(err.Error())
+	case auth_errors.ErrKeyModified:
+		httpStatus = http.StatusConflict
+		httpResponse = []byte("authorizations are being changed concurrently; try again")
 	default:
 		httpStatus = http.StatusInternalServerError
 		httpResponse = []byte(err.Error())
@@ -482,43 +900,330 @@ func getAuthorization(w http.ResponseWriter, req *http.Request) {
 
 }
 
-// listAuthorization lists all authorizations
+// listAuthorization lists the authorizations matching the query parameters:
+//    principal, localGroup: principal of the authorizations; localGroup=true if it's the name of a local group
+//    local: true for local principals, false for LDAP groups
+//    role, tenant: role granted and tenant it's granted on
+//    limit, next: size and cursor of the page; all the authorizations are returned as a plain list if
+//                 neither is given, otherwise a ListAuthorizationsReply is returned
+// Returns these HTTP status codes:
+//    200 (OK)
+//    400 (invalid query parameter)
+//    500 (internal server error)
 func listAuthorizations(w http.ResponseWriter, req *http.Request) {
 
 	defer common.Untrace(common.Trace())
 
-	var httpStatus int
-	var httpResponse []byte
+	query := req.URL.Query()
 
-	// invoke helper to get authz
-	authzList, err := auth.ListAuthorizations()
-	switch err {
-	case nil:
-		httpStatus = http.StatusOK
+	filter, err := authorizationFilter(query)
+	if err != nil {
+		processStatusCodes(http.StatusBadRequest, []byte(err.Error()), w)
+		return
+	}
 
-		// convert authorizations to authorization reply msgs
-		authzReplyList := []GetAuthorizationReply{}
-		for _, authz := range authzList {
-			authzReply := convertAuthz(authz)
-			authzReplyList = append(authzReplyList, authzReply)
-		}
+	limit, err := listPageLimit(query)
+	if err != nil {
+		processStatusCodes(http.StatusBadRequest, []byte(err.Error()), w)
+		return
+	}
 
-		// convert authorization reply list to JSON
-		jsonAuthzReplyList, err := json.Marshal(authzReplyList)
-		if err != nil {
-			httpStatus = http.StatusInternalServerError
-			httpResponse = []byte(err.Error())
-			break
+	statusCode, resp := listAuthorizationsHelper(filter, limit, query.Get("next"))
+	processStatusCodes(statusCode, resp, w)
+}
+
+// Elevation handler functions
+// Any local user can request a role for a limited time; only admins can decide the requests.
+
+// requestElevation records a request of the caller to be granted a role for a limited time.
+// it can return various HTTP status codes:
+//    201 (Created; the request is pending)
+//    400 (BadRequest; invalid role, tenant, duration or reason, or LDAP user)
+//    401 (missing or invalid token)
+//    403 (Forbidden; impersonation or down-scoped token)
+//    500 (internal server error)
+func requestElevation(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	isValid, token := isTokenValid(req.Header.Get("X-Auth-Token"), w)
+	if !isValid {
+		return
+	}
+
+	if token.IsImpersonation() || token.IsScoped() {
+		authError(w, http.StatusForbidden, "Elevation cannot be requested while impersonating a user or with a down-scoped token")
+		return
+	}
+
+	// LDAP users are authorized through their groups which can't be elevated on behalf of one user
+	if !token.IsLocalUser() {
+		authError(w, http.StatusBadRequest, "Elevation can only be requested by local users")
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	elevationReq := &elevationReq{}
+	if err := json.Unmarshal(body, elevationReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal elevation request from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := requestElevationHelper(token.Username(), elevationReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// listElevationRequests lists the elevation requests, oldest first. Admins see all the requests,
+// the other users see their own. Query parameters:
+//    requester: username of the requester; admins only
+//    status: pending, approved or denied
+// it can return various HTTP status codes:
+//    200 (OK)
+//    401 (missing or invalid token)
+//    500 (internal server error)
+func listElevationRequests(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	isValid, token := isTokenValid(req.Header.Get("X-Auth-Token"), w)
+	if !isValid {
+		return
+	}
+
+	query := req.URL.Query()
+	requester := query.Get("requester")
+	if !token.IsSuperuser() {
+		requester = token.Username()
+	}
+
+	statusCode, resp := listElevationRequestsHelper(requester, query.Get("status"))
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getElevationRequest returns the given elevation request; the users who are not admins can only
+// get their own requests.
+// it can return various HTTP status codes:
+//    200 (OK)
+//    401 (missing or invalid token)
+//    404 (NotFound; request not found)
+//    500 (internal server error)
+func getElevationRequest(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	isValid, token := isTokenValid(req.Header.Get("X-Auth-Token"), w)
+	if !isValid {
+		return
+	}
+
+	requester := ""
+	if !token.IsSuperuser() {
+		requester = token.Username()
+	}
+
+	statusCode, resp := getElevationRequestHelper(mux.Vars(req)["id"], requester)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// approveElevationRequest grants the role of the given pending request for the duration requested.
+// it can return various HTTP status codes:
+//    200 (OK; the role is granted)
+//    403 (Forbidden; the caller is the requester)
+//    404 (NotFound; request not found)
+//    409 (Conflict; the request was already decided)
+//    500 (internal server error)
+func approveElevationRequest(w http.ResponseWriter, req *http.Request) {
+	decideElevationRequest(w, req, true)
+}
+
+// denyElevationRequest denies the given pending request.
+// it can return various HTTP status codes:
+//    200 (OK; the request is denied)
+//    403 (Forbidden; the caller is the requester)
+//    404 (NotFound; request not found)
+//    409 (Conflict; the request was already decided)
+//    500 (internal server error)
+func denyElevationRequest(w http.ResponseWriter, req *http.Request) {
+	decideElevationRequest(w, req, false)
+}
+
+// decideElevationRequest approves or denies the given pending request on behalf of the caller; see
+// approveElevationRequest and denyElevationRequest.
+func decideElevationRequest(w http.ResponseWriter, req *http.Request, approve bool) {
+	// validated by adminOnly
+	tokenStr, _ := getTokenFromHeader(req)
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		authError(w, http.StatusUnauthorized, "Bad token")
+		return
+	}
+
+	decisionReq := &elevationDecisionReq{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	// the comment is optional
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, decisionReq); err != nil {
+			serverError(w, errors.New("Failed to unmarshal decision from request body: "+err.Error()))
+			return
 		}
-		httpResponse = jsonAuthzReplyList
+	}
+
+	statusCode, resp := decideElevationHelper(mux.Vars(req)["id"], token.Username(), approve, decisionReq.Comment)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// Break-glass handler functions
+
+// breakGlassChallenge returns the challenge the next break-glass code must be derived from; it
+// requires no token since it's meant for when nobody can log in.
+// it can return various HTTP status codes:
+//    200 (OK; the challenge is only set if the access is armed)
+//    500 (internal server error)
+func breakGlassChallenge(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	statusCode, resp := breakGlassChallengeHelper()
+	processStatusCodes(statusCode, resp, w)
+}
 
+// breakGlassLogin grants a short-lived admin token in exchange for a break-glass code; the access is
+// disarmed until an admin re-arms it.
+// it can return various HTTP status codes:
+//    200 (the response carries the token)
+//    400 (code was not provided)
+//    401 (access not armed or invalid code)
+//    500 (something broke)
+func breakGlassLogin(w http.ResponseWriter, req *http.Request) {
+	common.SetDefaultResponseHeaders(w)
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	loginReq := &breakGlassLoginReq{}
+	if err := json.Unmarshal(body, loginReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal code from request body: "+err.Error()))
+		return
+	}
+
+	if common.IsEmpty(loginReq.Code) {
+		authError(w, http.StatusBadRequest, "Code must be provided")
+		return
+	}
+
+	tokenStr, err := auth.BreakGlassLogin(loginReq.Code, req.RemoteAddr)
+	switch err {
+	case nil:
+	case auth_errors.ErrAccessDenied:
+		authError(w, http.StatusUnauthorized, "Break-glass access is not armed or the code is invalid")
+		return
 	default:
-		httpStatus = http.StatusInternalServerError
-		httpResponse = []byte(err.Error())
+		serverError(w, errors.New("Failed to use the break-glass access: "+err.Error()))
+		return
 	}
 
-	// process status codes
-	processStatusCodes(httpStatus, httpResponse, w)
+	w.WriteHeader(http.StatusOK)
+	writeJSONResponse(w, LoginResponse{Token: tokenStr})
+}
+
+// impersonate grants the caller a short-lived token evaluating RBAC as the given local user or as
+// the given LDAP principals; the token can't be used on the admin endpoints.
+// it can return various HTTP status codes:
+//    200 (OK; the response contains the impersonation token)
+//    400 (BadRequest; no username, or no principals for a LDAP user)
+//    403 (Forbidden; down-scoped token)
+//    404 (NotFound; the local user doesn't exist)
+//    500 (internal server error)
+func impersonate(w http.ResponseWriter, req *http.Request) {
+	// validated by adminOnly
+	tokenStr, _ := getTokenFromHeader(req)
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		authError(w, http.StatusUnauthorized, "Bad token")
+		return
+	}
+
+	// the impersonation token would not be limited to the scope
+	if token.IsScoped() {
+		authError(w, http.StatusForbidden, "Users cannot be impersonated with a down-scoped token")
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	impersonateReq := &impersonateReq{}
+	if err := json.Unmarshal(body, impersonateReq); err != nil {
+		serverError(w, errors.New("Failed to unmarshal impersonation request from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := impersonateHelper(token.Username(), impersonateReq)
+	processStatusCodes(statusCode, resp, w)
+}
+
+// getBreakGlass returns the state of the break-glass access: public key, challenge, last arming and use.
+// it can return various HTTP status codes:
+//    200 (OK)
+//    404 (NotFound; the access was never armed)
+//    500 (internal server error)
+func getBreakGlass(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := getBreakGlassHelper()
+	processStatusCodes(statusCode, resp, w)
+}
+
+// armBreakGlass arms the break-glass access with a new challenge, optionally with a new public key;
+// the codes and the tokens of the previous challenge are no longer accepted.
+// it can return various HTTP status codes:
+//    200 (OK; the access is armed)
+//    400 (BadRequest; invalid public key, or none given and none set before)
+//    403 (Forbidden; the token was granted by the break-glass access itself)
+//    409 (Conflict; the access was changed concurrently)
+//    500 (internal server error)
+func armBreakGlass(w http.ResponseWriter, req *http.Request) {
+	// validated by adminOnly
+	tokenStr, _ := getTokenFromHeader(req)
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		authError(w, http.StatusUnauthorized, "Bad token")
+		return
+	}
+
+	// otherwise the break-glass access could be extended indefinitely with the tokens it grants
+	if token.IsBreakGlass() {
+		authError(w, http.StatusForbidden, "Break-glass access cannot be re-armed with a break-glass token")
+		return
+	}
+
+	armReq := &breakGlassArmReq{}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	// the public key is optional
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, armReq); err != nil {
+			serverError(w, errors.New("Failed to unmarshal public key from request body: "+err.Error()))
+			return
+		}
+	}
+
+	statusCode, resp := armBreakGlassHelper(token.Username(), armReq.PublicKey)
+	processStatusCodes(statusCode, resp, w)
 }
 
 // LDAP configuration management handler functions
@@ -527,7 +1232,7 @@ func listAuthorizations(w http.ResponseWriter, req *http.Request) {
 // addLdapConfiguration adds LDAP configuration to the system.
 // it can return various HTTP codes:
 //    201 (Created; configuration added to the system)
-//    404 (BadRequest; configuration exists in the system already)
+//    400 (BadRequest; invalid settings or configuration exists in the system already)
 //    500 (internal server error)
 func addLdapConfiguration(w http.ResponseWriter, req *http.Request) {
 	body, err := ioutil.ReadAll(req.Body)
@@ -547,13 +1252,116 @@ func addLdapConfiguration(w http.ResponseWriter, req *http.Request) {
 
 }
 
-// getLdapConfiguration retrieves LDAP configuration from the system.
+// testLdapConfiguration tests the given LDAP configuration step by step without saving it.
+// it can return various HTTP codes:
+//    200 (OK; test was run; the outcome of each step is in the response)
+//    400 (BadRequest; invalid settings)
+//    500 (internal server error)
+func testLdapConfiguration(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	lt := &types.LdapConfigurationTest{}
+	if err := json.Unmarshal(body, lt); err != nil {
+		serverError(w, errors.New("Failed to unmarshal LDAP configuration from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := testLdapConfigurationHelper(lt)
+	processStatusCodes(statusCode, resp, w)
+
+}
+
+// testStoredLdapConfiguration tests the given stored LDAP configuration step by step; the body
+// optionally carries the `username` and `password` of the user to test with.
+// it can return various HTTP codes:
+//    200 (OK; test was run; the outcome of each step is in the response)
+//    404 (NotFound; configuration doesn't exist)
+//    500 (internal server error)
+func testStoredLdapConfiguration(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		serverError(w, errors.New("Failed to read body from request: "+err.Error()))
+		return
+	}
+
+	lt := &types.LdapConfigurationTest{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, lt); err != nil {
+			serverError(w, errors.New("Failed to unmarshal user credentials from request body: "+err.Error()))
+			return
+		}
+	}
+
+	statusCode, resp := testStoredLdapConfigurationHelper(ldapConfigurationName(req), lt.Username, lt.Password)
+	processStatusCodes(statusCode, resp, w)
+
+}
+
+// getLdapConfigurations retrieves all the LDAP configurations from the system.
+// it can return various HTTP codes:
+//    200 (OK; fetch was successful)
+//    500 (internal server error)
+func getLdapConfigurations(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := getLdapConfigurationsHelper()
+	processStatusCodes(statusCode, resp, w)
+
+}
+
+// getLdapConfiguration retrieves the given LDAP configuration from the system.
 // it can return various HTTP codes:
 //    200 (OK; fetch was successful)
 //    404 (NotFound, configuration not found)
 //    500 (internal server error)
 func getLdapConfiguration(w http.ResponseWriter, req *http.Request) {
-	statusCode, resp := getLdapConfigurationHelper()
+	statusCode, resp := getLdapConfigurationHelper(ldapConfigurationName(req))
+	processStatusCodes(statusCode, resp, w)
+
+}
+
+// getLdapServers retrieves the health of the servers of the given LDAP configuration.
+// it can return various HTTP codes:
+//    200 (OK; fetch was successful)
+//    404 (NotFound, configuration not found)
+//    500 (internal server error)
+func getLdapServers(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := getLdapServersHelper(ldapConfigurationName(req))
+	processStatusCodes(statusCode, resp, w)
+
+}
+
+// getLdapMetrics retrieves the connection pool, cache and latency metrics of the given LDAP configuration.
+// it can return various HTTP codes:
+//    200 (OK; fetch was successful)
+//    404 (NotFound, configuration not found)
+//    500 (internal server error)
+func getLdapMetrics(w http.ResponseWriter, req *http.Request) {
+	statusCode, resp := getLdapMetricsHelper(ldapConfigurationName(req))
+	processStatusCodes(statusCode, resp, w)
+
+}
+
+// searchLdapDirectory searches the directory of the given LDAP configuration for the groups or users
+// whose name contains the `q` query parameter; `limit` and `next` query parameters select the page.
+// it can return various HTTP codes:
+//    200 (OK; search was successful)
+//    400 (BadRequest; invalid page parameters)
+//    404 (NotFound, configuration not found)
+//    500 (internal server error)
+func searchLdapDirectory(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	limit, err := pageLimit(query.Get("limit"))
+	if err != nil {
+		processStatusCodes(http.StatusBadRequest, []byte(err.Error()), w)
+		return
+	}
+
+	statusCode, resp := searchLdapDirectoryHelper(ldapConfigurationName(req), mux.Vars(req)["kind"],
+		query.Get("q"), limit, query.Get("next"))
 	processStatusCodes(statusCode, resp, w)
 
 }
@@ -564,14 +1372,17 @@ func getLdapConfiguration(w http.ResponseWriter, req *http.Request) {
 //    404 (NotFound; configuration not found)
 //    500 (internal server error)
 func deleteLdapConfiguration(w http.ResponseWriter, req *http.Request) {
-	statusCode, resp := deleteLdapConfigurationHelper()
+	statusCode, resp := deleteLdapConfigurationHelper(ldapConfigurationName(req))
 	processStatusCodes(statusCode, resp, w)
 
 }
 
-// updateLdapConfiguration updates the existing LDAP configuration in the system.
+// updateLdapConfiguration updates the existing LDAP configuration in the system;
+// the domain and search settings given empty are cleared, the ones left out of
+// the request are not changed.
 // it can return various HTTP codes:
 //    200 (OK; configuration updated)
+//    400 (BadRequest; invalid settings)
 //    404 (NotFound, configuration not found)
 //    500 (internal server error)
 func updateLdapConfiguration(w http.ResponseWriter, req *http.Request) {
@@ -587,7 +1398,93 @@ func updateLdapConfiguration(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	statusCode, resp := updateLdapConfigurationHelper(ls)
+	fields := updatedFields{}
+	if err := json.Unmarshal(body, &fields); err != nil {
+		serverError(w, errors.New("Failed to unmarshal user info. from request body: "+err.Error()))
+		return
+	}
+
+	statusCode, resp := updateLdapConfigurationHelper(ldapConfigurationName(req), ls, fields)
 	processStatusCodes(statusCode, resp, w)
 
 }
+
+// pageLimit parses the given `limit` query parameter; defaultPageLimit is returned if it is empty.
+func pageLimit(limit string) (int, error) {
+	if common.IsEmpty(limit) {
+		return defaultPageLimit, nil
+	}
+
+	value, err := strconv.Atoi(limit)
+	if err != nil || value <= 0 || value > maxPageLimit {
+		return 0, fmt.Errorf("limit must be a number between 1 and %d", maxPageLimit)
+	}
+
+	return value, nil
+}
+
+// listPageLimit parses the `limit` query parameter of a listing which returns everything as a plain list
+// unless a page is requested with `limit` or `next`.
+// return values:
+//  int: size of the page; 0 if no page is requested
+//  error: if the limit is invalid
+func listPageLimit(query url.Values) (int, error) {
+	if common.IsEmpty(query.Get("limit")) && common.IsEmpty(query.Get("next")) {
+		return 0, nil
+	}
+
+	return pageLimit(query.Get("limit"))
+}
+
+// boolQueryParameter parses a boolean query parameter; nil is returned if it is empty.
+func boolQueryParameter(query url.Values, name string) (*bool, error) {
+	if common.IsEmpty(query.Get(name)) {
+		return nil, nil
+	}
+
+	value, err := strconv.ParseBool(query.Get(name))
+	if err != nil {
+		return nil, fmt.Errorf("%s must be true or false", name)
+	}
+
+	return &value, nil
+}
+
+// authorizationFilter parses the filters of an authorization listing, see listAuthorizations.
+func authorizationFilter(query url.Values) (db.AuthorizationFilter, error) {
+	filter := db.AuthorizationFilter{PrincipalName: query.Get("principal"), TenantName: query.Get("tenant")}
+
+	localGroup, err := boolQueryParameter(query, "localGroup")
+	if err != nil {
+		return filter, err
+	}
+
+	if localGroup != nil && *localGroup && !common.IsEmpty(filter.PrincipalName) {
+		filter.PrincipalName = types.LocalGroupPrincipal(filter.PrincipalName)
+	}
+
+	if filter.Local, err = boolQueryParameter(query, "local"); err != nil {
+		return filter, err
+	}
+
+	if !common.IsEmpty(query.Get("role")) {
+		role, err := types.Role(query.Get("role"))
+		if err != nil {
+			return filter, fmt.Errorf("illegal role specified")
+		}
+
+		filter.Role = role.String()
+	}
+
+	return filter, nil
+}
+
+// ldapConfigurationName returns the name of the LDAP configuration given in the request URL;
+// requests made to `/ldap_configuration` (as in the previous releases) refer to the default configuration.
+func ldapConfigurationName(req *http.Request) string {
+	if name, found := mux.Vars(req)["name"]; found {
+		return name
+	}
+
+	return types.DefaultLdapConfigurationName
+}
@@ -4,12 +4,16 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
 	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/auth/ldap"
 	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
 	auth_errors "github.com/contiv/auth_proxy/common/errors"
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/db"
@@ -20,20 +24,48 @@ import (
 // updateLdapConfigurationInfo helper function for `updateLdapConfigurationHelper`.
 // params:
 //  ldapConfiguration: configuration to be updated in the data store
+//  fields: fields found in the update request; the domain and search settings found are
+//          updated even if they are empty, which reverts them to their default
 //  actual: existing configuration in the data store
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
 //          this could be an error message or JSON response based on the execution flow or nil
-func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, actual *types.LdapConfiguration) (int, []byte) {
+func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, fields updatedFields, actual *types.LdapConfiguration) (int, []byte) {
 	ldapConfigurationUpdateObj := &types.LdapConfiguration{
+		Name:                   actual.Name,
 		Server:                 actual.Server,
 		Port:                   actual.Port,
+		Servers:                actual.Servers,
+		Order:                  actual.Order,
+		UsernamePrefixes:       actual.UsernamePrefixes,
+		UsernameSuffixes:       actual.UsernameSuffixes,
 		BaseDN:                 actual.BaseDN,
 		ServiceAccountDN:       actual.ServiceAccountDN,
 		ServiceAccountPassword: actual.ServiceAccountPassword,
 		StartTLS:               actual.StartTLS,
 		InsecureSkipVerify:     actual.InsecureSkipVerify,
+		LDAPS:                  actual.LDAPS,
+		CACertificate:          actual.CACertificate,
+		ServerName:             actual.ServerName,
+		ClientCertificate:      actual.ClientCertificate,
+		ClientKey:              actual.ClientKey,
+		ConnectTimeout:         actual.ConnectTimeout,
+		ReadTimeout:            actual.ReadTimeout,
+		PoolSize:               actual.PoolSize,
+		CacheTTL:               actual.CacheTTL,
+		RevalidationInterval:   actual.RevalidationInterval,
+		DirectoryType:          actual.DirectoryType,
+		UserSearchFilter:       actual.UserSearchFilter,
+		UsernameAttribute:      actual.UsernameAttribute,
+		GroupObjectClass:       actual.GroupObjectClass,
+		GroupMembership:        actual.GroupMembership,
+		GroupNameAttribute:     actual.GroupNameAttribute,
+		GroupResolution:        actual.GroupResolution,
+		GroupMaxDepth:          actual.GroupMaxDepth,
+		GroupBaseDN:            actual.GroupBaseDN,
+		UserAttributes:         actual.UserAttributes,
+		UsernamePattern:        actual.UsernamePattern,
 	}
 
 	// update `Server`
@@ -46,6 +78,28 @@ func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, act
 		ldapConfigurationUpdateObj.Port = ldapConfiguration.Port
 	}
 
+	// update `Servers`, `UsernamePrefixes` and `UsernameSuffixes`; lists given in the request replace the existing ones
+	if fields.has("servers") {
+		ldapConfigurationUpdateObj.Servers = ldapConfiguration.Servers
+	}
+
+	if fields.has("username_prefixes") {
+		ldapConfigurationUpdateObj.UsernamePrefixes = ldapConfiguration.UsernamePrefixes
+	}
+
+	if fields.has("username_suffixes") {
+		ldapConfigurationUpdateObj.UsernameSuffixes = ldapConfiguration.UsernameSuffixes
+	}
+
+	// update `Order`
+	if fields.has("order") {
+		ldapConfigurationUpdateObj.Order = ldapConfiguration.Order
+	}
+
+	if err := ldapConfigurationUpdateObj.ValidateDomainSettings(); err != nil {
+		return http.StatusBadRequest, []byte(err.(*auth_errors.AuthError).Message)
+	}
+
 	// update `BaseDN`
 	if !common.IsEmpty(ldapConfiguration.BaseDN) {
 		ldapConfigurationUpdateObj.BaseDN = ldapConfiguration.BaseDN
@@ -71,12 +125,116 @@ func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, act
 		ldapConfigurationUpdateObj.InsecureSkipVerify = ldapConfiguration.InsecureSkipVerify
 	}
 
+	// update `LDAPS`
+	if actual.LDAPS != ldapConfiguration.LDAPS {
+		ldapConfigurationUpdateObj.LDAPS = ldapConfiguration.LDAPS
+	}
+
+	// update `CACertificate`
+	if !common.IsEmpty(ldapConfiguration.CACertificate) {
+		ldapConfigurationUpdateObj.CACertificate = ldapConfiguration.CACertificate
+	}
+
+	// update `ServerName`
+	if !common.IsEmpty(ldapConfiguration.ServerName) {
+		ldapConfigurationUpdateObj.ServerName = ldapConfiguration.ServerName
+	}
+
+	// update `ClientCertificate` and `ClientKey`; these go together
+	if !common.IsEmpty(ldapConfiguration.ClientCertificate) || !common.IsEmpty(ldapConfiguration.ClientKey) {
+		if common.IsEmpty(ldapConfiguration.ClientCertificate) || common.IsEmpty(ldapConfiguration.ClientKey) {
+			return http.StatusBadRequest, []byte("Client certificate and key must be updated together")
+		}
+
+		ldapConfigurationUpdateObj.ClientCertificate = ldapConfiguration.ClientCertificate
+		ldapConfigurationUpdateObj.ClientKey = ldapConfiguration.ClientKey
+	}
+
+	// update timeouts
+	if ldapConfiguration.ConnectTimeout != 0 {
+		ldapConfigurationUpdateObj.ConnectTimeout = ldapConfiguration.ConnectTimeout
+	}
+
+	if ldapConfiguration.ReadTimeout != 0 {
+		ldapConfigurationUpdateObj.ReadTimeout = ldapConfiguration.ReadTimeout
+	}
+
+	// update pool and cache settings
+	if ldapConfiguration.PoolSize != 0 {
+		ldapConfigurationUpdateObj.PoolSize = ldapConfiguration.PoolSize
+	}
+
+	if ldapConfiguration.CacheTTL != 0 {
+		ldapConfigurationUpdateObj.CacheTTL = ldapConfiguration.CacheTTL
+	}
+
+	if ldapConfiguration.RevalidationInterval != 0 {
+		ldapConfigurationUpdateObj.RevalidationInterval = ldapConfiguration.RevalidationInterval
+	}
+
+	if err := ldapConfigurationUpdateObj.ValidateConnectionSettings(); err != nil {
+		return http.StatusBadRequest, []byte(err.(*auth_errors.AuthError).Message)
+	}
+
+	// update search settings; the values which are empty are taken from the `DirectoryType` preset
+	if fields.has("directory_type") {
+		ldapConfigurationUpdateObj.DirectoryType = ldapConfiguration.DirectoryType
+	}
+
+	if fields.has("user_search_filter") {
+		ldapConfigurationUpdateObj.UserSearchFilter = ldapConfiguration.UserSearchFilter
+	}
+
+	if fields.has("username_attribute") {
+		ldapConfigurationUpdateObj.UsernameAttribute = ldapConfiguration.UsernameAttribute
+	}
+
+	if fields.has("group_object_class") {
+		ldapConfigurationUpdateObj.GroupObjectClass = ldapConfiguration.GroupObjectClass
+	}
+
+	if fields.has("group_membership") {
+		ldapConfigurationUpdateObj.GroupMembership = ldapConfiguration.GroupMembership
+	}
+
+	if fields.has("group_name_attribute") {
+		ldapConfigurationUpdateObj.GroupNameAttribute = ldapConfiguration.GroupNameAttribute
+	}
+
+	if fields.has("group_resolution") {
+		ldapConfigurationUpdateObj.GroupResolution = ldapConfiguration.GroupResolution
+	}
+
+	// update `GroupMaxDepth`; negative values are rejected by the validation below
+	if fields.has("group_max_depth") {
+		ldapConfigurationUpdateObj.GroupMaxDepth = ldapConfiguration.GroupMaxDepth
+	}
+
+	if fields.has("group_base_dn") {
+		ldapConfigurationUpdateObj.GroupBaseDN = ldapConfiguration.GroupBaseDN
+	}
+
+	// update `UserAttributes`; the mapping given in the request replaces the existing one
+	if fields.has("user_attributes") {
+		ldapConfigurationUpdateObj.UserAttributes = ldapConfiguration.UserAttributes
+	}
+
+	if fields.has("username_pattern") {
+		ldapConfigurationUpdateObj.UsernamePattern = ldapConfiguration.UsernamePattern
+	}
+
+	if err := ldapConfigurationUpdateObj.ValidateSearchSettings(); err != nil {
+		return http.StatusBadRequest, []byte(err.(*auth_errors.AuthError).Message)
+	}
+
 	err := db.UpdateLdapConfiguration(ldapConfigurationUpdateObj)
 
 	switch err {
 	case nil:
-		ldapConfigurationUpdateObj.ServiceAccountPassword = ""
-		jData, err := json.Marshal(ldapConfigurationUpdateObj)
+		// pooled connections and cached users of the old configuration must not be used anymore
+		ldap.Invalidate(ldapConfigurationUpdateObj.Name)
+
+		jData, err := json.Marshal(ldapConfigurationResponse(ldapConfigurationUpdateObj))
 		if err != nil {
 			return http.StatusInternalServerError, []byte(err.Error())
 		}
@@ -93,17 +251,34 @@ func updateLdapConfigurationInfo(ldapConfiguration *types.LdapConfiguration, act
 
 // updateLdapConfigurationHelper helper function to update LDAP configuration in the data store.
 // params:
+//  name: name of the LDAP configuration to be updated
 //  ldapConfiguration: configuration to be updated in the data store
+//  fields: fields found in the update request
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
 //          this could be an error message or JSON response based on the execution flow or nil
-func updateLdapConfigurationHelper(ldapConfiguration *types.LdapConfiguration) (int, []byte) {
-	actual, err := db.GetLdapConfiguration()
+func updateLdapConfigurationHelper(name string, ldapConfiguration *types.LdapConfiguration, fields updatedFields) (int, []byte) {
+	if !common.IsEmpty(ldapConfiguration.Name) && ldapConfiguration.Name != name {
+		return http.StatusBadRequest, []byte("LDAP configuration can't be renamed")
+	}
+
+	actual, err := db.GetLdapConfiguration(name)
 
 	switch err {
 	case nil:
-		return updateLdapConfigurationInfo(ldapConfiguration, actual)
+		// secrets are stored encrypted; they are encrypted again when the updated configuration is stored
+		if actual.ServiceAccountPassword, err = common.Decrypt(actual.ServiceAccountPassword); err != nil {
+			log.Debugf("Failed to decrypt LDAP service account password: %#v", err)
+			return http.StatusInternalServerError, []byte("Failed to retrieve LDAP setting from the data store")
+		}
+
+		if actual.ClientKey, err = common.DecryptEnvelope(actual.ClientKey); err != nil {
+			log.Debugf("Failed to decrypt LDAP client key: %#v", err)
+			return http.StatusInternalServerError, []byte("Failed to retrieve LDAP setting from the data store")
+		}
+
+		return updateLdapConfigurationInfo(ldapConfiguration, fields, actual)
 	case auth_errors.ErrKeyNotFound:
 		return http.StatusNotFound, nil
 	default:
@@ -113,16 +288,69 @@ func updateLdapConfigurationHelper(ldapConfiguration *types.LdapConfiguration) (
 
 }
 
+// searchLdapDirectoryHelper helper function to search the directory of the given LDAP configuration.
+// params:
+//  name: name of the LDAP configuration
+//  kind: `ldap.DirectoryGroups` or `ldap.DirectoryUsers`
+//  query: part of the name of the groups/users to search for
+//  limit: maximum number of entries to be returned
+//  next: cursor returned along with the previous page; empty for the first page
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful search, it contains `DirectorySearchReply` object
+func searchLdapDirectoryHelper(name, kind, query string, limit int, next string) (int, []byte) {
+	// cursor is the offset of the page in the (sorted) search result
+	offset := 0
+	if !common.IsEmpty(next) {
+		var err error
+		if offset, err = strconv.Atoi(next); err != nil || offset < 0 {
+			return http.StatusBadRequest, []byte("Invalid cursor")
+		}
+	}
+
+	entries, truncated, err := ldap.SearchDirectory(name, kind, query)
+	switch {
+	case err == auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case err != nil:
+		log.Debugf("Failed to search LDAP directory: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to search the LDAP directory")
+	}
+
+	reply := DirectorySearchReply{Entries: []ldap.DirectoryEntry{}, Total: len(entries), Truncated: truncated}
+	if offset < len(entries) {
+		end := offset + limit
+		if end < len(entries) {
+			reply.Next = strconv.Itoa(end)
+		} else {
+			end = len(entries)
+		}
+
+		reply.Entries = entries[offset:end]
+	}
+
+	jData, err := json.Marshal(reply)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
 // deleteLdapConfigurationHelper helper function to delete LDAP configuration from the data store.
+// params:
+//  name: name of the LDAP configuration to be deleted
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
 //          this could be an error message or JSON response based on the execution flow or nil
-func deleteLdapConfigurationHelper() (int, []byte) {
-	err := db.DeleteLdapConfiguration()
+func deleteLdapConfigurationHelper(name string) (int, []byte) {
+	err := db.DeleteLdapConfiguration(name)
 
 	switch err {
 	case nil:
+		ldap.Invalidate(name)
 		return http.StatusNoContent, nil
 	case auth_errors.ErrKeyNotFound:
 		return http.StatusNotFound, nil
@@ -133,19 +361,99 @@ func deleteLdapConfigurationHelper() (int, []byte) {
 
 }
 
+// getLdapConfigurationsHelper helper function to retrieve all the LDAP configurations from the data store.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch, it contains the configurations (with no secrets) in the order they are tried
+func getLdapConfigurationsHelper() (int, []byte) {
+	configurations, err := db.GetLdapConfigurations()
+	if err != nil {
+		log.Debugf("Failed to retrieve LDAP configurations: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to retrieve LDAP configurations from the data store")
+	}
+
+	result := []*types.LdapConfiguration{}
+	for _, ldapConfiguration := range configurations {
+		result = append(result, ldapConfigurationResponse(ldapConfiguration))
+	}
+
+	jData, err := json.Marshal(result)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// getLdapServersHelper helper function to retrieve the health of the servers of the given LDAP configuration.
+// params:
+//  name: name of the LDAP configuration
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch, it contains the health of the servers in their configured order
+func getLdapServersHelper(name string) (int, []byte) {
+	ldapConfiguration, err := db.GetLdapConfiguration(name)
+
+	switch err {
+	case nil:
+		jData, err := json.Marshal(ldap.GetServerHealth(ldapConfiguration))
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to retrieve LDAP configuration: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to retrieve LDAP configuration from the data store")
+	}
+
+}
+
+// getLdapMetricsHelper helper function to retrieve the connection pool, cache and latency metrics of the given LDAP configuration.
+// params:
+//  name: name of the LDAP configuration
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch, it contains the metrics as seen by this process
+func getLdapMetricsHelper(name string) (int, []byte) {
+	_, err := db.GetLdapConfiguration(name)
+
+	switch err {
+	case nil:
+		jData, err := json.Marshal(ldap.GetMetrics(name))
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to retrieve LDAP configuration: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to retrieve LDAP configuration from the data store")
+	}
+
+}
+
 // getLdapConfigurationHelper helper function to retrieve LDAP configuration from the data store.
+// params:
+//  name: name of the LDAP configuration
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
 //          this could be an error message or JSON response based on the execution flow or nil
-func getLdapConfigurationHelper() (int, []byte) {
-	ldapConfiguration, err := db.GetLdapConfiguration()
+func getLdapConfigurationHelper(name string) (int, []byte) {
+	ldapConfiguration, err := db.GetLdapConfiguration(name)
 
 	switch err {
 	case nil:
-		// return the configuration with no password
-		ldapConfiguration.ServiceAccountPassword = ""
-		jData, err := json.Marshal(ldapConfiguration)
+		// return the configuration with no secrets
+		jData, err := json.Marshal(ldapConfigurationResponse(ldapConfiguration))
 		if err != nil {
 			return http.StatusInternalServerError, []byte(err.Error())
 		}
@@ -160,6 +468,91 @@ func getLdapConfigurationHelper() (int, []byte) {
 
 }
 
+// validateLdapConfiguration validates the settings of the given (new) LDAP configuration.
+// params:
+//  ldapConfiguration: configuration to be validated
+// return values:
+//  error: nil if the configuration is valid otherwise an error with code auth_errors.IllegalArguments
+func validateLdapConfiguration(ldapConfiguration *types.LdapConfiguration) error {
+	if common.IsEmpty(ldapConfiguration.Server) || (ldapConfiguration.Port == 0 || ldapConfiguration.Port > 65535) {
+		return auth_errors.NewError(auth_errors.IllegalArguments, "Invalid Server/Port details")
+	}
+
+	if common.IsEmpty(ldapConfiguration.ServiceAccountDN) || common.IsEmpty(ldapConfiguration.ServiceAccountPassword) {
+		return auth_errors.NewError(auth_errors.IllegalArguments, "Empty service account DN/Password")
+	}
+
+	if common.IsEmpty(ldapConfiguration.BaseDN) {
+		return auth_errors.NewError(auth_errors.IllegalArguments, "Empty base DN")
+	}
+
+	if err := ldapConfiguration.ValidateDomainSettings(); err != nil {
+		return err
+	}
+
+	if err := ldapConfiguration.ValidateSearchSettings(); err != nil {
+		return err
+	}
+
+	return ldapConfiguration.ValidateConnectionSettings()
+}
+
+// testLdapConfigurationHelper helper function to test the given (possibly unsaved) LDAP configuration;
+// nothing is persisted.
+// params:
+//  ldapConfigurationTest: configuration to be tested along with the optional user credentials
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful test run, it contains the outcome of each step (`ldap.TestResult`)
+func testLdapConfigurationHelper(ldapConfigurationTest *types.LdapConfigurationTest) (int, []byte) {
+	if common.IsEmpty(ldapConfigurationTest.Name) {
+		ldapConfigurationTest.Name = types.DefaultLdapConfigurationName
+	}
+
+	if err := validateLdapConfiguration(&ldapConfigurationTest.LdapConfiguration); err != nil {
+		return http.StatusBadRequest, []byte(err.(*auth_errors.AuthError).Message)
+	}
+
+	ldapManager := ldap.Manager{Config: ldapConfigurationTest.LdapConfiguration}
+	result := ldapManager.Test(ldapConfigurationTest.Username, ldapConfigurationTest.Password)
+
+	jData, err := json.Marshal(result)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// testStoredLdapConfigurationHelper helper function to test the given LDAP configuration from the data store.
+// params:
+//  name: name of the LDAP configuration
+//  username: user to search for (optional)
+//  password: password of the user; the user bind is skipped if it is empty
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful test run, it contains the outcome of each step (`ldap.TestResult`)
+func testStoredLdapConfigurationHelper(name, username, password string) (int, []byte) {
+	result, err := ldap.TestConfiguration(name, username, password)
+
+	switch err {
+	case nil:
+		jData, err := json.Marshal(result)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to retrieve LDAP configuration: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to retrieve LDAP configuration from the data store")
+	}
+}
+
 // addLdapConfigurationHelper helper function to add given ldap configuration to the data store.
 // params:
 //  ldapConfiguration: configuration to be added to the data store
@@ -168,32 +561,30 @@ func getLdapConfigurationHelper() (int, []byte) {
 //  []byte: http response message; this goes along with status code
 //          this could be an error message or JSON response based on the execution flow
 func addLdapConfigurationHelper(ldapConfiguration *types.LdapConfiguration) (int, []byte) {
-	if common.IsEmpty(ldapConfiguration.Server) || (ldapConfiguration.Port == 0 || ldapConfiguration.Port > 65535) {
-		return http.StatusBadRequest, []byte("Invalid Server/Port details")
-	}
-
-	if common.IsEmpty(ldapConfiguration.ServiceAccountDN) || common.IsEmpty(ldapConfiguration.ServiceAccountPassword) {
-		return http.StatusBadRequest, []byte("Empty service account DN/Password")
+	if common.IsEmpty(ldapConfiguration.Name) {
+		ldapConfiguration.Name = types.DefaultLdapConfigurationName
 	}
 
-	if common.IsEmpty(ldapConfiguration.BaseDN) {
-		return http.StatusBadRequest, []byte("Empty base DN")
+	if err := validateLdapConfiguration(ldapConfiguration); err != nil {
+		return http.StatusBadRequest, []byte(err.(*auth_errors.AuthError).Message)
 	}
 
 	err := db.AddLdapConfiguration(ldapConfiguration)
 
 	switch err {
 	case nil:
-		// return same object with no password
-		ldapConfiguration.ServiceAccountPassword = ""
-		jData, err := json.Marshal(ldapConfiguration)
+		// the configurations used to re-validate the sessions must be read again
+		ldap.Invalidate(ldapConfiguration.Name)
+
+		// return same object with no secrets
+		jData, err := json.Marshal(ldapConfigurationResponse(ldapConfiguration))
 		if err != nil {
 			return http.StatusInternalServerError, []byte(err.Error())
 		}
 
 		return http.StatusCreated, jData
 	case auth_errors.ErrKeyExists:
-		return http.StatusBadRequest, []byte("LDAP setttings exists already. Request `update` if some config needs change")
+		return http.StatusBadRequest, []byte(fmt.Sprintf("LDAP configuration %q exists already. Request `update` if some config needs change", ldapConfiguration.Name))
 	default:
 		log.Debugf("Failed to add LDAP configuration: %#v", err)
 		return http.StatusInternalServerError, []byte("Failed to add LDAP configuration to the system")
@@ -213,10 +604,7 @@ func getLocalUserHelper(username string) (int, []byte) {
 
 	switch err {
 	case nil:
-		user.Password = ""
-		user.PasswordHash = []byte{}
-
-		jData, err := json.Marshal(user)
+		jData, err := json.Marshal(localUserResponse(user))
 		if err != nil {
 			return http.StatusInternalServerError, []byte(err.Error())
 		}
@@ -232,29 +620,31 @@ func getLocalUserHelper(username string) (int, []byte) {
 }
 
 // getLocalUsersHelper helper function to get the list of local users.
+// params:
+//  filter: selects the users
+//  limit: size of the page; 0 to return all the users as a plain list
+//  next: cursor of the page
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
 //          on successful fetch from data store, it contains the list of localuser objects
-func getLocalUsersHelper() (int, []byte) {
-	users, err := db.GetLocalUsers()
+func getLocalUsersHelper(filter db.LocalUserFilter, limit int, next string) (int, []byte) {
+	users, nextPage, err := db.ListLocalUsers(filter, limit, next)
 	if err != nil {
 		return http.StatusInternalServerError, []byte(err.Error())
 	}
 
 	localUsers := []types.LocalUser{}
 	for _, user := range users {
-		lu := types.LocalUser{
-			Username:  user.Username,
-			FirstName: user.FirstName,
-			LastName:  user.LastName,
-			Disable:   user.Disable,
-		}
+		localUsers = append(localUsers, *localUserResponse(user))
+	}
 
-		localUsers = append(localUsers, lu)
+	var reply interface{} = localUsers
+	if limit > 0 {
+		reply = ListLocalUsersReply{Users: localUsers, Next: nextPage}
 	}
 
-	jData, err := json.Marshal(localUsers)
+	jData, err := json.Marshal(reply)
 	if err != nil {
 		log.Debugf("Failed to marshal %#v: %#v", jData, err)
 		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to fetch local users"))
@@ -271,14 +661,18 @@ func getLocalUsersHelper() (int, []byte) {
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
-func updateLocalUserInfo(username string, updateReq *types.LocalUser, actual *types.LocalUser) (int, []byte) {
+func updateLocalUserInfo(username string, updateReq *localUserUpdateReq, actual *types.LocalUser) (int, []byte) {
 	updatedUserObj := &types.LocalUser{
 		// username == actual.Username
-		Username:     actual.Username,
-		FirstName:    actual.FirstName,
-		LastName:     actual.LastName,
-		Disable:      actual.Disable,
-		PasswordHash: actual.PasswordHash,
+		Username:           actual.Username,
+		FirstName:          actual.FirstName,
+		LastName:           actual.LastName,
+		Disable:            actual.Disable,
+		PasswordHash:       actual.PasswordHash,
+		PasswordHistory:    actual.PasswordHistory,
+		PasswordChangedAt:  actual.PasswordChangedAt,
+		SessionGeneration:  actual.SessionGeneration,
+		MustChangePassword: actual.MustChangePassword,
 		// `Password` will be empty
 	}
 
@@ -293,22 +687,33 @@ func updateLocalUserInfo(username string, updateReq *types.LocalUser, actual *ty
 	}
 
 	// Update `disable`
-	if actual.Disable != updateReq.Disable {
-		updatedUserObj.Disable = updateReq.Disable
+	if updateReq.Disable != nil {
+		updatedUserObj.Disable = *updateReq.Disable
+	}
+
+	// Update `must_change_password`; the admin can set or clear it
+	if updateReq.MustChangePassword != nil {
+		updatedUserObj.MustChangePassword = *updateReq.MustChangePassword
 	}
 
-	// Update `password`
+	// Update `password`; the new password needn't be changed on the next login unless the admin says so
 	if !common.IsEmpty(updateReq.Password) {
+		if statusCode, resp := checkPasswordPolicy(username, updateReq.Password, actual.PasswordHashes()); statusCode != http.StatusOK {
+			return statusCode, resp
+		}
+
 		updatedUserObj.Password = updateReq.Password
+		if updateReq.MustChangePassword == nil {
+			updatedUserObj.MustChangePassword = false
+		}
+		// tokens issued so far are no longer accepted
+		updatedUserObj.SessionGeneration++
 	}
 
 	err := db.UpdateLocalUser(username, updatedUserObj)
 	switch err {
 	case nil:
-		updatedUserObj.Password = ""
-		updatedUserObj.PasswordHash = []byte{}
-
-		jData, err := json.Marshal(updatedUserObj)
+		jData, err := json.Marshal(localUserResponse(updatedUserObj))
 		if err != nil {
 			return http.StatusInternalServerError, []byte(err.Error())
 		}
@@ -328,11 +733,11 @@ func updateLocalUserInfo(username string, updateReq *types.LocalUser, actual *ty
 // updateLocalUserHelper helper function to update the existing user details in the data store.
 // params:
 // username: of the user to be updated
-// userUpdateReq: *localUserCreateRequest contains the fields to be updated
+// userUpdateReq: *localUserUpdateReq contains the fields to be updated
 // return values:
 //  int: http status code
 //  []byte: http response message; this goes along with status code
-func updateLocalUserHelper(username string, userUpdateReq *types.LocalUser) (int, []byte) {
+func updateLocalUserHelper(username string, userUpdateReq *localUserUpdateReq) (int, []byte) {
 	if common.IsEmpty(username) {
 		return http.StatusBadRequest, []byte("Empty username")
 	}
@@ -386,13 +791,22 @@ func addLocalUserHelper(userCreateReq *types.LocalUser) (int, []byte) {
 		return http.StatusBadRequest, []byte("Username/Password is empty")
 	}
 
+	if strings.HasPrefix(userCreateReq.Username, types.LocalGroupPrincipalPrefix) || strings.Contains(userCreateReq.Username, "/") {
+		return http.StatusBadRequest, []byte(fmt.Sprintf("Invalid username %q", userCreateReq.Username))
+	}
+
+	if statusCode, resp := checkPasswordPolicy(userCreateReq.Username, userCreateReq.Password, nil); statusCode != http.StatusOK {
+		return statusCode, resp
+	}
+
+	// these are maintained by the data store layer
+	userCreateReq.PasswordHistory = nil
+	userCreateReq.PasswordChangedAt = 0
+
 	err := db.AddLocalUser(userCreateReq)
 	switch err {
 	case nil:
-		userCreateReq.Password = ""
-		userCreateReq.PasswordHash = []byte{}
-
-		jData, err := json.Marshal(userCreateReq)
+		jData, err := json.Marshal(localUserResponse(userCreateReq))
 		if err != nil {
 			log.Debugf("Failed to marshal %#v: %#v", userCreateReq, err)
 			return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to add local user %q to the system", userCreateReq.Username))
@@ -408,42 +822,393 @@ func addLocalUserHelper(userCreateReq *types.LocalUser) (int, []byte) {
 
 }
 
-// isTokenValid checks if the given token string is valid(correctness, expiry, etc.) and writes
-// the respective http response based on the validation.
+// changePasswordHelper helper function to change the password of the given local user.
 // params:
-//  tokenStr: token string obtained from the http request
-//  w: http response writer
+//  username: of the local user changing the password
+//  cpReq: current and new password of the user
 // return values:
-//  bool: boolean representing the token validatity
-//  *auth.Token: token object parsed from the tokenStr
-func isTokenValid(tokenStr string, w http.ResponseWriter) (bool, *auth.Token) {
-	if common.IsEmpty(tokenStr) {
-		authError(w, http.StatusUnauthorized, "Empty auth token")
-		return false, nil
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful change, it contains `LoginResponse` object carrying a new token
+func changePasswordHelper(username string, cpReq *changePasswordReq) (int, []byte) {
+	if common.IsEmpty(cpReq.CurrentPassword) || common.IsEmpty(cpReq.NewPassword) {
+		return http.StatusBadRequest, []byte("Current and new password must be provided")
 	}
 
-	// NOTE: our current implementation focuses on just two local users admin(superuser) and ops(only network operations).
-	// this is mainly to provide some basic difference between two users
-	// this needs to be fine-grained once we have the backend and capabilities defined
+	user, err := db.GetLocalUser(username)
+	switch err {
+	case nil:
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusUnauthorized, []byte(fmt.Sprintf("User %q not found", username))
+	default:
+		log.Debugf("Failed to fetch local user %q: %#v", username, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to fetch local user %q", username))
+	}
 
-	token, err := auth.ParseToken(tokenStr)
-	if err != nil {
-		authError(w, http.StatusBadRequest, "Bad token")
-		return false, nil
+	if user.Disable {
+		return http.StatusForbidden, []byte(fmt.Sprintf("User %q is disabled", username))
 	}
 
-	// TODO: Check if the user is still active (~disable/~delete)
-	return true, token
-}
+	if !common.ValidatePassword(cpReq.CurrentPassword, user.PasswordHash) {
+		audit.Warn("password_change_failed", audit.Fields{"username": username, "reason": "incorrect current password"})
+		return http.StatusForbidden, []byte("Current password is incorrect")
+	}
+
+	if statusCode, resp := checkPasswordPolicy(username, cpReq.NewPassword, user.PasswordHashes()); statusCode != http.StatusOK {
+		return statusCode, resp
+	}
+
+	user.Password = cpReq.NewPassword
+	user.MustChangePassword = false
+	// tokens issued so far are no longer accepted
+	user.SessionGeneration++
+
+	if err := db.UpdateLocalUser(username, user); err != nil {
+		log.Debugf("Failed to change password of local user %q: %#v", username, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to change password of local user %q", username))
+	}
+
+	audit.Record("password_changed", audit.Fields{"username": username, "sessions_revoked": true})
+
+	// hand out a new token; as the caller's token has been revoked along with the others
+	tokenStr, err := auth.Authenticate(username, cpReq.NewPassword)
+	if err != nil {
+		log.Debugf("Failed to authenticate local user %q after password change: %#v", username, err)
+		return http.StatusInternalServerError, []byte("Password changed, but failed to generate a new token; please login again")
+	}
+
+	jData, err := json.Marshal(LoginResponse{Token: tokenStr})
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// whoAmIHelper helper function to describe the session of the given token.
+// params:
+//  token: parsed token of the caller
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `WhoAmIResponse` object
+func whoAmIHelper(token *auth.Token) (int, []byte) {
+	whoami := WhoAmIResponse{
+		Username:           token.Username(),
+		Local:              token.IsLocalUser(),
+		Role:               token.Role(),
+		Principals:         token.Principals(),
+		Attributes:         token.Attributes(),
+		MustChangePassword: token.MustChangePassword(),
+		ExpiresAt:          token.ExpiresAt(),
+		Actor:              token.Actor(),
+		ScopedTenants:      token.ScopedTenants(),
+		ScopedMethods:      token.ScopedMethods(),
+	}
+
+	principal, err := db.GetPrincipal(whoami.Username, whoami.Local)
+	switch err {
+	case nil:
+		whoami.LastLogin = principal.LastLogin
+	case auth_errors.ErrKeyNotFound:
+		// e.g. tokens issued before principal records were kept
+	default:
+		log.Debugf("Failed to fetch principal record of %q: %#v", whoami.Username, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to fetch principal record of %q", whoami.Username))
+	}
+
+	jData, err := json.Marshal(whoami)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// getLocalGroupsHelper helper function to get the list of local groups.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch from data store, it contains the list of local group objects
+func getLocalGroupsHelper() (int, []byte) {
+	groups, err := db.GetLocalGroups()
+	if err != nil {
+		log.Debugf("Failed to fetch local groups: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to fetch local groups")
+	}
+
+	jData, err := json.Marshal(groups)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// getLocalGroupHelper helper function to get the details of given local group.
+// params:
+//  name: of the group to fetch details from the data store
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch from data store, it contains `types.LocalGroup` object
+func getLocalGroupHelper(name string) (int, []byte) {
+	group, err := db.GetLocalGroup(name)
+	return localGroupResponse(name, group, err, http.StatusOK)
+}
+
+// addLocalGroupHelper helper function to add given local group to the data store.
+// params:
+//  group: *types.LocalGroup request object; to be added to the store
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func addLocalGroupHelper(group *types.LocalGroup) (int, []byte) {
+	if common.IsEmpty(group.Name) || strings.ContainsAny(group.Name, "/,") {
+		return http.StatusBadRequest, []byte("Empty or invalid group name")
+	}
+
+	err := db.AddLocalGroup(group)
+	switch err {
+	case auth_errors.ErrKeyExists:
+		return http.StatusBadRequest, []byte(fmt.Sprintf("Group %q exists already", group.Name))
+	default:
+		return localGroupResponse(group.Name, group, err, http.StatusCreated)
+	}
+}
+
+// updateLocalGroupHelper helper function to update the description of the given local group.
+// params:
+//  name: of the group to be updated
+//  updateReq: fields to be updated
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func updateLocalGroupHelper(name string, updateReq *localGroupUpdateReq) (int, []byte) {
+	group, err := db.UpdateLocalGroup(name, updateReq.Description)
+	return localGroupResponse(name, group, err, http.StatusOK)
+}
+
+// deleteLocalGroupHelper helper function to delete given local group and its authorizations from the data store;
+// the sessions of its members are revoked.
+// params:
+//  name: of the group to be deleted from store
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func deleteLocalGroupHelper(name string) (int, []byte) {
+	err := db.DeleteLocalGroup(name)
+	switch err {
+	case nil:
+		return http.StatusNoContent, nil
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	default:
+		log.Debugf("Failed to delete local group %q: %#v", name, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to delete local group %q from the system", name))
+	}
+}
+
+// addLocalGroupMemberHelper helper function to add the given local user to the local group.
+// params:
+//  name: of the group
+//  username: of the local user to be added
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func addLocalGroupMemberHelper(name, username string) (int, []byte) {
+	if common.IsEmpty(username) {
+		return http.StatusBadRequest, []byte("Empty username")
+	}
+
+	group, err := db.AddLocalGroupMember(name, username)
+	return localGroupResponse(name, group, err, http.StatusOK)
+}
+
+// deleteLocalGroupMemberHelper helper function to remove the given local user from the local group;
+// the sessions of the user are revoked.
+// params:
+//  name: of the group
+//  username: of the local user to be removed
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func deleteLocalGroupMemberHelper(name, username string) (int, []byte) {
+	group, err := db.DeleteLocalGroupMember(name, username)
+	return localGroupResponse(name, group, err, http.StatusOK)
+}
+
+// localGroupResponse helper function to convert the result of a local group operation into a http response.
+// params:
+//  name: of the group
+//  group: group returned by the operation
+//  err: error returned by the operation
+//  successCode: http status code to be returned on success
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+func localGroupResponse(name string, group *types.LocalGroup, err error, successCode int) (int, []byte) {
+	switch err {
+	case nil:
+		jData, err := json.Marshal(group)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+
+		return successCode, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case auth_errors.ErrUserNotFound:
+		return http.StatusBadRequest, []byte("Local user not found or not a member of the group")
+	default:
+		log.Debugf("Failed to process local group %q: %#v", name, err)
+		return http.StatusInternalServerError, []byte(fmt.Sprintf("Failed to process local group %q", name))
+	}
+}
+
+// ldapConfigurationResponse returns a copy of the given configuration which can be sent back
+// to the client; service account password and client key are never sent back.
+// params:
+//  ldapConfiguration: LDAP configuration as stored in the data store
+// return values:
+//  *types.LdapConfiguration: configuration carrying no secrets
+func ldapConfigurationResponse(ldapConfiguration *types.LdapConfiguration) *types.LdapConfiguration {
+	response := *ldapConfiguration
+	response.ServiceAccountPassword = ""
+	response.ClientKey = ""
+
+	return &response
+}
+
+// localUserResponse returns a copy of the given user which can be sent back to the client;
+// password, password hashes and other internal details are never sent back.
+// params:
+//  user: local user object as stored in the data store
+// return values:
+//  *types.LocalUser: user object carrying only the fields that are visible to the client
+func localUserResponse(user *types.LocalUser) *types.LocalUser {
+	return &types.LocalUser{
+		Username:           user.Username,
+		FirstName:          user.FirstName,
+		LastName:           user.LastName,
+		Disable:            user.Disable,
+		MustChangePassword: user.MustChangePassword,
+	}
+}
+
+// checkPasswordPolicy helper function to check the given password against the configured password policy.
+// params:
+//  username: of the user whose password is being set
+//  password: new password of the user
+//  history: hashes of the current and previous passwords of the user
+// return values:
+//  int: http.StatusOK if the password complies with the policy, otherwise the http status code to be returned
+//  []byte: http response message describing the violation; nil if the password complies with the policy
+func checkPasswordPolicy(username, password string, history [][]byte) (int, []byte) {
+	passwordPolicy, err := db.GetPasswordPolicy()
+	if err != nil {
+		log.Debugf("Failed to retrieve password policy: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to retrieve password policy from the data store")
+	}
+
+	if err := passwordPolicy.Check(username, password, history); err != nil {
+		return http.StatusBadRequest, []byte(err.(*auth_errors.AuthError).Message)
+	}
+
+	return http.StatusOK, nil
+}
+
+// getPasswordPolicyHelper helper function to retrieve the password policy from the data store.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful fetch from data store, it contains `types.PasswordPolicy` object
+func getPasswordPolicyHelper() (int, []byte) {
+	passwordPolicy, err := db.GetPasswordPolicy()
+	if err != nil {
+		log.Debugf("Failed to retrieve password policy: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to retrieve password policy from the data store")
+	}
+
+	jData, err := json.Marshal(passwordPolicy)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// updatePasswordPolicyHelper helper function to replace the password policy in the data store.
+// params:
+//  passwordPolicy: policy to be written to the data store
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on successful update, it contains the updated `types.PasswordPolicy` object
+func updatePasswordPolicyHelper(passwordPolicy *types.PasswordPolicy) (int, []byte) {
+	if passwordPolicy.DenyList == nil {
+		passwordPolicy.DenyList = []string{}
+	}
+
+	err := db.UpdatePasswordPolicy(passwordPolicy)
+	switch err {
+	case nil:
+		jData, err := json.Marshal(passwordPolicy)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrIllegalArguments:
+		return http.StatusBadRequest, []byte(fmt.Sprintf("Invalid password policy; lengths/counts must not be negative and at most %d passwords can be remembered", types.MaxPasswordHistoryCount))
+	default:
+		log.Debugf("Failed to update password policy: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to update password policy in the data store")
+	}
+}
+
+// isTokenValid checks if the given token string is valid(correctness, expiry, etc.) and writes
+// the respective http response based on the validation.
+// params:
+//  tokenStr: token string obtained from the http request
+//  w: http response writer
+// return values:
+//  bool: boolean representing the token validatity
+//  *auth.Token: token object parsed from the tokenStr
+func isTokenValid(tokenStr string, w http.ResponseWriter) (bool, *auth.Token) {
+	if common.IsEmpty(tokenStr) {
+		authError(w, http.StatusUnauthorized, "Empty auth token")
+		return false, nil
+	}
+
+	// NOTE: our current implementation focuses on just two local users admin(superuser) and ops(only network operations).
+	// this is mainly to provide some basic difference between two users
+	// this needs to be fine-grained once we have the backend and capabilities defined
+
+	token, err := auth.ParseToken(tokenStr)
+	if err != nil {
+		authError(w, http.StatusBadRequest, "Bad token")
+		return false, nil
+	}
+
+	// restricted tokens can only be used to change the password
+	if token.MustChangePassword() {
+		authError(w, http.StatusForbidden, auth_errors.ErrPasswordChangeRequired.(*auth_errors.AuthError).Message)
+		return false, nil
+	}
+
+	// TODO: Check if the user is still active (~disable/~delete)
+	return true, token
+}
 
 //
-// processStatusCodes processes the given statusCode and
-// writes the respective http response using the given writer.
-// params:
-//  statusCode: integer representing the http status code
-//  resp: response to be written along with statusCode
-//  w: http response writer
-//
+// processStatusCodes processes the given statusCode and
+// writes the respective http response using the given writer.
+// params:
+//  statusCode: integer representing the http status code
+//  resp: response to be written along with statusCode
+//  w: http response writer
+//
 func processStatusCodes(statusCode int, resp []byte, w http.ResponseWriter) {
 	common.SetDefaultResponseHeaders(w)
 	switch statusCode {
@@ -495,6 +1260,599 @@ func writeJSONResponse(w http.ResponseWriter, data interface{}) {
 	w.Write(jData)
 }
 
+// addAuthorizationOperation validates an authorization to be added and resolves its principal.
+// params:
+//  addAuthzReq: authorization to be added
+// return values:
+//  auth.AuthorizationOperation: operation adding the authorization
+//  int: 0 if the authorization is valid, otherwise the http status code
+//  []byte: http response message explaining why the authorization is invalid
+func addAuthorizationOperation(addAuthzReq *AddAuthorizationRequest) (auth.AuthorizationOperation, int, []byte) {
+	operation := auth.AuthorizationOperation{Op: auth.AuthzOpAdd, Role: addAuthzReq.Role, TenantName: addAuthzReq.TenantName}
+
+	if common.IsEmpty(addAuthzReq.PrincipalName) {
+		log.Warnf("principal name missing from authorization: %#v", addAuthzReq)
+		return operation, http.StatusBadRequest, []byte("principal name is missing")
+	}
+
+	// LDAP users are granted access through their groups
+	if addAuthzReq.LdapUser && (!addAuthzReq.Deny || addAuthzReq.Local || addAuthzReq.LocalGroup) {
+		log.Warnf("allow or local authorization given to an LDAP user: %#v", addAuthzReq)
+		return operation, http.StatusBadRequest, []byte("only deny authorizations can be given to an LDAP user; authorize its groups instead")
+	}
+
+	if addAuthzReq.Deny {
+		if common.IsEmpty(addAuthzReq.TenantName) {
+			log.Warnf("deny authorization without specifying tenant: %#v", addAuthzReq)
+			return operation, http.StatusBadRequest, []byte("deny authorization requires a tenant to be specified")
+		}
+
+		// resources are named after the netmaster resources subject to RBAC
+		if _, found := rbacDetails[addAuthzReq.ResourceType]; !common.IsEmpty(addAuthzReq.ResourceType) && !found {
+			log.Warnf("illegal resource type specified in authorization: %#v", addAuthzReq)
+			return operation, http.StatusBadRequest, []byte(fmt.Sprintf("illegal resource type %q specified", addAuthzReq.ResourceType))
+		}
+
+		if common.IsEmpty(addAuthzReq.ResourceType) && !common.IsEmpty(addAuthzReq.ResourceName) {
+			log.Warnf("resource name without resource type in authorization: %#v", addAuthzReq)
+			return operation, http.StatusBadRequest, []byte("resource name requires a resource type to be specified")
+		}
+
+		// rule IDs are only unique within a policy; rules are named by their key
+		if addAuthzReq.ResourceType == "rules" && !common.IsEmpty(addAuthzReq.ResourceName) {
+			if parts := strings.Split(addAuthzReq.ResourceName, ":"); len(parts) != 3 || parts[0] != addAuthzReq.TenantName {
+				log.Warnf("illegal rule name specified in authorization: %#v", addAuthzReq)
+				return operation, http.StatusBadRequest, []byte("rules must be named by their key <tenant>:<policy>:<ruleId>")
+			}
+		}
+
+		operation.Role, operation.Deny = "", true
+		operation.Resource = types.Resource{Type: addAuthzReq.ResourceType, Name: addAuthzReq.ResourceName}
+	} else {
+		role, err := types.Role(addAuthzReq.Role)
+		if err != nil {
+			log.Warnf("illegal role specified in authorization: %#v", addAuthzReq)
+			return operation, http.StatusBadRequest, []byte("illegal role specified")
+		}
+
+		// If role specific is ops, a tenant name must be specified
+		if role == types.Ops && common.IsEmpty(addAuthzReq.TenantName) {
+			log.Warnf("ops role without specifying tenant in authorization: %#v", addAuthzReq)
+			return operation, http.StatusBadRequest, []byte("ops role requires a tenant to be specified")
+		}
+
+		if !common.IsEmpty(addAuthzReq.ResourceType) || !common.IsEmpty(addAuthzReq.ResourceName) {
+			log.Warnf("resource specified in allow authorization: %#v", addAuthzReq)
+			return operation, http.StatusBadRequest, []byte("only deny authorizations can be limited to a resource")
+		}
+	}
+
+	if addAuthzReq.NotBefore < 0 || addAuthzReq.ExpiresAt < 0 {
+		log.Warnf("illegal validity period specified in authorization: %#v", addAuthzReq)
+		return operation, http.StatusBadRequest, []byte("not_before and expires_at must be unix timestamps")
+	}
+
+	// a time-bound authorization must expire in the future and after it takes effect
+	if addAuthzReq.ExpiresAt != 0 && (addAuthzReq.ExpiresAt <= time.Now().Unix() || addAuthzReq.ExpiresAt <= addAuthzReq.NotBefore) {
+		log.Warnf("illegal validity period specified in authorization: %#v", addAuthzReq)
+		return operation, http.StatusBadRequest, []byte("expires_at must be in the future and after not_before")
+	}
+
+	operation.NotBefore, operation.ExpiresAt = addAuthzReq.NotBefore, addAuthzReq.ExpiresAt
+
+	// local groups are authorized using their principal name
+	operation.PrincipalName, operation.Local = addAuthzReq.PrincipalName, addAuthzReq.Local
+	if addAuthzReq.LocalGroup {
+		if _, err := db.GetLocalGroup(operation.PrincipalName); err != nil {
+			log.Warnf("local group not found for authorization: %#v", addAuthzReq)
+			return operation, http.StatusBadRequest, []byte("local group not found")
+		}
+
+		operation.PrincipalName, operation.Local = types.LocalGroupPrincipal(operation.PrincipalName), true
+	}
+
+	// LDAP users are denied access using their principal name
+	if addAuthzReq.LdapUser {
+		operation.PrincipalName = types.LdapUserPrincipal(operation.PrincipalName)
+	}
+
+	// LDAP groups are looked up in the directory if requested; a typo would add a useless authorization
+	if addAuthzReq.ValidatePrincipal && !operation.Local && !addAuthzReq.LdapUser {
+		var httpStatus int
+		var httpResponse []byte
+
+		group, err := ldap.FindGroup(operation.PrincipalName)
+		switch {
+		case err == auth_errors.ErrLDAPConfigurationNotFound, err == nil && group == nil:
+			httpStatus = http.StatusBadRequest
+			httpResponse = []byte("LDAP group not found")
+		case err != nil:
+			log.Errorf("failed to look up LDAP group %q: %v", operation.PrincipalName, err)
+			httpStatus = http.StatusInternalServerError
+			httpResponse = []byte("failed to look up the LDAP group in the directory")
+		case group.Name != operation.PrincipalName:
+			httpStatus = http.StatusBadRequest
+			httpResponse = []byte(fmt.Sprintf("LDAP group not found; did you mean %q?", group.Name))
+		}
+
+		if httpStatus != 0 {
+			log.Warnf("LDAP group not validated for authorization: %#v", addAuthzReq)
+			return operation, httpStatus, httpResponse
+		}
+	}
+
+	return operation, 0, nil
+}
+
+// authzBatchFailure returns the http response message of a failure to write authorizations.
+// params:
+//  err: error returned when writing the authorizations
+//  partialFailure: error reported if the changes were committed, but not completely written yet
+//  otherwise: error reported if nothing was written
+// return values:
+//  []byte: http response message
+func authzBatchFailure(err error, partialFailure error, otherwise error) []byte {
+	if batchErr, ok := err.(*db.AuthorizationBatchError); ok && batchErr.Committed {
+		return []byte(partialFailure.Error() + ": " + batchErr.Error())
+	}
+
+	return []byte(otherwise.Error())
+}
+
+// updateAuthorizationHelper changes the role and/or tenant of an authorization.
+// params:
+//  authzUUID: UUID of the authorization
+//  updateAuthzReq: role and/or tenant to be set
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow or nil
+func updateAuthorizationHelper(authzUUID string, updateAuthzReq *UpdateAuthorizationRequest) (int, []byte) {
+	if !common.IsEmpty(updateAuthzReq.Role) {
+		if _, err := types.Role(updateAuthzReq.Role); err != nil {
+			log.Warnf("illegal role specified in authorization update: %#v", updateAuthzReq)
+			return http.StatusBadRequest, []byte("illegal role specified")
+		}
+	}
+
+	authz, err := auth.UpdateAuthorization(authzUUID, updateAuthzReq.Role, updateAuthzReq.TenantName)
+	switch err {
+	case nil:
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case auth_errors.ErrIllegalOperation:
+		return http.StatusBadRequest, []byte(err.Error())
+	case auth_errors.ErrIllegalArguments:
+		return http.StatusBadRequest, []byte("admin role can't be granted on a tenant, role authorizations can't be scoped to a tenant and deny authorizations carry no role")
+	case auth_errors.ErrKeyModified:
+		return http.StatusConflict, []byte("authorizations are being changed concurrently; try again")
+	default:
+		return http.StatusInternalServerError, authzBatchFailure(err, auth_errors.ErrPartialFailureToUpdateAuthz, auth_errors.ErrUpdateAuthorization)
+	}
+
+	jData, err := json.Marshal(convertAuthz(authz))
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// bulkAuthorizationsHelper validates a list of authorization operations all or nothing, then applies them;
+// see auth.ApplyAuthorizationOperations.
+// params:
+//  bulkAuthzReq: operations to be applied
+// return values:
+//  int: http status code
+//  []byte: http response message; JSON BulkAuthorizationReply reporting the outcome of each operation,
+//          or an error message if the request is empty
+func bulkAuthorizationsHelper(bulkAuthzReq *BulkAuthorizationRequest) (int, []byte) {
+	if len(bulkAuthzReq.Operations) == 0 {
+		return http.StatusBadRequest, []byte("no operations given")
+	}
+
+	reply := BulkAuthorizationReply{Results: []BulkAuthorizationResult{}}
+	for _, operation := range bulkAuthzReq.Operations {
+		reply.Results = append(reply.Results, BulkAuthorizationResult{Op: operation.Op, Status: BulkOpNotApplied})
+	}
+
+	// failed marks the given operation as failed, the others keep their status
+	failed := func(index, httpStatus int, httpResponse []byte) (int, []byte) {
+		reply.Results[index].Status = BulkOpFailed
+		reply.Results[index].Error = string(httpResponse)
+
+		jData, err := json.Marshal(reply)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+
+		return httpStatus, jData
+	}
+
+	operations := []auth.AuthorizationOperation{}
+	for i, operation := range bulkAuthzReq.Operations {
+		switch operation.Op {
+		case auth.AuthzOpAdd:
+			addOperation, httpStatus, httpResponse := addAuthorizationOperation(&operation.AddAuthorizationRequest)
+			if httpStatus != 0 {
+				return failed(i, httpStatus, httpResponse)
+			}
+
+			operations = append(operations, addOperation)
+		case auth.AuthzOpUpdate, auth.AuthzOpDelete:
+			if common.IsEmpty(operation.AuthzUUID) {
+				return failed(i, http.StatusBadRequest, []byte("authorization UUID is missing"))
+			}
+
+			operations = append(operations, auth.AuthorizationOperation{
+				Op:         operation.Op,
+				AuthzUUID:  operation.AuthzUUID,
+				Role:       operation.Role,
+				TenantName: operation.TenantName,
+			})
+		default:
+			return failed(i, http.StatusBadRequest, []byte(fmt.Sprintf("illegal operation %q", operation.Op)))
+		}
+	}
+
+	authzList, err := auth.ApplyAuthorizationOperations(operations)
+	if opErr, ok := err.(*auth.AuthorizationOperationError); ok {
+		if opErr.Committed {
+			for i := range reply.Results {
+				reply.Results[i].Status = BulkOpPending
+			}
+		}
+
+		switch opErr.Err {
+		case auth_errors.ErrKeyNotFound:
+			return failed(opErr.Index, http.StatusNotFound, []byte("authorization not found"))
+		case auth_errors.ErrIllegalOperation:
+			return failed(opErr.Index, http.StatusBadRequest, []byte(opErr.Err.Error()))
+		case auth_errors.ErrIllegalArguments:
+			return failed(opErr.Index, http.StatusBadRequest, []byte("illegal role or tenant"))
+		case auth_errors.ErrKeyModified:
+			return failed(opErr.Index, http.StatusConflict, []byte("authorizations are being changed concurrently; try again"))
+		default:
+			return failed(opErr.Index, http.StatusInternalServerError, []byte(opErr.Err.Error()))
+		}
+	} else if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	for i, authz := range authzList {
+		authzReply := convertAuthz(authz)
+		reply.Results[i].Status = BulkOpApplied
+		reply.Results[i].Authorization = &authzReply
+	}
+
+	jData, err := json.Marshal(reply)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// listAuthorizationsHelper lists the authorizations matching a filter.
+// params:
+//  filter: selects the authorizations
+//  limit: size of the page; 0 to return all the authorizations as a plain list
+//  next: cursor of the page
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          this could be an error message or JSON response based on the execution flow or nil
+func listAuthorizationsHelper(filter db.AuthorizationFilter, limit int, next string) (int, []byte) {
+	authzList, nextPage, err := db.ListAuthorizationsPage(filter, limit, next)
+	if err != nil {
+		log.Error("failed to list authorizations, err:", err)
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	// convert authorizations to authorization reply msgs
+	authzReplyList := []GetAuthorizationReply{}
+	for _, authz := range authzList {
+		authzReplyList = append(authzReplyList, convertAuthz(authz))
+	}
+
+	var reply interface{} = authzReplyList
+	if limit > 0 {
+		reply = ListAuthorizationsReply{AuthList: authzReplyList, Next: nextPage}
+	}
+
+	jData, err := json.Marshal(reply)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// requestElevationHelper helper function to record an elevation request of the given user.
+// params:
+//  requester: username of the local user asking for the role
+//  elevationReq: role, tenant, duration and reason of the request
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the pending `types.ElevationRequest`
+func requestElevationHelper(requester string, elevationReq *elevationReq) (int, []byte) {
+	role, err := types.Role(elevationReq.Role)
+	if err != nil {
+		return http.StatusBadRequest, []byte("illegal role specified")
+	}
+
+	duration := time.Duration(elevationReq.DurationSeconds) * time.Second
+	request, err := auth.RequestElevation(requester, role, elevationReq.TenantName, duration, elevationReq.Reason)
+	switch err {
+	case nil:
+		return elevationRequestResponse(request, http.StatusCreated)
+	case auth_errors.ErrIllegalArguments:
+		return http.StatusBadRequest, []byte(fmt.Sprintf("a reason, a tenant for the ops role and a duration of at most %v are required", auth.MaxElevationDuration))
+	default:
+		return http.StatusInternalServerError, []byte("Failed to record the elevation request")
+	}
+}
+
+// downscopeTokenHelper helper function to exchange a token for a down-scoped one.
+// params:
+//  token: parsed token of the caller
+//  downscopeReq: tenants, methods and lifetime the new token is limited to
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `LoginResponse` object
+func downscopeTokenHelper(token *auth.Token, downscopeReq *downscopeReq) (int, []byte) {
+	lifetime := time.Duration(downscopeReq.LifetimeSeconds) * time.Second
+	tokenStr, err := auth.DownscopeToken(token, downscopeReq.Tenants, downscopeReq.Methods, lifetime)
+	switch err {
+	case nil:
+	case auth_errors.ErrIllegalArguments:
+		return http.StatusBadRequest, []byte("at least one restriction is required; methods must be GET, POST, PUT, PATCH or DELETE, " +
+			"the lifetime must not be negative and a down-scoped token can't be widened")
+	default:
+		log.Debugf("Failed to down-scope token of %q: %#v", token.Username(), err)
+		return http.StatusInternalServerError, []byte("Failed to down-scope the token")
+	}
+
+	jData, err := json.Marshal(LoginResponse{Token: tokenStr})
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// accessDecisionHelper helper function to tell whether a token grants access to a tenant or a
+// resource of it, as enforced on the netmaster requests (see enforceRBAC).
+// params:
+//  token: parsed token of the caller
+//  tenant: tenant the access is checked on
+//  resource: resource the access is checked on; empty for the tenant itself
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `AccessDecisionReply` object
+func accessDecisionHelper(token *auth.Token, tenant types.Tenant, resource types.Resource) (int, []byte) {
+	decision := AccessDecisionReply{
+		TenantName:   string(tenant),
+		ResourceType: resource.Type,
+		ResourceName: resource.Name,
+	}
+
+	if token.IsSuperuser() && token.ScopedTenants() == nil {
+		decision.Allowed, decision.Reason = true, AccessDecisionAdmin
+	} else {
+		switch err := token.CheckClaims(tenant, types.Ops, resource).(type) {
+		case nil:
+			decision.Allowed, decision.Reason = true, AccessDecisionAuthorized
+		case *auth.DenyError:
+			deniedBy := convertAuthz(err.Authorization)
+			decision.Reason, decision.DeniedBy = AccessDecisionDenied, &deniedBy
+		default:
+			if err != auth_errors.ErrUnauthorized {
+				log.Debugf("Failed to check access of %q to tenant %q: %#v", token.Username(), tenant, err)
+				return http.StatusInternalServerError, []byte("Failed to check access")
+			}
+
+			decision.Reason = AccessDecisionNotAuthorized
+		}
+	}
+
+	jData, err := json.Marshal(decision)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// impersonateHelper helper function to grant an admin a token impersonating a user.
+// params:
+//  actor: username of the admin
+//  impersonateReq: local user or LDAP principals to be impersonated
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `LoginResponse` object
+func impersonateHelper(actor string, impersonateReq *impersonateReq) (int, []byte) {
+	tokenStr, err := auth.Impersonate(actor, impersonateReq.Username, impersonateReq.Local, impersonateReq.Principals, impersonateReq.DN)
+	switch err {
+	case nil:
+	case auth_errors.ErrIllegalArguments:
+		return http.StatusBadRequest, []byte("a username, and the principals of a LDAP user, are required")
+	case auth_errors.ErrUserNotFound:
+		return http.StatusNotFound, []byte(fmt.Sprintf("local user %q not found", impersonateReq.Username))
+	default:
+		log.Debugf("Failed to impersonate %q: %#v", impersonateReq.Username, err)
+		return http.StatusInternalServerError, []byte("Failed to impersonate the user")
+	}
+
+	jData, err := json.Marshal(LoginResponse{Token: tokenStr})
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// listElevationRequestsHelper helper function to list the elevation requests.
+// params:
+//  requester: username of the requester; all the requesters if empty
+//  status: status of the requests; all the statuses if empty
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the list of `types.ElevationRequest` objects
+func listElevationRequestsHelper(requester, status string) (int, []byte) {
+	requests, err := db.GetElevationRequests(requester, status)
+	if err != nil {
+		log.Debugf("Failed to fetch elevation requests: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to fetch elevation requests")
+	}
+
+	jData, err := json.Marshal(requests)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// getElevationRequestHelper helper function to get an elevation request.
+// params:
+//  id: ID of the request
+//  requester: the request is only returned if it belongs to this user, unless it's empty
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the `types.ElevationRequest`
+func getElevationRequestHelper(id, requester string) (int, []byte) {
+	request, err := db.GetElevationRequest(id)
+	switch {
+	case err == auth_errors.ErrKeyNotFound, err == nil && !common.IsEmpty(requester) && request.Requester != requester:
+		return http.StatusNotFound, nil
+	case err != nil:
+		log.Debugf("Failed to fetch elevation request %q: %#v", id, err)
+		return http.StatusInternalServerError, []byte("Failed to fetch the elevation request")
+	default:
+		return elevationRequestResponse(request, http.StatusOK)
+	}
+}
+
+// decideElevationHelper helper function to approve or deny an elevation request.
+// params:
+//  id: ID of the request
+//  decider: username of the admin taking the decision
+//  approve: true to approve the request, false to deny it
+//  comment: comment of the decider
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the `types.ElevationRequest` decided
+func decideElevationHelper(id, decider string, approve bool, comment string) (int, []byte) {
+	request, err := auth.DecideElevation(id, decider, approve, comment)
+	switch err {
+	case nil:
+		return elevationRequestResponse(request, http.StatusOK)
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case auth_errors.ErrAccessDenied:
+		return http.StatusForbidden, []byte("elevation requests must be decided by another admin")
+	case auth_errors.ErrIllegalOperation:
+		return http.StatusConflict, []byte("the elevation request was already decided")
+	case auth_errors.ErrKeyModified:
+		return http.StatusConflict, []byte("authorizations are being changed concurrently; try again")
+	default:
+		return http.StatusInternalServerError, authzBatchFailure(err, auth_errors.ErrPartialFailureToAddAuthz, auth_errors.ErrInternal)
+	}
+}
+
+// elevationRequestResponse returns the given elevation request as an http response.
+func elevationRequestResponse(request *types.ElevationRequest, successCode int) (int, []byte) {
+	jData, err := json.Marshal(request)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return successCode, jData
+}
+
+// breakGlassChallengeHelper helper function to get the challenge of the break-glass access.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains `BreakGlassChallengeResponse` object
+func breakGlassChallengeHelper() (int, []byte) {
+	challenge := BreakGlassChallengeResponse{}
+
+	breakGlass, err := db.GetBreakGlass()
+	switch err {
+	case nil:
+		if breakGlass.Armed {
+			challenge.Armed, challenge.Challenge = true, breakGlass.Challenge
+		}
+	case auth_errors.ErrKeyNotFound:
+	default:
+		log.Debugf("Failed to fetch break-glass access: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to fetch break-glass access")
+	}
+
+	jData, err := json.Marshal(challenge)
+	if err != nil {
+		return http.StatusInternalServerError, []byte(err.Error())
+	}
+
+	return http.StatusOK, jData
+}
+
+// getBreakGlassHelper helper function to get the state of the break-glass access.
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the `types.BreakGlass` object
+func getBreakGlassHelper() (int, []byte) {
+	breakGlass, err := db.GetBreakGlass()
+	return breakGlassResponse(breakGlass, err)
+}
+
+// armBreakGlassHelper helper function to arm the break-glass access.
+// params:
+//  armedBy: username of the admin arming the access
+//  publicKey: PEM encoded Ed25519 public key; the current key is kept if empty
+// return values:
+//  int: http status code
+//  []byte: http response message; this goes along with status code
+//          on success, it contains the armed `types.BreakGlass` object
+func armBreakGlassHelper(armedBy, publicKey string) (int, []byte) {
+	breakGlass, err := auth.ArmBreakGlass(armedBy, publicKey)
+	if err == auth_errors.ErrIllegalArguments {
+		return http.StatusBadRequest, []byte("a PEM encoded Ed25519 public key is required")
+	}
+
+	return breakGlassResponse(breakGlass, err)
+}
+
+// breakGlassResponse returns the given state of the break-glass access as an http response.
+func breakGlassResponse(breakGlass *types.BreakGlass, err error) (int, []byte) {
+	switch err {
+	case nil:
+		jData, err := json.Marshal(breakGlass)
+		if err != nil {
+			return http.StatusInternalServerError, []byte(err.Error())
+		}
+
+		return http.StatusOK, jData
+	case auth_errors.ErrKeyNotFound:
+		return http.StatusNotFound, nil
+	case auth_errors.ErrKeyModified:
+		return http.StatusConflict, []byte("break-glass access was changed concurrently; try again")
+	default:
+		log.Debugf("Failed to process break-glass access: %#v", err)
+		return http.StatusInternalServerError, []byte("Failed to process break-glass access")
+	}
+}
+
 //
 // convertAuthz converts the Authorization object into reply struct for Add
 // authorization and Get authorization API calls
@@ -514,10 +1872,31 @@ func convertAuthz(authz types.Authorization) GetAuthorizationReply {
 		Role:          authz.ClaimValue,
 	}
 
+	// local groups are known by their name, not by their principal name
+	if authz.Local && strings.HasPrefix(authz.PrincipalName, types.LocalGroupPrincipalPrefix) {
+		getAuthzReply.PrincipalName = strings.TrimPrefix(authz.PrincipalName, types.LocalGroupPrincipalPrefix)
+		getAuthzReply.LocalGroup = true
+	}
+
+	// LDAP users are known by their DN
+	if !authz.Local && strings.HasPrefix(authz.PrincipalName, types.LdapUserPrincipalPrefix) {
+		getAuthzReply.PrincipalName = strings.TrimPrefix(authz.PrincipalName, types.LdapUserPrincipalPrefix)
+		getAuthzReply.LdapUser = true
+	}
+
 	// Fill in tenant name only for tenant claim key
 	if strings.HasPrefix(authz.ClaimKey, types.TenantClaimKey) {
 		getAuthzReply.TenantName = strings.TrimPrefix(authz.ClaimKey, types.TenantClaimKey)
 	}
 
+	getAuthzReply.NotBefore, getAuthzReply.ExpiresAt = authz.NotBefore, authz.ExpiresAt
+	getAuthzReply.Deny, getAuthzReply.ResourceType, getAuthzReply.ResourceName = authz.Deny, authz.ResourceType, authz.ResourceName
+	if authz.ExpiresAt != 0 {
+		getAuthzReply.RemainingSeconds = authz.ExpiresAt - time.Now().Unix()
+		if getAuthzReply.RemainingSeconds < 0 {
+			getAuthzReply.RemainingSeconds = 0
+		}
+	}
+
 	return getAuthzReply
 }
@@ -21,6 +21,21 @@ const (
 	// LoginPath is the authentication endpoint on the proxy
 	LoginPath = V1Prefix + "/login"
 
+	// ChangePasswordPath is the endpoint local users change their own password on
+	ChangePasswordPath = V1Prefix + "/change_password"
+
+	// WhoAmIPath is the endpoint users get the details of their own session on
+	WhoAmIPath = V1Prefix + "/whoami"
+
+	// AccessDecisionPath is the endpoint users check their access to a tenant or a resource on
+	AccessDecisionPath = V1Prefix + "/access_decision"
+
+	// DownscopeTokenPath is the endpoint users exchange their token for a down-scoped one on
+	DownscopeTokenPath = V1Prefix + "/downscope_token"
+
+	// ImpersonatePath is the endpoint admins get a token acting as another user on
+	ImpersonatePath = V1Prefix + "/impersonate"
+
 	// HealthCheckPath is the health check endpoint on the proxy
 	HealthCheckPath = V1Prefix + "/health"
 
@@ -227,16 +242,36 @@ func addRoutes(s *Server, router *mux.Router) {
 	// Authentication endpoint
 	//
 	router.Path(LoginPath).Methods("POST").HandlerFunc(loginHandler)
+	router.Path(ChangePasswordPath).Methods("POST").HandlerFunc(changePasswordHandler)
+	router.Path(WhoAmIPath).Methods("GET").HandlerFunc(whoAmIHandler)
+	router.Path(DownscopeTokenPath).Methods("POST").HandlerFunc(downscopeTokenHandler)
+	router.Path(AccessDecisionPath).Methods("GET").HandlerFunc(accessDecisionHandler)
+	router.Path(ImpersonatePath).Methods("POST").HandlerFunc(adminOnly(impersonate))
 
 	//
 	// User management endpoints
 	//
 	addUserMgmtRoutes(router)
 
+	//
+	// Local group management endpoints
+	//
+	addLocalGroupMgmtRoutes(router)
+
 	// Authorization endpoints
 	//
 	addAuthorizationRoutes(router)
 
+	//
+	// Elevation request endpoints
+	//
+	addElevationRoutes(router)
+
+	//
+	// Break-glass emergency access endpoints
+	//
+	addBreakGlassRoutes(router)
+
 	//
 	// LDAP configuration management endpoints
 	//
@@ -271,21 +306,66 @@ func addUserMgmtRoutes(router *mux.Router) {
 	router.Path(V1Prefix + "/local_users/{username}").Methods("PATCH").HandlerFunc(adminOnly(updateLocalUser))
 	router.Path(V1Prefix + "/local_users/{username}").Methods("GET").HandlerFunc(adminOnly(getLocalUser))
 	router.Path(V1Prefix + "/local_users").Methods("GET").HandlerFunc(adminOnly(getLocalUsers))
+	router.Path(V1Prefix + "/password_policy").Methods("GET").HandlerFunc(adminOnly(getPasswordPolicy))
+	router.Path(V1Prefix + "/password_policy").Methods("PUT").HandlerFunc(adminOnly(updatePasswordPolicy))
+}
+
+// addLocalGroupMgmtRoutes adds local group management routes to the mux.Router.
+// All local group management routes are admin-only.
+func addLocalGroupMgmtRoutes(router *mux.Router) {
+	router.Path(V1Prefix + "/local_groups").Methods("POST").HandlerFunc(adminOnly(addLocalGroup))
+	router.Path(V1Prefix + "/local_groups/{name}").Methods("DELETE").HandlerFunc(adminOnly(deleteLocalGroup))
+	router.Path(V1Prefix + "/local_groups/{name}").Methods("PATCH").HandlerFunc(adminOnly(updateLocalGroup))
+	router.Path(V1Prefix + "/local_groups/{name}").Methods("GET").HandlerFunc(adminOnly(getLocalGroup))
+	router.Path(V1Prefix + "/local_groups").Methods("GET").HandlerFunc(adminOnly(getLocalGroups))
+	router.Path(V1Prefix + "/local_groups/{name}/members").Methods("POST").HandlerFunc(adminOnly(addLocalGroupMember))
+	router.Path(V1Prefix + "/local_groups/{name}/members/{username}").Methods("DELETE").HandlerFunc(adminOnly(deleteLocalGroupMember))
 }
 
 // addAuthorizationRoutes adds authorization routes to the mux.Router
 // All authorization management routes are admin-only.
 func addAuthorizationRoutes(router *mux.Router) {
 	router.Path(V1Prefix + "/authorizations").Methods("POST").HandlerFunc(adminOnly(addAuthorization))
+	router.Path(V1Prefix + "/authorizations/bulk").Methods("POST").HandlerFunc(adminOnly(bulkAuthorizations))
+	router.Path(V1Prefix + "/authorizations/{authzUUID}").Methods("PATCH").HandlerFunc(adminOnly(updateAuthorization))
 	router.Path(V1Prefix + "/authorizations/{authzUUID}").Methods("DELETE").HandlerFunc(adminOnly(deleteAuthorization))
 	router.Path(V1Prefix + "/authorizations/{authzUUID}").Methods("GET").HandlerFunc(adminOnly(getAuthorization))
 	router.Path(V1Prefix + "/authorizations").Methods("GET").HandlerFunc(adminOnly(listAuthorizations))
 }
 
+// addElevationRoutes adds the elevation request routes to the mux.Router
+// Any user can request elevation and list their requests; decisions are admin-only.
+func addElevationRoutes(router *mux.Router) {
+	router.Path(V1Prefix + "/elevation_requests").Methods("POST").HandlerFunc(requestElevation)
+	router.Path(V1Prefix + "/elevation_requests").Methods("GET").HandlerFunc(listElevationRequests)
+	router.Path(V1Prefix + "/elevation_requests/{id}").Methods("GET").HandlerFunc(getElevationRequest)
+	router.Path(V1Prefix + "/elevation_requests/{id}/approve").Methods("POST").HandlerFunc(adminOnly(approveElevationRequest))
+	router.Path(V1Prefix + "/elevation_requests/{id}/deny").Methods("POST").HandlerFunc(adminOnly(denyElevationRequest))
+}
+
+// addBreakGlassRoutes adds the break-glass access routes to the mux.Router
+// The challenge and the login are meant for when nobody can log in; arming is admin-only.
+func addBreakGlassRoutes(router *mux.Router) {
+	router.Path(V1Prefix + "/break_glass/challenge").Methods("GET").HandlerFunc(breakGlassChallenge)
+	router.Path(V1Prefix + "/break_glass/login").Methods("POST").HandlerFunc(breakGlassLogin)
+	router.Path(V1Prefix + "/break_glass").Methods("GET").HandlerFunc(adminOnly(getBreakGlass))
+	router.Path(V1Prefix + "/break_glass/arm").Methods("POST").HandlerFunc(adminOnly(armBreakGlass))
+}
+
 // addLdapConfigurationMgmtRoutes adds LDAP configuration management routes to mux.Router.
+// `/ldap_configuration` is the collection of all the LDAP configurations (domains);
+// DELETE/PATCH on the collection act on the default configuration as in the previous releases.
 func addLdapConfigurationMgmtRoutes(router *mux.Router) {
 	router.Path(V1Prefix + "/ldap_configuration").Methods("POST").HandlerFunc(adminOnly(addLdapConfiguration))
-	router.Path(V1Prefix + "/ldap_configuration").Methods("GET").HandlerFunc(adminOnly(getLdapConfiguration))
+	router.Path(V1Prefix + "/ldap_configuration").Methods("GET").HandlerFunc(adminOnly(getLdapConfigurations))
 	router.Path(V1Prefix + "/ldap_configuration").Methods("DELETE").HandlerFunc(adminOnly(deleteLdapConfiguration))
 	router.Path(V1Prefix + "/ldap_configuration").Methods("PATCH").HandlerFunc(adminOnly(updateLdapConfiguration))
+	router.Path(V1Prefix + "/ldap_configuration/test").Methods("POST").HandlerFunc(adminOnly(testLdapConfiguration))
+	router.Path(V1Prefix + "/ldap_configuration/{name}").Methods("GET").HandlerFunc(adminOnly(getLdapConfiguration))
+	router.Path(V1Prefix + "/ldap_configuration/{name}").Methods("DELETE").HandlerFunc(adminOnly(deleteLdapConfiguration))
+	router.Path(V1Prefix + "/ldap_configuration/{name}").Methods("PATCH").HandlerFunc(adminOnly(updateLdapConfiguration))
+	router.Path(V1Prefix + "/ldap_configuration/{name}/test").Methods("POST").HandlerFunc(adminOnly(testStoredLdapConfiguration))
+	router.Path(V1Prefix + "/ldap_configuration/{name}/servers").Methods("GET").HandlerFunc(adminOnly(getLdapServers))
+	router.Path(V1Prefix + "/ldap_configuration/{name}/metrics").Methods("GET").HandlerFunc(adminOnly(getLdapMetrics))
+	router.Path(V1Prefix + "/ldap_configuration/{name}/{kind:groups|users}").Methods("GET").HandlerFunc(adminOnly(searchLdapDirectory))
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/contiv/auth_proxy/auth"
 	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/common/audit"
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/contivmodel/client"
 	"github.com/gorilla/mux"
@@ -80,6 +81,9 @@ var (
 //       POST: tenant name is obtained from the payload
 //       GET, PUT, DELETE: tenant name is obtained by querying (http.GET) netmaster for the named resource
 //    4. Responses of superuser's request is never filtered (auth.NullFilter)
+//    5. Down-scoped tokens are limited to the methods of their scope; tokens down-scoped to some tenants
+//       go through the tenant checks even if they belong to a superuser, so they can't reach the
+//       admin-only netmaster resources nor create or delete tenants
 func enforceRBAC(s *Server) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, req *http.Request) {
 		vars := mux.Vars(req)
@@ -91,7 +95,22 @@ func enforceRBAC(s *Server) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 
-		if token.IsSuperuser() {
+		// requests are authorized as the impersonated user but traced back to the admin
+		if token.IsImpersonation() {
+			audit.Record("impersonated_request", audit.Fields{
+				"actor":    token.Actor(),
+				"username": token.Username(),
+				"method":   req.Method,
+				"path":     req.URL.Path,
+			})
+		}
+
+		if !token.AllowsMethod(req.Method) {
+			authError(w, http.StatusForbidden, "Insufficient privileges; method not allowed by the token")
+			return
+		}
+
+		if token.IsSuperuser() && token.ScopedTenants() == nil {
 			proxyRequest(s, req, w, token, auth.NullFilter)
 			return
 		}
@@ -161,7 +180,7 @@ func rbacUsingTenant(s *Server, req *http.Request, w http.ResponseWriter, token
 			return
 		}
 
-		if checkClaims(w, token, types.Tenant(rName)) {
+		if checkClaims(req, w, token, types.Tenant(rName), types.Resource{}) {
 			proxyRequest(s, req, w, token, auth.NullFilter)
 		}
 	default:
@@ -191,27 +210,30 @@ func authorized(s *Server, req *http.Request, w http.ResponseWriter, token *auth
 			return false
 		}
 
+		// the resource is the one deny authorizations are checked against, e.g. the EPG of the
+		// `endpoints` inspect endpoint
 		tenantName := ""
-		switch resourceObj.(type) {
+		r := types.Resource{}
+		switch obj := resourceObj.(type) {
 		case *client.AppProfile:
-			tenantName = resourceObj.(*client.AppProfile).TenantName
+			tenantName, r = obj.TenantName, types.Resource{Type: "appProfiles", Name: obj.AppProfileName}
 		case *client.EndpointGroup:
-			tenantName = resourceObj.(*client.EndpointGroup).TenantName
+			tenantName, r = obj.TenantName, types.Resource{Type: "endpointGroups", Name: obj.GroupName}
 		case *client.ExtContractsGroup:
-			tenantName = resourceObj.(*client.ExtContractsGroup).TenantName
+			tenantName, r = obj.TenantName, types.Resource{Type: "extContractsGroups", Name: obj.ContractsGroupName}
 		case *client.Netprofile:
-			tenantName = resourceObj.(*client.Netprofile).TenantName
+			tenantName, r = obj.TenantName, types.Resource{Type: "netprofiles", Name: obj.ProfileName}
 		case *client.Network:
-			tenantName = resourceObj.(*client.Network).TenantName
+			tenantName, r = obj.TenantName, types.Resource{Type: "networks", Name: obj.NetworkName}
 		case *client.Policy:
-			tenantName = resourceObj.(*client.Policy).TenantName
+			tenantName, r = obj.TenantName, types.Resource{Type: "policys", Name: obj.PolicyName}
 		case *client.Rule:
-			tenantName = resourceObj.(*client.Rule).TenantName
+			tenantName, r = obj.TenantName, types.Resource{Type: "rules", Name: auth.RuleKey(obj)}
 		case *client.ServiceLB:
-			tenantName = resourceObj.(*client.ServiceLB).TenantName
+			tenantName, r = obj.TenantName, types.Resource{Type: "serviceLBs", Name: obj.ServiceName}
 		}
 
-		return checkClaims(w, token, types.Tenant(tenantName))
+		return checkClaims(req, w, token, types.Tenant(tenantName), r)
 	}
 
 	return false
@@ -272,17 +294,37 @@ func getResourceDetails(req *http.Request, w http.ResponseWriter, endpoint, rNam
 	return data
 }
 
-// checkClaims checks given tentant claims on the token
+// checkClaims checks given tentant claims on the token; the requests denied by a deny
+// authorization are recorded in the audit trail.
 // params:
+//  req:        http request object
 //  w:          http response writer
 //  token:      containing claims
 //  tenantName: of the requested resource
+//  resource:   requested resource; empty for the tenant itself
 // return values:
 //  bool: true if the user is authorized on given tenant, otherwise false
 //  errors are written using response writer
-func checkClaims(w http.ResponseWriter, token *auth.Token, tenant types.Tenant) bool {
+func checkClaims(req *http.Request, w http.ResponseWriter, token *auth.Token, tenant types.Tenant, resource types.Resource) bool {
 	log.Debugf("Tenant name of the requested resource %q, checking authZ...", tenant)
-	if err := token.CheckClaims(tenant, types.Ops); err != nil {
+	if err := token.CheckClaims(tenant, types.Ops, resource); err != nil {
+		// tell which deny authorization denied access, if any, so that it can be looked up
+		if denyErr, ok := err.(*auth.DenyError); ok {
+			audit.Warn("access_denied_by_rule", audit.Fields{
+				"username":      token.Username(),
+				"principal":     denyErr.Authorization.PrincipalName,
+				"tenant":        string(tenant),
+				"resource_type": resource.Type,
+				"resource_name": resource.Name,
+				"authz_uuid":    denyErr.Authorization.UUID,
+				"method":        req.Method,
+				"path":          req.URL.Path,
+			})
+
+			authError(w, http.StatusForbidden, "Insufficient privileges; "+denyErr.Error())
+			return false
+		}
+
 		authError(w, http.StatusForbidden, "Insufficient privileges")
 		return false
 	}
@@ -1,5 +1,12 @@
 package proxy
 
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/auth/ldap"
+	"github.com/contiv/auth_proxy/common/types"
+)
+
 // This file contains the list of structs used in the HTTP handlers.
 
 // this is to maintain uniformity in UI. Right now, all the requests are sent as JSON
@@ -9,8 +16,51 @@ type loginReq struct {
 }
 
 // LoginResponse holds the token returned upon successful login.
+// MustChangePassword is set if the token can only be used to change the password.
 type LoginResponse struct {
-	Token string `json:"token"`
+	Token              string `json:"token"`
+	MustChangePassword bool   `json:"must_change_password,omitempty"`
+}
+
+// WhoAmIResponse holds the details of the session of the caller.
+//
+// Fields:
+//  Username: name of the user the token was issued to
+//  Local: set if the user is a local user; else it's a LDAP/AD user
+//  Role: role granted by the token
+//  Principals: principals the token was issued with (local user/groups or LDAP groups)
+//  Attributes: user attributes carried by the token (e.g. display name, email)
+//  MustChangePassword: set if the token can only be used to change the password
+//  ExpiresAt: expiration time of the token as unix timestamp
+//  LastLogin: time of the last login of the user as unix timestamp; omitted if unknown
+//  Actor: username of the admin impersonating the user; omitted if the token is not an impersonation token
+//  ScopedTenants: tenants a down-scoped token is limited to; omitted if there is no such restriction
+//  ScopedMethods: HTTP methods a down-scoped token is limited to; omitted if there is no such restriction
+type WhoAmIResponse struct {
+	Username           string            `json:"username"`
+	Local              bool              `json:"local"`
+	Role               string            `json:"role,omitempty"`
+	Principals         []string          `json:"principals"`
+	Attributes         map[string]string `json:"attributes"`
+	MustChangePassword bool              `json:"must_change_password,omitempty"`
+	ExpiresAt          int64             `json:"expires_at"`
+	LastLogin          int64             `json:"last_login,omitempty"`
+	Actor              string            `json:"act,omitempty"`
+	ScopedTenants      []string          `json:"scoped_tenants,omitempty"`
+	ScopedMethods      []string          `json:"scoped_methods,omitempty"`
+}
+
+// downscopeReq holds the restrictions of a down-scoped token; empty restrictions are inherited from the token exchanged.
+type downscopeReq struct {
+	Tenants         []string `json:"tenants"`
+	Methods         []string `json:"methods"`
+	LifetimeSeconds int64    `json:"lifetime_seconds"`
+}
+
+// changePasswordReq holds the current and the new password of a local user changing their own password.
+type changePasswordReq struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
 }
 
 //
@@ -22,14 +72,113 @@ type LoginResponse struct {
 //    can be a local user or an LDAP group
 //  Local: true if the name corresponds to a local user, false if it's an LDAP
 //    group.
+//  LocalGroup: true if the name corresponds to a local group; `Local` is ignored in this case.
+//  LdapUser: true if the name is the DN of an LDAP user; only deny authorizations can be given
+//    to an LDAP user, access is granted to its groups. `Local` must be false.
 //  Role:  Level of access granted to principal
 //  TenantName: Tenant name that the above principal will have access to. Based on role type, this may not be set. For example, a tenant name is ignored if role is admin.
+//  ValidatePrincipal: true to check that the LDAP group exists in the directory before adding the
+//    authorization; ignored for local principals.
+//  NotBefore: unix timestamp the authorization takes effect at; optional
+//  ExpiresAt: unix timestamp the authorization expires at; optional. Expired authorizations are
+//    ignored and deleted automatically.
+//  Deny: true to deny the principal access to the tenant instead of granting it; the role is
+//    ignored. Deny authorizations take precedence over the others.
+//  ResourceType: netmaster resource (e.g. networks) a deny authorization is limited to; optional
+//  ResourceName: name of the resource a deny authorization is limited to; optional. Rules are
+//    named by their key (<tenant>:<policy>:<ruleId>)
 //
 type AddAuthorizationRequest struct {
-	PrincipalName string `json:"principalName"`
-	Local         bool   `json:"local"`
-	Role          string `json:"role"`
-	TenantName    string `json:"tenantName"`
+	PrincipalName     string `json:"principalName"`
+	Local             bool   `json:"local"`
+	LocalGroup        bool   `json:"localGroup"`
+	LdapUser          bool   `json:"ldapUser,omitempty"`
+	Role              string `json:"role"`
+	TenantName        string `json:"tenantName"`
+	ValidatePrincipal bool   `json:"validatePrincipal,omitempty"`
+	NotBefore         int64  `json:"not_before,omitempty"`
+	ExpiresAt         int64  `json:"expires_at,omitempty"`
+	Deny              bool   `json:"deny,omitempty"`
+	ResourceType      string `json:"resource_type,omitempty"`
+	ResourceName      string `json:"resource_name,omitempty"`
+}
+
+//
+// UpdateAuthorizationRequest message is sent for UpdateAuthorization
+// operation.
+//
+// Fields:
+//  Role: Level of access to be granted; unchanged if empty
+//  TenantName: Tenant name the role is granted on; unchanged if empty. It can't be set
+//    on a role authorization (admin role or role claim of a principal).
+//
+type UpdateAuthorizationRequest struct {
+	Role       string `json:"role"`
+	TenantName string `json:"tenantName"`
+}
+
+//
+// BulkAuthorizationRequest message is sent for the bulk authorization
+// operation; the operations are validated all or nothing, then applied in
+// order as a single batch which takes effect entirely or not at all.
+//
+// Fields:
+//  Operations: operations to be applied
+//
+type BulkAuthorizationRequest struct {
+	Operations []BulkAuthorizationOperation `json:"operations"`
+}
+
+//
+// BulkAuthorizationOperation is an operation of a bulk authorization request.
+//
+// Fields:
+//  Op: "add", "update" or "delete"
+//  AuthzUUID: authorization to be updated or deleted
+//  AddAuthorizationRequest: authorization to be added; only role and
+//    tenantName are used by updates (see UpdateAuthorizationRequest)
+//
+type BulkAuthorizationOperation struct {
+	Op        string `json:"op"`
+	AuthzUUID string `json:"authzUUID,omitempty"`
+	AddAuthorizationRequest
+}
+
+// outcomes of the operations of a bulk authorization request
+const (
+	BulkOpApplied    = "applied"     // the operation is in effect
+	BulkOpFailed     = "failed"      // the operation which failed; see Error
+	BulkOpNotApplied = "not_applied" // nothing was written for the operation
+	BulkOpPending    = "pending"     // the operation was committed; it takes effect once the batch is completed
+)
+
+//
+// BulkAuthorizationReply message is returned by the bulk authorization
+// operation. Operations reported as pending take effect although
+// the request failed.
+//
+// Fields:
+//  Results: outcome of each operation, in the order of the request
+//
+type BulkAuthorizationReply struct {
+	Results []BulkAuthorizationResult `json:"results"`
+}
+
+//
+// BulkAuthorizationResult reports the outcome of an operation of a bulk
+// authorization request.
+//
+// Fields:
+//  Op: operation as requested
+//  Status: outcome of the operation, see BulkOp*
+//  Error: why the operation failed
+//  Authorization: authorization added, updated or deleted when applied
+//
+type BulkAuthorizationResult struct {
+	Op            string                 `json:"op"`
+	Status        string                 `json:"status"`
+	Error         string                 `json:"error,omitempty"`
+	Authorization *GetAuthorizationReply `json:"authorization,omitempty"`
 }
 
 //
@@ -40,32 +189,179 @@ type AddAuthorizationRequest struct {
 //  AuthzUUID: An unique identifier for each authorization
 //  PrincipalName: name of the user for whom an authorization needs to be added. This
 //    can be a local user or an LDAP group
-//  Local: true if the name corresponds to a local user, false if it's an LDAP
+//  Local: true if the name corresponds to a local user or group, false if it's an LDAP
 //    group.
+//  LocalGroup: true if the name corresponds to a local group
+//  LdapUser: true if the name is the DN of an LDAP user; set on deny authorizations only
 //  Role:  Level of access to the tenant specified by TenantName
 //  TenantName: Tenant name that the above user will have access to
+//  NotBefore: unix timestamp the authorization takes effect at; unset if it is
+//    in effect from its creation
+//  ExpiresAt: unix timestamp the authorization expires at; unset if it never expires
+//  RemainingSeconds: time left before the authorization expires; unset if it never expires
+//  Deny: true if the authorization denies access to the tenant; Role is unset then
+//  ResourceType: netmaster resource a deny authorization is limited to; unset for the whole tenant
+//  ResourceName: name of the resource a deny authorization is limited to; unset for all of them
 //
 type GetAuthorizationReply struct {
-	AuthzUUID     string
-	PrincipalName string
-	Local         bool
-	Role          string
-	TenantName    string
+	AuthzUUID        string
+	PrincipalName    string
+	Local            bool
+	LocalGroup       bool
+	LdapUser         bool `json:"ldapUser,omitempty"`
+	Role             string
+	TenantName       string
+	NotBefore        int64  `json:"not_before,omitempty"`
+	ExpiresAt        int64  `json:"expires_at,omitempty"`
+	RemainingSeconds int64  `json:"remaining_seconds,omitempty"`
+	Deny             bool   `json:"deny,omitempty"`
+	ResourceType     string `json:"resource_type,omitempty"`
+	ResourceName     string `json:"resource_name,omitempty"`
 }
 
+//
+// AccessDecisionReply message is returned by the access decision operation: it
+// tells whether the caller's token grants access to a tenant or a resource of it.
+//
+// Fields:
+//  TenantName: tenant the access is checked on
+//  ResourceType: netmaster resource the access is checked on; unset for the tenant itself
+//  ResourceName: name of the resource the access is checked on
+//  Allowed: true if the access is granted
+//  Reason: why the access is granted or not, see AccessDecision*
+//  DeniedBy: deny authorization which denied access; unset if access was not denied by one
+//
+type AccessDecisionReply struct {
+	TenantName   string                 `json:"tenantName"`
+	ResourceType string                 `json:"resource_type,omitempty"`
+	ResourceName string                 `json:"resource_name,omitempty"`
+	Allowed      bool                   `json:"allowed"`
+	Reason       string                 `json:"reason"`
+	DeniedBy     *GetAuthorizationReply `json:"denied_by,omitempty"`
+}
+
+// reasons of the access decisions
+const (
+	AccessDecisionAdmin         = "admin"          // admins access all the tenants
+	AccessDecisionAuthorized    = "authorized"     // an authorization grants access
+	AccessDecisionDenied        = "denied"         // a deny authorization denies access; see DeniedBy
+	AccessDecisionNotAuthorized = "not_authorized" // no authorization grants access, or out of the scope of the token
+)
+
 //
 // ListAuthorizationsReply message is received from List*Authorizations
-// operation.
+// operation when a page is requested (`limit` or `next` query parameter).
 //
 // Fields:
-//  AuthList: slice of GetAuthorizationReply structures
-//  Error: error encountered during operation, if any
+//  AuthList: page of GetAuthorizationReply structures sorted by UUID
+//  Next: cursor of the next page (`next` query parameter); empty on the last page
 //
 type ListAuthorizationsReply struct {
-	AuthList []GetAuthorizationReply
+	AuthList []GetAuthorizationReply `json:"authorizations"`
+	Next     string                  `json:"next,omitempty"`
+}
+
+//
+// ListLocalUsersReply message is returned by the local user listing
+// operation when a page is requested (`limit` or `next` query parameter).
+//
+// Fields:
+//  Users: page of local users sorted by username
+//  Next: cursor of the next page (`next` query parameter); empty on the last page
+//
+type ListLocalUsersReply struct {
+	Users []types.LocalUser `json:"users"`
+	Next  string            `json:"next,omitempty"`
+}
+
+//
+// DirectorySearchReply message is returned by the LDAP directory search
+// operation.
+//
+// Fields:
+//  Entries: page of the matching groups or users sorted by name
+//  Total: number of matching entries
+//  Truncated: true if the directory has more matching entries than
+//    `ldap.DirectorySearchLimit`; the query needs to be narrowed down to find them
+//  Next: cursor of the next page (`next` query parameter); empty on the last page
+//
+type DirectorySearchReply struct {
+	Entries   []ldap.DirectoryEntry `json:"entries"`
+	Total     int                   `json:"total"`
+	Truncated bool                  `json:"truncated,omitempty"`
+	Next      string                `json:"next,omitempty"`
 }
 
 // errorResponse represent error response; used to write error messages to http response.
 type errorResponse struct {
 	Error string `json:"error"`
 }
+
+// localUserUpdateReq holds the fields of a local user that can be updated; the fields left
+// out (nil) are not changed.
+type localUserUpdateReq struct {
+	Password           string `json:"password,omitempty"`
+	FirstName          string `json:"first_name"`
+	LastName           string `json:"last_name"`
+	Disable            *bool  `json:"disable,omitempty"`
+	MustChangePassword *bool  `json:"must_change_password,omitempty"`
+}
+
+// updatedFields holds the top-level fields found in the body of an update request; this tells the
+// fields set to their zero value, which clears them, from the ones left out, which are not changed.
+type updatedFields map[string]json.RawMessage
+
+// has tells whether the given field was found in the update request.
+func (f updatedFields) has(name string) bool {
+	_, ok := f[name]
+	return ok
+}
+
+// localGroupUpdateReq holds the fields of a local group that can be updated.
+type localGroupUpdateReq struct {
+	Description string `json:"description"`
+}
+
+// localGroupMemberReq holds the username of the local user to be added to a local group.
+type localGroupMemberReq struct {
+	Username string `json:"username"`
+}
+
+// elevationReq holds the role a user requests for a limited time and why.
+type elevationReq struct {
+	Role            string `json:"role"`
+	TenantName      string `json:"tenantName"`
+	DurationSeconds int64  `json:"duration_seconds"`
+	Reason          string `json:"reason"`
+}
+
+// impersonateReq holds the user an admin impersonates: a local user, or the principals of a LDAP user
+// along with its DN, if known, to apply its deny authorizations.
+type impersonateReq struct {
+	Username   string   `json:"username"`
+	Local      bool     `json:"local"`
+	Principals []string `json:"principals"`
+	DN         string   `json:"dn,omitempty"`
+}
+
+// breakGlassLoginReq holds the one-time code of the break-glass access.
+type breakGlassLoginReq struct {
+	Code string `json:"code"`
+}
+
+// breakGlassArmReq holds the public key the break-glass access is armed with; the current key is kept if empty.
+type breakGlassArmReq struct {
+	PublicKey string `json:"public_key"`
+}
+
+// BreakGlassChallengeResponse holds the challenge the next break-glass code must be derived from.
+// Challenge is only set if the access is armed.
+type BreakGlassChallengeResponse struct {
+	Armed     bool   `json:"armed"`
+	Challenge string `json:"challenge,omitempty"`
+}
+
+// elevationDecisionReq holds the comment of an admin approving or denying an elevation request.
+type elevationDecisionReq struct {
+	Comment string `json:"comment"`
+}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"strings"
@@ -148,6 +149,88 @@ func (d *ConsulStateDriver) Write(key string, value []byte) error {
 	return err
 }
 
+//
+// CompareAndSwap atomically writes a key-value pair to the consul KV store
+// only if the current value of the key is the expected one (check-and-set
+// on the modify index of the value read). Unlike Write, it is not retried.
+//
+// Parameters:
+//   key:       key to be stored
+//   prevValue: expected current value; nil if the key must not exist
+//   value:     value to be stored
+//
+// Return values:
+//   error: auth_errors.ErrKeyModified if the current value differs
+//          Error when reading or writing a KV pair via the consul client
+//          nil if successful
+//
+func (d *ConsulStateDriver) CompareAndSwap(key string, prevValue, value []byte) error {
+	key = processKey(key)
+	kv, _, err := d.Client.KV().Get(key, nil)
+	if err != nil {
+		return err
+	}
+
+	// a modify index of 0 only creates the key if it doesn't exist
+	modifyIndex := uint64(0)
+	switch {
+	case kv == nil && prevValue == nil:
+	case kv == nil || prevValue == nil || !bytes.Equal(kv.Value, prevValue):
+		return auth_errors.ErrKeyModified
+	default:
+		modifyIndex = kv.ModifyIndex
+	}
+
+	swapped, _, err := d.Client.KV().CAS(&api.KVPair{Key: key, Value: value, ModifyIndex: modifyIndex}, nil)
+	if err != nil {
+		return err
+	}
+
+	if !swapped {
+		return auth_errors.ErrKeyModified
+	}
+
+	return nil
+}
+
+//
+// CompareAndDelete atomically removes a key from the consul KV store only if
+// its current value is the expected one (check-and-set on the modify index
+// of the value read). Unlike Write, it is not retried.
+//
+// Parameters:
+//   key:       key to be removed
+//   prevValue: expected current value
+//
+// Return values:
+//   error: auth_errors.ErrKeyModified if the current value differs or the
+//          key doesn't exist
+//          Error when reading or deleting a KV pair via the consul client
+//          nil if successful
+//
+func (d *ConsulStateDriver) CompareAndDelete(key string, prevValue []byte) error {
+	key = processKey(key)
+	kv, _, err := d.Client.KV().Get(key, nil)
+	if err != nil {
+		return err
+	}
+
+	if kv == nil || !bytes.Equal(kv.Value, prevValue) {
+		return auth_errors.ErrKeyModified
+	}
+
+	deleted, _, err := d.Client.KV().DeleteCAS(&api.KVPair{Key: key, ModifyIndex: kv.ModifyIndex}, nil)
+	if err != nil {
+		return err
+	}
+
+	if !deleted {
+		return auth_errors.ErrKeyModified
+	}
+
+	return nil
+}
+
 //
 // Read returns the value for a key
 //
@@ -200,16 +283,34 @@ func (d *ConsulStateDriver) Read(key string) ([]byte, error) {
 //          nil if successful
 //
 func (d *ConsulStateDriver) ReadAll(baseKey string) ([][]byte, error) {
+	values, _, err := d.ReadAllWithIndex(baseKey)
+	return values, err
+}
+
+//
+// ReadAllWithIndex returns all state for a key along with the consul index
+// it was read at
+//
+// Parameters:
+//   key:    key for which all values are to be retrieved
+//
+// Return values:
+//   [][]byte: list of values associated with the given key
+//   uint64:   consul index of the read; also set if the key is not found
+//   error: Error when writing to the KeysAPI of consul client
+//          nil if successful
+//
+func (d *ConsulStateDriver) ReadAllWithIndex(baseKey string) ([][]byte, uint64, error) {
 	baseKey = processKey(baseKey)
 
-	kvs, _, err := d.Client.KV().List(baseKey, nil)
+	kvs, qm, err := d.Client.KV().List(baseKey, nil)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 	// Consul returns success and a nil kv when a key is not found,
 	// translate it to 'Key not found' error
 	if kvs == nil {
-		return nil, auth_errors.ErrKeyNotFound
+		return nil, qm.LastIndex, auth_errors.ErrKeyNotFound
 	}
 
 	values := [][]byte{}
@@ -224,7 +325,13 @@ func (d *ConsulStateDriver) ReadAll(baseKey string) ([][]byte, error) {
 		values = append(values, kv.Value)
 	}
 
-	return values, nil
+	return values, qm.LastIndex, nil
+}
+
+// consulListing is the listing of the keys under the watched key, as of a consul index.
+type consulListing struct {
+	kvs   api.KVPairs
+	index uint64
 }
 
 //
@@ -236,19 +343,28 @@ func (d *ConsulStateDriver) ReadAll(baseKey string) ([][]byte, error) {
 //   chKVPairs:      channel on which change notifications are received
 //   chValueChanges: channel using which any value changes are communicated
 //                   to the caller
-//   chErr:          channel using which any errors are communicated to the
-//                   caller
-//   chStop:         channel using which waiting for events can be stopped
+//   chDone:         channel whose closing stops waiting for events
 //
 func (d *ConsulStateDriver) channelConsulEvents(baseKey string, kvCache map[string]*api.KVPair,
-	chKVPairs chan api.KVPairs, chValueChanges chan [2][]byte, chErr chan error, chStop chan bool) {
+	chKVPairs chan consulListing, chValueChanges chan valueChange, chDone chan struct{}) {
+
+	// send channels the translated response unless the watch is stopped
+	send := func(values [2][]byte, index uint64) bool {
+		select {
+		case chValueChanges <- valueChange{values: values, index: index}:
+			return true
+		case <-chDone:
+			return false
+		}
+	}
+
 	for {
 		select {
 		// block on change notifications
-		case kvs := <-chKVPairs:
+		case listing := <-chKVPairs:
 			kvsRcvd := map[string]*api.KVPair{}
 			// Generate Create/Modifiy events for the keys recvd
-			for _, kv := range kvs {
+			for _, kv := range listing.kvs {
 				// XXX: The logic below assumes that the node returned is always a node
 				// of interest. Eg: If we set a watch on /a/b/c, then we are mostly
 				// interested in changes in that directory i.e. changes to /a/b/c/d1..d2
@@ -269,20 +385,25 @@ func (d *ConsulStateDriver) channelConsulEvents(baseKey string, kvCache map[stri
 				kvCache[kv.Key] = kv
 
 				//channel the translated response
-				chValueChanges <- valueChange
+				if !send(valueChange, kv.ModifyIndex) {
+					return
+				}
 			}
 
 			// Generate Delete events for missing keys
 			for key, kv := range kvCache {
 				if _, ok := kvsRcvd[key]; !ok {
 					log.Debugf("Received delete for key: %q, Pair: %+v", kv.Key, kv)
-					chValueChanges <- [2][]byte{nil, kv.Value}
+					// the index of the deletion is unknown; it's no later than the listing
+					if !send([2][]byte{nil, kv.Value}, listing.index) {
+						return
+					}
 					// remove this key from the map of seen keys
 					delete(kvCache, key)
 				}
 			}
 
-		case <-chStop:
+		case <-chDone:
 			log.Infof("Stop request received")
 			return
 		}
@@ -302,17 +423,39 @@ func (d *ConsulStateDriver) channelConsulEvents(baseKey string, kvCache map[stri
 //          nil if successful
 //
 func (d *ConsulStateDriver) WatchAll(baseKey string, chValueChanges chan [2][]byte) error {
+	chChanges := make(chan valueChange, 1)
+	go forwardValues(chChanges, chValueChanges)
+
+	return d.watchAll(baseKey, 0, chChanges, nil)
+}
+
+//
+// watchAll watches value changes for a key in consul until chStop is closed
+//
+// Parameters:
+//   baseKey:         key for which changes are to be watched
+//   afterIndex:      consul index the changes are watched after; 0 to watch the
+//                    changes from now on. Consul keeps no trace of the deleted keys,
+//                    so the keys deleted since this index are not reported
+//   chValueChanges:  channel that will be used to communicate
+//                    any changes to values of a key
+//   chStop:          channel whose closing stops the watch; if nil, the watch
+//                    never stops and server errors are retried forever
+//
+// Return values:
+//   error: Any error when watching for a value change for a key,
+//          nil once the watch is stopped
+//
+func (d *ConsulStateDriver) watchAll(baseKey string, afterIndex uint64, chValueChanges chan valueChange, chStop chan struct{}) error {
 
 	// trim leading '/' of a key
 	baseKey = processKey(baseKey)
 
-	chKVPairs := make(chan api.KVPairs, 1)
+	chKVPairs := make(chan consulListing, 1)
 
 	// channel that will be used to stop watching for state-change events
-	chStop := make(chan bool, 1)
-
-	// channel that will be used to receive errors
-	chErr := make(chan error, 2)
+	chDone := make(chan struct{})
+	defer close(chDone)
 
 	// Consul returns all the keys as return value of List(). The following map helps
 	// track of state that has been seen and used to appropriately generate
@@ -333,40 +476,57 @@ func (d *ConsulStateDriver) WatchAll(baseKey string, chValueChanges chan [2][]by
 	if kvs == nil {
 		kvs = api.KVPairs{}
 	}
+
+	// the keys modified since afterIndex are reported as created by the first listing
 	for _, kv := range kvs {
-		kvCache[kv.Key] = kv
+		if afterIndex == 0 || kv.ModifyIndex <= afterIndex {
+			kvCache[kv.Key] = kv
+		}
 	}
 	waitIndex = qm.LastIndex
 
-	go d.channelConsulEvents(baseKey, kvCache, chKVPairs, chValueChanges, chErr, chStop)
+	go d.channelConsulEvents(baseKey, kvCache, chKVPairs, chValueChanges, chDone)
+
+	if afterIndex != 0 {
+		select {
+		case chKVPairs <- consulListing{kvs: kvs, index: qm.LastIndex}:
+		case <-chStop:
+			return nil
+		}
+	}
 
 	for {
+		// the blocking query can't be interrupted; the stop is noticed once it returns
 		select {
-		case err := <-chErr:
-			return err
+		case <-chStop:
+			return nil
 		default:
-			kvs, qm, err := d.Client.KV().List(baseKey, &api.QueryOptions{WaitIndex: waitIndex})
-			if err != nil {
-				if api.IsServerError(err) || strings.Contains(err.Error(), "EOF") || strings.Contains(err.Error(), "connection refused") {
-					log.Warnf("Consul watch: server error: %v for %s. Retrying..", err, baseKey)
-					time.Sleep(5 * time.Second)
-					continue
-				} else {
-					log.Errorf("consul watch failed for key %q. Error: %s. stopping watch..", baseKey, err)
-					chStop <- true
-					return err
-				}
-			}
-			// Consul returns success and a nil kv when a key is not found.
-			// This shall translate into appropriate 'Delete' events or
-			// no events (depending on whether some keys were seen before)
-			// XXX: shall we stop the watch in this case?
-			if kvs == nil {
-				kvs = api.KVPairs{}
+		}
+
+		kvs, qm, err := d.Client.KV().List(baseKey, &api.QueryOptions{WaitIndex: waitIndex})
+		if err != nil {
+			if chStop == nil && (api.IsServerError(err) || strings.Contains(err.Error(), "EOF") || strings.Contains(err.Error(), "connection refused")) {
+				log.Warnf("Consul watch: server error: %v for %s. Retrying..", err, baseKey)
+				time.Sleep(5 * time.Second)
+				continue
 			}
 
-			waitIndex = qm.LastIndex
-			chKVPairs <- kvs
+			log.Errorf("consul watch failed for key %q. Error: %s. stopping watch..", baseKey, err)
+			return err
+		}
+		// Consul returns success and a nil kv when a key is not found.
+		// This shall translate into appropriate 'Delete' events or
+		// no events (depending on whether some keys were seen before)
+		// XXX: shall we stop the watch in this case?
+		if kvs == nil {
+			kvs = api.KVPairs{}
+		}
+
+		waitIndex = qm.LastIndex
+		select {
+		case chKVPairs <- consulListing{kvs: kvs, index: qm.LastIndex}:
+		case <-chStop:
+			return nil
 		}
 	}
 }
@@ -444,6 +604,27 @@ func (d *ConsulStateDriver) ReadAllState(baseKey string, sType types.State,
 	return readAllStateCommon(d, baseKey, sType, unmarshal)
 }
 
+//
+// ReadAllStateWithIndex reads all the state for a baseKey along with the
+// consul index it was read at
+//
+// Parameters:
+//   baseKey:    key whose values are to be read
+//   sType:      types.State
+//   unmarshal:  function that is used to convert key's values
+//               from a byte slice to values of type types.State
+//
+// Return values:
+//   []types.State: Retrieved values for a key as type types.State
+//   uint64:        consul index of the read
+//   error:         Any error returned by readAllStateWithIndexCommon
+//
+func (d *ConsulStateDriver) ReadAllStateWithIndex(baseKey string, sType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, uint64, error) {
+	baseKey = processKey(baseKey)
+	return readAllStateWithIndexCommon(d, baseKey, sType, unmarshal)
+}
+
 //
 // WatchAllState watches all state changes for a key
 //
@@ -463,14 +644,14 @@ func (d *ConsulStateDriver) WatchAllState(baseKey string, sType types.State,
 	baseKey = processKey(baseKey)
 
 	// channel that will be used to communicate value changes
-	chValueChanges := make(chan [2][]byte, 1)
+	chValueChanges := make(chan valueChange, 1)
 
 	// channel used to communicate errors
 	chErr := make(chan error, 1)
 
-	go channelStateEvents(d, sType, unmarshal, chValueChanges, chStateChanges, chErr)
+	go channelStateEvents(d, sType, unmarshal, chValueChanges, chStateChanges, chErr, nil)
 
-	err := d.WatchAll(baseKey, chValueChanges)
+	err := d.watchAll(baseKey, 0, chValueChanges, nil)
 	if err != nil {
 		return err
 	}
@@ -480,6 +661,48 @@ func (d *ConsulStateDriver) WatchAllState(baseKey string, sType types.State,
 
 }
 
+//
+// WatchAllStateUntil watches all state changes for a key until chStop is closed
+//
+// Parameters:
+//    baseKey:        key to be watched
+//    afterIndex:     consul index the changes are watched after, e.g. as returned
+//                    by ReadAllStateWithIndex; 0 to watch the changes from now on.
+//                    The keys deleted since this index are not reported (see watchAll)
+//    sType:          types.State to convert values to/from
+//    unmarshal:      function used to convert values to types.State
+//    chStateChanges: channel of types.WatchState
+//    chStop:         channel whose closing stops the watch
+//
+// Return values:
+//    error: Any error when watching all state, including the server
+//           errors; nil once the watch is stopped
+//
+func (d *ConsulStateDriver) WatchAllStateUntil(baseKey string, afterIndex uint64, sType types.State,
+	unmarshal func([]byte, interface{}) error, chStateChanges chan types.WatchState, chStop chan struct{}) error {
+
+	chValueChanges := make(chan valueChange, 1)
+
+	// stops channelStateEvents on return
+	chDone := make(chan struct{})
+	defer close(chDone)
+
+	// errors of both the watch and channelStateEvents
+	chErr := make(chan error, 2)
+
+	go channelStateEvents(d, sType, unmarshal, chValueChanges, chStateChanges, chErr, chDone)
+	go func() {
+		chErr <- d.watchAll(baseKey, afterIndex, chValueChanges, chDone)
+	}()
+
+	select {
+	case err := <-chErr:
+		return err
+	case <-chStop:
+		return nil
+	}
+}
+
 //
 // WriteState writes state for a key into the consul KV store
 //
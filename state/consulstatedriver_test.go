@@ -49,6 +49,18 @@ func TestConsulStateDriverRead(t *testing.T) {
 	commonTestStateDriverRead(t, driver)
 }
 
+// Test to check compare-and-swap in KV store
+func TestConsulStateDriverCompareAndSwap(t *testing.T) {
+	driver := setupConsulDriver(t)
+	commonTestStateDriverCompareAndSwap(t, driver)
+}
+
+// Test to check compare-and-delete in KV store
+func TestConsulStateDriverCompareAndDelete(t *testing.T) {
+	driver := setupConsulDriver(t)
+	commonTestStateDriverCompareAndDelete(t, driver)
+}
+
 // Test to check `ReadAll` from KV store
 func TestConsulStateDriverReadAll(t *testing.T) {
 	driver := setupConsulDriver(t)
@@ -107,3 +119,9 @@ func TestConsulStateDriverWatchAllStateDelete(t *testing.T) {
 	driver := setupConsulDriver(t)
 	commonTestStateDriverWatchAllStateDelete(t, driver)
 }
+
+// Test to watch the state changed since a read in KV store
+func TestConsulStateDriverWatchAllStateAfterIndex(t *testing.T) {
+	driver := setupConsulDriver(t)
+	commonTestStateDriverWatchAllStateAfterIndex(t, driver)
+}
@@ -154,6 +154,70 @@ func (d *EtcdStateDriver) Write(key string, value []byte) error {
 	return err
 }
 
+//
+// CompareAndSwap atomically writes a key-value pair to the etcd KV store
+// only if the current value of the key is the expected one. Unlike Write,
+// it is not retried: a retry could fail after the first attempt succeeded.
+//
+// Parameters:
+//   key:       key to be stored
+//   prevValue: expected current value; nil if the key must not exist
+//   value:     value to be stored
+//
+// Return values:
+//   error: auth_errors.ErrKeyModified if the current value differs
+//          Error when writing to the KeysAPI of etcd client
+//          nil if successful
+//
+func (d *EtcdStateDriver) CompareAndSwap(key string, prevValue, value []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+
+	opts := &client.SetOptions{PrevExist: client.PrevNoExist}
+	if prevValue != nil {
+		opts = &client.SetOptions{PrevExist: client.PrevExist, PrevValue: string(prevValue)}
+	}
+
+	_, err := d.KeysAPI.Set(ctx, key, string(value[:]), opts)
+	if cErr, ok := err.(client.Error); ok {
+		switch cErr.Code {
+		case client.ErrorCodeTestFailed, client.ErrorCodeNodeExist, client.ErrorCodeKeyNotFound:
+			return auth_errors.ErrKeyModified
+		}
+	}
+
+	return err
+}
+
+//
+// CompareAndDelete atomically removes a key from the etcd KV store only if
+// its current value is the expected one. Unlike Write, it is not retried.
+//
+// Parameters:
+//   key:       key to be removed
+//   prevValue: expected current value
+//
+// Return values:
+//   error: auth_errors.ErrKeyModified if the current value differs or the
+//          key doesn't exist
+//          Error when deleting via the KeysAPI of etcd client
+//          nil if successful
+//
+func (d *EtcdStateDriver) CompareAndDelete(key string, prevValue []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
+	defer cancel()
+
+	_, err := d.KeysAPI.Delete(ctx, key, &client.DeleteOptions{PrevValue: string(prevValue)})
+	if cErr, ok := err.(client.Error); ok {
+		switch cErr.Code {
+		case client.ErrorCodeTestFailed, client.ErrorCodeKeyNotFound:
+			return auth_errors.ErrKeyModified
+		}
+	}
+
+	return err
+}
+
 //
 // Read returns state for a key
 //
@@ -204,6 +268,24 @@ func (d *EtcdStateDriver) Read(key string) ([]byte, error) {
 //             nil if successful
 //
 func (d *EtcdStateDriver) ReadAll(baseKey string) ([][]byte, error) {
+	values, _, err := d.ReadAllWithIndex(baseKey)
+	return values, err
+}
+
+//
+// ReadAllWithIndex returns all values for a key along with the etcd index
+// they were read at
+//
+// Parameters:
+//   key:    key for which all values are to be retrieved
+//
+// Return values:
+//   [][]byte: slice of values associated with the given key
+//   uint64:   etcd index of the read; also set if the key is not found
+//   error:    Error when writing to the KeysAPI of etcd client
+//             nil if successful
+//
+func (d *EtcdStateDriver) ReadAllWithIndex(baseKey string) ([][]byte, uint64, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), ctxTimeout)
 	defer cancel()
 
@@ -221,9 +303,15 @@ func (d *EtcdStateDriver) ReadAll(baseKey string) ([][]byte, error) {
 				values = append(values, []byte(node.Value))
 			}
 
-			return values, nil
+			return values, resp.Index, nil
 		} else if client.IsKeyNotFound(err) {
-			return nil, auth_errors.ErrKeyNotFound
+			// the changes made since the key was found missing can be watched too
+			var index uint64
+			if etcdErr, ok := err.(client.Error); ok {
+				index = etcdErr.Index
+			}
+
+			return nil, index, auth_errors.ErrKeyNotFound
 		} else if err.Error() == client.ErrClusterUnavailable.Error() {
 			// retry after a delay
 			time.Sleep(time.Second)
@@ -232,24 +320,37 @@ func (d *EtcdStateDriver) ReadAll(baseKey string) ([][]byte, error) {
 
 	}
 
-	return [][]byte{}, err
+	return [][]byte{}, 0, err
 }
 
 //
 // channelEtcdEvents
 //
 // Parameters:
+//   ctx:            context whose cancellation stops the watch
 //   watcher:        Any struct that implements the Watcher interface provided
 //                   by the etcd client
-//   chValueChanges: Channel of type [2][]byte used to communicate the value changes
+//   chValueChanges: Channel of type valueChange used to communicate the value changes
 //                   for a key in the KV store
+//   chErr:          Channel used to communicate the error which stopped the watch;
+//                   if nil, errors are retried forever
 //
-func (d *EtcdStateDriver) channelEtcdEvents(watcher client.Watcher, chValueChanges chan [2][]byte) {
+func (d *EtcdStateDriver) channelEtcdEvents(ctx context.Context, watcher client.Watcher,
+	chValueChanges chan valueChange, chErr chan error) {
 	for {
 		// block on change notifications
-		etcdRsp, err := watcher.Next(context.Background())
+		etcdRsp, err := watcher.Next(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
 			log.Errorf("Error %v during watch", err)
+			if chErr != nil {
+				chErr <- err
+				return
+			}
+
 			time.Sleep(time.Second)
 			continue
 		}
@@ -278,7 +379,11 @@ func (d *EtcdStateDriver) channelEtcdEvents(watcher client.Watcher, chValueChang
 		log.Debugf("Observed event:%q for key: %s", eventStr, etcdRsp.Node.Key)
 
 		// send changes in values for the key to a channel
-		chValueChanges <- byteValues
+		select {
+		case chValueChanges <- valueChange{values: byteValues, index: etcdRsp.Node.ModifiedIndex}:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -303,7 +408,9 @@ func (d *EtcdStateDriver) WatchAll(baseKey string, chValueChanges chan [2][]byte
 		return errors.New("etcd watch failed")
 	}
 
-	go d.channelEtcdEvents(watcher, chValueChanges)
+	chChanges := make(chan valueChange, 1)
+	go forwardValues(chChanges, chValueChanges)
+	go d.channelEtcdEvents(context.Background(), watcher, chChanges, nil)
 
 	return nil
 }
@@ -387,17 +494,68 @@ func (d *EtcdStateDriver) ReadState(key string, value types.State,
 func readAllStateCommon(d types.StateDriver, baseKey string, sType types.State,
 	unmarshal func([]byte, interface{}) error) ([]types.State, error) {
 
-	stateType := reflect.TypeOf(sType)
-	sliceType := reflect.SliceOf(stateType)
-	values := reflect.MakeSlice(sliceType, 0, 1)
-
 	byteValues, err := d.ReadAll(baseKey)
 	if err != nil {
 		return nil, err
 	}
+
+	return decodeStates(d, byteValues, sType, unmarshal)
+}
+
+//
+// readAllStateWithIndexCommon is readAllStateCommon which also returns the
+// index of the KV store the states were read at
+//
+// Parameters:
+//   d:          StateDriver abstracting etcd or consul KV store
+//   baseKey:    key whose state is to be read from KV store
+//   sType:      State
+//   unmarshal:  Unmarshal function to convert key's value from a byte slice
+//               to a struct of type types.State
+//
+// Return value:
+//   []types.State: slice of states
+//   uint64:        index of the read, as returned by ReadAllWithIndex
+//   error:         Error returned when reading the key and unmarshaling it
+//                  nil if successful
+//
+func readAllStateWithIndexCommon(d types.StateDriver, baseKey string, sType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, uint64, error) {
+
+	byteValues, index, err := d.ReadAllWithIndex(baseKey)
+	if err != nil {
+		return nil, index, err
+	}
+
+	states, err := decodeStates(d, byteValues, sType, unmarshal)
+	return states, index, err
+}
+
+//
+// decodeStates unmarshals the given values into a slice of type types.State
+//
+// Parameters:
+//   d:          StateDriver the states are bound to
+//   byteValues: values read from the KV store
+//   sType:      State
+//   unmarshal:  Unmarshal function to convert key's value from a byte slice
+//               to a struct of type types.State
+//
+// Return value:
+//   []types.State: slice of states
+//   error:         Error returned when unmarshaling the values
+//                  nil if successful
+//
+func decodeStates(d types.StateDriver, byteValues [][]byte, sType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, error) {
+
+	stateType := reflect.TypeOf(sType)
+	sliceType := reflect.SliceOf(stateType)
+	values := reflect.MakeSlice(sliceType, 0, 1)
+
 	for _, byteValue := range byteValues {
 		value := reflect.New(stateType)
-		err = unmarshal(byteValue, value.Interface())
+		err := unmarshal(byteValue, value.Interface())
 		if err != nil {
 			return nil, err
 		}
@@ -439,6 +597,48 @@ func (d *EtcdStateDriver) ReadAllState(baseKey string, sType types.State,
 	return readAllStateCommon(d, baseKey, sType, unmarshal)
 }
 
+//
+// ReadAllStateWithIndex returns all state for a key along with the etcd index
+// it was read at
+//
+// Parameters:
+//   baseKey:    key whose values are to be read
+//   sType:      types.State struct into which values are to be
+//               unmarshaled
+//   unmarshal:  function that is used to convert key's values to
+//               values of type types.State
+//
+// Return values:
+//   []types.State: slice of states for the given key
+//   uint64:        etcd index of the read
+//   error:         Any error returned by readAllStateWithIndexCommon
+//                  nil if successful
+//
+func (d *EtcdStateDriver) ReadAllStateWithIndex(baseKey string, sType types.State,
+	unmarshal func([]byte, interface{}) error) ([]types.State, uint64, error) {
+	return readAllStateWithIndexCommon(d, baseKey, sType, unmarshal)
+}
+
+// valueChange is a change of the value of a key observed by a watch.
+type valueChange struct {
+	values [2][]byte // current and previous value; nil if the key was created or deleted
+	index  uint64    // index of the KV store the change was made at
+}
+
+//
+// forwardValues forwards the values of the changes to a channel of [2][]byte,
+// the type of the channels of WatchAll, forever.
+//
+// Parameters:
+//    chChanges:      channel of the changes observed
+//    chValueChanges: channel of the values of the changes
+//
+func forwardValues(chChanges chan valueChange, chValueChanges chan [2][]byte) {
+	for change := range chChanges {
+		chValueChanges <- change.values
+	}
+}
+
 //
 // channelStateEvents watches for updates (create, modify, delete) to a state of
 // specified type and unmarshals (given a function) all changes and puts them on
@@ -449,24 +649,32 @@ func (d *EtcdStateDriver) ReadAllState(baseKey string, sType types.State,
 //    sType:          types.State
 //    unmarshal:      function used to unmarshall byte slice values into
 //                    type types.State
-//    chValueChanges: channel of [2][]byte via which this method
+//    chValueChanges: channel of valueChange via which this method
 //                    returns any value changes that were observed in the KV store
 //    chStateChanges: channel of type types.WatchState via which this method
 //                    returns any state changes that were observed in the KV store
 //    chErr:          channel of type error via which this method returns
 //                    any errors encountered
+//    chStop:         channel whose closing stops this method; nil to never stop
 //
 func channelStateEvents(d types.StateDriver, sType types.State,
 	unmarshal func([]byte, interface{}) error,
-	chValueChanges chan [2][]byte,
+	chValueChanges chan valueChange,
 	chStateChanges chan types.WatchState,
-	chErr chan error) {
+	chErr chan error,
+	chStop <-chan struct{}) {
 
 	for {
 		// block on change notifications
-		byteRsp := <-chValueChanges
+		var change valueChange
+		select {
+		case change = <-chValueChanges:
+		case <-chStop:
+			return
+		}
 
-		stateChange := types.WatchState{Curr: nil, Prev: nil}
+		byteRsp := change.values
+		stateChange := types.WatchState{Curr: nil, Prev: nil, Index: change.index}
 		for i := 0; i < 2; i++ {
 			if byteRsp[i] == nil {
 				continue
@@ -494,7 +702,11 @@ func channelStateEvents(d types.StateDriver, sType types.State,
 		}
 
 		// send state changes for the key to a channel
-		chStateChanges <- stateChange
+		select {
+		case chStateChanges <- stateChange:
+		case <-chStop:
+			return
+		}
 	}
 }
 
@@ -514,24 +726,73 @@ func (d *EtcdStateDriver) WatchAllState(baseKey string, sType types.State,
 	unmarshal func([]byte, interface{}) error, chStateChanges chan types.WatchState) error {
 
 	// channel that will be used to communicate value changes
-	// from the WatchAll function
-	chValueChanges := make(chan [2][]byte, 1)
+	// from the etcd watcher
+	chValueChanges := make(chan valueChange, 1)
 
 	// channel that will be used to communicate errors
 	// from the channelStateEvents method
 	chErr := make(chan error, 1)
 
-	go channelStateEvents(d, sType, unmarshal, chValueChanges, chStateChanges, chErr)
+	go channelStateEvents(d, sType, unmarshal, chValueChanges, chStateChanges, chErr, nil)
 
-	err := d.WatchAll(baseKey, chValueChanges)
-	if err != nil {
-		return err
+	watcher := d.KeysAPI.Watcher(baseKey, &client.WatcherOptions{Recursive: true})
+	if watcher == nil {
+		log.Errorf("etcd watch failed")
+		return errors.New("etcd watch failed")
 	}
 
-	err = <-chErr
+	go d.channelEtcdEvents(context.Background(), watcher, chValueChanges, nil)
+
+	err := <-chErr
 	return err
 }
 
+//
+// WatchAllStateUntil watches all state from the baseKey until chStop is closed
+//
+// Parameters:
+//    baseKey:        key to be watched
+//    afterIndex:     etcd index the changes are watched after, e.g. as returned
+//                    by ReadAllStateWithIndex; 0 to watch the changes from now on
+//    sType:          types.State struct to convert values to
+//    unmarshal:      function used to convert values to types.State
+//    chStateChanges: channel of types.WatchState
+//    chStop:         channel whose closing stops the watch
+//
+// Return values:
+//    error: Any error when watching all state, including the errors of
+//           the etcd watcher; nil once the watch is stopped
+//
+func (d *EtcdStateDriver) WatchAllStateUntil(baseKey string, afterIndex uint64, sType types.State,
+	unmarshal func([]byte, interface{}) error, chStateChanges chan types.WatchState, chStop chan struct{}) error {
+
+	// stops both the etcd watcher and channelStateEvents on return
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the watch fails if etcd no longer holds the changes made after afterIndex
+	watcher := d.KeysAPI.Watcher(baseKey, &client.WatcherOptions{AfterIndex: afterIndex, Recursive: true})
+	if watcher == nil {
+		log.Errorf("etcd watch failed")
+		return errors.New("etcd watch failed")
+	}
+
+	chValueChanges := make(chan valueChange, 1)
+
+	// errors of both the etcd watcher and channelStateEvents
+	chErr := make(chan error, 2)
+
+	go channelStateEvents(d, sType, unmarshal, chValueChanges, chStateChanges, chErr, ctx.Done())
+	go d.channelEtcdEvents(ctx, watcher, chValueChanges, chErr)
+
+	select {
+	case err := <-chErr:
+		return err
+	case <-chStop:
+		return nil
+	}
+}
+
 //
 // WriteState writes a value of types.State for a key in the KV store
 //
@@ -114,6 +114,66 @@ func commonTestStateDriverRead(t *testing.T, d types.StateDriver) {
 
 }
 
+// Test helper function to check compare-and-swap in KV store
+func commonTestStateDriverCompareAndSwap(t *testing.T, d types.StateDriver) {
+	key := "TestKeyRawCompareAndSwap"
+	d.Clear(key)
+
+	if err := d.CompareAndSwap(key, nil, []byte("v1")); err != nil {
+		t.Fatalf("failed to create key, err: %s", err)
+	}
+
+	// the key exists already
+	if err := d.CompareAndSwap(key, nil, []byte("v2")); err != auth_errors.ErrKeyModified {
+		t.Fatalf("expected `ErrKeyModified`, found: %v", err)
+	}
+
+	if err := d.CompareAndSwap(key, []byte("v1"), []byte("v2")); err != nil {
+		t.Fatalf("failed to swap value, err: %s", err)
+	}
+
+	// the value has been swapped already
+	if err := d.CompareAndSwap(key, []byte("v1"), []byte("v3")); err != auth_errors.ErrKeyModified {
+		t.Fatalf("expected `ErrKeyModified`, found: %v", err)
+	}
+
+	readBytes, err := d.Read(key)
+	if err != nil {
+		t.Fatalf("failed to read from KV store, err: %s", err)
+	}
+
+	if string(readBytes) != "v2" {
+		t.Fatalf("expected value v2, found: %s", readBytes)
+	}
+}
+
+// Test helper function to check compare-and-delete in KV store
+func commonTestStateDriverCompareAndDelete(t *testing.T, d types.StateDriver) {
+	key := "TestKeyRawCompareAndDelete"
+	d.Clear(key)
+
+	// the key doesn't exist
+	if err := d.CompareAndDelete(key, []byte("v1")); err != auth_errors.ErrKeyModified {
+		t.Fatalf("expected `ErrKeyModified`, found: %v", err)
+	}
+
+	if err := d.Write(key, []byte("v1")); err != nil {
+		t.Fatalf("failed to write bytes, err: %s", err)
+	}
+
+	if err := d.CompareAndDelete(key, []byte("v2")); err != auth_errors.ErrKeyModified {
+		t.Fatalf("expected `ErrKeyModified`, found: %v", err)
+	}
+
+	if err := d.CompareAndDelete(key, []byte("v1")); err != nil {
+		t.Fatalf("failed to delete key, err: %s", err)
+	}
+
+	if _, err := d.Read(key); err != auth_errors.ErrKeyNotFound {
+		t.Fatalf("expected `ErrKeyNotFound`, found: %v", err)
+	}
+}
+
 // Test helper function to check writes to KV store
 func commonTestStateDriverWriteState(t *testing.T, d types.StateDriver) {
 	state := &testState{
@@ -415,6 +475,55 @@ for_label:
 	}
 }
 
+// Test helper function to check that the changes made after a read are
+// watched even if they're made before the watch is started
+func commonTestStateDriverWatchAllStateAfterIndex(t *testing.T, d types.StateDriver) {
+	state := &testState{IntField: 1234, StrField: "testString"}
+	baseKey := "after_index"
+	key := baseKey + "/testKeyRead"
+	laterKey := baseKey + "/testKeyWatchAll"
+
+	err := d.WriteState(key, state, json.Marshal)
+	if err != nil {
+		t.Fatalf("failed to write state, err: %s", err)
+	}
+	defer func() {
+		d.ClearState(key)
+		d.ClearState(laterKey)
+	}()
+
+	states, index, err := d.ReadAllStateWithIndex(baseKey, state, json.Unmarshal)
+	if err != nil || len(states) != 1 {
+		t.Fatalf("failed to read all state, err: %v, states: %v", err, states)
+	}
+
+	// written before the watch is started
+	err = d.WriteState(laterKey, state, json.Marshal)
+	if err != nil {
+		t.Fatalf("failed to write state, err: %s", err)
+	}
+
+	recvErr := make(chan error, 1)
+	stateCh := make(chan types.WatchState, 1)
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		recvErr <- d.WatchAllStateUntil(baseKey, index, state, json.Unmarshal, stateCh, stop)
+	}()
+
+	select {
+	case watchState := <-stateCh:
+		if watchState.Curr == nil || watchState.Index <= index {
+			t.Fatalf("Unexpected watch state %+v after index %d", watchState, index)
+		}
+	case err := <-recvErr:
+		t.Fatalf("watch failed, err: %v", err)
+	case <-time.After(waitTimeout):
+		t.Fatalf("timed out waiting for events")
+	}
+}
+
 // Test to check state driver initialization
 func TestEtcdStateDriverInit(t *testing.T) {
 	setupEtcdDriver(t)
@@ -444,6 +553,18 @@ func TestEtcdStateDriverRead(t *testing.T) {
 	commonTestStateDriverRead(t, driver)
 }
 
+// Test to check compare-and-swap in KV store
+func TestEtcdStateDriverCompareAndSwap(t *testing.T) {
+	driver := setupEtcdDriver(t)
+	commonTestStateDriverCompareAndSwap(t, driver)
+}
+
+// Test to check compare-and-delete in KV store
+func TestEtcdStateDriverCompareAndDelete(t *testing.T) {
+	driver := setupEtcdDriver(t)
+	commonTestStateDriverCompareAndDelete(t, driver)
+}
+
 // Test helper function to check read all keys from a dir in the KV store
 func commonTestStateDriverReadAll(t *testing.T, d types.StateDriver) {
 	testBytes := []byte{0xb, 0xa, 0xd, 0xb, 0xa, 0xb, 0xe}
@@ -571,3 +692,9 @@ func TestEtcdStateDriverWatchAllStateDelete(t *testing.T) {
 	driver := setupEtcdDriver(t)
 	commonTestStateDriverWatchAllStateDelete(t, driver)
 }
+
+// Test to watch the state changed since a read in KV store
+func TestEtcdStateDriverWatchAllStateAfterIndex(t *testing.T) {
+	driver := setupEtcdDriver(t)
+	commonTestStateDriverWatchAllStateAfterIndex(t, driver)
+}
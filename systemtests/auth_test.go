@@ -2,6 +2,10 @@ package systemtests
 
 import (
 	"encoding/json"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
 
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/db"
@@ -106,6 +110,235 @@ func (s *systemtestSuite) TestBuiltInAdminAuthorizationImmortality(c *C) {
 	c.Assert(resp.StatusCode, Equals, 400)
 }
 
+// TestAuthorizationPrincipalValidation checks that LDAP groups are looked up in the
+// directory only when the validation is requested.
+func (s *systemtestSuite) TestAuthorizationPrincipalValidation(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/authorizations"
+
+		// there is no LDAP configuration to look up the group in
+		data := `{"PrincipalName":"CN=Devs,DC=example,DC=com","local":false,"role":"` + types.Ops.String() +
+			`","tenantName":"XXX","validatePrincipal":true}`
+		resp, _ := proxyPost(c, adToken, endpoint, []byte(data))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		data = `{"PrincipalName":"CN=Devs,DC=example,DC=com","local":false,"role":"` + types.Ops.String() +
+			`","tenantName":"XXX"}`
+		authz := s.addAuthorization(c, data, adToken)
+		s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+
+		// validation is ignored for local principals
+		data = `{"PrincipalName":"` + username + `","local":true,"role":"` + types.Ops.String() +
+			`","tenantName":"XXX","validatePrincipal":true}`
+		authz = s.addAuthorization(c, data, adToken)
+		s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+	})
+}
+
+// TestUpdateAuthorization checks that the role and tenant of an authorization can be changed in place.
+func (s *systemtestSuite) TestUpdateAuthorization(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		data := `{"PrincipalName":"` + username + `","local":true,"role":"` + types.Ops.String() + `","tenantName":"XXX"}`
+		authz := s.addAuthorization(c, data, adToken)
+		endpoint := proxy.V1Prefix + "/authorizations/" + authz.AuthzUUID
+
+		resp, body := proxyPatch(c, adToken, endpoint, []byte(`{"tenantName":"YYY"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		updated := proxy.GetAuthorizationReply{}
+		c.Assert(json.Unmarshal(body, &updated), IsNil)
+		c.Assert(updated.AuthzUUID, Equals, authz.AuthzUUID)
+		c.Assert(updated.TenantName, Equals, "YYY")
+		c.Assert(updated.Role, Equals, types.Ops.String())
+		c.Assert(s.getAuthorization(c, authz.AuthzUUID, adToken), DeepEquals, updated)
+
+		// admins are granted all the tenants by their role authorization
+		resp, _ = proxyPatch(c, adToken, endpoint, []byte(`{"role":"`+types.Admin.String()+`"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPatch(c, adToken, endpoint, []byte(`{"role":"XXX"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPatch(c, adToken, proxy.V1Prefix+"/authorizations/XXX", []byte(`{"tenantName":"YYY"}`))
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		// the authorization of the built-in admin can't be changed
+		auths, err := db.ListAuthorizationsByPrincipal(types.Admin.String())
+		c.Assert(err, IsNil)
+		resp, _ = proxyPatch(c, adToken, proxy.V1Prefix+"/authorizations/"+auths[0].UUID, []byte(`{"role":"`+types.Ops.String()+`"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+	})
+}
+
+// TestBulkAuthorizations checks that bulk operations are validated all or nothing and applied as a batch.
+func (s *systemtestSuite) TestBulkAuthorizations(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/authorizations/bulk"
+
+		bulk := func(data string, expectedStatus int) proxy.BulkAuthorizationReply {
+			resp, body := proxyPost(c, adToken, endpoint, []byte(data))
+			c.Assert(resp.StatusCode, Equals, expectedStatus)
+
+			reply := proxy.BulkAuthorizationReply{}
+			c.Assert(json.Unmarshal(body, &reply), IsNil)
+			return reply
+		}
+
+		data := `{"PrincipalName":"` + username + `","local":true,"role":"` + types.Ops.String() + `","tenantName":"XXX"}`
+		authz := s.addAuthorization(c, data, adToken)
+
+		reply := bulk(`{"operations":[`+
+			`{"op":"add","principalName":"`+username+`","local":true,"role":"`+types.Ops.String()+`","tenantName":"YYY"},`+
+			`{"op":"update","authzUUID":"`+authz.AuthzUUID+`","tenantName":"ZZZ"}]}`, 200)
+		c.Assert(len(reply.Results), Equals, 2)
+		c.Assert(reply.Results[0].Status, Equals, proxy.BulkOpApplied)
+		c.Assert(reply.Results[0].Authorization.TenantName, Equals, "YYY")
+		c.Assert(reply.Results[1].Status, Equals, proxy.BulkOpApplied)
+		c.Assert(s.getAuthorization(c, authz.AuthzUUID, adToken).TenantName, Equals, "ZZZ")
+		added := reply.Results[0].Authorization.AuthzUUID
+
+		// nothing is applied if an operation is invalid
+		reply = bulk(`{"operations":[`+
+			`{"op":"delete","authzUUID":"`+added+`"},`+
+			`{"op":"delete","authzUUID":"`+added+`"}]}`, 404)
+		c.Assert(reply.Results[0].Status, Equals, proxy.BulkOpNotApplied)
+		c.Assert(reply.Results[1].Status, Equals, proxy.BulkOpFailed)
+		s.getAuthorization(c, added, adToken)
+
+		reply = bulk(`{"operations":[`+
+			`{"op":"delete","authzUUID":"`+added+`"},`+
+			`{"op":"add","principalName":"`+username+`","local":true,"role":"XXX"}]}`, 400)
+		c.Assert(reply.Results[1].Status, Equals, proxy.BulkOpFailed)
+		c.Assert(reply.Results[1].Error, Equals, "illegal role specified")
+		s.getAuthorization(c, added, adToken)
+
+		reply = bulk(`{"operations":[`+
+			`{"op":"delete","authzUUID":"`+added+`"},`+
+			`{"op":"delete","authzUUID":"`+authz.AuthzUUID+`"}]}`, 200)
+		c.Assert(reply.Results[1].Authorization.TenantName, Equals, "ZZZ")
+
+		resp, _ := proxyGet(c, adToken, proxy.V1Prefix+"/authorizations/"+added)
+		c.Assert(resp.StatusCode, Equals, 404)
+	})
+}
+
+// TestListAuthorizationsFilters checks the filters and pagination of the authorization listing.
+func (s *systemtestSuite) TestListAuthorizationsFilters(c *C) {
+	runTest(func(ms *MockServer) {
+		adToken = adminToken(c)
+		endpoint := proxy.V1Prefix + "/authorizations"
+		principal := "CN=Listing,DC=example,DC=com"
+
+		list := func(query string) []proxy.GetAuthorizationReply {
+			resp, body := proxyGet(c, adToken, endpoint+"?principal="+url.QueryEscape(principal)+query)
+			c.Assert(resp.StatusCode, Equals, 200)
+
+			authzList := []proxy.GetAuthorizationReply{}
+			c.Assert(json.Unmarshal(body, &authzList), IsNil)
+			return authzList
+		}
+
+		added := []proxy.GetAuthorizationReply{}
+		for _, tenant := range []string{"T1", "T2", "T3"} {
+			data := `{"PrincipalName":"` + principal + `","local":false,"role":"` + types.Ops.String() + `","tenantName":"` + tenant + `"}`
+			added = append(added, s.addAuthorization(c, data, adToken))
+		}
+
+		authzList := list("&tenant=T2")
+		c.Assert(len(authzList), Equals, 1)
+		c.Assert(authzList[0], DeepEquals, added[1])
+
+		// the tenant authorizations and the role authorization of the group
+		c.Assert(len(list("&local=false&role="+types.Ops.String())), Equals, 4)
+		c.Assert(len(list("&local=true")), Equals, 0)
+
+		resp, _ := proxyGet(c, adToken, endpoint+"?role=XXX")
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// pages of 2 authorizations sorted by UUID
+		uuids := []string{}
+		next := ""
+		for {
+			resp, body := proxyGet(c, adToken, endpoint+"?principal="+url.QueryEscape(principal)+"&limit=2&next="+next)
+			c.Assert(resp.StatusCode, Equals, 200)
+
+			page := proxy.ListAuthorizationsReply{}
+			c.Assert(json.Unmarshal(body, &page), IsNil)
+			c.Assert(len(page.AuthList) <= 2, Equals, true)
+			for _, authz := range page.AuthList {
+				uuids = append(uuids, authz.AuthzUUID)
+			}
+
+			if next = page.Next; next == "" {
+				break
+			}
+		}
+
+		c.Assert(len(uuids), Equals, 4)
+		c.Assert(sort.StringsAreSorted(uuids), Equals, true)
+
+		for _, authzUUID := range uuids {
+			s.deleteAuthorization(c, authzUUID, adToken)
+		}
+	})
+}
+
+// TestTimeBoundAuthorizations checks that authorizations are only in effect within their validity period.
+func (s *systemtestSuite) TestTimeBoundAuthorizations(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		testuserToken := loginAs(c, username, username)
+		endpoint := proxy.V1Prefix + "/local_users/" + username
+		update := []byte(`{"first_name":"Temp", "last_name": "User"}`)
+		grant := func(window string) string {
+			return `{"PrincipalName":"` + username + `","local":true,"role":"admin",` + window + `}`
+		}
+
+		now := time.Now().Unix()
+
+		// the validity period must end in the future, after it starts
+		resp, _ := proxyPost(c, adToken, proxy.V1Prefix+"/authorizations", []byte(grant(`"expires_at":`+strconv.FormatInt(now-10, 10))))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, adToken, proxy.V1Prefix+"/authorizations", []byte(grant(`"not_before":`+strconv.FormatInt(now+20, 10)+`,"expires_at":`+strconv.FormatInt(now+10, 10))))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// not in effect yet
+		authz := s.addAuthorization(c, grant(`"not_before":`+strconv.FormatInt(now+3600, 10)+`,"expires_at":`+strconv.FormatInt(now+7200, 10)), adToken)
+		c.Assert(authz.NotBefore, Equals, now+3600)
+		c.Assert(authz.ExpiresAt, Equals, now+7200)
+		c.Assert(authz.RemainingSeconds > 3600, Equals, true)
+		c.Assert(s.getAuthorization(c, authz.AuthzUUID, adToken).ExpiresAt, Equals, now+7200)
+
+		resp, _ = proxyPatch(c, testuserToken, endpoint, update)
+		c.Assert(resp.StatusCode, Equals, 403)
+		s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+
+		// in effect until it expires
+		authz = s.addAuthorization(c, grant(`"expires_at":`+strconv.FormatInt(now+3, 10)), adToken)
+		c.Assert(authz.RemainingSeconds > 0, Equals, true)
+
+		resp, _ = proxyPatch(c, testuserToken, endpoint, update)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		time.Sleep(4 * time.Second)
+		resp, _ = proxyPatch(c, testuserToken, endpoint, update)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// left to the reaper otherwise
+		s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+	})
+}
+
 // addAuthorization helper function for the tests
 func (s *systemtestSuite) addAuthorization(c *C, data, token string) proxy.GetAuthorizationReply {
 	endpoint := proxy.V1Prefix + "/authorizations"
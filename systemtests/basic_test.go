@@ -6,6 +6,7 @@ import (
 	"net/http"
 
 	"github.com/contiv/auth_proxy/common"
+	"github.com/contiv/auth_proxy/db"
 	"github.com/contiv/auth_proxy/proxy"
 
 	. "gopkg.in/check.v1"
@@ -118,6 +119,10 @@ func (s *systemtestSuite) TestHealthCheck(c *C) {
 		c.Assert(hcr.Status, Equals, proxy.StatusUnhealthy)
 		c.Assert(hcr.NetmasterHealth.Status, Equals, proxy.StatusUnhealthy)
 
+		// authorization lookups are served from memory
+		c.Assert(hcr.AuthorizationCache.State, Equals, db.AuthzCacheSynced)
+		c.Assert(hcr.AuthorizationCache.WatchAlive, Equals, true)
+
 		//
 		// second check: we add a /version to mockserver and should get back
 		//               a healthy response.
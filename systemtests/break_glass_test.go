@@ -0,0 +1,117 @@
+package systemtests
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+
+	"github.com/contiv/auth_proxy/auth"
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+	. "gopkg.in/check.v1"
+)
+
+// TestBreakGlass tests the single use of the break-glass access and its re-arming by an admin
+func (s *systemtestSuite) TestBreakGlass(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.V1Prefix + "/break_glass"
+		publicKey, privateKey := breakGlassKeys(c)
+
+		// only admins can arm the access, with a valid key
+		resp, _ := proxyPost(c, opsToken(c), endpoint+"/arm", []byte(`{"public_key":`+publicKey+`}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, _ = proxyPost(c, token, endpoint+"/arm", []byte(`{"public_key":"xxx"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		breakGlass := s.armBreakGlass(c, token, `{"public_key":`+publicKey+`}`)
+		c.Assert(breakGlass.Armed, Equals, true)
+		c.Assert(breakGlass.ArmedBy, Equals, types.Admin.String())
+
+		challenge := s.breakGlassChallenge(c)
+		c.Assert(challenge, DeepEquals, proxy.BreakGlassChallengeResponse{Armed: true, Challenge: breakGlass.Challenge})
+
+		// codes derived from another challenge or with another key are rejected
+		code, err := auth.BreakGlassCode(privateKey, "xxx")
+		c.Assert(err, IsNil)
+		resp, _ = proxyPost(c, "", endpoint+"/login", []byte(`{"code":"`+code+`"}`))
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		code, err = auth.BreakGlassCode(privateKey, challenge.Challenge)
+		c.Assert(err, IsNil)
+
+		resp, body := proxyPost(c, "", endpoint+"/login", []byte(`{"code":"`+code+`"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		login := proxy.LoginResponse{}
+		c.Assert(json.Unmarshal(body, &login), IsNil)
+
+		// the token grants admin access
+		resp, body = proxyGet(c, login.Token, proxy.WhoAmIPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+		whoami := proxy.WhoAmIResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Username, Equals, auth.BreakGlassUsername)
+		c.Assert(whoami.Role, Equals, types.Admin.String())
+
+		resp, _ = proxyGet(c, login.Token, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// but it can't re-arm the access
+		resp, _ = proxyPost(c, login.Token, endpoint+"/arm", []byte{})
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// the code can't be used twice
+		resp, _ = proxyPost(c, "", endpoint+"/login", []byte(`{"code":"`+code+`"}`))
+		c.Assert(resp.StatusCode, Equals, 401)
+		c.Assert(s.breakGlassChallenge(c), DeepEquals, proxy.BreakGlassChallengeResponse{})
+
+		// re-arming revokes the token granted before
+		rearmed := s.armBreakGlass(c, token, "")
+		c.Assert(rearmed.Challenge, Not(Equals), breakGlass.Challenge)
+		c.Assert(rearmed.Generation, Equals, breakGlass.Generation+1)
+
+		resp, _ = proxyGet(c, login.Token, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Not(Equals), 200)
+	})
+}
+
+// breakGlassKeys returns a new Ed25519 key pair: the JSON quoted public key and the private key,
+// both PEM encoded.
+func breakGlassKeys(c *C) (string, []byte) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, IsNil)
+
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	c.Assert(err, IsNil)
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	c.Assert(err, IsNil)
+
+	publicKey, err := json.Marshal(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER})))
+	c.Assert(err, IsNil)
+
+	return string(publicKey), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER})
+}
+
+// armBreakGlass helper function for the tests
+func (s *systemtestSuite) armBreakGlass(c *C, token, data string) types.BreakGlass {
+	resp, body := proxyPost(c, token, proxy.V1Prefix+"/break_glass/arm", []byte(data))
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	breakGlass := types.BreakGlass{}
+	c.Assert(json.Unmarshal(body, &breakGlass), IsNil)
+	return breakGlass
+}
+
+// breakGlassChallenge helper function for the tests
+func (s *systemtestSuite) breakGlassChallenge(c *C) proxy.BreakGlassChallengeResponse {
+	resp, body := proxyGet(c, "", proxy.V1Prefix+"/break_glass/challenge")
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	challenge := proxy.BreakGlassChallengeResponse{}
+	c.Assert(json.Unmarshal(body, &challenge), IsNil)
+	return challenge
+}
@@ -0,0 +1,173 @@
+package systemtests
+
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/proxy"
+	. "gopkg.in/check.v1"
+)
+
+// TestDenyAuthorizations tests that deny authorizations take precedence over the authorizations granting access
+func (s *systemtestSuite) TestDenyAuthorizations(c *C) {
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		endpoint := proxy.V1Prefix + "/authorizations"
+
+		// deny authorizations are limited to a tenant, and optionally to a netmaster resource
+		resp, _ := proxyPost(c, adToken, endpoint, []byte(`{"PrincipalName":"`+username+`","local":true,"deny":true}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, adToken, endpoint, []byte(`{"PrincipalName":"`+username+`","local":true,"deny":true,"tenantName":"t1","resource_type":"foo"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, adToken, endpoint, []byte(`{"PrincipalName":"`+username+`","local":true,"deny":true,"tenantName":"t1","resource_name":"n2"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, adToken, endpoint, []byte(`{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"t1","resource_type":"networks"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// rule IDs are only unique within a policy; rules are named by their key
+		resp, _ = proxyPost(c, adToken, endpoint, []byte(`{"PrincipalName":"`+username+`","local":true,"deny":true,"tenantName":"t1","resource_type":"rules","resource_name":"r1"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, adToken, endpoint, []byte(`{"PrincipalName":"`+username+`","local":true,"deny":true,"tenantName":"t1","resource_type":"rules","resource_name":"t2:p1:r1"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		allowT1 := s.addAuthorization(c, `{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"t1"}`, adToken)
+		allowT2 := s.addAuthorization(c, `{"PrincipalName":"`+username+`","local":true,"role":"ops","tenantName":"t2"}`, adToken)
+		denyN2 := s.addAuthorization(c, `{"PrincipalName":"`+username+`","local":true,"deny":true,"tenantName":"t1","resource_type":"networks","resource_name":"n2"}`, adToken)
+		denyT2 := s.addAuthorization(c, `{"PrincipalName":"`+username+`","local":true,"deny":true,"tenantName":"t2"}`, adToken)
+		c.Assert(denyN2.Deny, Equals, true)
+		c.Assert(denyN2.Role, Equals, "")
+		c.Assert(denyN2.ResourceType, Equals, "networks")
+		c.Assert(denyN2.ResourceName, Equals, "n2")
+
+		// deny authorizations carry no role
+		resp, _ = proxyPatch(c, adToken, endpoint+"/"+denyN2.AuthzUUID, []byte(`{"role":"ops"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		userToken := loginAs(c, username, username)
+
+		// the denied tenant and resource are filtered out of the lists
+		ms.AddHardcodedResponse("/api/v1/tenants/", []byte(`[{"tenantName":"t1"},{"tenantName":"t2"}]`))
+		resp, body := proxyGet(c, userToken, "/api/v1/tenants/")
+		c.Assert(resp.StatusCode, Equals, 200)
+		s.processListResponse(c, "tenants", string(body), []string{"t1"})
+
+		ms.AddHardcodedResponse("/api/v1/networks/", []byte(`[{"tenantName":"t1","networkName":"n1"},{"tenantName":"t1","networkName":"n2"}]`))
+		resp, body = proxyGet(c, userToken, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 200)
+		networks := []map[string]interface{}{}
+		c.Assert(json.Unmarshal(body, &networks), IsNil)
+		c.Assert(len(networks), Equals, 1)
+		c.Assert(networks[0]["networkName"], Equals, "n1")
+
+		// and can't be reached; the response tells which authorization denied access
+		ms.AddHardcodedResponse("/api/v1/networks/t1:n1/", []byte(`{"tenantName":"t1","networkName":"n1"}`))
+		ms.AddHardcodedResponse("/api/v1/networks/t1:n2/", []byte(`{"tenantName":"t1","networkName":"n2"}`))
+
+		resp, _ = proxyGet(c, userToken, "/api/v1/networks/t1:n1/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body = proxyGet(c, userToken, "/api/v1/networks/t1:n2/")
+		c.Assert(resp.StatusCode, Equals, 403)
+		c.Assert(string(body), Equals, `{"error":"Insufficient privileges; access denied by authorization `+denyN2.AuthzUUID+`"}`)
+
+		ms.AddHardcodedResponse("/api/v1/tenants/t2/", []byte(`{"foo":"bar"}`))
+		resp, _ = proxyGet(c, userToken, "/api/v1/tenants/t2/")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// the decision endpoint tells which rule denied access
+		decision := s.accessDecision(c, userToken, "tenant=t1&resource_type=networks&resource_name=n2")
+		c.Assert(decision.Allowed, Equals, false)
+		c.Assert(decision.Reason, Equals, proxy.AccessDecisionDenied)
+		c.Assert(decision.DeniedBy, NotNil)
+		c.Assert(decision.DeniedBy.AuthzUUID, Equals, denyN2.AuthzUUID)
+
+		decision = s.accessDecision(c, userToken, "tenant=t1&resource_type=networks&resource_name=n1")
+		c.Assert(decision.Allowed, Equals, true)
+		c.Assert(decision.Reason, Equals, proxy.AccessDecisionAuthorized)
+		c.Assert(decision.DeniedBy, IsNil)
+
+		decision = s.accessDecision(c, userToken, "tenant=t3")
+		c.Assert(decision.Allowed, Equals, false)
+		c.Assert(decision.Reason, Equals, proxy.AccessDecisionNotAuthorized)
+
+		// admins are not subject to deny authorizations
+		decision = s.accessDecision(c, adToken, "tenant=t2")
+		c.Assert(decision.Allowed, Equals, true)
+		c.Assert(decision.Reason, Equals, proxy.AccessDecisionAdmin)
+
+		resp, _ = proxyGet(c, userToken, proxy.AccessDecisionPath)
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// access is granted again once the deny authorization is deleted
+		s.deleteAuthorization(c, denyN2.AuthzUUID, adToken)
+		resp, _ = proxyGet(c, userToken, "/api/v1/networks/t1:n2/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		for _, authz := range []proxy.GetAuthorizationReply{allowT1, allowT2, denyT2} {
+			s.deleteAuthorization(c, authz.AuthzUUID, adToken)
+		}
+	})
+}
+
+// TestLdapUserDenyAuthorizations tests that a deny authorization given to an LDAP user takes precedence over the
+// authorizations of its groups
+func (s *systemtestSuite) TestLdapUserDenyAuthorizations(c *C) {
+	runTest(func(ms *MockServer) {
+		adToken = adminToken(c)
+		endpoint := proxy.V1Prefix + "/authorizations"
+		deniedDN := "CN=Jane Doe,CN=Users,DC=ccn,DC=example,DC=com"
+		memberDN := "CN=John Doe,CN=Users,DC=ccn,DC=example,DC=com"
+
+		// LDAP users are granted access through their groups
+		resp, _ := proxyPost(c, adToken, endpoint, []byte(`{"PrincipalName":"`+deniedDN+`","ldapUser":true,"role":"ops","tenantName":"t1"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, adToken, endpoint, []byte(`{"PrincipalName":"`+deniedDN+`","ldapUser":true,"local":true,"deny":true,"tenantName":"t1"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		allowGroup := s.addAuthorization(c, `{"PrincipalName":"ldap_devs","local":false,"role":"ops","tenantName":"t1"}`, adToken)
+		denyUser := s.addAuthorization(c, `{"PrincipalName":"`+deniedDN+`","ldapUser":true,"deny":true,"tenantName":"t1"}`, adToken)
+		c.Assert(denyUser.LdapUser, Equals, true)
+		c.Assert(denyUser.Local, Equals, false)
+
+		// the members of the group are impersonated as they log in: with the group and their DN
+		deniedToken := s.impersonate(c, adToken, `{"username":"jane","principals":["ldap_devs"],"dn":"`+deniedDN+`"}`)
+		memberToken := s.impersonate(c, adToken, `{"username":"john","principals":["ldap_devs"],"dn":"`+memberDN+`"}`)
+
+		ms.AddHardcodedResponse("/api/v1/tenants/t1/", []byte(`{"foo":"bar"}`))
+
+		resp, _ = proxyGet(c, memberToken, "/api/v1/tenants/t1/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body := proxyGet(c, deniedToken, "/api/v1/tenants/t1/")
+		c.Assert(resp.StatusCode, Equals, 403)
+		c.Assert(string(body), Equals, `{"error":"Insufficient privileges; access denied by authorization `+denyUser.AuthzUUID+`"}`)
+
+		decision := s.accessDecision(c, deniedToken, "tenant=t1")
+		c.Assert(decision.Allowed, Equals, false)
+		c.Assert(decision.Reason, Equals, proxy.AccessDecisionDenied)
+		c.Assert(decision.DeniedBy.AuthzUUID, Equals, denyUser.AuthzUUID)
+
+		// access is granted again through the group once the deny authorization is deleted
+		s.deleteAuthorization(c, denyUser.AuthzUUID, adToken)
+		resp, _ = proxyGet(c, deniedToken, "/api/v1/tenants/t1/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		s.deleteAuthorization(c, allowGroup.AuthzUUID, adToken)
+	})
+}
+
+// accessDecision checks the access of the given token and returns the decision or asserts.
+func (s *systemtestSuite) accessDecision(c *C, token, query string) proxy.AccessDecisionReply {
+	resp, body := proxyGet(c, token, proxy.AccessDecisionPath+"?"+query)
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	decision := proxy.AccessDecisionReply{}
+	c.Assert(json.Unmarshal(body, &decision), IsNil)
+
+	return decision
+}
@@ -0,0 +1,101 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/contiv/auth_proxy/proxy"
+	. "gopkg.in/check.v1"
+)
+
+// TestDownscopeToken tests that a down-scoped token is limited to the tenants, methods and lifetime of its scope
+func (s *systemtestSuite) TestDownscopeToken(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		// at least one restriction, on supported methods
+		resp, _ := proxyPost(c, token, proxy.DownscopeTokenPath, []byte(`{}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, token, proxy.DownscopeTokenPath, []byte(`{"methods":["FOO"]}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, token, proxy.DownscopeTokenPath, []byte(`{"lifetime_seconds":-1}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		scopedToken := s.downscopeToken(c, token, `{"tenants":["t1"],"methods":["get"],"lifetime_seconds":60}`)
+
+		resp, body := proxyGet(c, scopedToken, proxy.WhoAmIPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+		whoami := proxy.WhoAmIResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Username, Equals, adminUsername)
+		c.Assert(whoami.ScopedTenants, DeepEquals, []string{"t1"})
+		c.Assert(whoami.ScopedMethods, DeepEquals, []string{"GET"})
+		c.Assert(whoami.ExpiresAt <= time.Now().Add(time.Minute).Unix(), Equals, true)
+
+		// only the tenants of the scope are listed and reached, even by an admin
+		endpoint := "/api/v1/tenants/"
+		ms.AddHardcodedResponse(endpoint, []byte(`[{"tenantName":"t1"},{"tenantName":"t2"},{"tenantName":"t3"}]`))
+
+		resp, body = proxyGet(c, scopedToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+		s.processListResponse(c, "tenants", string(body), []string{"t1"})
+
+		ms.AddHardcodedResponse(endpoint+"t1/", []byte(`{"foo":"bar"}`))
+		ms.AddHardcodedResponse(endpoint+"t2/", []byte(`{"foo":"bar"}`))
+
+		resp, _ = proxyGet(c, scopedToken, endpoint+"t1/")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body = proxyGet(c, scopedToken, endpoint+"t2/")
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		// nor the global resources and the admin endpoints
+		ms.AddHardcodedResponse("/api/v1/globals/", []byte(`{"foo":"bar"}`))
+		resp, body = proxyGet(c, scopedToken, "/api/v1/globals/")
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		resp, _ = proxyGet(c, scopedToken, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// only the methods of the scope are allowed
+		resp, _ = proxyDelete(c, scopedToken, endpoint+"t1/")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		readOnlyToken := s.downscopeToken(c, token, `{"methods":["GET"]}`)
+
+		resp, _ = proxyGet(c, readOnlyToken, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, _ = proxyPost(c, readOnlyToken, proxy.V1Prefix+"/local_users", []byte(`{"username":"scoped","password":"scoped"}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// a down-scoped token can be narrowed further but never widened
+		resp, _ = proxyPost(c, scopedToken, proxy.DownscopeTokenPath, []byte(`{"tenants":["t2"]}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPost(c, readOnlyToken, proxy.DownscopeTokenPath, []byte(`{"methods":["GET","DELETE"]}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		narrowedToken := s.downscopeToken(c, readOnlyToken, `{"tenants":["t1"]}`)
+		resp, body = proxyGet(c, narrowedToken, proxy.WhoAmIPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+		whoami = proxy.WhoAmIResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.ScopedTenants, DeepEquals, []string{"t1"})
+		c.Assert(whoami.ScopedMethods, DeepEquals, []string{"GET"})
+	})
+}
+
+// downscopeToken down-scopes the given token and returns the down-scoped token or asserts.
+func (s *systemtestSuite) downscopeToken(c *C, token, data string) string {
+	resp, body := proxyPost(c, token, proxy.DownscopeTokenPath, []byte(data))
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	login := proxy.LoginResponse{}
+	c.Assert(json.Unmarshal(body, &login), IsNil)
+	c.Assert(len(login.Token), Not(Equals), 0)
+
+	return login.Token
+}
@@ -0,0 +1,121 @@
+package systemtests
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+	. "gopkg.in/check.v1"
+)
+
+// TestElevationRequests tests the request/approve flow of the just-in-time elevation
+func (s *systemtestSuite) TestElevationRequests(c *C) {
+	username := "test_elevation"
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		userToken := loginAs(c, username, username)
+		endpoint := proxy.V1Prefix + "/elevation_requests"
+		adminAPI := proxy.V1Prefix + "/local_users/" + username
+		update := []byte(`{"first_name":"Temp", "last_name": "User"}`)
+
+		// a reason and a duration within the limit are required
+		for _, data := range []string{
+			`{"role":"admin","duration_seconds":3600}`,
+			`{"role":"admin","duration_seconds":0,"reason":"incident"}`,
+			`{"role":"admin","duration_seconds":1000000,"reason":"incident"}`,
+			`{"role":"ops","duration_seconds":3600,"reason":"incident"}`,
+			`{"role":"xxx","duration_seconds":3600,"reason":"incident"}`,
+		} {
+			resp, _ := proxyPost(c, userToken, endpoint, []byte(data))
+			c.Assert(resp.StatusCode, Equals, 400)
+		}
+
+		approved := s.requestElevation(c, userToken, `{"role":"admin","duration_seconds":3600,"reason":"incident"}`)
+		c.Assert(approved.Requester, Equals, username)
+		c.Assert(approved.Status, Equals, types.ElevationPending)
+
+		denied := s.requestElevation(c, userToken, `{"role":"admin","duration_seconds":60,"reason":"curious"}`)
+
+		// nothing is granted until approved
+		resp, _ := proxyPatch(c, userToken, adminAPI, update)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// the requester can't decide its own requests
+		resp, _ = proxyPost(c, userToken, endpoint+"/"+approved.ID+"/approve", nil)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, body := proxyPost(c, token, endpoint+"/"+approved.ID+"/approve", []byte(`{"comment":"go ahead"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(json.Unmarshal(body, &approved), IsNil)
+		c.Assert(approved.Status, Equals, types.ElevationApproved)
+		c.Assert(approved.Decider, Equals, types.Admin.String())
+		c.Assert(approved.Comment, Equals, "go ahead")
+		c.Assert(approved.ExpiresAt > approved.DecidedAt, Equals, true)
+
+		authz := s.getAuthorization(c, approved.AuthzUUID, token)
+		c.Assert(authz.ExpiresAt, Equals, approved.ExpiresAt)
+
+		resp, _ = proxyPatch(c, userToken, adminAPI, update)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// decisions are final
+		resp, _ = proxyPost(c, token, endpoint+"/"+approved.ID+"/deny", nil)
+		c.Assert(resp.StatusCode, Equals, 409)
+
+		// another admin is needed, even for admins
+		resp, _ = proxyPost(c, userToken, endpoint+"/"+denied.ID+"/deny", nil)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, body = proxyPost(c, token, endpoint+"/"+denied.ID+"/deny", nil)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(json.Unmarshal(body, &denied), IsNil)
+		c.Assert(denied.Status, Equals, types.ElevationDenied)
+		c.Assert(denied.AuthzUUID, Equals, "")
+
+		resp, _ = proxyPost(c, token, endpoint+"/xxx/approve", nil)
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		// the requests are visible to admins and to their requester
+		requests := []types.ElevationRequest{}
+		resp, body = proxyGet(c, token, endpoint+"?requester="+username)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(json.Unmarshal(body, &requests), IsNil)
+		c.Assert(elevationRequestIDs(requests), DeepEquals, []string{approved.ID, denied.ID})
+
+		resp, body = proxyGet(c, userToken, endpoint+"?status="+types.ElevationDenied)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(json.Unmarshal(body, &requests), IsNil)
+		c.Assert(elevationRequestIDs(requests), DeepEquals, []string{denied.ID})
+
+		resp, _ = proxyGet(c, opsToken(c), endpoint+"/"+denied.ID)
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		s.deleteAuthorization(c, approved.AuthzUUID, token)
+	})
+}
+
+// requestElevation helper function for the tests
+func (s *systemtestSuite) requestElevation(c *C, token, data string) types.ElevationRequest {
+	resp, body := proxyPost(c, token, proxy.V1Prefix+"/elevation_requests", []byte(data))
+	c.Assert(resp.StatusCode, Equals, 201)
+
+	request := types.ElevationRequest{}
+	c.Assert(json.Unmarshal(body, &request), IsNil)
+	return request
+}
+
+// elevationRequestIDs returns the IDs of the requests made since the test started; the requests
+// of the previous runs are kept by the data store.
+func elevationRequestIDs(requests []types.ElevationRequest) []string {
+	ids := []string{}
+	for _, request := range requests {
+		if time.Since(time.Unix(request.CreatedAt, 0)) < time.Minute {
+			ids = append(ids, request.ID)
+		}
+	}
+
+	return ids
+}
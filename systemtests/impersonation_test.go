@@ -0,0 +1,79 @@
+package systemtests
+
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+	. "gopkg.in/check.v1"
+)
+
+// TestImpersonation tests that an admin impersonating a user gets the privileges of the user only
+func (s *systemtestSuite) TestImpersonation(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		// only admins can impersonate, existing users or given LDAP principals
+		resp, _ := proxyPost(c, opsToken(c), proxy.ImpersonatePath, []byte(`{"username":"`+adminUsername+`","local":true}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, _ = proxyPost(c, token, proxy.ImpersonatePath, []byte(`{"username":"nobody","local":true}`))
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		resp, _ = proxyPost(c, token, proxy.ImpersonatePath, []byte(`{"username":"jdoe","local":false}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		impersonationToken := s.impersonate(c, token, `{"username":"`+opsUsername+`","local":true}`)
+
+		// the session is the user's, acted by the admin
+		resp, body := proxyGet(c, impersonationToken, proxy.WhoAmIPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+		whoami := proxy.WhoAmIResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Username, Equals, opsUsername)
+		c.Assert(whoami.Local, Equals, true)
+		c.Assert(whoami.Role, Equals, types.Ops.String())
+		c.Assert(whoami.Actor, Equals, adminUsername)
+
+		// RBAC is evaluated as the user
+		endpoint := "/api/v1/globals/"
+		ms.AddHardcodedResponse(endpoint, []byte(`{"foo":"bar"}`))
+
+		resp, _ = proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body = proxyGet(c, impersonationToken, endpoint)
+		s.assertInsufficientPrivileges(c, resp, body)
+
+		// the admin endpoints are out of reach, even when impersonating an admin
+		resp, _ = proxyGet(c, impersonationToken, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		adminImpersonationToken := s.impersonate(c, token, `{"username":"jdoe","principals":["`+types.Admin.String()+`"]}`)
+
+		resp, _ = proxyGet(c, adminImpersonationToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, _ = proxyGet(c, adminImpersonationToken, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, _ = proxyPost(c, adminImpersonationToken, proxy.ImpersonatePath, []byte(`{"username":"`+opsUsername+`","local":true}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// nor can the impersonation token be used to change the password of the user
+		resp, _ = proxyPost(c, impersonationToken, proxy.ChangePasswordPath, []byte(`{"current_password":"`+opsPassword+`","new_password":"xxx"}`))
+		c.Assert(resp.StatusCode, Equals, 403)
+	})
+}
+
+// impersonate impersonates the given user and returns the impersonation token or asserts.
+func (s *systemtestSuite) impersonate(c *C, token, data string) string {
+	resp, body := proxyPost(c, token, proxy.ImpersonatePath, []byte(data))
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	login := proxy.LoginResponse{}
+	c.Assert(json.Unmarshal(body, &login), IsNil)
+	c.Assert(len(login.Token), Not(Equals), 0)
+
+	return login.Token
+}
@@ -13,6 +13,7 @@ import (
 
 	"github.com/contiv/auth_proxy/auth"
 	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/db"
 	"github.com/contiv/auth_proxy/proxy"
 	"github.com/contiv/auth_proxy/state"
 
@@ -55,14 +56,32 @@ func Test(t *testing.T) {
 	}
 
 	log.Info("Adding default users")
-	if err := auth.AddDefaultUsers(); err != nil {
+	if err := auth.AddDefaultUsers(""); err != nil {
 		log.Fatalln(err)
 	}
 
+	// most of the tests log in as built-in users with their default passwords
+	for _, username := range []string{adminUsername, opsUsername} {
+		if err := clearMustChangePassword(username); err != nil {
+			log.Fatalln(err)
+		}
+	}
+
 	// execute the systemtests
 	TestingT(t)
 }
 
+// clearMustChangePassword lets the given user log in without changing the password first.
+func clearMustChangePassword(username string) error {
+	user, err := db.GetLocalUser(username)
+	if err != nil {
+		return err
+	}
+
+	user.MustChangePassword = false
+	return db.UpdateLocalUser(username, user)
+}
+
 type systemtestSuite struct{}
 
 var _ = Suite(&systemtestSuite{})
@@ -240,6 +259,15 @@ func proxyPost(c *C, token, path string, body []byte) (*http.Response, []byte) {
 	return resp, body
 }
 
+// proxyPut is a convenience function which sends an insecure HTTPS PUT
+// request with the specified body to the proxy.
+func proxyPut(c *C, token, path string, body []byte) (*http.Response, []byte) {
+	resp, body, err := insecureJSONBody(token, path, "PUT", body)
+	c.Assert(err, IsNil)
+
+	return resp, body
+}
+
 // insecureJSONBody sends an insecure HTTPS POST request with the specified
 // JSON payload as the body.
 func insecureJSONBody(token, path, requestType string, body []byte) (*http.Response, []byte, error) {
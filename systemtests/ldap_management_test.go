@@ -1,12 +1,322 @@
 package systemtests
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"time"
+
+	"github.com/contiv/auth_proxy/auth/ldap"
+	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/proxy"
 	. "gopkg.in/check.v1"
 )
 
 // TODO: add system tests to test LDAP management CRUD operations
 
+// TestLdapConfigurationSecrets tests that LDAP secrets are never returned and TLS settings are validated
+func (s *systemtestSuite) TestLdapConfigurationSecrets(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.V1Prefix + "/ldap_configuration"
+		certificate, key := selfSignedCertificate(c)
+
+		ldapConfig := types.LdapConfiguration{
+			Server:                 ldapServer,
+			Port:                   636,
+			BaseDN:                 "DC=ccn,DC=example,DC=com",
+			ServiceAccountDN:       "CN=Service Account,CN=Users,DC=ccn,DC=example,DC=com",
+			ServiceAccountPassword: ldapPassword,
+			LDAPS:                  true,
+			CACertificate:          certificate,
+			ServerName:             "ldap.example.com",
+			ClientCertificate:      certificate,
+			ClientKey:              key,
+			ConnectTimeout:         5,
+			ReadTimeout:            10,
+		}
+
+		// LDAPS and StartTLS are mutually exclusive
+		ldapConfig.StartTLS = true
+		data, err := json.Marshal(ldapConfig)
+		c.Assert(err, IsNil)
+
+		resp, _ := proxyPost(c, token, endpoint, data)
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		ldapConfig.StartTLS = false
+		data, err = json.Marshal(ldapConfig)
+		c.Assert(err, IsNil)
+
+		resp, body := proxyPost(c, token, endpoint, data)
+		c.Assert(resp.StatusCode, Equals, 201)
+		s.assertNoLdapSecrets(c, body)
+
+		resp, body = proxyGet(c, token, endpoint+"/"+types.DefaultLdapConfigurationName)
+		c.Assert(resp.StatusCode, Equals, 200)
+		s.assertNoLdapSecrets(c, body)
+
+		obtained := types.LdapConfiguration{}
+		c.Assert(json.Unmarshal(body, &obtained), IsNil)
+		c.Assert(obtained.LDAPS, Equals, true)
+		c.Assert(obtained.CACertificate, Equals, certificate)
+		c.Assert(obtained.ClientCertificate, Equals, certificate)
+		c.Assert(obtained.ServerName, Equals, "ldap.example.com")
+
+		// client certificate and key go together
+		resp, _ = proxyPatch(c, token, endpoint, []byte(`{"ldaps":true,"client_key":"xxx"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyPatch(c, token, endpoint, []byte(`{"ldaps":true,"ca_certificate":"not a certificate"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// secrets are retained when they are not part of the update
+		resp, body = proxyPatch(c, token, endpoint, []byte(`{"ldaps":true,"read_timeout":20}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+		s.assertNoLdapSecrets(c, body)
+
+		s.deleteLdapConfiguration(c, token)
+	})
+}
+
+// TestLdapConfigurations tests the management of multiple LDAP configurations (domains)
+func (s *systemtestSuite) TestLdapConfigurations(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.V1Prefix + "/ldap_configuration"
+
+		emea := types.LdapConfiguration{
+			Name:                   "emea",
+			Server:                 ldapServer,
+			Port:                   389,
+			Servers:                []types.LdapServer{{Server: "dc2." + ldapServer, Port: 389}},
+			Order:                  2,
+			UsernameSuffixes:       []string{"@emea.example.com"},
+			BaseDN:                 "DC=emea,DC=example,DC=com",
+			ServiceAccountDN:       "CN=Service Account,CN=Users,DC=emea,DC=example,DC=com",
+			ServiceAccountPassword: ldapPassword,
+		}
+
+		americas := emea
+		americas.Name = "americas"
+		americas.Order = 1
+		americas.Servers = nil
+		americas.UsernameSuffixes = nil
+		americas.UsernamePrefixes = []string{"AMERICAS\\"}
+		americas.BaseDN = "DC=americas,DC=example,DC=com"
+
+		for _, cfg := range []types.LdapConfiguration{emea, americas} {
+			data, err := json.Marshal(cfg)
+			c.Assert(err, IsNil)
+
+			resp, body := proxyPost(c, token, endpoint, data)
+			c.Assert(resp.StatusCode, Equals, 201)
+			s.assertNoLdapSecrets(c, body)
+
+			// names are unique
+			resp, _ = proxyPost(c, token, endpoint, data)
+			c.Assert(resp.StatusCode, Equals, 400)
+		}
+
+		// invalid name and servers are rejected
+		invalid := emea
+		invalid.Name = "no/slashes"
+		data, err := json.Marshal(invalid)
+		c.Assert(err, IsNil)
+
+		resp, _ := proxyPost(c, token, endpoint, data)
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		invalid.Name = "invalid"
+		invalid.Servers = []types.LdapServer{{Server: "dc3." + ldapServer}}
+		data, err = json.Marshal(invalid)
+		c.Assert(err, IsNil)
+
+		resp, _ = proxyPost(c, token, endpoint, data)
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// configurations are listed in the order they are tried
+		resp, body := proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		configurations := []types.LdapConfiguration{}
+		c.Assert(json.Unmarshal(body, &configurations), IsNil)
+		c.Assert(len(configurations), Equals, 2)
+		c.Assert(configurations[0].Name, Equals, "americas")
+		c.Assert(configurations[1].Name, Equals, "emea")
+		c.Assert(configurations[1].Servers, DeepEquals, emea.Servers)
+
+		// servers can be updated; the name can't be
+		resp, body = proxyPatch(c, token, endpoint+"/americas", []byte(`{"servers":[{"server":"dc9.example.com","port":636}]}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		obtained := types.LdapConfiguration{}
+		c.Assert(json.Unmarshal(body, &obtained), IsNil)
+		c.Assert(obtained.Servers, DeepEquals, []types.LdapServer{{Server: "dc9.example.com", Port: 636}})
+		c.Assert(obtained.UsernamePrefixes, DeepEquals, americas.UsernamePrefixes)
+
+		resp, _ = proxyPatch(c, token, endpoint+"/americas", []byte(`{"name":"apac"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// health of the servers in the configured order
+		resp, body = proxyGet(c, token, endpoint+"/emea/servers")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		health := []map[string]interface{}{}
+		c.Assert(json.Unmarshal(body, &health), IsNil)
+		c.Assert(len(health), Equals, 2)
+		c.Assert(health[0]["server"], Equals, ldapServer)
+		c.Assert(health[1]["server"], Equals, "dc2."+ldapServer)
+
+		// pool and cache settings
+		resp, _ = proxyPatch(c, token, endpoint+"/emea", []byte(`{"pool_size":-1}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, body = proxyPatch(c, token, endpoint+"/emea", []byte(`{"pool_size":20,"cache_ttl":-1}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		obtained = types.LdapConfiguration{}
+		c.Assert(json.Unmarshal(body, &obtained), IsNil)
+		c.Assert(obtained.PoolSize, Equals, 20)
+		c.Assert(obtained.CacheTTL, Equals, -1)
+
+		// search settings given empty are reverted to the preset of the directory type
+		resp, _ = proxyPatch(c, token, endpoint+"/emea", []byte(`{"user_search_filter":"(uid={username})","group_max_depth":3}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		resp, body = proxyPatch(c, token, endpoint+"/emea", []byte(`{"user_search_filter":"","group_max_depth":0}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		obtained = types.LdapConfiguration{}
+		c.Assert(json.Unmarshal(body, &obtained), IsNil)
+		c.Assert(obtained.UserSearchFilter, Equals, "")
+		c.Assert(obtained.GroupMaxDepth, Equals, 0)
+		c.Assert(obtained.PoolSize, Equals, 20)
+
+		resp, body = proxyGet(c, token, endpoint+"/emea/metrics")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		metrics := map[string]interface{}{}
+		c.Assert(json.Unmarshal(body, &metrics), IsNil)
+		c.Assert(metrics["pool"], NotNil)
+		c.Assert(metrics["cache"], NotNil)
+
+		// directory search needs a valid page size
+		resp, _ = proxyGet(c, token, endpoint+"/emea/groups?q=devs&limit=0")
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyGet(c, token, endpoint+"/emea/users?next=-1")
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		for _, name := range []string{"emea", "americas"} {
+			resp, _ = proxyDelete(c, token, endpoint+"/"+name)
+			c.Assert(resp.StatusCode, Equals, 204)
+
+			resp, _ = proxyGet(c, token, endpoint+"/"+name)
+			c.Assert(resp.StatusCode, Equals, 404)
+
+			resp, _ = proxyGet(c, token, endpoint+"/"+name+"/servers")
+			c.Assert(resp.StatusCode, Equals, 404)
+
+			resp, _ = proxyGet(c, token, endpoint+"/"+name+"/metrics")
+			c.Assert(resp.StatusCode, Equals, 404)
+
+			resp, _ = proxyGet(c, token, endpoint+"/"+name+"/groups")
+			c.Assert(resp.StatusCode, Equals, 404)
+		}
+	})
+}
+
+// TestLdapConfigurationTest tests that configurations can be tested without saving them
+func (s *systemtestSuite) TestLdapConfigurationTest(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.V1Prefix + "/ldap_configuration"
+
+		test := types.LdapConfigurationTest{
+			LdapConfiguration: types.LdapConfiguration{
+				Name:                   "test",
+				Server:                 "127.0.0.1",
+				Port:                   1, // nothing listens on this port
+				BaseDN:                 "DC=example,DC=com",
+				ServiceAccountDN:       "CN=Service Account,CN=Users,DC=example,DC=com",
+				ServiceAccountPassword: ldapPassword,
+				ConnectTimeout:         2,
+			},
+			Username: "john",
+			Password: "johnpass",
+		}
+
+		data, err := json.Marshal(test)
+		c.Assert(err, IsNil)
+
+		resp, body := proxyPost(c, token, endpoint+"/test", data)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		result := ldap.TestResult{}
+		c.Assert(json.Unmarshal(body, &result), IsNil)
+		c.Assert(result.Success, Equals, false)
+		c.Assert(len(result.Steps), Equals, 2)
+		c.Assert(result.Steps[1].Step, Equals, ldap.StepTCPConnect)
+		c.Assert(result.Steps[1].Error, Not(Equals), "")
+
+		// nothing is saved
+		resp, _ = proxyGet(c, token, endpoint+"/test")
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		// invalid settings are rejected
+		test.BaseDN = ""
+		data, err = json.Marshal(test)
+		c.Assert(err, IsNil)
+
+		resp, _ = proxyPost(c, token, endpoint+"/test", data)
+		c.Assert(resp.StatusCode, Equals, 400)
+	})
+}
+
+// assertNoLdapSecrets checks that the given LDAP configuration response carries no secrets
+func (s *systemtestSuite) assertNoLdapSecrets(c *C, body []byte) {
+	response := map[string]interface{}{}
+	c.Assert(json.Unmarshal(body, &response), IsNil)
+
+	_, found := response["service_account_password"]
+	c.Assert(found, Equals, false)
+
+	_, found = response["client_key"]
+	c.Assert(found, Equals, false)
+}
+
+// selfSignedCertificate helper function which returns PEM encoded self-signed certificate and its key
+func selfSignedCertificate(c *C) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, IsNil)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: "ldap.example.com"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	c.Assert(err, IsNil)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	c.Assert(err, IsNil)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+}
+
 // addLdapConfiguration helper function for the tests
 func (s *systemtestSuite) addLdapConfiguration(c *C, token, data string) {
 	endpoint := proxy.V1Prefix + "/ldap_configuration"
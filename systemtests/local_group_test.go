@@ -0,0 +1,89 @@
+package systemtests
+
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+	. "gopkg.in/check.v1"
+)
+
+// TestLocalGroupEndpoints tests auth_proxy's local group endpoints and the
+// authorizations granted through local group membership
+func (s *systemtestSuite) TestLocalGroupEndpoints(c *C) {
+	username := "test_group_member"
+	s.addUser(c, username)
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.V1Prefix + "/local_groups"
+		groupEndpoint := endpoint + "/devs"
+
+		// local groups can only be managed by admins
+		resp, _ := proxyGet(c, opsToken(c), endpoint)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// members must be existing local users
+		resp, _ = proxyPost(c, token, endpoint, []byte(`{"name":"devs","members":["xxx"]}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		for _, name := range []string{"", "a/b", "a,b"} {
+			resp, _ = proxyPost(c, token, endpoint, []byte(`{"name":"`+name+`"}`))
+			c.Assert(resp.StatusCode, Equals, 400)
+		}
+
+		resp, body := proxyPost(c, token, endpoint, []byte(`{"name":"devs","description":"Developers"}`))
+		c.Assert(resp.StatusCode, Equals, 201)
+		c.Assert(string(body), Equals, `{"name":"devs","description":"Developers","members":[]}`)
+
+		resp, _ = proxyPost(c, token, endpoint, []byte(`{"name":"devs"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// the member has no admin privileges yet
+		userToken := loginAs(c, username, username)
+		resp, _ = proxyGet(c, userToken, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// grant `admin` role to the group and add the user to it
+		authzRequest := `{"principalName":"devs","localGroup":true,"role":"` + types.Admin.String() + `","tenantName":""}`
+		authz := s.addAuthorization(c, authzRequest, token)
+		c.Assert(authz.PrincipalName, Equals, "devs")
+		c.Assert(authz.LocalGroup, Equals, true)
+
+		resp, body = proxyPost(c, token, groupEndpoint+"/members", []byte(`{"username":"`+username+`"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		group := types.LocalGroup{}
+		c.Assert(json.Unmarshal(body, &group), IsNil)
+		c.Assert(group.Members, DeepEquals, []string{username})
+
+		userToken = loginAs(c, username, username)
+		resp, _ = proxyGet(c, userToken, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// removing the membership revokes the privileges on next login
+		resp, _ = proxyDelete(c, token, groupEndpoint+"/members/"+username)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		userToken = loginAs(c, username, username)
+		resp, _ = proxyGet(c, userToken, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, body = proxyPatch(c, token, groupEndpoint, []byte(`{"description":"Dev team"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, `{"name":"devs","description":"Dev team","members":[]}`)
+
+		// deleting the group removes its authorizations
+		resp, _ = proxyDelete(c, token, groupEndpoint)
+		c.Assert(resp.StatusCode, Equals, 204)
+
+		resp, _ = proxyGet(c, token, groupEndpoint)
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		resp, _ = proxyGet(c, token, proxy.V1Prefix+"/authorizations/"+authz.AuthzUUID)
+		c.Assert(resp.StatusCode, Equals, 404)
+
+		resp, _ = proxyDelete(c, token, proxy.V1Prefix+"/local_users/"+username)
+		c.Assert(resp.StatusCode, Equals, 204)
+	})
+}
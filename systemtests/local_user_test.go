@@ -1,6 +1,9 @@
 package systemtests
 
 import (
+	"encoding/json"
+	"strconv"
+
 	"github.com/contiv/auth_proxy/common/types"
 	"github.com/contiv/auth_proxy/proxy"
 	. "gopkg.in/check.v1"
@@ -187,6 +190,215 @@ func (s *systemtestSuite) TestLocalUserDeleteEndpoint(c *C) {
 	})
 }
 
+// TestLocalUserChangePassword tests auth_proxy's self-service password change endpoint
+func (s *systemtestSuite) TestLocalUserChangePassword(c *C) {
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+
+		for _, username := range newUsers {
+			// add new local_user to the system
+			data := `{"username":"` + username + `","password":"` + username + `", "disable":false}`
+			respBody := `{"username":"` + username + `","first_name":"","last_name":"","disable":false}`
+			s.addLocalUser(c, data, respBody, token)
+
+			firstToken := loginAs(c, username, username)
+			secondToken := loginAs(c, username, username)
+
+			// missing token
+			resp, _ := proxyPost(c, "", proxy.ChangePasswordPath, []byte(`{"current_password":"`+username+`","new_password":"test"}`))
+			c.Assert(resp.StatusCode, Equals, 401)
+
+			// incorrect current password
+			resp, _ = proxyPost(c, firstToken, proxy.ChangePasswordPath, []byte(`{"current_password":"wrong","new_password":"test"}`))
+			c.Assert(resp.StatusCode, Equals, 403)
+
+			// missing new password
+			resp, _ = proxyPost(c, firstToken, proxy.ChangePasswordPath, []byte(`{"current_password":"`+username+`"}`))
+			c.Assert(resp.StatusCode, Equals, 400)
+
+			newToken := s.changePassword(c, firstToken, username, "test")
+
+			// sessions established before the change are revoked
+			for _, t := range []string{firstToken, secondToken} {
+				resp, _ = proxyGet(c, t, "/api/v1/networks/")
+				c.Assert(resp.StatusCode, Equals, 400)
+			}
+
+			// the token handed out on password change can be used for another change
+			_ = s.changePassword(c, newToken, "test", "test2")
+
+			// try login again using old password
+			testuserToken, resp, err := login(username, "test")
+			c.Assert(err, IsNil)
+			c.Assert(resp.StatusCode, Equals, 401)
+			c.Assert(len(testuserToken), Equals, 0)
+
+			// try login again using new password
+			userToken := loginAs(c, username, "test2")
+
+			// a password reset by the admin revokes the sessions too
+			endpoint := proxy.V1Prefix + "/local_users/" + username
+			resp, _ = proxyPatch(c, token, endpoint, []byte(`{"password":"test3"}`))
+			c.Assert(resp.StatusCode, Equals, 200)
+
+			resp, _ = proxyGet(c, userToken, "/api/v1/networks/")
+			c.Assert(resp.StatusCode, Equals, 400)
+
+			// as does deleting the user
+			userToken = loginAs(c, username, "test3")
+
+			resp, _ = proxyDelete(c, token, endpoint)
+			c.Assert(resp.StatusCode, Equals, 204)
+
+			resp, _ = proxyGet(c, userToken, "/api/v1/networks/")
+			c.Assert(resp.StatusCode, Equals, 400)
+		}
+	})
+}
+
+// TestLocalUserMustChangePassword tests that a user who has to change the password can do only that
+func (s *systemtestSuite) TestLocalUserMustChangePassword(c *C) {
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		username := newUsers[0]
+
+		data := `{"username":"` + username + `","password":"` + username + `","must_change_password":true}`
+		respBody := `{"username":"` + username + `","first_name":"","last_name":"","disable":false,"must_change_password":true}`
+		s.addLocalUser(c, data, respBody, token)
+
+		// login response tells that the password has to be changed
+		data = `{"username":"` + username + `","password":"` + username + `"}`
+		resp, body := proxyPost(c, "", proxy.LoginPath, []byte(data))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		lr := proxy.LoginResponse{}
+		c.Assert(json.Unmarshal(body, &lr), IsNil)
+		c.Assert(lr.MustChangePassword, Equals, true)
+
+		restrictedToken := lr.Token
+		resp, _ = proxyGet(c, restrictedToken, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		newToken := s.changePassword(c, restrictedToken, username, "test")
+		resp, _ = proxyGet(c, newToken, proxy.V1Prefix+"/local_users")
+		c.Assert(resp.StatusCode, Equals, 403) // not an admin, but no longer restricted
+
+		endpoint := proxy.V1Prefix + "/local_users/" + username
+		resp, body = proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(string(body), Equals, `{"username":"`+username+`","first_name":"","last_name":"","disable":false}`)
+
+		resp, _ = proxyDelete(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 204)
+	})
+}
+
+// TestWhoAmI tests the endpoint users get the details of their own session on
+func (s *systemtestSuite) TestWhoAmI(c *C) {
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		username := newUsers[0]
+
+		data := `{"username":"` + username + `","password":"` + username + `","first_name":"John","last_name":"Doe"}`
+		respBody := `{"username":"` + username + `","first_name":"John","last_name":"Doe","disable":false}`
+		s.addLocalUser(c, data, respBody, token)
+
+		resp, _ := proxyGet(c, "", proxy.WhoAmIPath)
+		c.Assert(resp.StatusCode, Equals, 401)
+
+		userToken := loginAs(c, username, username)
+		resp, body := proxyGet(c, userToken, proxy.WhoAmIPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		whoami := proxy.WhoAmIResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Username, Equals, username)
+		c.Assert(whoami.Local, Equals, true)
+		c.Assert(whoami.Attributes, DeepEquals, map[string]string{"display_name": "John Doe"})
+		c.Assert(whoami.LastLogin, Not(Equals), int64(0))
+		c.Assert(whoami.ExpiresAt > whoami.LastLogin, Equals, true)
+
+		resp, body = proxyGet(c, token, proxy.WhoAmIPath)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		whoami = proxy.WhoAmIResponse{}
+		c.Assert(json.Unmarshal(body, &whoami), IsNil)
+		c.Assert(whoami.Username, Equals, types.Admin.String())
+		c.Assert(whoami.Role, Equals, types.Admin.String())
+
+		resp, _ = proxyDelete(c, token, proxy.V1Prefix+"/local_users/"+username)
+		c.Assert(resp.StatusCode, Equals, 204)
+	})
+}
+
+// changePassword helper function for the tests; returns the token handed out on password change
+func (s *systemtestSuite) changePassword(c *C, token, currentPassword, newPassword string) string {
+	data := `{"current_password":"` + currentPassword + `","new_password":"` + newPassword + `"}`
+
+	resp, body := proxyPost(c, token, proxy.ChangePasswordPath, []byte(data))
+	c.Assert(resp.StatusCode, Equals, 200)
+
+	lr := proxy.LoginResponse{}
+	c.Assert(json.Unmarshal(body, &lr), IsNil)
+	c.Assert(len(lr.Token), Not(Equals), 0)
+
+	return lr.Token
+}
+
+// TestLocalUsersListing checks the filters and pagination of the local user listing.
+func (s *systemtestSuite) TestLocalUsersListing(c *C) {
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.V1Prefix + "/local_users"
+
+		for _, username := range []string{"list_a", "list_b", "list_c"} {
+			data := `{"username":"` + username + `","password":"` + username + `", "disable":` + strconv.FormatBool(username == "list_b") + `}`
+			resp, _ := proxyPost(c, token, endpoint, []byte(data))
+			c.Assert(resp.StatusCode, Equals, 201)
+		}
+
+		resp, body := proxyGet(c, token, endpoint+"?prefix=list_&disabled=false")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		users := []types.LocalUser{}
+		c.Assert(json.Unmarshal(body, &users), IsNil)
+		c.Assert(len(users), Equals, 2)
+		c.Assert(users[0].Username, Equals, "list_a")
+		c.Assert(users[1].Username, Equals, "list_c")
+
+		resp, body = proxyGet(c, token, endpoint+"?prefix=list_&limit=2")
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		page := proxy.ListLocalUsersReply{}
+		c.Assert(json.Unmarshal(body, &page), IsNil)
+		c.Assert(len(page.Users), Equals, 2)
+		c.Assert(page.Next, Equals, "list_b")
+
+		resp, body = proxyGet(c, token, endpoint+"?prefix=list_&limit=2&next="+page.Next)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		page = proxy.ListLocalUsersReply{}
+		c.Assert(json.Unmarshal(body, &page), IsNil)
+		c.Assert(len(page.Users), Equals, 1)
+		c.Assert(page.Users[0].Username, Equals, "list_c")
+		c.Assert(page.Next, Equals, "")
+
+		resp, _ = proxyGet(c, token, endpoint+"?disabled=maybe")
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		resp, _ = proxyGet(c, token, endpoint+"?limit=0")
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		for _, username := range []string{"list_a", "list_b", "list_c"} {
+			resp, _ = proxyDelete(c, token, endpoint+"/"+username)
+			c.Assert(resp.StatusCode, Equals, 204)
+		}
+	})
+}
+
 // addLocalUser helper function for the tests
 func (s *systemtestSuite) addLocalUser(c *C, data, expectedRespBody, token string) {
 	endpoint := proxy.V1Prefix + "/local_users"
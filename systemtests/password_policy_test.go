@@ -0,0 +1,89 @@
+package systemtests
+
+import (
+	"encoding/json"
+
+	"github.com/contiv/auth_proxy/common/types"
+	"github.com/contiv/auth_proxy/proxy"
+	. "gopkg.in/check.v1"
+)
+
+// TestPasswordPolicyEndpoints tests auth_proxy's password policy endpoints
+func (s *systemtestSuite) TestPasswordPolicyEndpoints(c *C) {
+
+	runTest(func(ms *MockServer) {
+		token := adminToken(c)
+		endpoint := proxy.V1Prefix + "/password_policy"
+
+		// default policy
+		resp, body := proxyGet(c, token, endpoint)
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		passwordPolicy := &types.PasswordPolicy{}
+		c.Assert(json.Unmarshal(body, passwordPolicy), IsNil)
+		c.Assert(passwordPolicy, DeepEquals, types.DefaultPasswordPolicy())
+
+		// policies can only be managed by admins
+		resp, _ = proxyGet(c, opsToken(c), endpoint)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// invalid policy
+		resp, _ = proxyPut(c, token, endpoint, []byte(`{"min_length":-1}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		data := `{"min_length":8,"require_digit":true,"deny_list":["password1"],"disallow_username":true,"history_count":1}`
+		resp, _ = proxyPut(c, token, endpoint, []byte(data))
+		c.Assert(resp.StatusCode, Equals, 200)
+
+		// revert the policy so that it wont block other tests
+		defer func() {
+			resp, _ := proxyPut(c, token, endpoint, []byte(`{}`))
+			c.Assert(resp.StatusCode, Equals, 200)
+		}()
+
+		username := newUsers[0]
+		for _, password := range []string{"short1", "longenough", "password1", username + "12345678"} {
+			data := `{"username":"` + username + `","password":"` + password + `"}`
+			resp, body := proxyPost(c, token, proxy.V1Prefix+"/local_users", []byte(data))
+			c.Assert(resp.StatusCode, Equals, 400)
+			c.Assert(len(body), Not(Equals), 0)
+		}
+
+		data = `{"username":"` + username + `","password":"goodpassw0rd"}`
+		respBody := `{"username":"` + username + `","first_name":"","last_name":"","disable":false}`
+		s.addLocalUser(c, data, respBody, token)
+
+		// current password cannot be reused
+		userEndpoint := proxy.V1Prefix + "/local_users/" + username
+		resp, _ = proxyPatch(c, token, userEndpoint, []byte(`{"password":"goodpassw0rd"}`))
+		c.Assert(resp.StatusCode, Equals, 400)
+
+		// a password which has to be changed on the next login
+		data = `{"password":"temppassw0rd","must_change_password":true}`
+		respBody = `{"username":"` + username + `","first_name":"","last_name":"","disable":false,"must_change_password":true}`
+		s.updateLocalUser(c, username, data, respBody, token)
+
+		// login succeeds, but the token cannot be used for anything else
+		restrictedToken := loginAs(c, username, "temppassw0rd")
+
+		resp, _ = proxyGet(c, restrictedToken, endpoint)
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		resp, _ = proxyGet(c, restrictedToken, "/api/v1/networks/")
+		c.Assert(resp.StatusCode, Equals, 403)
+
+		// the admin can clear the flag; other fields are left alone
+		data = `{"must_change_password":false}`
+		respBody = `{"username":"` + username + `","first_name":"","last_name":"","disable":false}`
+		s.updateLocalUser(c, username, data, respBody, token)
+
+		loginReply := proxy.LoginResponse{}
+		resp, body = proxyPost(c, "", proxy.LoginPath, []byte(`{"username":"`+username+`","password":"temppassw0rd"}`))
+		c.Assert(resp.StatusCode, Equals, 200)
+		c.Assert(json.Unmarshal(body, &loginReply), IsNil)
+		c.Assert(loginReply.MustChangePassword, Equals, false)
+
+		resp, _ = proxyDelete(c, token, userEndpoint)
+		c.Assert(resp.StatusCode, Equals, 204)
+	})
+}